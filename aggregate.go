@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrAggregationNotSupported is returned when the storage backend does not
+// implement Aggregator
+var ErrAggregationNotSupported = errors.New("storage does not support aggregation")
+
+// Aggregator is implemented by storage backends that can count records
+// without returning them. Limit, Offset and sort options of the filter are
+// ignored; every matching record is counted.
+type Aggregator interface {
+	// Count returns the number of records matching the filter
+	Count(ctx context.Context, filter *QueryFilter) (int64, error)
+
+	// GroupBy counts matching records per combination of field values
+	// (e.g. "event_type", "result", "channel", "user_id") and, when bucket
+	// is at least one second, per time bucket. Rows are ordered by bucket,
+	// then by field values.
+	GroupBy(ctx context.Context, filter *QueryFilter, fields []string, bucket time.Duration) ([]AggregateRow, error)
+}
+
+// AggregateRow is one group returned by GroupBy
+type AggregateRow struct {
+	// Bucket is the start of the time bucket (Unix seconds); 0 without bucketing
+	Bucket int64 `json:"bucket,omitempty"`
+
+	// Groups maps each grouped field to its value ("" for empty fields)
+	Groups map[string]string `json:"groups,omitempty"`
+
+	Count int64 `json:"count"`
+}
+
+// aggregatorOf returns storage as an Aggregator, or ErrAggregationNotSupported
+func aggregatorOf(storage Storage) (Aggregator, error) {
+	if agg, ok := storage.(Aggregator); ok {
+		return agg, nil
+	}
+	return nil, ErrAggregationNotSupported
+}
+
+// validateGroupBy checks the group fields and returns the bucket in seconds
+func validateGroupBy(fields []string, bucket time.Duration) (int64, error) {
+	seen := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if _, ok := filterFields[field]; !ok {
+			return 0, fmt.Errorf("%w: unsupported group field %q", ErrInvalidFilter, field)
+		}
+		if seen[field] {
+			return 0, fmt.Errorf("%w: duplicate group field %q", ErrInvalidFilter, field)
+		}
+		seen[field] = true
+	}
+	seconds := int64(bucket / time.Second)
+	if bucket != 0 && seconds < 1 {
+		return 0, fmt.Errorf("%w: bucket must be at least one second", ErrInvalidFilter)
+	}
+	if len(fields) == 0 && seconds == 0 {
+		return 0, fmt.Errorf("%w: group by needs at least one field or a bucket", ErrInvalidFilter)
+	}
+	return seconds, nil
+}
+
+// bucketStart returns the start of the bucket containing timestamp
+func bucketStart(timestamp, seconds int64) int64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return timestamp - timestamp%seconds
+}
+
+// groupCounter counts records per group for backends without GROUP BY
+type groupCounter struct {
+	fields []string
+	bucket int64
+	rows   map[string]*AggregateRow
+}
+
+func newGroupCounter(fields []string, bucket int64) *groupCounter {
+	return &groupCounter{
+		fields: fields,
+		bucket: bucket,
+		rows:   make(map[string]*AggregateRow),
+	}
+}
+
+// add counts one record
+func (g *groupCounter) add(record *Record) {
+	values := make([]string, len(g.fields))
+	for i, field := range g.fields {
+		values[i] = filterFields[field](record)
+	}
+	g.addRow(bucketStart(record.Timestamp, g.bucket), values, 1)
+}
+
+// addRow adds count to the group identified by bucket and values
+func (g *groupCounter) addRow(bucket int64, values []string, count int64) {
+	key := fmt.Sprintf("%d\x00%s", bucket, strings.Join(values, "\x00"))
+	row, ok := g.rows[key]
+	if !ok {
+		row = &AggregateRow{Bucket: bucket}
+		if len(g.fields) > 0 {
+			row.Groups = make(map[string]string, len(g.fields))
+			for i, field := range g.fields {
+				row.Groups[field] = values[i]
+			}
+		}
+		g.rows[key] = row
+	}
+	row.Count += count
+}
+
+// result returns the rows ordered by bucket, then by field values
+func (g *groupCounter) result() []AggregateRow {
+	rows := make([]AggregateRow, 0, len(g.rows))
+	for _, row := range g.rows {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Bucket != rows[j].Bucket {
+			return rows[i].Bucket < rows[j].Bucket
+		}
+		for _, field := range g.fields {
+			if a, b := rows[i].Groups[field], rows[j].Groups[field]; a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+	return rows
+}
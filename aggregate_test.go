@@ -0,0 +1,247 @@
+package audit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregator_Count_AllBackends(t *testing.T) {
+	backends := newConditionBackends(t)
+
+	tests := []struct {
+		name     string
+		filter   *QueryFilter
+		expected int64
+	}{
+		{"nil filter", nil, 10},
+		{"equality", DefaultQueryFilter().WithEventType(string(EventLoginFailed)), 5},
+		{"limit ignored", DefaultQueryFilter().WithEventType(string(EventLoginFailed)).WithLimit(1).WithOffset(3), 5},
+		{"condition", DefaultQueryFilter().Where(In("user_id", "alice", "bob")), 3},
+		{"ipv6 cidr", DefaultQueryFilter().Where(InCIDR("2001:db8::/32")), 1},
+		{"metadata", DefaultQueryFilter().WithMetadata("tenant_id", "acme"), 2},
+		{"no match", DefaultQueryFilter().WithUserID("nobody"), 0},
+	}
+
+	for name, storage := range backends {
+		agg, ok := storage.(Aggregator)
+		require.True(t, ok, name)
+		for _, tt := range tests {
+			if name == "postgres-dialect" && tt.filter != nil && len(tt.filter.Metadata) > 0 {
+				// JSON functions differ; the shared table is SQLite
+				continue
+			}
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				count, err := agg.Count(context.Background(), tt.filter)
+				require.NoError(t, err)
+				assert.Equal(t, tt.expected, count)
+			})
+		}
+	}
+}
+
+func TestAggregator_GroupBy_AllBackends(t *testing.T) {
+	hour := int64(3600)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	specs := []struct {
+		eventType EventType
+		channel   string
+		offset    int64
+	}{
+		{EventVerificationFailed, "sms", 10},
+		{EventVerificationFailed, "sms", 20},
+		{EventVerificationFailed, "email", 30},
+		{EventVerificationSuccess, "sms", 40},
+		{EventVerificationFailed, "sms", hour + 5},
+		{EventVerificationFailed, "", hour + 6},
+		{EventVerificationFailed, "email", 2*hour + 1},
+	}
+	records := make([]*Record, len(specs))
+	for i, spec := range specs {
+		r := NewRecord(spec.eventType, ResultFailure).WithChannel(spec.channel)
+		r.Timestamp = base + spec.offset
+		records[i] = r
+	}
+	backends := newFilledBackends(t, records)
+
+	failed := DefaultQueryFilter().WithEventType(string(EventVerificationFailed))
+	tests := []struct {
+		name     string
+		filter   *QueryFilter
+		fields   []string
+		bucket   time.Duration
+		expected []AggregateRow
+	}{
+		{
+			name:   "failed verifications per hour per channel",
+			filter: failed,
+			fields: []string{"channel"},
+			bucket: time.Hour,
+			expected: []AggregateRow{
+				{Bucket: base, Groups: map[string]string{"channel": "email"}, Count: 1},
+				{Bucket: base, Groups: map[string]string{"channel": "sms"}, Count: 2},
+				{Bucket: base + hour, Groups: map[string]string{"channel": ""}, Count: 1},
+				{Bucket: base + hour, Groups: map[string]string{"channel": "sms"}, Count: 1},
+				{Bucket: base + 2*hour, Groups: map[string]string{"channel": "email"}, Count: 1},
+			},
+		},
+		{
+			name:   "per event type and channel",
+			fields: []string{"event_type", "channel"},
+			expected: []AggregateRow{
+				{Groups: map[string]string{"event_type": "verification_failed", "channel": ""}, Count: 1},
+				{Groups: map[string]string{"event_type": "verification_failed", "channel": "email"}, Count: 2},
+				{Groups: map[string]string{"event_type": "verification_failed", "channel": "sms"}, Count: 3},
+				{Groups: map[string]string{"event_type": "verification_success", "channel": "sms"}, Count: 1},
+			},
+		},
+		{
+			name:   "per hour only",
+			bucket: time.Hour,
+			expected: []AggregateRow{
+				{Bucket: base, Count: 4},
+				{Bucket: base + hour, Count: 2},
+				{Bucket: base + 2*hour, Count: 1},
+			},
+		},
+		{
+			name:     "no match",
+			filter:   DefaultQueryFilter().WithUserID("nobody"),
+			fields:   []string{"result"},
+			expected: []AggregateRow{},
+		},
+	}
+
+	for name, storage := range backends {
+		agg, ok := storage.(Aggregator)
+		require.True(t, ok, name)
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				rows, err := agg.GroupBy(context.Background(), tt.filter, tt.fields, tt.bucket)
+				require.NoError(t, err)
+				assert.Equal(t, tt.expected, rows)
+			})
+		}
+	}
+}
+
+func TestAggregator_GroupBy_ResidualCondition(t *testing.T) {
+	backends := newConditionBackends(t)
+	filter := DefaultQueryFilter().Where(InCIDR("2001:db8::/32", "10.0.0.0/8"))
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			rows, err := storage.(Aggregator).GroupBy(context.Background(), filter, []string{"event_type"}, 0)
+			require.NoError(t, err)
+			assert.Equal(t, []AggregateRow{
+				{Groups: map[string]string{"event_type": "access_denied"}, Count: 1},
+				{Groups: map[string]string{"event_type": "login_failed"}, Count: 1},
+			}, rows)
+		})
+	}
+}
+
+func TestValidateGroupBy(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  []string
+		bucket  time.Duration
+		seconds int64
+		wantErr bool
+	}{
+		{"field", []string{"event_type"}, 0, 0, false},
+		{"fields and bucket", []string{"result", "user_id"}, 15 * time.Minute, 900, false},
+		{"bucket only", nil, 24 * time.Hour, 86400, false},
+		{"nothing to group", nil, 0, 0, true},
+		{"unknown field", []string{"reason"}, 0, 0, true},
+		{"duplicate field", []string{"channel", "channel"}, 0, 0, true},
+		{"sub-second bucket", []string{"channel"}, time.Millisecond, 0, true},
+		{"negative bucket", nil, -time.Hour, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seconds, err := validateGroupBy(tt.fields, tt.bucket)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidFilter)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.seconds, seconds)
+		})
+	}
+}
+
+func TestAggregator_InvalidFilter(t *testing.T) {
+	for name, storage := range newConditionBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			agg := storage.(Aggregator)
+			_, err := agg.Count(context.Background(), DefaultQueryFilter().Where(In("reason", "x")))
+			assert.ErrorIs(t, err, ErrInvalidFilter)
+			_, err = agg.GroupBy(context.Background(), nil, []string{"reason"}, 0)
+			assert.ErrorIs(t, err, ErrInvalidFilter)
+		})
+	}
+}
+
+func TestAggregator_Wrappers(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+	sqliteStorage, err := NewDatabaseStorageFromDB(db, "sqlite", nil)
+	require.NoError(t, err)
+	require.NoError(t, sqliteStorage.Write(ctx, NewRecord(EventLoginFailed, ResultFailure).WithChannel("sms")))
+
+	t.Run("multi uses first backend", func(t *testing.T) {
+		multi := NewMultiStorage(nil, sqliteStorage, &errorStorage{})
+		count, err := multi.Count(ctx, nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+		rows, err := multi.GroupBy(ctx, nil, []string{"channel"}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []AggregateRow{{Groups: map[string]string{"channel": "sms"}, Count: 1}}, rows)
+	})
+
+	t.Run("multi without aggregator", func(t *testing.T) {
+		multi := NewMultiStorage(&errorStorage{}, sqliteStorage)
+		_, err := multi.Count(ctx, nil)
+		assert.ErrorIs(t, err, ErrAggregationNotSupported)
+		_, err = multi.GroupBy(ctx, nil, []string{"channel"}, 0)
+		assert.ErrorIs(t, err, ErrAggregationNotSupported)
+	})
+
+	t.Run("multi without storage", func(t *testing.T) {
+		_, err := NewMultiStorage().Count(ctx, nil)
+		assert.Error(t, err)
+		_, err = NewMultiStorage().GroupBy(ctx, nil, []string{"channel"}, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("encrypting", func(t *testing.T) {
+		storage := NewEncryptingStorage(sqliteStorage, newTestFieldEncryptor(t, NewMemoryDataKeyStore()))
+		count, err := storage.Count(ctx, DefaultQueryFilter().WithChannel("sms"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+		rows, err := storage.GroupBy(ctx, nil, []string{"event_type"}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []AggregateRow{{Groups: map[string]string{"event_type": "login_failed"}, Count: 1}}, rows)
+
+		unsupported := NewEncryptingStorage(&errorStorage{}, newTestFieldEncryptor(t, NewMemoryDataKeyStore()))
+		_, err = unsupported.Count(ctx, nil)
+		assert.ErrorIs(t, err, ErrAggregationNotSupported)
+		_, err = unsupported.GroupBy(ctx, nil, []string{"channel"}, 0)
+		assert.ErrorIs(t, err, ErrAggregationNotSupported)
+	})
+
+	t.Run("noop", func(t *testing.T) {
+		count, err := NewNoopStorage().Count(ctx, nil)
+		require.NoError(t, err)
+		assert.Zero(t, count)
+		rows, err := NewNoopStorage().GroupBy(ctx, nil, []string{"channel"}, 0)
+		require.NoError(t, err)
+		assert.Empty(t, rows)
+	})
+}
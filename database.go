@@ -4,45 +4,157 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/netip"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	_ "github.com/go-sql-driver/mysql" // MySQL driver
 	_ "github.com/lib/pq"              // PostgreSQL driver
+	_ "modernc.org/sqlite"             // SQLite driver
 )
 
 const maxTableNameLen = 64
 
+// defaultPurgeBatchSize is the number of rows Purge deletes per statement
+const defaultPurgeBatchSize = 1000
+
+// defaultConnectTimeout bounds the initial ping and table creation
+const defaultConnectTimeout = 5 * time.Second
+
 // validateTableName ensures table name is safe for SQL identifier use (no injection).
-// Only allows [a-zA-Z0-9_] and max 64 characters.
+// Only allows [a-zA-Z0-9_] and max 64 characters, optionally qualified by a
+// schema name of the same form ("schema.table").
 func validateTableName(name string) error {
+	if schema, table, ok := strings.Cut(name, "."); ok {
+		if err := validateIdentifier("schema", schema); err != nil {
+			return err
+		}
+		name = table
+	}
+	return validateIdentifier("table", name)
+}
+
+// validateIdentifier checks one part of a table name
+func validateIdentifier(kind, name string) error {
 	if name == "" {
-		return fmt.Errorf("table name cannot be empty")
+		return fmt.Errorf("%s name cannot be empty", kind)
 	}
 	if len(name) > maxTableNameLen {
-		return fmt.Errorf("table name too long: max %d characters", maxTableNameLen)
+		return fmt.Errorf("%s name too long: max %d characters", kind, maxTableNameLen)
 	}
 	for _, r := range name {
 		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_' {
-			return fmt.Errorf("invalid table name: only alphanumeric and underscore allowed")
+			return fmt.Errorf("invalid %s name: only alphanumeric and underscore allowed", kind)
 		}
 	}
 	return nil
 }
 
 // DatabaseStorage implements Storage interface for database-based audit logging
-// Supports PostgreSQL and MySQL
+// Supports PostgreSQL, MySQL, SQLite and dialects added with RegisterDialect
 type DatabaseStorage struct {
-	db        *sql.DB
-	dbType    string // "postgres" or "mysql"
-	tableName string
+	db              *sql.DB
+	dialect         Dialect
+	tableName       string
+	metadataIndexes []string
+	fullTextIndex   bool
+
+	partitioned        bool
+	partitionsAhead    int
+	partitionRetention time.Duration
+	stopMaintenance    chan struct{}
+	maintenanceDone    chan struct{}
+
+	purgeBatchSize   int
+	statementTimeout time.Duration
+	readMode         ReadMode
+	bulkCopy         bool
+
+	replica          *sql.DB
+	ownsReplica      bool
+	replicaFreshness time.Duration
+
+	// Writes to embedded databases hold writeMu, see EmbeddedDialect
+	serialWrites bool
+	writeMu      sync.Mutex
+	stopVacuum   chan struct{}
+	vacuumDone   chan struct{}
 }
 
 // DatabaseConfig holds configuration for database storage
 type DatabaseConfig struct {
 	TableName string // Custom table name (default: "audit_logs")
+
+	// IndexedMetadataKeys lists hot metadata keys (e.g. "tenant_id") that get an
+	// expression index so equality filters on them avoid full scans.
+	// Supported on PostgreSQL and SQLite; ignored on MySQL.
+	IndexedMetadataKeys []string
+
+	// FullTextIndex adds a GIN index over a tsvector of the fields searched by
+	// QueryFilter.Text, used to narrow multi-word searches.
+	// Supported on PostgreSQL; ignored elsewhere.
+	FullTextIndex bool
+
+	// AutoMigrate runs Migrate on startup instead of only creating a
+	// missing table, so existing tables pick up schema changes
+	AutoMigrate bool
+
+	// Partitioned creates the table range-partitioned by month of
+	// timestamp (PostgreSQL and MySQL). It applies when the table is
+	// created; existing tables must be converted by hand.
+	Partitioned        bool
+	PartitionsAhead    int           // Upcoming months kept created (default: 3)
+	PartitionRetention time.Duration // Drop months older than this (default: 0, keep all)
+	PartitionInterval  time.Duration // How often partitions are maintained (default: 24h)
+
+	// PurgeBatchSize is the number of rows Purge deletes per statement,
+	// bounding how long each delete holds locks (default: 1000)
+	PurgeBatchSize int
+
+	// VacuumInterval is how often embedded databases (SQLite) are vacuumed
+	// in the background (default: 0, never; see Vacuum)
+	VacuumInterval time.Duration
+
+	// Connection pool of databases opened from a URL; zero values keep the
+	// database/sql defaults. NewDatabaseStorageFromDB leaves the pool as is.
+	MaxOpenConns    int           // Maximum open connections (default: unlimited)
+	MaxIdleConns    int           // Maximum idle connections (default: 2)
+	ConnMaxLifetime time.Duration // Close connections older than this (default: never)
+	ConnMaxIdleTime time.Duration // Close connections idle longer than this (default: never)
+
+	// ConnectTimeout bounds the initial ping and table creation
+	// (default: 5s; migrations have their own limit)
+	ConnectTimeout time.Duration
+
+	// StatementTimeout bounds each statement run by Write, WriteBatch,
+	// Query, Count, GroupBy and Purge (default: 0, only the caller's context)
+	StatementTimeout time.Duration
+
+	// ReplicaURL opens a read replica of the same database type that serves
+	// Query, Count and GroupBy; writes, purges and migrations stay on the
+	// primary. ReplicaDB uses an existing connection instead, which Close
+	// leaves open.
+	ReplicaURL string
+	ReplicaDB  *sql.DB
+
+	// ReadMode selects whether rows that fail to scan, or whose metadata
+	// is not valid JSON, are left out of Query results (ReadLenient, see
+	// QueryWithReport) or fail the read (ReadStrict). Count, GroupBy and
+	// Purge only read rows for conditions SQL cannot evaluate.
+	ReadMode ReadMode
+
+	// ReplicaFreshness sends reads that can match records newer than this
+	// to the primary, since the replica may lag behind it: those without
+	// an end time, or ending within the window (default: 0, the replica
+	// serves every read)
+	ReplicaFreshness time.Duration
 }
 
 // DefaultDatabaseConfig returns default database configuration
@@ -52,6 +164,30 @@ func DefaultDatabaseConfig() *DatabaseConfig {
 	}
 }
 
+// connectTimeout returns the ConnectTimeout or its default
+func (c *DatabaseConfig) connectTimeout() time.Duration {
+	if c.ConnectTimeout <= 0 {
+		return defaultConnectTimeout
+	}
+	return c.ConnectTimeout
+}
+
+// configurePool applies the pool settings of config that are set
+func configurePool(db *sql.DB, config *DatabaseConfig) {
+	if config.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+	if config.ConnMaxIdleTime != 0 {
+		db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+	}
+}
+
 // NewDatabaseStorage creates a new database storage instance
 func NewDatabaseStorage(databaseURL string) (*DatabaseStorage, error) {
 	return NewDatabaseStorageWithConfig(databaseURL, nil)
@@ -69,22 +205,20 @@ func NewDatabaseStorageWithConfig(databaseURL string, config *DatabaseConfig) (*
 	if err := validateTableName(tableName); err != nil {
 		return nil, err
 	}
+	for _, key := range config.IndexedMetadataKeys {
+		if err := validateMetadataKey(key); err != nil {
+			return nil, fmt.Errorf("invalid indexed metadata key: %w", err)
+		}
+	}
 
 	// Detect database type from URL
-	var dbType string
-	var driver string
-	var dsn string
-	if len(databaseURL) >= 10 && databaseURL[:10] == "postgres://" {
-		dbType = "postgres"
-		driver = "postgres"
-		dsn = databaseURL
-	} else if len(databaseURL) >= 8 && databaseURL[:8] == "mysql://" {
-		dbType = "mysql"
-		driver = "mysql"
-		// Convert mysql:// to DSN format
-		dsn = databaseURL[8:]
-	} else {
-		return nil, fmt.Errorf("unsupported database URL format, must start with postgres:// or mysql://")
+	dialect, driver, dsn, err := openDialectURL(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validatePartitioning(dialect, tableName, config); err != nil {
+		return nil, err
 	}
 
 	// Open database connection. When logging errors from this package, do not
@@ -93,9 +227,10 @@ func NewDatabaseStorageWithConfig(databaseURL string, config *DatabaseConfig) (*
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	configurePool(db, config)
 
 	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), config.connectTimeout())
 	defer cancel()
 	if err := db.PingContext(ctx); err != nil {
 		_ = db.Close()
@@ -103,15 +238,35 @@ func NewDatabaseStorageWithConfig(databaseURL string, config *DatabaseConfig) (*
 	}
 
 	storage := &DatabaseStorage{
-		db:        db,
-		dbType:    dbType,
-		tableName: tableName,
+		db:                 db,
+		dialect:            dialect,
+		tableName:          tableName,
+		metadataIndexes:    config.IndexedMetadataKeys,
+		fullTextIndex:      config.FullTextIndex,
+		partitioned:        config.Partitioned,
+		partitionsAhead:    config.PartitionsAhead,
+		partitionRetention: config.PartitionRetention,
+		purgeBatchSize:     config.PurgeBatchSize,
+		statementTimeout:   config.StatementTimeout,
+		readMode:           config.ReadMode,
+	}
+	if storage.partitionsAhead == 0 {
+		storage.partitionsAhead = defaultPartitionsAhead
 	}
+	if storage.purgeBatchSize <= 0 {
+		storage.purgeBatchSize = defaultPurgeBatchSize
+	}
+	_, storage.serialWrites = dialect.(EmbeddedDialect)
+	storage.bulkCopy = supportsCopy(db, dialect)
 
-	// Create table if it doesn't exist
-	if err := storage.createTable(ctx); err != nil {
+	if err := storage.openReplica(config); err != nil {
 		_ = db.Close()
-		return nil, fmt.Errorf("failed to create table: %w", err)
+		return nil, err
+	}
+	if err := storage.initSchema(config); err != nil {
+		_ = storage.closeReplica()
+		_ = db.Close()
+		return nil, err
 	}
 
 	return storage, nil
@@ -129,387 +284,1063 @@ func NewDatabaseStorageFromDB(db *sql.DB, dbType string, config *DatabaseConfig)
 	if err := validateTableName(tableName); err != nil {
 		return nil, err
 	}
+	for _, key := range config.IndexedMetadataKeys {
+		if err := validateMetadataKey(key); err != nil {
+			return nil, fmt.Errorf("invalid indexed metadata key: %w", err)
+		}
+	}
 
-	if dbType != "postgres" && dbType != "mysql" && dbType != "sqlite" {
-		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	dialect, err := dialectFor(dbType)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePartitioning(dialect, tableName, config); err != nil {
+		return nil, err
 	}
 
 	storage := &DatabaseStorage{
-		db:        db,
-		dbType:    dbType,
-		tableName: tableName,
+		db:                 db,
+		dialect:            dialect,
+		tableName:          tableName,
+		metadataIndexes:    config.IndexedMetadataKeys,
+		fullTextIndex:      config.FullTextIndex,
+		partitioned:        config.Partitioned,
+		partitionsAhead:    config.PartitionsAhead,
+		partitionRetention: config.PartitionRetention,
+		purgeBatchSize:     config.PurgeBatchSize,
+		statementTimeout:   config.StatementTimeout,
+		readMode:           config.ReadMode,
 	}
+	if storage.partitionsAhead == 0 {
+		storage.partitionsAhead = defaultPartitionsAhead
+	}
+	if storage.purgeBatchSize <= 0 {
+		storage.purgeBatchSize = defaultPurgeBatchSize
+	}
+	_, storage.serialWrites = dialect.(EmbeddedDialect)
+	storage.bulkCopy = supportsCopy(db, dialect)
 
-	// Create table if it doesn't exist
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := storage.createTable(ctx); err != nil {
-		return nil, fmt.Errorf("failed to create table: %w", err)
+	if err := storage.openReplica(config); err != nil {
+		return nil, err
+	}
+	if err := storage.initSchema(config); err != nil {
+		_ = storage.closeReplica()
+		return nil, err
 	}
 
 	return storage, nil
 }
 
-// createTable creates the audit_logs table if it doesn't exist
+// initSchema migrates the table, or creates it if it doesn't exist, and
+// starts partition maintenance for partitioned tables and vacuuming if
+// configured
+func (s *DatabaseStorage) initSchema(config *DatabaseConfig) error {
+	if config.AutoMigrate {
+		// Migrations may wait for another instance and alter large tables
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		if _, err := s.Migrate(ctx, nil); err != nil {
+			return fmt.Errorf("failed to migrate schema: %w", err)
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), config.connectTimeout())
+		defer cancel()
+		if err := s.createTable(ctx); err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+	}
+
+	if s.partitioned {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		if _, err := s.maintainPartitions(ctx, time.Now()); err != nil {
+			return fmt.Errorf("failed to maintain partitions: %w", err)
+		}
+		interval := config.PartitionInterval
+		if interval <= 0 {
+			interval = defaultPartitionInterval
+		}
+		s.startPartitionMaintenance(interval)
+	}
+
+	// Started last, so no goroutine outlives a failed initialization
+	if config.VacuumInterval > 0 && s.serialWrites {
+		s.startVacuum(config.VacuumInterval)
+	}
+	return nil
+}
+
+// createTable creates the audit_logs table if it doesn't exist, and the
+// lookup and metadata indexes an existing table may lack
 func (s *DatabaseStorage) createTable(ctx context.Context) error {
-	var createTableSQL string
-
-	switch s.dbType {
-	case "postgres":
-		createTableSQL = fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			id BIGSERIAL PRIMARY KEY,
-			event_type VARCHAR(50) NOT NULL,
-			event_id VARCHAR(100),
-			user_id VARCHAR(100),
-			challenge_id VARCHAR(100),
-			session_id VARCHAR(100),
-			channel VARCHAR(20),
-			destination VARCHAR(255),
-			purpose VARCHAR(50),
-			resource VARCHAR(255),
-			result VARCHAR(20),
-			reason VARCHAR(255),
-			provider VARCHAR(50),
-			provider_message_id VARCHAR(255),
-			ip VARCHAR(45),
-			user_agent TEXT,
-			request_id VARCHAR(100),
-			trace_id VARCHAR(100),
-			timestamp BIGINT NOT NULL,
-			duration_ms BIGINT,
-			metadata JSONB,
-			created_at TIMESTAMP NOT NULL DEFAULT NOW()
-		);
-
-		CREATE INDEX IF NOT EXISTS idx_%s_user_id ON %s(user_id);
-		CREATE INDEX IF NOT EXISTS idx_%s_challenge_id ON %s(challenge_id);
-		CREATE INDEX IF NOT EXISTS idx_%s_session_id ON %s(session_id);
-		CREATE INDEX IF NOT EXISTS idx_%s_event_type ON %s(event_type);
-		CREATE INDEX IF NOT EXISTS idx_%s_timestamp ON %s(timestamp);
-		CREATE INDEX IF NOT EXISTS idx_%s_created_at ON %s(created_at);
-		`, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName)
-
-	case "mysql":
-		createTableSQL = fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			id BIGINT AUTO_INCREMENT PRIMARY KEY,
-			event_type VARCHAR(50) NOT NULL,
-			event_id VARCHAR(100),
-			user_id VARCHAR(100),
-			challenge_id VARCHAR(100),
-			session_id VARCHAR(100),
-			channel VARCHAR(20),
-			destination VARCHAR(255),
-			purpose VARCHAR(50),
-			resource VARCHAR(255),
-			result VARCHAR(20),
-			reason VARCHAR(255),
-			provider VARCHAR(50),
-			provider_message_id VARCHAR(255),
-			ip VARCHAR(45),
-			user_agent TEXT,
-			request_id VARCHAR(100),
-			trace_id VARCHAR(100),
-			timestamp BIGINT NOT NULL,
-			duration_ms BIGINT,
-			metadata JSON,
-			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			INDEX idx_%s_user_id (user_id),
-			INDEX idx_%s_challenge_id (challenge_id),
-			INDEX idx_%s_session_id (session_id),
-			INDEX idx_%s_event_type (event_type),
-			INDEX idx_%s_timestamp (timestamp),
-			INDEX idx_%s_created_at (created_at)
-		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
-		`, s.tableName,
-			s.tableName, s.tableName, s.tableName,
-			s.tableName, s.tableName, s.tableName)
-
-	case "sqlite":
-		createTableSQL = fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			event_type VARCHAR(50) NOT NULL,
-			event_id VARCHAR(100),
-			user_id VARCHAR(100),
-			challenge_id VARCHAR(100),
-			session_id VARCHAR(100),
-			channel VARCHAR(20),
-			destination VARCHAR(255),
-			purpose VARCHAR(50),
-			resource VARCHAR(255),
-			result VARCHAR(20),
-			reason VARCHAR(255),
-			provider VARCHAR(50),
-			provider_message_id VARCHAR(255),
-			ip VARCHAR(45),
-			user_agent TEXT,
-			request_id VARCHAR(100),
-			trace_id VARCHAR(100),
-			timestamp BIGINT NOT NULL,
-			duration_ms BIGINT,
-			metadata TEXT,
-			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-		);
-
-		CREATE INDEX IF NOT EXISTS idx_%s_user_id ON %s(user_id);
-		CREATE INDEX IF NOT EXISTS idx_%s_challenge_id ON %s(challenge_id);
-		CREATE INDEX IF NOT EXISTS idx_%s_session_id ON %s(session_id);
-		CREATE INDEX IF NOT EXISTS idx_%s_event_type ON %s(event_type);
-		CREATE INDEX IF NOT EXISTS idx_%s_timestamp ON %s(timestamp);
-		CREATE INDEX IF NOT EXISTS idx_%s_created_at ON %s(created_at);
-		`, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName,
-			s.tableName, s.tableName)
+	statements, err := s.tableStatements()
+	if err != nil {
+		return err
+	}
+	statements = append(statements, s.lookupIndexStatements()...)
+	// Skipped until Migrate converts a legacy text column
+	if stmt := s.dialect.MetadataDocumentIndex(s.tableName); stmt != "" {
+		statements = append(statements, stmt)
+	}
 
-	default:
-		return fmt.Errorf("unsupported database type: %s", s.dbType)
+	// MySQL index statements share session variables
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
 	}
+	defer func() { _ = conn.Close() }()
+	return execStatements(ctx, conn, append(statements, s.configIndexStatements()...))
+}
 
-	// Execute each statement separately for SQLite
-	statements := strings.Split(createTableSQL, ";")
-	for _, stmt := range statements {
-		stmt = strings.TrimSpace(stmt)
-		if stmt == "" {
-			continue
+// tableStatements returns the statements creating the table and its fixed
+// indexes, as of schema version 1
+func (s *DatabaseStorage) tableStatements() ([]string, error) {
+	return s.dialect.CreateTable(s.tableName, s.partitioned)
+}
+
+// lookupIndexStatements returns the statements creating the indexes on
+// lookup fields (schema version 4). They are idempotent, so createTable
+// runs them on every start as well.
+func (s *DatabaseStorage) lookupIndexStatements() []string {
+	var statements []string
+	for _, column := range lookupIndexColumns {
+		statements = append(statements, s.dialect.CreateIndex(s.tableName, indexName(s.tableName, column), column)...)
+	}
+	return statements
+}
+
+// configIndexStatements returns the statements creating the optional
+// indexes selected by DatabaseConfig. They are idempotent and run on every
+// start, so enabling one later needs no migration.
+func (s *DatabaseStorage) configIndexStatements() []string {
+	var statements []string
+
+	// Expression indexes for hot metadata keys; each expression must match
+	// the one built by sqlWhere for the planner to use it
+	for _, key := range s.metadataIndexes {
+		name := indexName(s.tableName, "meta_"+strings.NewReplacer(".", "_", "-", "_").Replace(key))
+		if stmt := s.dialect.MetadataIndex(s.tableName, name, key); stmt != "" {
+			statements = append(statements, stmt)
 		}
-		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
-			return err
+	}
+	if s.fullTextIndex {
+		if stmt := s.dialect.TextIndex(s.tableName); stmt != "" {
+			statements = append(statements, stmt)
 		}
 	}
+	return statements
+}
+
+// sqlExecer is implemented by *sql.DB, *sql.Conn and *sql.Tx
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
 
+// execStatements runs statements in order, stopping at the first error
+func execStatements(ctx context.Context, db sqlExecer, statements []string) error {
+	for _, stmt := range statements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// execWrite runs a statement that writes, one at a time on embedded
+// databases so concurrent writers queue here instead of on busy retries
+func (s *DatabaseStorage) execWrite(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if s.serialWrites {
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+	}
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	return s.db.ExecContext(ctx, query, args...)
+}
+
+// statementContext bounds ctx by the StatementTimeout, if set
+func (s *DatabaseStorage) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.statementTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.statementTimeout)
+}
+
+// recordInsertColumns are the columns written for each record, in the
+// order of recordInsertArgs
+var recordInsertColumns = []string{
+	"event_type", "event_id", "user_id", "challenge_id", "session_id",
+	"channel", "destination", "purpose", "resource", "result", "reason",
+	"provider", "provider_message_id", "ip", "user_agent", "request_id",
+	"trace_id", "timestamp", "duration_ms", "metadata",
+}
+
+// maxBatchRows bounds the rows of one WriteBatch insert, keeping the bind
+// parameters within every dialect's limit
+const maxBatchRows = 500
+
 // Write writes an audit record to the database
 func (s *DatabaseStorage) Write(ctx context.Context, record *Record) error {
-	// Marshal metadata to JSON
+	args, err := s.recordInsertArgs(record)
+	if err != nil {
+		return err
+	}
+
+	query := s.dialect.Insert(s.tableName, recordInsertColumns, 1)
+	if _, err := s.execWrite(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to insert audit record: %w", err)
+	}
+
+	return nil
+}
+
+// WriteBatch writes records with multi-row inserts of up to 500 records.
+// Each insert is atomic, but a failed insert leaves earlier ones written.
+func (s *DatabaseStorage) WriteBatch(ctx context.Context, records []*Record) error {
+	for start := 0; start < len(records); start += maxBatchRows {
+		chunk := records[start:min(start+maxBatchRows, len(records))]
+		args := make([]interface{}, 0, len(chunk)*len(recordInsertColumns))
+		for _, record := range chunk {
+			recordArgs, err := s.recordInsertArgs(record)
+			if err != nil {
+				return err
+			}
+			args = append(args, recordArgs...)
+		}
+
+		query := s.dialect.Insert(s.tableName, recordInsertColumns, len(chunk))
+		if _, err := s.execWrite(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to insert audit records: %w", err)
+		}
+	}
+	return nil
+}
+
+// recordInsertArgs returns the bind values of recordInsertColumns
+func (s *DatabaseStorage) recordInsertArgs(record *Record) ([]interface{}, error) {
+	// Records without metadata store NULL so JSON functions used by
+	// metadata filters never see an empty string
 	var metadataJSON []byte
-	var err error
 	if record.Metadata != nil {
+		var err error
 		metadataJSON, err = json.Marshal(record.Metadata)
 		if err != nil {
-			return fmt.Errorf("failed to marshal metadata: %w", err)
-		}
-	}
-
-	var query string
-	var args []interface{}
-
-	switch s.dbType {
-	case "postgres":
-		query = fmt.Sprintf(`
-		INSERT INTO %s (
-			event_type, event_id, user_id, challenge_id, session_id,
-			channel, destination, purpose, resource, result, reason,
-			provider, provider_message_id, ip, user_agent, request_id,
-			trace_id, timestamp, duration_ms, metadata
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
-		`, s.tableName)
-		args = []interface{}{
-			string(record.EventType), record.EventID, record.UserID,
-			record.ChallengeID, record.SessionID, record.Channel,
-			record.Destination, record.Purpose, record.Resource,
-			string(record.Result), record.Reason, record.Provider,
-			record.ProviderMessageID, record.IP, record.UserAgent,
-			record.RequestID, record.TraceID, record.Timestamp,
-			record.DurationMS, metadataJSON,
-		}
-
-	case "mysql", "sqlite":
-		query = fmt.Sprintf(`
-		INSERT INTO %s (
-			event_type, event_id, user_id, challenge_id, session_id,
-			channel, destination, purpose, resource, result, reason,
-			provider, provider_message_id, ip, user_agent, request_id,
-			trace_id, timestamp, duration_ms, metadata
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, s.tableName)
-		args = []interface{}{
-			string(record.EventType), record.EventID, record.UserID,
-			record.ChallengeID, record.SessionID, record.Channel,
-			record.Destination, record.Purpose, record.Resource,
-			string(record.Result), record.Reason, record.Provider,
-			record.ProviderMessageID, record.IP, record.UserAgent,
-			record.RequestID, record.TraceID, record.Timestamp,
-			record.DurationMS, string(metadataJSON),
+			return nil, fmt.Errorf("failed to marshal metadata: %w", err)
 		}
-
-	default:
-		return fmt.Errorf("unsupported database type: %s", s.dbType)
 	}
 
-	_, err = s.db.ExecContext(ctx, query, args...)
+	return []interface{}{
+		string(record.EventType), record.EventID, record.UserID,
+		record.ChallengeID, record.SessionID, record.Channel,
+		record.Destination, record.Purpose, record.Resource,
+		string(record.Result), record.Reason, record.Provider,
+		record.ProviderMessageID, record.IP, record.UserAgent,
+		record.RequestID, record.TraceID, record.Timestamp,
+		record.DurationMS, s.dialect.MetadataValue(metadataJSON),
+	}, nil
+}
+
+// Query queries audit records from the database. Records whose metadata
+// cannot be decoded are returned with nil Metadata; use QueryWithReport to
+// find them.
+func (s *DatabaseStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record, error) {
+	return s.query(ctx, filter, nil)
+}
+
+// QueryWithReport implements ReportingQuerier; it finds rows corrupted
+// outside this package, e.g. by manual edits or other writers
+func (s *DatabaseStorage) QueryWithReport(ctx context.Context, filter *QueryFilter) ([]*Record, *QueryReport, error) {
+	report := &QueryReport{}
+	records, err := s.query(ctx, filter, report)
 	if err != nil {
-		return fmt.Errorf("failed to insert audit record: %w", err)
+		return nil, nil, err
 	}
-
-	return nil
+	return records, report, nil
 }
 
-// Query queries audit records from the database
-func (s *DatabaseStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record, error) {
+// query runs Query, filling report if not nil
+func (s *DatabaseStorage) query(ctx context.Context, filter *QueryFilter, report *QueryReport) ([]*Record, error) {
 	if filter == nil {
 		filter = DefaultQueryFilter()
 	}
 	filter.Normalize()
-
-	// Build WHERE clause
-	var whereClauses []string
-	var args []interface{}
-	argIndex := 1
-
-	addCondition := func(column, value string) {
-		if value == "" {
-			return
-		}
-		if s.dbType == "postgres" {
-			whereClauses = append(whereClauses, fmt.Sprintf("%s = $%d", column, argIndex))
-		} else {
-			whereClauses = append(whereClauses, fmt.Sprintf("%s = ?", column))
-		}
-		args = append(args, value)
-		argIndex++
+	if err := filter.Validate(); err != nil {
+		return nil, err
 	}
 
-	addCondition("event_type", filter.EventType)
-	addCondition("user_id", filter.UserID)
-	addCondition("challenge_id", filter.ChallengeID)
-	addCondition("session_id", filter.SessionID)
-	addCondition("channel", filter.Channel)
-	addCondition("result", filter.Result)
-	addCondition("ip", filter.IP)
-
-	if filter.StartTime > 0 {
-		if s.dbType == "postgres" {
-			whereClauses = append(whereClauses, fmt.Sprintf("timestamp >= $%d", argIndex))
-		} else {
-			whereClauses = append(whereClauses, "timestamp >= ?")
-		}
-		args = append(args, filter.StartTime)
-		argIndex++
-	}
+	where := s.buildWhere(filter)
 
-	if filter.EndTime > 0 {
-		if s.dbType == "postgres" {
-			whereClauses = append(whereClauses, fmt.Sprintf("timestamp <= $%d", argIndex))
-		} else {
-			whereClauses = append(whereClauses, "timestamp <= ?")
-		}
-		args = append(args, filter.EndTime)
-		argIndex++
+	// Conditions that SQL can only approximate (e.g. IPv6 ranges) are
+	// re-checked in Go, so pagination has to happen here as well
+	residual := where.residualFilter()
+	pagination := ""
+	if residual == nil {
+		pagination = fmt.Sprintf("LIMIT %s OFFSET %s", where.arg(filter.Limit), where.arg(filter.Offset))
 	}
 
-	// Build query
-	whereClause := ""
-	if len(whereClauses) > 0 {
-		whereClause = "WHERE " + strings.Join(whereClauses, " AND ")
+	// Unreadable records are identified by row id
+	columns := recordColumns
+	var id *int64
+	if report != nil || s.readMode == ReadStrict {
+		columns = "id, " + columns
+		id = new(int64)
 	}
 
-	var query string
-	if s.dbType == "postgres" {
-		query = fmt.Sprintf(`
-		SELECT event_type, event_id, user_id, challenge_id, session_id,
-		       channel, destination, purpose, resource, result, reason,
-		       provider, provider_message_id, ip, user_agent, request_id,
-		       trace_id, timestamp, duration_ms, metadata
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM %s
 		%s
-		ORDER BY timestamp DESC
-		LIMIT $%d OFFSET $%d
-		`, s.tableName, whereClause, argIndex, argIndex+1)
-		args = append(args, filter.Limit, filter.Offset)
-	} else {
-		query = fmt.Sprintf(`
-		SELECT event_type, event_id, user_id, challenge_id, session_id,
-		       channel, destination, purpose, resource, result, reason,
-		       provider, provider_message_id, ip, user_agent, request_id,
-		       trace_id, timestamp, duration_ms, metadata
-		FROM %s
 		%s
-		ORDER BY timestamp DESC
-		LIMIT ? OFFSET ?
-		`, s.tableName, whereClause)
-		args = append(args, filter.Limit, filter.Offset)
-	}
+		%s
+		`, columns, s.tableName, where.String(), orderBy(filter), pagination)
 
-	rows, err := s.db.QueryContext(ctx, query, args...)
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	rows, err := s.readDB(filter).QueryContext(ctx, query, where.args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query audit records: %w", err)
 	}
 	defer func() { _ = rows.Close() }()
 
 	var results []*Record
+	skipped, unreadable := 0, 0
 	for rows.Next() {
-		record := &Record{}
-		var eventType, result string
-		var eventID, userID, challengeID, sessionID sql.NullString
-		var channel, destination, purpose, resource sql.NullString
-		var reason, provider, providerMessageID sql.NullString
-		var ip, userAgent, requestID, traceID sql.NullString
-		var durationMS sql.NullInt64
-		var metadataJSON sql.NullString
-
-		err := rows.Scan(
-			&eventType, &eventID, &userID, &challengeID, &sessionID,
-			&channel, &destination, &purpose, &resource, &result, &reason,
-			&provider, &providerMessageID, &ip, &userAgent, &requestID,
-			&traceID, &record.Timestamp, &durationMS, &metadataJSON,
-		)
-		if err != nil {
+		record, err := scanRecord(rows, id)
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) && id != nil {
+			decodeErr.ID = *id
+		}
+		if err != nil && s.readMode == ReadStrict {
+			return nil, fmt.Errorf("failed to read audit record %d: %w", *id, err)
+		}
+		if err != nil && decodeErr == nil {
+			if report != nil {
+				report.Skipped = append(report.Skipped, SkippedRecord{ID: *id, Reason: err.Error()})
+			} else {
+				unreadable++
+			}
 			continue
 		}
 
-		record.EventType = EventType(eventType)
-		record.Result = Result(result)
-		record.EventID = eventID.String
-		record.UserID = userID.String
-		record.ChallengeID = challengeID.String
-		record.SessionID = sessionID.String
-		record.Channel = channel.String
-		record.Destination = destination.String
-		record.Purpose = purpose.String
-		record.Resource = resource.String
-		record.Reason = reason.String
-		record.Provider = provider.String
-		record.ProviderMessageID = providerMessageID.String
-		record.IP = ip.String
-		record.UserAgent = userAgent.String
-		record.RequestID = requestID.String
-		record.TraceID = traceID.String
-		record.DurationMS = durationMS.Int64
-
-		if metadataJSON.Valid && metadataJSON.String != "" {
-			_ = json.Unmarshal([]byte(metadataJSON.String), &record.Metadata)
+		if residual != nil {
+			if !matchesFilter(record, residual) {
+				continue
+			}
+			if skipped < filter.Offset {
+				skipped++
+				continue
+			}
 		}
 
 		results = append(results, record)
+		if decodeErr != nil && report != nil {
+			report.DecodeErrors = append(report.DecodeErrors, decodeErr)
+		}
+		if residual != nil && len(results) >= filter.Limit {
+			break
+		}
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating rows: %w", err)
 	}
+	if unreadable > 0 {
+		log.Printf("[audit] Skipped %d unreadable audit records of %s; use QueryWithReport to find them", unreadable, s.tableName)
+	}
 
 	return results, nil
 }
 
+// recordColumns is the column list read by scanRecord
+const recordColumns = `event_type, event_id, user_id, challenge_id, session_id,
+		       channel, destination, purpose, resource, result, reason,
+		       provider, provider_message_id, ip, user_agent, request_id,
+		       trace_id, timestamp, duration_ms, metadata`
+
+// buildWhere translates the filter's criteria into a WHERE clause
+func (s *DatabaseStorage) buildWhere(filter *QueryFilter) *sqlWhere {
+	where := &sqlWhere{dialect: s.dialect, textIndex: s.fullTextIndex}
+	where.addEqual("event_type", filter.EventType)
+	where.addEqual("user_id", filter.UserID)
+	where.addEqual("challenge_id", filter.ChallengeID)
+	where.addEqual("session_id", filter.SessionID)
+	where.addEqual("channel", filter.Channel)
+	where.addEqual("result", filter.Result)
+	where.addEqual("ip", filter.IP)
+	where.addEqual("event_id", filter.EventID)
+	where.addEqual("request_id", filter.RequestID)
+	where.addEqual("trace_id", filter.TraceID)
+	where.addEqual("provider", filter.Provider)
+	where.addEqual("provider_message_id", filter.ProviderMessageID)
+	where.addEqual("purpose", filter.Purpose)
+	where.addEqual("resource", filter.Resource)
+	where.addEqual("destination", filter.Destination)
+
+	if filter.StartTime > 0 {
+		where.add("timestamp >= " + where.arg(filter.StartTime))
+	}
+	if filter.EndTime > 0 {
+		where.add("timestamp <= " + where.arg(filter.EndTime))
+	}
+	for _, c := range filter.Conditions {
+		where.addCondition(c)
+	}
+	for _, c := range filter.Metadata {
+		where.addMetadataCondition(c)
+	}
+	where.addText(filter.Text)
+	if filter.Expr != nil {
+		where.addExpr(filter.Expr)
+	}
+
+	return where
+}
+
+// Count returns the number of records matching the filter
+func (s *DatabaseStorage) Count(ctx context.Context, filter *QueryFilter) (int64, error) {
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	if err := filter.Validate(); err != nil {
+		return 0, err
+	}
+
+	where := s.buildWhere(filter)
+	if where.residualFilter() != nil {
+		var count int64
+		err := s.forEachResidual(ctx, s.readDB(filter), where, func(*Record) { count++ })
+		return count, err
+	}
+
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	var count int64
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s %s", s.tableName, where.String())
+	if err := s.readDB(filter).QueryRowContext(ctx, query, where.args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count audit records: %w", err)
+	}
+	return count, nil
+}
+
+// GroupBy counts matching records per field values and time bucket
+func (s *DatabaseStorage) GroupBy(ctx context.Context, filter *QueryFilter, fields []string, bucket time.Duration) ([]AggregateRow, error) {
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	seconds, err := validateGroupBy(fields, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := newGroupCounter(fields, seconds)
+	where := s.buildWhere(filter)
+	if where.residualFilter() != nil {
+		if err := s.forEachResidual(ctx, s.readDB(filter), where, counter.add); err != nil {
+			return nil, err
+		}
+		return counter.result(), nil
+	}
+
+	// Group fields are validated column names; the bucket is an integer
+	var columns []string
+	if seconds > 0 {
+		columns = append(columns, fmt.Sprintf("timestamp - (timestamp %% %d)", seconds))
+	}
+	for _, field := range fields {
+		columns = append(columns, "COALESCE("+field+", '')")
+	}
+	positions := make([]string, len(columns))
+	for i := range positions {
+		positions[i] = strconv.Itoa(i + 1)
+	}
+	query := fmt.Sprintf("SELECT %s, COUNT(*) FROM %s %s GROUP BY %s",
+		strings.Join(columns, ", "), s.tableName, where.String(), strings.Join(positions, ", "))
+
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	rows, err := s.readDB(filter).QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate audit records: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var bucketStart, count int64
+		values := make([]string, len(fields))
+		var dest []interface{}
+		if seconds > 0 {
+			dest = append(dest, &bucketStart)
+		}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		dest = append(dest, &count)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan aggregate row: %w", err)
+		}
+		counter.addRow(bucketStart, values, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return counter.result(), nil
+}
+
+// forEachResidual streams rows of db matching where and calls fn for those
+// that also pass the residual conditions
+func (s *DatabaseStorage) forEachResidual(ctx context.Context, db *sql.DB, where *sqlWhere, fn func(*Record)) error {
+	residual := where.residualFilter()
+	query := fmt.Sprintf("SELECT %s FROM %s %s", recordColumns, s.tableName, where.String())
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return fmt.Errorf("failed to query audit records: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		record, err := scanRecord(rows, nil)
+		if err != nil && s.readMode == ReadStrict {
+			return fmt.Errorf("failed to read audit record: %w", err)
+		}
+		if err != nil && !isDecodeError(err) {
+			continue
+		}
+		if matchesFilter(record, residual) {
+			fn(record)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+	return nil
+}
+
+// Purge deletes records older than olderThan matching the filter, at most
+// PurgeBatchSize rows per statement so no delete holds locks for long
+func (s *DatabaseStorage) Purge(ctx context.Context, olderThan time.Time, filter *QueryFilter) (int64, error) {
+	filter, err := purgeFilter(olderThan, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	where := s.buildWhere(filter)
+	if where.residualFilter() != nil {
+		return s.purgeResidual(ctx, filter)
+	}
+
+	query := s.dialect.DeleteBatch(s.tableName, where.String(), s.purgeBatchSize)
+
+	var total int64
+	for {
+		result, err := s.execWrite(ctx, query, where.args...)
+		if err != nil {
+			return total, fmt.Errorf("failed to purge audit records: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("failed to purge audit records: %w", err)
+		}
+		total += n
+		if n < int64(s.purgeBatchSize) {
+			return total, nil
+		}
+	}
+}
+
+// purgeResidual purges records matching conditions that SQL only
+// approximates: each batch is re-checked in Go and deleted by id
+func (s *DatabaseStorage) purgeResidual(ctx context.Context, filter *QueryFilter) (int64, error) {
+	var total int64
+	var lastID int64
+	for {
+		where := s.buildWhere(filter)
+		residual := where.residualFilter()
+		where.add("id > " + where.arg(lastID))
+		query := fmt.Sprintf("SELECT id, %s FROM %s %s ORDER BY id LIMIT %d",
+			recordColumns, s.tableName, where.String(), s.purgeBatchSize)
+
+		queryCtx, cancel := s.statementContext(ctx)
+		rows, err := s.db.QueryContext(queryCtx, query, where.args...)
+		if err != nil {
+			cancel()
+			return total, fmt.Errorf("failed to query audit records: %w", err)
+		}
+		var ids []interface{}
+		scanned := 0
+		for rows.Next() {
+			var id int64
+			record, err := scanRecord(rows, &id)
+			if err != nil && s.readMode == ReadStrict {
+				_ = rows.Close()
+				cancel()
+				return total, fmt.Errorf("failed to read audit record %d: %w", id, err)
+			}
+			// Unreadable rows still count towards the batch and move past
+			// it, or a full batch would look like the last one
+			scanned++
+			lastID = max(lastID, id)
+			if err != nil && !isDecodeError(err) {
+				continue
+			}
+			if matchesFilter(record, residual) {
+				ids = append(ids, id)
+			}
+		}
+		_ = rows.Close()
+		cancel()
+		if err := rows.Err(); err != nil {
+			return total, fmt.Errorf("error iterating rows: %w", err)
+		}
+
+		if len(ids) > 0 {
+			placeholders := make([]string, len(ids))
+			for i := range ids {
+				placeholders[i] = s.dialect.Placeholder(i + 1)
+			}
+			query := fmt.Sprintf("DELETE FROM %s WHERE id IN (%s)", s.tableName, strings.Join(placeholders, ", "))
+			result, err := s.execWrite(ctx, query, ids...)
+			if err != nil {
+				return total, fmt.Errorf("failed to purge audit records: %w", err)
+			}
+			n, _ := result.RowsAffected()
+			total += n
+		}
+		if scanned < s.purgeBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// orderBy returns the ORDER BY clause for the filter's sort options; id
+// breaks remaining ties in insertion order
+func orderBy(filter *QueryFilter) string {
+	dir := "DESC"
+	if filter.ascending() {
+		dir = "ASC"
+	}
+	switch filter.sortKey() {
+	case SortByDuration:
+		return fmt.Sprintf("ORDER BY COALESCE(duration_ms, 0) %s, timestamp %s, id %s", dir, dir, dir)
+	case SortByEventType:
+		return fmt.Sprintf("ORDER BY event_type %s, timestamp %s, id %s", dir, dir, dir)
+	default:
+		return fmt.Sprintf("ORDER BY timestamp %s, id %s", dir, dir)
+	}
+}
+
+// scanRecord scans one row of the standard SELECT column list, preceded by
+// the row id if id is not nil. The id comes first so it is set even when a
+// later column fails to scan. A record whose metadata cannot be decoded is
+// returned with nil Metadata and a *DecodeError.
+func scanRecord(rows *sql.Rows, id *int64) (*Record, error) {
+	record := &Record{}
+	var eventType, result string
+	var eventID, userID, challengeID, sessionID sql.NullString
+	var channel, destination, purpose, resource sql.NullString
+	var reason, provider, providerMessageID sql.NullString
+	var ip, userAgent, requestID, traceID sql.NullString
+	var durationMS sql.NullInt64
+	var metadataJSON sql.NullString
+
+	dest := []interface{}{
+		&eventType, &eventID, &userID, &challengeID, &sessionID,
+		&channel, &destination, &purpose, &resource, &result, &reason,
+		&provider, &providerMessageID, &ip, &userAgent, &requestID,
+		&traceID, &record.Timestamp, &durationMS, &metadataJSON,
+	}
+	if id != nil {
+		dest = append([]interface{}{id}, dest...)
+	}
+	err := rows.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	record.EventType = EventType(eventType)
+	record.Result = Result(result)
+	record.EventID = eventID.String
+	record.UserID = userID.String
+	record.ChallengeID = challengeID.String
+	record.SessionID = sessionID.String
+	record.Channel = channel.String
+	record.Destination = destination.String
+	record.Purpose = purpose.String
+	record.Resource = resource.String
+	record.Reason = reason.String
+	record.Provider = provider.String
+	record.ProviderMessageID = providerMessageID.String
+	record.IP = ip.String
+	record.UserAgent = userAgent.String
+	record.RequestID = requestID.String
+	record.TraceID = traceID.String
+	record.DurationMS = durationMS.Int64
+
+	if metadataJSON.Valid && metadataJSON.String != "" {
+		if err := json.Unmarshal([]byte(metadataJSON.String), &record.Metadata); err != nil {
+			record.Metadata = nil
+			return record, &DecodeError{EventID: record.EventID, Err: err}
+		}
+	}
+
+	return record, nil
+}
+
+// sqlWhere builds a WHERE clause with placeholders for the storage dialect
+type sqlWhere struct {
+	dialect   Dialect
+	textIndex bool // Full-text index exists (see FullTextIndex)
+	clauses   []string
+	args      []interface{}
+
+	// residual and residualExpr hold conditions the clause only
+	// approximates; matching rows must be re-checked with matchesFilter
+	residual     []Condition
+	residualExpr *Expr
+}
+
+// arg adds a bind argument and returns its placeholder
+func (w *sqlWhere) arg(value interface{}) string {
+	w.args = append(w.args, value)
+	return w.dialect.Placeholder(len(w.args))
+}
+
+func (w *sqlWhere) add(clause string) {
+	w.clauses = append(w.clauses, clause)
+}
+
+// addEqual adds "column = value" unless value is empty
+func (w *sqlWhere) addEqual(column, value string) {
+	if value == "" {
+		return
+	}
+	w.add(column + " = " + w.arg(value))
+}
+
+// addCondition translates a validated Condition. Negated forms use COALESCE
+// so rows with NULL columns behave like records with empty fields.
+func (w *sqlWhere) addCondition(c Condition) {
+	column := c.Field
+	coalesced := "COALESCE(" + column + ", '')"
+
+	switch c.Op {
+	case OpIn, OpNotIn:
+		expr := column
+		if c.Op == OpNotIn || containsString(c.Values, "") {
+			expr = coalesced
+		}
+		placeholders := make([]string, len(c.Values))
+		for i, v := range c.Values {
+			placeholders[i] = w.arg(v)
+		}
+		not := ""
+		if c.Op == OpNotIn {
+			not = "NOT "
+		}
+		w.add(fmt.Sprintf("%s %sIN (%s)", expr, not, strings.Join(placeholders, ", ")))
+
+	case OpPrefix, OpNotPrefix:
+		// SUBSTR keeps the comparison case-sensitive on every dialect, unlike LIKE
+		parts := make([]string, len(c.Values))
+		for i, v := range c.Values {
+			parts[i] = fmt.Sprintf("SUBSTR(%s, 1, %d) = %s", coalesced, utf8.RuneCountInString(v), w.arg(v))
+		}
+		clause := "(" + strings.Join(parts, " OR ") + ")"
+		if c.Op == OpNotPrefix {
+			clause = "NOT " + clause
+		}
+		w.add(clause)
+
+	case OpCIDR, OpNotCIDR:
+		expr := column
+		if c.Op == OpNotCIDR {
+			expr = coalesced
+		}
+		var exact, approx []string
+		for _, v := range c.Values {
+			prefix, _ := parseCIDR(v)
+			if !translatesExactly(prefix) {
+				// Textual IPv6 forms and ranges inside an octet cannot be
+				// matched by prefix; narrow the candidates and check in Go
+				if c.Op == OpCIDR {
+					approx = append(approx, fmt.Sprintf("%s LIKE %s", expr, w.arg(ipv4Pattern(prefix))))
+				}
+				continue
+			}
+			if prefix.Bits() == 32 {
+				addr := prefix.Addr().String()
+				exact = append(exact, fmt.Sprintf("%s = %s", expr, w.arg(addr)),
+					fmt.Sprintf("%s LIKE %s", expr, w.arg(addr+":%")))
+				continue
+			}
+			exact = append(exact, fmt.Sprintf("%s LIKE %s", expr, w.arg(ipv4Pattern(prefix))))
+		}
+		if len(exact) < len(c.Values) {
+			w.residual = append(w.residual, c)
+		}
+		if c.Op == OpCIDR {
+			w.add("(" + strings.Join(append(exact, approx...), " OR ") + ")")
+		} else if len(exact) > 0 {
+			// Only the exactly translated ranges can be excluded in SQL
+			w.add("NOT (" + strings.Join(exact, " OR ") + ")")
+		}
+	}
+}
+
+// addMetadataCondition translates a validated MetadataCondition
+func (w *sqlWhere) addMetadataCondition(c MetadataCondition) {
+	typ, value, text := w.dialect.MetadataExprs(c.Key)
+
+	stringType, _, numberTypes := w.dialect.MetadataTypes()
+	isNumber := typ + " IN ('" + strings.Join(numberTypes, "', '") + "')"
+
+	compare := func(op string) string {
+		n, _ := metadataNumber(c.Value)
+		return w.dialect.MetadataCompare(isNumber, value, text, op, w.arg(n))
+	}
+	equal := func() string {
+		switch v := c.Value.(type) {
+		case string:
+			return fmt.Sprintf("(%s = '%s' AND %s = %s)", typ, stringType, text, w.arg(v))
+		case bool:
+			return w.dialect.MetadataBoolEquals(typ, text, v)
+		}
+		return compare("=")
+	}
+
+	switch c.Op {
+	case MetaExists:
+		w.add(typ + " IS NOT NULL")
+	case MetaNotExists:
+		w.add(typ + " IS NULL")
+	case MetaEq:
+		w.addMetadataContains(c)
+		w.add(equal())
+	case MetaNe:
+		w.add("NOT COALESCE(" + equal() + ", FALSE)")
+	case MetaGt:
+		w.add(compare(">"))
+	case MetaGte:
+		w.add(compare(">="))
+	case MetaLt:
+		w.add(compare("<"))
+	case MetaLte:
+		w.add(compare("<="))
+	}
+}
+
+// addMetadataContains narrows an equality on a string or boolean key with
+// a containment test the metadata document index can serve. Numbers are
+// left out: equality compares them numerically, containment exactly.
+func (w *sqlWhere) addMetadataContains(c MetadataCondition) {
+	switch c.Value.(type) {
+	case string, bool:
+	default:
+		return
+	}
+	doc, err := json.Marshal(map[string]interface{}{c.Key: c.Value})
+	if err != nil {
+		return
+	}
+	n := len(w.args)
+	if clause := w.dialect.MetadataContains(w.arg(string(doc))); clause != "" {
+		w.add(clause)
+	} else {
+		w.args = w.args[:n]
+	}
+}
+
+// postgresTextVector is the document indexed by FullTextIndex; queries must
+// use the same expression for the planner to pick the GIN index
+const postgresTextVector = `(to_tsvector('simple', COALESCE(reason, '') || ' ' || COALESCE(user_agent, '') || ' ' || COALESCE(resource, '')) || jsonb_to_tsvector('simple', COALESCE(metadata, '{}'), '["string"]'))`
+
+// addText adds a case-insensitive substring search over reason, user_agent,
+// resource and metadata string values at any depth
+func (w *sqlWhere) addText(text string) {
+	needle := textNeedle(text)
+	if needle == "" {
+		return
+	}
+	pattern := "%" + strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(needle) + "%"
+
+	var parts []string
+	for _, column := range []string{"reason", "user_agent", "resource"} {
+		parts = append(parts, w.dialect.ContainsText(column, w.arg(pattern)))
+	}
+	parts = append(parts, w.dialect.MetadataContainsText(w.arg(pattern)))
+	clause := "(" + strings.Join(parts, " OR ") + ")"
+
+	// Words with whitespace on both sides are whole tokens of any matching
+	// record, so the text index can narrow the candidates first
+	if w.textIndex {
+		if words := textIndexWords(needle); len(words) > 0 {
+			n := len(w.args)
+			if filter := w.dialect.TextIndexFilter(w.arg(strings.Join(words, " & "))); filter != "" {
+				clause = filter + " AND " + clause
+			} else {
+				w.args = w.args[:n]
+			}
+		}
+	}
+	w.add(clause)
+}
+
+// textIndexWords returns the inner words of needle made of ASCII letters
+// only, which PostgreSQL's parser always emits as single tokens
+func textIndexWords(needle string) []string {
+	fields := strings.FieldsFunc(needle, func(r rune) bool {
+		return r < utf8.RuneSelf && isQuerySpace(byte(r))
+	})
+	if len(fields) < 3 {
+		return nil
+	}
+	var words []string
+	for _, field := range fields[1 : len(fields)-1] {
+		letters := true
+		for _, c := range field {
+			if c < 'a' || c > 'z' {
+				letters = false
+				break
+			}
+		}
+		if letters {
+			words = append(words, field)
+		}
+	}
+	return words
+}
+
+// addExpr translates a validated expression. Expressions with a leaf SQL
+// can only approximate are evaluated in Go instead, since NOT would turn
+// the approximation into a wrong answer.
+func (w *sqlWhere) addExpr(e *Expr) {
+	if !exprTranslatesExactly(e) {
+		w.residualExpr = e
+		return
+	}
+	w.add(w.exprClause(e))
+}
+
+// exprClause returns the SQL for an exactly translatable expression. Leaves
+// are wrapped in COALESCE so NULL columns cannot leak three-valued logic
+// into NOT and OR.
+func (w *sqlWhere) exprClause(e *Expr) string {
+	switch {
+	case len(e.And) > 0, len(e.Or) > 0:
+		terms, sep := e.And, " AND "
+		if len(e.Or) > 0 {
+			terms, sep = e.Or, " OR "
+		}
+		parts := make([]string, len(terms))
+		for i, t := range terms {
+			parts[i] = w.exprClause(t)
+		}
+		return "(" + strings.Join(parts, sep) + ")"
+	case e.Not != nil:
+		return "NOT " + w.exprClause(e.Not)
+	}
+
+	// Build the leaf with the shared translators, continuing the placeholders
+	leaf := &sqlWhere{dialect: w.dialect, textIndex: w.textIndex, args: w.args}
+	switch {
+	case e.Condition != nil:
+		leaf.addCondition(*e.Condition)
+	case e.Metadata != nil:
+		leaf.addMetadataCondition(*e.Metadata)
+	case e.Text != "":
+		leaf.addText(e.Text)
+	case e.Time != nil:
+		if e.Time.Start > 0 {
+			leaf.add("timestamp >= " + leaf.arg(e.Time.Start))
+		}
+		if e.Time.End > 0 {
+			leaf.add("timestamp <= " + leaf.arg(e.Time.End))
+		}
+	}
+	w.args = leaf.args
+	if len(leaf.clauses) == 0 {
+		return "1 = 1"
+	}
+	return "COALESCE(" + strings.Join(leaf.clauses, " AND ") + ", FALSE)"
+}
+
+// exprTranslatesExactly reports whether every CIDR leaf of e can be matched
+// in SQL without a Go re-check
+func exprTranslatesExactly(e *Expr) bool {
+	for _, sub := range append(append([]*Expr{e.Not}, e.And...), e.Or...) {
+		if sub != nil && !exprTranslatesExactly(sub) {
+			return false
+		}
+	}
+	if e.Condition == nil || (e.Condition.Op != OpCIDR && e.Condition.Op != OpNotCIDR) {
+		return true
+	}
+	for _, v := range e.Condition.Values {
+		prefix, _ := parseCIDR(v)
+		if !translatesExactly(prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// residualFilter returns the conditions to re-check in Go, or nil
+func (w *sqlWhere) residualFilter() *QueryFilter {
+	if len(w.residual) == 0 && w.residualExpr == nil {
+		return nil
+	}
+	return &QueryFilter{Conditions: w.residual, Expr: w.residualExpr}
+}
+
+// String returns the WHERE clause, or "" when there are no conditions
+func (w *sqlWhere) String() string {
+	if len(w.clauses) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(w.clauses, " AND ")
+}
+
+// translatesExactly reports whether a CIDR range can be matched in SQL
+// without a Go re-check: IPv4 ranges of whole octets other than 0.0.0.0/0
+func translatesExactly(prefix netip.Prefix) bool {
+	return prefix.Addr().Is4() && prefix.Bits() > 0 && prefix.Bits()%8 == 0
+}
+
+// ipv4Pattern returns a LIKE pattern over dotted-decimal text, optionally
+// followed by a port, for the whole octets of prefix (e.g. 172.16.0.0/12
+// becomes "172.%"). IPv6 ranges and ranges within the first octet match
+// any address of their family.
+func ipv4Pattern(prefix netip.Prefix) string {
+	if !prefix.Addr().Is4() {
+		return "%:%"
+	}
+	octets := prefix.Addr().As4()
+	lead := ""
+	for i := 0; i < prefix.Bits()/8 && i < 3; i++ {
+		lead += strconv.Itoa(int(octets[i])) + "."
+	}
+	if lead == "" {
+		return "%.%"
+	}
+	return lead + "%"
+}
+
 // Close closes the database connection
 func (s *DatabaseStorage) Close() error {
+	s.stopPartitionMaintenance()
+	s.stopVacuuming()
+	replicaErr := s.closeReplica()
 	if s.db != nil {
-		return s.db.Close()
+		if err := s.db.Close(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return replicaErr
 }
 
 // DB returns the underlying database connection
@@ -517,7 +1348,12 @@ func (s *DatabaseStorage) DB() *sql.DB {
 	return s.db
 }
 
-// DBType returns the database type
+// DBType returns the database type, the name of the dialect
 func (s *DatabaseStorage) DBType() string {
-	return s.dbType
+	return s.dialect.Name()
+}
+
+// Dialect returns the SQL dialect
+func (s *DatabaseStorage) Dialect() Dialect {
+	return s.dialect
 }
@@ -3,8 +3,12 @@ package audit
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -347,15 +351,21 @@ func TestValidateTableName(t *testing.T) {
 		assert.NoError(t, validateTableName("audit_logs"))
 		assert.NoError(t, validateTableName("AuditLogs2"))
 	})
+	t.Run("schema-qualified", func(t *testing.T) {
+		assert.NoError(t, validateTableName("audit.logs"))
+		assert.ErrorContains(t, validateTableName(".logs"), "schema name cannot be empty")
+		assert.ErrorContains(t, validateTableName("audit."), "table name cannot be empty")
+		assert.ErrorContains(t, validateTableName("audit-x.logs"), "invalid schema name")
+		assert.ErrorContains(t, validateTableName("a.b.c"), "invalid table name")
+		assert.ErrorContains(t, validateTableName(strings.Repeat("a", maxTableNameLen+1)+".logs"), "schema name too long")
+	})
 }
 
 func TestCreateTable_UnsupportedDBType(t *testing.T) {
 	db := newTestSQLiteDB(t)
 	defer func() { _ = db.Close() }()
 
-	s := &DatabaseStorage{db: db, dbType: "invalid", tableName: "audit_logs"}
-	ctx := context.Background()
-	err := s.createTable(ctx)
+	_, err := NewDatabaseStorageFromDB(db, "invalid", nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "unsupported database type")
 }
@@ -376,19 +386,19 @@ func TestDatabaseStorage_Write_MetadataMarshalError(t *testing.T) {
 }
 
 // TestDatabaseStorage_Query_PostgresBranch covers the postgres query-building path.
-// Uses sqlite DB with dbType "postgres" so the SELECT uses $1,$2 placeholders.
+// Uses sqlite DB with the postgres dialect so the SELECT uses $1,$2 placeholders.
 func TestDatabaseStorage_Query_PostgresBranch(t *testing.T) {
 	db := newTestSQLiteDB(t)
 	defer func() { _ = db.Close() }()
 
 	_, _ = db.Exec(`CREATE TABLE IF NOT EXISTS audit_logs (
-		event_type TEXT, event_id TEXT, user_id TEXT, challenge_id TEXT, session_id TEXT,
+		id INTEGER PRIMARY KEY AUTOINCREMENT, event_type TEXT, event_id TEXT, user_id TEXT, challenge_id TEXT, session_id TEXT,
 		channel TEXT, destination TEXT, purpose TEXT, resource TEXT, result TEXT, reason TEXT,
 		provider TEXT, provider_message_id TEXT, ip TEXT, user_agent TEXT, request_id TEXT,
 		trace_id TEXT, timestamp INTEGER, duration_ms INTEGER, metadata TEXT
 	)`)
 
-	s := &DatabaseStorage{db: db, dbType: "postgres", tableName: "audit_logs"}
+	s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs"}
 	results, err := s.Query(context.Background(), DefaultQueryFilter())
 	require.NoError(t, err)
 	if results != nil {
@@ -396,6 +406,127 @@ func TestDatabaseStorage_Query_PostgresBranch(t *testing.T) {
 	}
 }
 
+func TestNewDatabaseStorage_SQLiteURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.db")
+	for _, url := range []string{"sqlite://" + path, "file:" + path} {
+		t.Run(url, func(t *testing.T) {
+			storage, err := NewDatabaseStorage(url)
+			require.NoError(t, err)
+			defer func() { _ = storage.Close() }()
+			assert.Equal(t, "sqlite", storage.DBType())
+
+			var journalMode string
+			require.NoError(t, storage.DB().QueryRow("PRAGMA journal_mode").Scan(&journalMode))
+			assert.Equal(t, "wal", journalMode)
+			var busyTimeout int
+			require.NoError(t, storage.DB().QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout))
+			assert.Equal(t, 5000, busyTimeout)
+
+			require.NoError(t, storage.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess)))
+			results, err := storage.Query(context.Background(), DefaultQueryFilter())
+			require.NoError(t, err)
+			assert.NotEmpty(t, results)
+		})
+	}
+}
+
+func TestDatabaseStorage_SQLiteConcurrentWrites(t *testing.T) {
+	storage, err := NewDatabaseStorage("sqlite://" + filepath.Join(t.TempDir(), "audit.db"))
+	require.NoError(t, err)
+	defer func() { _ = storage.Close() }()
+
+	const writers, perWriter = 8, 25
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*perWriter)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if err := storage.Write(ctx, NewRecord(EventLoginSuccess, ResultSuccess)); err != nil {
+					errs <- err
+				}
+				if _, err := storage.Count(ctx, nil); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	count, err := storage.Count(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(writers*perWriter), count)
+}
+
+func TestNewDatabaseStorageFromDB_SchemaQualified(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS audit.logs (")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS idx_logs_user_id ON audit.logs(user_id)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 1; i < len(auditIndexColumns)+len(lookupIndexColumns); i++ {
+		mock.ExpectExec("CREATE INDEX IF NOT EXISTS idx_logs_").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS idx_logs_metadata ON audit.logs USING GIN")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS idx_logs_meta_tenant_id ON audit.logs ((metadata->>'tenant_id'))")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit.logs (")).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	storage, err := NewDatabaseStorageFromDB(db, "postgres", &DatabaseConfig{
+		TableName:           "audit.logs",
+		IndexedMetadataKeys: []string{"tenant_id"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, storage.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess)))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = NewDatabaseStorageFromDB(newTestSQLiteDB(t), "sqlite", &DatabaseConfig{TableName: "audit.logs"})
+	assert.ErrorContains(t, err, "schema-qualified table names are not supported on sqlite")
+}
+
+func TestNewDatabaseStorageWithConfig_Pool(t *testing.T) {
+	storage, err := NewDatabaseStorageWithConfig("sqlite://"+filepath.Join(t.TempDir(), "audit.db"), &DatabaseConfig{
+		MaxOpenConns:    3,
+		MaxIdleConns:    1,
+		ConnMaxLifetime: time.Hour,
+		ConnMaxIdleTime: time.Minute,
+		ConnectTimeout:  time.Second,
+	})
+	require.NoError(t, err)
+	defer func() { _ = storage.Close() }()
+	assert.Equal(t, 3, storage.DB().Stats().MaxOpenConnections)
+
+	assert.Equal(t, defaultConnectTimeout, (&DatabaseConfig{}).connectTimeout())
+	assert.Equal(t, time.Second, (&DatabaseConfig{ConnectTimeout: time.Second}).connectTimeout())
+}
+
+func TestDatabaseStorage_StatementTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs", statementTimeout: 20 * time.Millisecond}
+
+	mock.ExpectExec("INSERT INTO audit_logs").WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(1, 1))
+	err = s.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess))
+	assert.ErrorContains(t, err, "failed to insert audit record")
+
+	mock.ExpectQuery("SELECT COUNT").WillDelayFor(time.Second).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	_, err = s.Count(context.Background(), nil)
+	assert.ErrorContains(t, err, "failed to count audit records")
+
+	mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	count, err := s.Count(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
 func TestNewDatabaseStorage_InvalidURL(t *testing.T) {
 	// Test unsupported URL format
 	_, err := NewDatabaseStorage("invalid://localhost/db")
@@ -843,11 +974,13 @@ func TestDatabaseStorage_Write_PostgresBranch(t *testing.T) {
 	require.NoError(t, err)
 	defer func() { _ = db.Close() }()
 
-	// Postgres createTable: one CREATE TABLE + 6 CREATE INDEX
+	// Postgres createTable: one CREATE TABLE + 10 CREATE INDEX + the
+	// metadata GIN index
 	mock.ExpectExec("CREATE TABLE.*").WillReturnResult(sqlmock.NewResult(0, 0))
-	for i := 0; i < 6; i++ {
+	for i := 0; i < 10; i++ {
 		mock.ExpectExec("CREATE INDEX.*").WillReturnResult(sqlmock.NewResult(0, 0))
 	}
+	mock.ExpectExec("idx_audit_logs_metadata ON audit_logs USING GIN").WillReturnResult(sqlmock.NewResult(0, 0))
 	storage, err := NewDatabaseStorageFromDB(db, "postgres", nil)
 	require.NoError(t, err)
 	require.NoError(t, mock.ExpectationsWereMet())
@@ -859,23 +992,28 @@ func TestDatabaseStorage_Write_PostgresBranch(t *testing.T) {
 	require.NoError(t, mock.ExpectationsWereMet())
 }
 
-// TestDatabaseStorage_Write_UnsupportedDBType covers the default branch in Write (unsupported db type).
-func TestDatabaseStorage_Write_UnsupportedDBType(t *testing.T) {
-	db := newTestSQLiteDB(t)
-	defer func() { _ = db.Close() }()
-	storage := &DatabaseStorage{db: db, dbType: "unknown", tableName: "audit_logs"}
-	record := NewRecord(EventLoginSuccess, ResultSuccess)
-	err := storage.Write(context.Background(), record)
+// TestDatabaseStorage_UnsupportedDBType covers a database type without a registered dialect.
+func TestDatabaseStorage_UnsupportedDBType(t *testing.T) {
+	_, err := dialectFor("unknown")
 	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "unsupported database type")
+	assert.Contains(t, err.Error(), "unsupported database type: unknown")
 }
 
-// TestCreateTable_MySQLBranch covers createTable for mysql (single CREATE TABLE statement with INDEX).
+// TestCreateTable_MySQLBranch covers createTable for mysql (CREATE TABLE with INDEX, then the
+// lookup indexes an existing table may lack).
 func TestCreateTable_MySQLBranch(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	require.NoError(t, err)
 	defer func() { _ = db.Close() }()
 	mock.ExpectExec("CREATE TABLE.*").WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, column := range lookupIndexColumns {
+		index := "idx_audit_logs_" + column
+		mock.ExpectExec(regexp.QuoteMeta("SET @audit_create_index = IF((SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'audit_logs' AND index_name = '" + index + "') > 0, 'DO 0', 'CREATE INDEX " + index + " ON audit_logs (" + column + ")')")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("PREPARE audit_create_index FROM @audit_create_index").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("EXECUTE audit_create_index").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DEALLOCATE PREPARE audit_create_index").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
 	_, err = NewDatabaseStorageFromDB(db, "mysql", nil)
 	require.NoError(t, err)
 	require.NoError(t, mock.ExpectationsWereMet())
@@ -903,7 +1041,7 @@ func TestDatabaseStorage_Query_RowsErr(t *testing.T) {
 
 	// Allow createTable to succeed (sqlite: one CREATE TABLE + several CREATE INDEX)
 	mock.ExpectExec("CREATE TABLE.*").WillReturnResult(sqlmock.NewResult(0, 0))
-	for i := 0; i < 6; i++ {
+	for i := 0; i < 10; i++ {
 		mock.ExpectExec("CREATE INDEX.*").WillReturnResult(sqlmock.NewResult(0, 0))
 	}
 
@@ -927,3 +1065,224 @@ func TestDatabaseStorage_Query_RowsErr(t *testing.T) {
 	assert.Contains(t, err.Error(), "error iterating rows")
 	require.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestDatabaseStorage_IndexedMetadataKeys(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	storage, err := NewDatabaseStorageFromDB(db, "sqlite", &DatabaseConfig{
+		IndexedMetadataKeys: []string{"tenant_id", "client.app-id"},
+	})
+	require.NoError(t, err)
+
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index'
+		AND name IN ('idx_audit_logs_meta_tenant_id', 'idx_audit_logs_meta_client_app_id')`).Scan(&count))
+	assert.Equal(t, 2, count)
+
+	// Rows with legacy empty-string metadata must not break the index
+	_, err = db.Exec(`INSERT INTO audit_logs (event_type, result, timestamp, metadata) VALUES ('x', 'y', 1, '')`)
+	require.NoError(t, err)
+	require.NoError(t, storage.Write(context.Background(),
+		NewRecord(EventLoginSuccess, ResultSuccess).WithMetadata("tenant_id", "acme")))
+
+	// The equality filter uses the expression index
+	where := &sqlWhere{dialect: SQLiteDialect{}}
+	where.addMetadataCondition(MetadataEquals("tenant_id", "acme"))
+	rows, err := db.Query("EXPLAIN QUERY PLAN SELECT * FROM audit_logs "+where.String(), where.args...)
+	require.NoError(t, err)
+	var plan strings.Builder
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		require.NoError(t, rows.Scan(&id, &parent, &unused, &detail))
+		plan.WriteString(detail)
+	}
+	require.NoError(t, rows.Close())
+	assert.Contains(t, plan.String(), "idx_audit_logs_meta_tenant_id")
+
+	results, err := storage.Query(context.Background(), DefaultQueryFilter().WithMetadata("tenant_id", "acme"))
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+}
+
+func TestDatabaseStorage_IndexedMetadataKeys_Postgres(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectExec("CREATE TABLE.*").WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < 10; i++ {
+		mock.ExpectExec("CREATE INDEX.*").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec("idx_audit_logs_metadata ON audit_logs USING GIN").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE INDEX IF NOT EXISTS idx_audit_logs_meta_tenant_id ON audit_logs \(\(metadata->>'tenant_id'\)\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, err = NewDatabaseStorageFromDB(db, "postgres", &DatabaseConfig{IndexedMetadataKeys: []string{"tenant_id"}})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDatabaseStorage_FullTextIndex(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectExec("CREATE TABLE.*").WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < 10; i++ {
+		mock.ExpectExec("CREATE INDEX.*").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec("idx_audit_logs_metadata ON audit_logs USING GIN").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE INDEX IF NOT EXISTS idx_audit_logs_text ON audit_logs USING GIN \(\(to_tsvector\('simple'`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	storage, err := NewDatabaseStorageFromDB(db, "postgres", &DatabaseConfig{FullTextIndex: true})
+	require.NoError(t, err)
+	assert.True(t, storage.buildWhere(DefaultQueryFilter()).textIndex)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// Ignored on SQLite
+	sqliteDB := newTestSQLiteDB(t)
+	defer func() { _ = sqliteDB.Close() }()
+	_, err = NewDatabaseStorageFromDB(sqliteDB, "sqlite", &DatabaseConfig{FullTextIndex: true})
+	require.NoError(t, err)
+}
+
+func TestDatabaseStorage_IndexedMetadataKeys_Invalid(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	_, err := NewDatabaseStorageFromDB(db, "sqlite", &DatabaseConfig{IndexedMetadataKeys: []string{"bad'key"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid indexed metadata key")
+
+	_, err = NewDatabaseStorageWithConfig("postgres://localhost/audit", &DatabaseConfig{IndexedMetadataKeys: []string{""}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid indexed metadata key")
+}
+
+func TestDatabaseStorage_Write_NilMetadataStoresNull(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	storage, err := NewDatabaseStorageFromDB(db, "sqlite", nil)
+	require.NoError(t, err)
+	require.NoError(t, storage.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess)))
+
+	var isNull bool
+	require.NoError(t, db.QueryRow("SELECT metadata IS NULL FROM audit_logs").Scan(&isNull))
+	assert.True(t, isNull)
+}
+
+func TestDatabaseStorage_LookupIndexes(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+	}{
+		{name: "new table"},
+		{name: "table created without lookup indexes", existing: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestSQLiteDB(t)
+			defer func() { _ = db.Close() }()
+			if tt.existing {
+				statements, err := SQLiteDialect{}.CreateTable("audit_logs", false)
+				require.NoError(t, err)
+				require.NoError(t, execStatements(context.Background(), db, statements))
+			}
+
+			_, err := NewDatabaseStorageFromDB(db, "sqlite", nil)
+			require.NoError(t, err)
+
+			for _, column := range []string{"event_id", "request_id", "trace_id", "provider_message_id"} {
+				var count int
+				require.NoError(t, db.QueryRow(
+					"SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", "idx_audit_logs_"+column,
+				).Scan(&count))
+				assert.Equal(t, 1, count, column)
+			}
+		})
+	}
+}
+
+func TestDatabaseStorage_GroupBy_SQL(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	storage := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs"}
+	mock.ExpectQuery(`SELECT timestamp - \(timestamp % 3600\), COALESCE\(channel, ''\), COUNT\(\*\) FROM audit_logs WHERE event_type = \$1 GROUP BY 1, 2`).
+		WithArgs("verification_failed").
+		WillReturnRows(sqlmock.NewRows([]string{"bucket", "channel", "count"}).
+			AddRow(7200, "sms", 4).
+			AddRow(3600, "email", 2))
+
+	filter := DefaultQueryFilter().WithEventType("verification_failed")
+	rows, err := storage.GroupBy(context.Background(), filter, []string{"channel"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []AggregateRow{
+		{Bucket: 3600, Groups: map[string]string{"channel": "email"}, Count: 2},
+		{Bucket: 7200, Groups: map[string]string{"channel": "sms"}, Count: 4},
+	}, rows)
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM audit_logs`).WillReturnError(errors.New("connection lost"))
+	_, err = storage.Count(context.Background(), nil)
+	assert.ErrorContains(t, err, "failed to count audit records")
+
+	mock.ExpectQuery(`SELECT COALESCE\(result, ''\), COUNT`).WillReturnError(errors.New("connection lost"))
+	_, err = storage.GroupBy(context.Background(), nil, []string{"result"}, 0)
+	assert.ErrorContains(t, err, "failed to aggregate audit records")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDatabaseStorage_QueryWithReport(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+	s, err := NewDatabaseStorageFromDB(db, "sqlite", nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, s.Write(ctx, NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("u1").WithMetadata("tenant_id", "acme").SetTimestamp(300)))
+	_, err = db.Exec(`INSERT INTO audit_logs (event_type, event_id, user_id, result, timestamp, metadata) VALUES ('login_success', 'evt-2', 'u2', 'success', 200, '{"tenant_id":')`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO audit_logs (event_type, user_id, result, timestamp) VALUES ('login_success', 'u3', 'success', 'yesterday')`)
+	require.NoError(t, err)
+
+	// Query keeps returning the record with corrupted metadata, without it
+	results, err := s.Query(ctx, DefaultQueryFilter())
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "acme", results[0].Metadata["tenant_id"])
+	assert.Nil(t, results[1].Metadata)
+
+	results, report, err := s.QueryWithReport(ctx, DefaultQueryFilter())
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Len(t, report.Skipped, 1)
+	assert.Equal(t, int64(3), report.Skipped[0].ID)
+	assert.Contains(t, report.Skipped[0].Reason, `"timestamp"`)
+	require.Len(t, report.DecodeErrors, 1)
+	decodeErr := report.DecodeErrors[0]
+	assert.Equal(t, int64(2), decodeErr.ID)
+	assert.Equal(t, "evt-2", decodeErr.EventID)
+	assert.ErrorContains(t, decodeErr, "failed to decode metadata of record 2")
+
+	var syntaxErr *json.SyntaxError
+	assert.ErrorAs(t, decodeErr, &syntaxErr)
+
+	data, err := json.Marshal(report)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"decode_errors":[{"error":"unexpected end of JSON input","event_id":"evt-2","id":2}]`)
+	assert.Contains(t, string(data), `"skipped":[{"id":3,"reason":`)
+
+	// Only records in the results are reported
+	filter := DefaultQueryFilter()
+	filter.Conditions = []Condition{InCIDR("2001:db8::/32")}
+	results, report, err = s.QueryWithReport(ctx, filter)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+	assert.Empty(t, report.DecodeErrors)
+}
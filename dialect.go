@@ -0,0 +1,343 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dialect describes the SQL of one database engine for DatabaseStorage.
+// Built-in dialects are registered as "postgres", "mysql" and "sqlite";
+// register others with RegisterDialect. A dialect for a compatible engine
+// can embed a built-in one and override what differs.
+type Dialect interface {
+	// Name is the database type the dialect is registered under
+	Name() string
+
+	// Placeholder returns the n-th bind parameter, counting from 1
+	Placeholder(n int) string
+
+	// CreateTable returns the statements creating the audit table and the
+	// indexes on auditIndexColumns (schema version 1). Changes belong in a
+	// new schema version. partitioned is only true for dialects
+	// implementing PartitionDialect.
+	CreateTable(table string, partitioned bool) ([]string, error)
+
+	// AlterColumnType changes the type of a column, or returns "" if the
+	// database does not enforce column types
+	AlterColumnType(table, column, typ string) string
+
+	// CreateIndex returns the statements creating index on column unless
+	// the table already has an index of that name
+	CreateIndex(table, index, column string) []string
+
+	// MetadataIndex returns the statement creating an expression index on
+	// a metadata key, or "" if unsupported
+	MetadataIndex(table, index, key string) string
+
+	// TextIndex returns the statement creating the FullTextIndex, or "" if
+	// unsupported
+	TextIndex(table string) string
+
+	// MetadataDocumentIndex returns the statement creating an index over
+	// the whole metadata document, or "" if unsupported. It does nothing
+	// while the column still holds text, see ConvertMetadataColumn.
+	MetadataDocumentIndex(table string) string
+
+	// ConvertMetadataColumn returns the statement converting a text
+	// metadata column to the native JSON type, or "" if the column is
+	// always created native. It must leave native columns unchanged.
+	ConvertMetadataColumn(table string) string
+
+	// CurrentTimestamp is the column default for creation times
+	CurrentTimestamp() string
+
+	// TableExistsQuery returns a query counting the tables named table,
+	// which may be schema-qualified, and its arguments
+	TableExistsQuery(table string) (string, []interface{})
+
+	// Lock takes the named advisory lock on conn, waiting at most timeout,
+	// and returns its release function
+	Lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (func(), error)
+
+	// Insert returns an INSERT of rows rows into columns
+	Insert(table string, columns []string, rows int) string
+
+	// InsertIgnore returns an INSERT of one row that does nothing when the
+	// key column already holds the value
+	InsertIgnore(table string, columns []string, key string) string
+
+	// DeleteBatch returns a DELETE of at most limit rows matching where
+	// (a WHERE clause, possibly empty), lowest id first
+	DeleteBatch(table, where string, limit int) string
+
+	// MetadataValue converts marshaled metadata (nil for none) to the bind
+	// value of the metadata column
+	MetadataValue(data []byte) interface{}
+
+	// MetadataExprs returns expressions for the JSON type, the scalar value
+	// and the text of a validated metadata key; a missing key must yield a
+	// NULL type
+	MetadataExprs(key string) (typ, value, text string)
+
+	// MetadataTypes returns the type names MetadataExprs yields for strings,
+	// booleans and numbers
+	MetadataTypes() (str, boolean string, numbers []string)
+
+	// MetadataBoolEquals matches a boolean metadata value
+	MetadataBoolEquals(typ, text string, v bool) string
+
+	// MetadataCompare compares a numeric metadata value with the bind
+	// parameter arg, false for non-numbers
+	MetadataCompare(isNumber, value, text, op, arg string) string
+
+	// ContainsText matches column case-insensitively against the LIKE
+	// pattern in arg, escaped with '!'
+	ContainsText(column, arg string) string
+
+	// MetadataContainsText matches metadata string values at any depth
+	// like ContainsText
+	MetadataContainsText(arg string) string
+
+	// MetadataContains matches rows whose metadata contains the JSON
+	// document in arg, so MetadataDocumentIndex can narrow equality
+	// filters, or returns "" if unsupported
+	MetadataContains(arg string) string
+
+	// TextIndexFilter narrows a text search to rows whose FullTextIndex
+	// holds every word in the tsquery-style arg, or returns "" if
+	// unsupported
+	TextIndexFilter(arg string) string
+}
+
+// PartitionDialect is implemented by dialects that support range
+// partitioning of the audit table by month of timestamp
+type PartitionDialect interface {
+	Dialect
+
+	// ValidatePartitioning checks that table can be partitioned
+	ValidatePartitioning(table string) error
+
+	// PartitionName names the partition of the month starting at month
+	PartitionName(table string, month time.Time) string
+
+	// ListPartitionsQuery returns a query listing the partition names of
+	// table and its arguments
+	ListPartitionsQuery(table string) (string, []interface{})
+
+	// AddPartitions returns the months of wanted it can add next to the
+	// existing months, sorted, and the statements adding them
+	AddPartitions(table string, existing, wanted []time.Time) ([]time.Time, []string)
+
+	// DropPartitions returns the statements dropping the named partitions
+	DropPartitions(table string, names []string) []string
+
+	// ExpireUnpartitioned deletes at most limit rows older than its one bind
+	// parameter that are not in a monthly partition, or returns ""
+	ExpireUnpartitioned(table string, limit int) string
+}
+
+// EmbeddedDialect is implemented by dialects of in-process engines that
+// allow one writer at a time. DatabaseStorage serializes its writes to them
+// and can vacuum them periodically, see DatabaseConfig.VacuumInterval.
+type EmbeddedDialect interface {
+	Dialect
+
+	// VacuumStatements returns the statements compacting the database
+	VacuumStatements(table string) []string
+}
+
+// CopyDialect is implemented by dialects that bulk load rows faster with a
+// COPY-style protocol than with multi-row INSERT, see Importer. Importer
+// only uses it with the lib/pq driver.
+type CopyDialect interface {
+	Dialect
+
+	// CopyIn returns the statement to prepare in a transaction: each Exec
+	// with a row's values buffers the row, and a final Exec without
+	// arguments loads them
+	CopyIn(table string, columns []string) string
+}
+
+// DialectOpener is implemented by dialects that NewDatabaseStorage can
+// open from a URL starting with their name and "://"
+type DialectOpener interface {
+	// OpenURL returns the database/sql driver and data source name for
+	// the URL
+	OpenURL(databaseURL string) (driver, dsn string, err error)
+}
+
+var (
+	dialectsMu sync.RWMutex
+	dialects   = make(map[string]Dialect)
+)
+
+func init() {
+	RegisterDialect(PostgresDialect{})
+	RegisterDialect(MySQLDialect{})
+	RegisterDialect(SQLiteDialect{})
+}
+
+// RegisterDialect makes a dialect available by its name. It panics if the
+// name is empty or already registered, like sql.Register.
+func RegisterDialect(d Dialect) {
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+	if d == nil || d.Name() == "" {
+		panic("audit: RegisterDialect dialect is nil or unnamed")
+	}
+	if _, dup := dialects[d.Name()]; dup {
+		panic("audit: RegisterDialect called twice for dialect " + d.Name())
+	}
+	dialects[d.Name()] = d
+}
+
+// LookupDialect returns the dialect registered under name
+func LookupDialect(name string) (Dialect, bool) {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+	d, ok := dialects[name]
+	return d, ok
+}
+
+// Dialects returns the names of the registered dialects, sorted
+func Dialects() []string {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+	names := make([]string, 0, len(dialects))
+	for name := range dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dialectFor returns the dialect registered under dbType
+func dialectFor(dbType string) (Dialect, error) {
+	d, ok := LookupDialect(dbType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return d, nil
+}
+
+// auditTableColumns lists the columns of the audit table between id and
+// created_at, with the types shared by the built-in dialects
+const auditTableColumns = `event_type VARCHAR(50) NOT NULL,
+			event_id VARCHAR(100),
+			user_id VARCHAR(100),
+			challenge_id VARCHAR(100),
+			session_id VARCHAR(100),
+			channel VARCHAR(20),
+			destination VARCHAR(255),
+			purpose VARCHAR(50),
+			resource VARCHAR(255),
+			result VARCHAR(20),
+			reason VARCHAR(255),
+			provider VARCHAR(50),
+			provider_message_id VARCHAR(255),
+			ip VARCHAR(45),
+			user_agent TEXT,
+			request_id VARCHAR(100),
+			trace_id VARCHAR(100),
+			timestamp BIGINT NOT NULL,
+			duration_ms BIGINT,`
+
+// auditIndexColumns lists the columns indexed by CreateTable (schema
+// version 1). Later indexes need their own schema version, because tables
+// adopted as version 1 do not get them.
+var auditIndexColumns = []string{
+	"user_id", "challenge_id", "session_id", "event_type", "timestamp", "created_at",
+}
+
+// lookupIndexColumns lists the lookup fields indexed by schema version 4
+var lookupIndexColumns = []string{
+	"event_id", "request_id", "trace_id", "provider_message_id",
+}
+
+// splitTableName splits a schema-qualified table name; schema is empty for
+// unqualified names
+func splitTableName(table string) (schema, name string) {
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		return schema, name
+	}
+	return "", table
+}
+
+// indexName names an index of table. Indexes live in the schema of their
+// table, so the name leaves the schema out.
+func indexName(table, suffix string) string {
+	_, name := splitTableName(table)
+	return "idx_" + name + "_" + suffix
+}
+
+// createIndexStatements returns CREATE INDEX IF NOT EXISTS statements for
+// the fixed indexes
+func createIndexStatements(table string) []string {
+	statements := make([]string, len(auditIndexColumns))
+	for i, column := range auditIndexColumns {
+		statements[i] = createIndexIfNotExists(table, indexName(table, column), column)
+	}
+	return statements
+}
+
+// createIndexIfNotExists returns a CREATE INDEX IF NOT EXISTS statement
+func createIndexIfNotExists(table, index, column string) string {
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(%s)", index, table, column)
+}
+
+// insertSQL builds a multi-row INSERT with placeholders from d
+func insertSQL(d Dialect, verb, table string, columns []string, rows int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s (%s) VALUES ", verb, table, strings.Join(columns, ", "))
+	n := 0
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for c := range columns {
+			if c > 0 {
+				b.WriteString(", ")
+			}
+			n++
+			b.WriteString(d.Placeholder(n))
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// openDialectURL returns the dialect, driver and data source name for a
+// URL starting with the name of a dialect implementing DialectOpener, or
+// for a SQLite file: URL
+func openDialectURL(databaseURL string) (Dialect, string, string, error) {
+	if strings.HasPrefix(databaseURL, "file:") {
+		databaseURL = "sqlite://" + strings.TrimPrefix(databaseURL, "file:")
+	}
+	if scheme, _, ok := strings.Cut(databaseURL, "://"); ok {
+		if d, found := LookupDialect(scheme); found {
+			if opener, ok := d.(DialectOpener); ok {
+				driver, dsn, err := opener.OpenURL(databaseURL)
+				return d, driver, dsn, err
+			}
+		}
+	}
+
+	var schemes []string
+	for _, name := range Dialects() {
+		if d, _ := LookupDialect(name); d != nil {
+			if _, ok := d.(DialectOpener); ok {
+				schemes = append(schemes, name+"://")
+			}
+		}
+	}
+	if n := len(schemes); n > 1 {
+		schemes = append(schemes[:n-2], schemes[n-2]+" or "+schemes[n-1])
+	}
+	return nil, "", "", fmt.Errorf("unsupported database URL format, must start with %s", strings.Join(schemes, ", "))
+}
@@ -0,0 +1,309 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQLDialect is the MySQL dialect, registered as "mysql"
+type MySQLDialect struct{}
+
+// Name implements Dialect
+func (MySQLDialect) Name() string { return "mysql" }
+
+// Placeholder implements Dialect
+func (MySQLDialect) Placeholder(int) string { return "?" }
+
+// OpenURL implements DialectOpener; the driver takes the DSN after the
+// scheme. Besides the driver's tls parameter, the DSN may name PEM files
+// with tls-ca (server CA) and tls-cert and tls-key (client certificate).
+func (MySQLDialect) OpenURL(databaseURL string) (string, string, error) {
+	dsn := strings.TrimPrefix(databaseURL, "mysql://")
+	if !strings.Contains(dsn, "tls-") {
+		return "mysql", dsn, nil
+	}
+	dsn, err := registerMySQLTLS(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	return "mysql", dsn, nil
+}
+
+// registerMySQLTLS registers the TLS configuration given by the tls-ca,
+// tls-cert and tls-key parameters of dsn with the driver and returns the
+// DSN referring to it. The driver would reject the unescaped paths, so the
+// parameters are removed before it parses the DSN.
+func registerMySQLTLS(dsn string) (string, error) {
+	at := strings.LastIndex(dsn, "@") + 1
+	q := strings.Index(dsn[at:], "?")
+	if q < 0 {
+		return dsn, nil
+	}
+	base, query := dsn[:at+q], dsn[at+q+1:]
+
+	var params []string
+	files := make(map[string]string)
+	for _, param := range strings.Split(query, "&") {
+		key, value, _ := strings.Cut(param, "=")
+		switch key {
+		case "tls-ca", "tls-cert", "tls-key":
+			path, err := url.QueryUnescape(value)
+			if err != nil {
+				return "", fmt.Errorf("invalid %s: %w", key, err)
+			}
+			files[key] = path
+		case "tls":
+			// Replaced by the registered configuration
+		default:
+			params = append(params, param)
+		}
+	}
+	caFile, certFile, keyFile := files["tls-ca"], files["tls-cert"], files["tls-key"]
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return dsn, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return "", fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read TLS CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("invalid TLS CA: no PEM certificates in %s", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to load TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Identical parameters share a registration; the driver sets the
+	// server name from the address
+	sum := sha256.Sum256([]byte(caFile + "\x00" + certFile + "\x00" + keyFile))
+	name := "audit-" + hex.EncodeToString(sum[:8])
+	if err := mysql.RegisterTLSConfig(name, tlsConfig); err != nil {
+		return "", fmt.Errorf("failed to register TLS config: %w", err)
+	}
+	return base + "?" + strings.Join(append(params, "tls="+name), "&"), nil
+}
+
+// CreateTable implements Dialect; indexes are part of the table definition
+func (MySQLDialect) CreateTable(table string, partitioned bool) ([]string, error) {
+	idColumn, primaryKey, tableOptions := "id BIGINT AUTO_INCREMENT PRIMARY KEY", "", ""
+	if partitioned {
+		// The first monthly partition also holds older rows; pmax
+		// catches rows past the created months
+		month := monthStart(time.Now())
+		idColumn = "id BIGINT AUTO_INCREMENT"
+		primaryKey = ",\n\t\t\tPRIMARY KEY (id, timestamp)"
+		tableOptions = fmt.Sprintf("\n\t\tPARTITION BY RANGE (timestamp) (PARTITION %s VALUES LESS THAN (%d), PARTITION %s VALUES LESS THAN MAXVALUE)",
+			partitionSuffix(month), month.AddDate(0, 1, 0).Unix(), mysqlMaxPartition)
+	}
+	indexes := make([]string, len(auditIndexColumns))
+	for i, column := range auditIndexColumns {
+		indexes[i] = fmt.Sprintf("INDEX %s (%s)", indexName(table, column), column)
+	}
+	return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			%s,
+			%s
+			metadata JSON,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			%s%s
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4%s`,
+		table, idColumn, auditTableColumns, strings.Join(indexes, ",\n\t\t\t"), primaryKey, tableOptions)}, nil
+}
+
+// AlterColumnType implements Dialect
+func (MySQLDialect) AlterColumnType(table, column, typ string) string {
+	return fmt.Sprintf("ALTER TABLE %s MODIFY %s %s", table, column, typ)
+}
+
+// CreateIndex implements Dialect. MySQL has no CREATE INDEX IF NOT EXISTS,
+// so the statement is chosen from information_schema and run as a prepared
+// statement; the statements must share a session.
+func (MySQLDialect) CreateIndex(table, index, column string) []string {
+	schema, name := splitTableName(table)
+	schemaExpr := "DATABASE()"
+	if schema != "" {
+		schemaExpr = "'" + schema + "'"
+	}
+	return []string{
+		fmt.Sprintf("SET @audit_create_index = IF((SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = %s AND table_name = '%s' AND index_name = '%s') > 0, 'DO 0', 'CREATE INDEX %s ON %s (%s)')",
+			schemaExpr, name, index, index, table, column),
+		"PREPARE audit_create_index FROM @audit_create_index",
+		"EXECUTE audit_create_index",
+		"DEALLOCATE PREPARE audit_create_index",
+	}
+}
+
+// MetadataIndex implements Dialect; MySQL needs generated columns instead
+func (MySQLDialect) MetadataIndex(table, index, key string) string { return "" }
+
+// TextIndex implements Dialect
+func (MySQLDialect) TextIndex(table string) string { return "" }
+
+// MetadataDocumentIndex implements Dialect; JSON columns cannot be indexed
+// directly
+func (MySQLDialect) MetadataDocumentIndex(table string) string { return "" }
+
+// ConvertMetadataColumn implements Dialect
+func (MySQLDialect) ConvertMetadataColumn(table string) string { return "" }
+
+// CurrentTimestamp implements Dialect
+func (MySQLDialect) CurrentTimestamp() string { return "CURRENT_TIMESTAMP" }
+
+// TableExistsQuery implements Dialect; unqualified names are looked up in
+// the current database
+func (MySQLDialect) TableExistsQuery(table string) (string, []interface{}) {
+	condition, args := mysqlTableCondition("table_schema", "table_name", table)
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE " + condition, args
+}
+
+// mysqlTableCondition matches the schema and name columns of
+// information_schema against table
+func mysqlTableCondition(schemaColumn, nameColumn, table string) (string, []interface{}) {
+	schema, name := splitTableName(table)
+	if schema == "" {
+		return fmt.Sprintf("%s = DATABASE() AND %s = ?", schemaColumn, nameColumn), []interface{}{name}
+	}
+	return fmt.Sprintf("%s = ? AND %s = ?", schemaColumn, nameColumn), []interface{}{schema, name}
+}
+
+// Lock implements Dialect with GET_LOCK, which waits in whole seconds
+func (MySQLDialect) Lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (func(), error) {
+	var got sql.NullInt64
+	seconds := int(timeout / time.Second)
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, seconds).Scan(&got); err != nil {
+		return nil, err
+	}
+	if !got.Valid || got.Int64 != 1 {
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+	return func() {
+		_, _ = conn.ExecContext(context.WithoutCancel(ctx), "SELECT RELEASE_LOCK(?)", name)
+	}, nil
+}
+
+// Insert implements Dialect
+func (d MySQLDialect) Insert(table string, columns []string, rows int) string {
+	return insertSQL(d, "INSERT INTO", table, columns, rows)
+}
+
+// InsertIgnore implements Dialect
+func (d MySQLDialect) InsertIgnore(table string, columns []string, key string) string {
+	return insertSQL(d, "INSERT IGNORE INTO", table, columns, 1)
+}
+
+// DeleteBatch implements Dialect; MySQL cannot LIMIT a subquery of IN
+func (MySQLDialect) DeleteBatch(table, where string, limit int) string {
+	return fmt.Sprintf("DELETE FROM %s %s ORDER BY id LIMIT %d", table, where, limit)
+}
+
+// MetadataValue implements Dialect
+func (MySQLDialect) MetadataValue(data []byte) interface{} {
+	if data == nil {
+		return nil
+	}
+	return string(data)
+}
+
+// MetadataExprs implements Dialect
+func (MySQLDialect) MetadataExprs(key string) (typ, value, text string) {
+	extract := fmt.Sprintf(`JSON_EXTRACT(metadata, '$."%s"')`, key)
+	return "JSON_TYPE(" + extract + ")", extract, "JSON_UNQUOTE(" + extract + ")"
+}
+
+// MetadataTypes implements Dialect
+func (MySQLDialect) MetadataTypes() (string, string, []string) {
+	return "STRING", "BOOLEAN", []string{"INTEGER", "UNSIGNED INTEGER", "DOUBLE", "DECIMAL"}
+}
+
+// MetadataBoolEquals implements Dialect
+func (MySQLDialect) MetadataBoolEquals(typ, text string, v bool) string {
+	return fmt.Sprintf("(%s = 'BOOLEAN' AND %s = '%t')", typ, text, v)
+}
+
+// MetadataCompare implements Dialect
+func (MySQLDialect) MetadataCompare(isNumber, value, text, op, arg string) string {
+	return fmt.Sprintf("(%s AND %s %s %s)", isNumber, value, op, arg)
+}
+
+// ContainsText implements Dialect
+func (MySQLDialect) ContainsText(column, arg string) string {
+	return fmt.Sprintf("LOWER(%s) LIKE %s ESCAPE '!'", column, arg)
+}
+
+// MetadataContainsText implements Dialect
+func (MySQLDialect) MetadataContainsText(arg string) string {
+	return fmt.Sprintf("JSON_SEARCH(LOWER(metadata), 'one', %s, '!') IS NOT NULL", arg)
+}
+
+// MetadataContains implements Dialect
+func (MySQLDialect) MetadataContains(arg string) string { return "" }
+
+// TextIndexFilter implements Dialect
+func (MySQLDialect) TextIndexFilter(arg string) string { return "" }
+
+// ValidatePartitioning implements PartitionDialect
+func (MySQLDialect) ValidatePartitioning(table string) error { return nil }
+
+// PartitionName implements PartitionDialect; partitions belong to the table
+func (MySQLDialect) PartitionName(table string, month time.Time) string {
+	return partitionSuffix(month)
+}
+
+// ListPartitionsQuery implements PartitionDialect
+func (MySQLDialect) ListPartitionsQuery(table string) (string, []interface{}) {
+	condition, args := mysqlTableCondition("TABLE_SCHEMA", "TABLE_NAME", table)
+	return "SELECT PARTITION_NAME FROM information_schema.PARTITIONS WHERE " + condition + " AND PARTITION_NAME IS NOT NULL", args
+}
+
+// AddPartitions implements PartitionDialect. Only pmax can be split, so
+// months go after the last existing one.
+func (d MySQLDialect) AddPartitions(table string, existing, wanted []time.Time) ([]time.Time, []string) {
+	var added []time.Time
+	for _, month := range wanted {
+		if len(existing) > 0 && !month.After(existing[len(existing)-1]) {
+			continue
+		}
+		added = append(added, month)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+	parts := make([]string, 0, len(added)+1)
+	for _, month := range added {
+		parts = append(parts, fmt.Sprintf("PARTITION %s VALUES LESS THAN (%d)", d.PartitionName(table, month), month.AddDate(0, 1, 0).Unix()))
+	}
+	parts = append(parts, fmt.Sprintf("PARTITION %s VALUES LESS THAN MAXVALUE", mysqlMaxPartition))
+	return added, []string{fmt.Sprintf("ALTER TABLE %s REORGANIZE PARTITION %s INTO (%s)",
+		table, mysqlMaxPartition, strings.Join(parts, ", "))}
+}
+
+// DropPartitions implements PartitionDialect
+func (MySQLDialect) DropPartitions(table string, names []string) []string {
+	return []string{fmt.Sprintf("ALTER TABLE %s DROP PARTITION %s", table, strings.Join(names, ", "))}
+}
+
+// ExpireUnpartitioned implements PartitionDialect; older rows share the
+// first monthly partition and are dropped with it
+func (MySQLDialect) ExpireUnpartitioned(table string, limit int) string { return "" }
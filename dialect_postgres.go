@@ -0,0 +1,265 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresDialect is the PostgreSQL dialect, registered as "postgres"
+type PostgresDialect struct{}
+
+// Name implements Dialect
+func (PostgresDialect) Name() string { return "postgres" }
+
+// Placeholder implements Dialect
+func (PostgresDialect) Placeholder(n int) string { return fmt.Sprintf("$%d", n) }
+
+// OpenURL implements DialectOpener
+func (PostgresDialect) OpenURL(databaseURL string) (string, string, error) {
+	return "postgres", databaseURL, nil
+}
+
+// CreateTable implements Dialect
+func (d PostgresDialect) CreateTable(table string, partitioned bool) ([]string, error) {
+	// Partitioned tables need the partition key in the primary key
+	idColumn, primaryKey, tableOptions := "id BIGSERIAL PRIMARY KEY", "", ""
+	if partitioned {
+		idColumn = "id BIGSERIAL"
+		primaryKey = ",\n\t\t\tPRIMARY KEY (id, timestamp)"
+		tableOptions = " PARTITION BY RANGE (timestamp)"
+	}
+	statements := []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			%s,
+			%s
+			metadata JSONB,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW()%s
+		)%s`, table, idColumn, auditTableColumns, primaryKey, tableOptions)}
+	statements = append(statements, createIndexStatements(table)...)
+	if partitioned {
+		// Rows outside the monthly partitions, e.g. imported history
+		statements = append(statements, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s DEFAULT", d.defaultPartition(table), table))
+	}
+	return statements, nil
+}
+
+// AlterColumnType implements Dialect
+func (PostgresDialect) AlterColumnType(table, column, typ string) string {
+	return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", table, column, typ)
+}
+
+// CreateIndex implements Dialect
+func (PostgresDialect) CreateIndex(table, index, column string) []string {
+	return []string{createIndexIfNotExists(table, index, column)}
+}
+
+// MetadataIndex implements Dialect
+func (PostgresDialect) MetadataIndex(table, index, key string) string {
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s ((metadata->>'%s'))", index, table, key)
+}
+
+// TextIndex implements Dialect
+func (PostgresDialect) TextIndex(table string) string {
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING GIN (%s)", indexName(table, "text"), table, postgresTextVector)
+}
+
+// MetadataDocumentIndex implements Dialect with a GIN index serving
+// containment (@>) queries
+func (PostgresDialect) MetadataDocumentIndex(table string) string {
+	return fmt.Sprintf(`DO $$
+BEGIN
+	IF (SELECT format_type(atttypid, NULL) FROM pg_attribute WHERE attrelid = '%s'::regclass AND attname = 'metadata') = 'jsonb' THEN
+		CREATE INDEX IF NOT EXISTS %s ON %s USING GIN (metadata jsonb_path_ops);
+	END IF;
+END $$`, table, indexName(table, "metadata"), table)
+}
+
+// ConvertMetadataColumn implements Dialect. Text columns written through
+// lib/pq hold the bytea hex form of the JSON, which is decoded first; the
+// migration fails, and rolls back, on any other invalid JSON.
+func (PostgresDialect) ConvertMetadataColumn(table string) string {
+	return fmt.Sprintf(`DO $$
+BEGIN
+	IF (SELECT format_type(atttypid, NULL) FROM pg_attribute WHERE attrelid = '%s'::regclass AND attname = 'metadata') <> 'jsonb' THEN
+		ALTER TABLE %s ALTER COLUMN metadata TYPE JSONB USING CASE
+			WHEN metadata::text = '' THEN NULL
+			WHEN left(metadata::text, 2) = '\x' THEN convert_from(decode(substr(metadata::text, 3), 'hex'), 'UTF8')::jsonb
+			ELSE metadata::text::jsonb
+		END;
+	END IF;
+END $$`, table, table)
+}
+
+// CurrentTimestamp implements Dialect
+func (PostgresDialect) CurrentTimestamp() string { return "NOW()" }
+
+// TableExistsQuery implements Dialect; unqualified names are looked up in
+// the current schema
+func (PostgresDialect) TableExistsQuery(table string) (string, []interface{}) {
+	schema, name := splitTableName(table)
+	if schema == "" {
+		return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1", []interface{}{name}
+	}
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = $1 AND table_name = $2", []interface{}{schema, name}
+}
+
+// Lock implements Dialect with a session advisory lock keyed by a hash of
+// name
+func (PostgresDialect) Lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (func(), error) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	key := int64(h.Sum64())
+
+	lockCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err := conn.ExecContext(lockCtx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		return nil, err
+	}
+	return func() {
+		_, _ = conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", key)
+	}, nil
+}
+
+// Insert implements Dialect
+func (d PostgresDialect) Insert(table string, columns []string, rows int) string {
+	return insertSQL(d, "INSERT INTO", table, columns, rows)
+}
+
+// InsertIgnore implements Dialect
+func (d PostgresDialect) InsertIgnore(table string, columns []string, key string) string {
+	return insertSQL(d, "INSERT INTO", table, columns, 1) + fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", key)
+}
+
+// DeleteBatch implements Dialect
+func (PostgresDialect) DeleteBatch(table, where string, limit int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT id FROM %s %s ORDER BY id LIMIT %d)", table, table, where, limit)
+}
+
+// MetadataValue implements Dialect; JSONB accepts the JSON bytes
+func (PostgresDialect) MetadataValue(data []byte) interface{} {
+	return data
+}
+
+// MetadataExprs implements Dialect
+func (PostgresDialect) MetadataExprs(key string) (typ, value, text string) {
+	return fmt.Sprintf("jsonb_typeof(metadata->'%s')", key),
+		fmt.Sprintf("metadata->'%s'", key),
+		fmt.Sprintf("metadata->>'%s'", key)
+}
+
+// MetadataTypes implements Dialect
+func (PostgresDialect) MetadataTypes() (string, string, []string) {
+	return "string", "boolean", []string{"number"}
+}
+
+// MetadataBoolEquals implements Dialect
+func (PostgresDialect) MetadataBoolEquals(typ, text string, v bool) string {
+	return fmt.Sprintf("(%s = 'boolean' AND %s = '%t')", typ, text, v)
+}
+
+// MetadataCompare implements Dialect; only numbers are cast, since a plain
+// AND could cast strings and fail
+func (PostgresDialect) MetadataCompare(isNumber, value, text, op, arg string) string {
+	return fmt.Sprintf("CASE WHEN %s THEN (%s)::numeric %s %s ELSE FALSE END", isNumber, text, op, arg)
+}
+
+// ContainsText implements Dialect
+func (PostgresDialect) ContainsText(column, arg string) string {
+	return fmt.Sprintf("%s ILIKE %s ESCAPE '!'", column, arg)
+}
+
+// MetadataContainsText implements Dialect
+func (PostgresDialect) MetadataContainsText(arg string) string {
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM jsonb_path_query(metadata, 'strict $.**') AS m(v) WHERE jsonb_typeof(m.v) = 'string' AND m.v #>> '{}' ILIKE %s ESCAPE '!')`, arg)
+}
+
+// MetadataContains implements Dialect
+func (PostgresDialect) MetadataContains(arg string) string {
+	return fmt.Sprintf("metadata @> %s::jsonb", arg)
+}
+
+// TextIndexFilter implements Dialect
+func (PostgresDialect) TextIndexFilter(arg string) string {
+	return fmt.Sprintf("%s @@ to_tsquery('simple', %s)", postgresTextVector, arg)
+}
+
+// CopyIn implements CopyDialect
+func (PostgresDialect) CopyIn(table string, columns []string) string {
+	schema, name := splitTableName(table)
+	if schema == "" {
+		return pq.CopyIn(name, columns...)
+	}
+	return pq.CopyInSchema(schema, name, columns...)
+}
+
+// ValidatePartitioning implements PartitionDialect
+func (d PostgresDialect) ValidatePartitioning(table string) error {
+	// Partitions are created in the schema of the table
+	if _, name := splitTableName(d.defaultPartition(table)); len(name) > maxPostgresIdentifierLen {
+		return fmt.Errorf("table name too long for partitioning: max %d characters", maxPostgresIdentifierLen-len("_pdefault"))
+	}
+	return nil
+}
+
+// PartitionName implements PartitionDialect; partitions are tables
+func (PostgresDialect) PartitionName(table string, month time.Time) string {
+	return table + "_" + partitionSuffix(month)
+}
+
+// defaultPartition names the partition for rows outside the monthly ones
+func (PostgresDialect) defaultPartition(table string) string {
+	return table + "_pdefault"
+}
+
+// ListPartitionsQuery implements PartitionDialect
+func (PostgresDialect) ListPartitionsQuery(table string) (string, []interface{}) {
+	return "SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass", []interface{}{table}
+}
+
+// AddPartitions implements PartitionDialect; any missing month can be added.
+// Rows of the month already in the default partition, e.g. from a backfill,
+// would violate its new constraint, so the default partition is detached
+// while they are moved into the new partition.
+func (d PostgresDialect) AddPartitions(table string, existing, wanted []time.Time) ([]time.Time, []string) {
+	var added []time.Time
+	var statements []string
+	for _, month := range wanted {
+		partition, from, to := d.PartitionName(table, month), month.Unix(), month.AddDate(0, 1, 0).Unix()
+		create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%d) TO (%d)", partition, table, from, to)
+		inMonth := fmt.Sprintf("timestamp >= %d AND timestamp < %d", from, to)
+		added = append(added, month)
+		statements = append(statements, fmt.Sprintf(`DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM %[1]s WHERE %[4]s) THEN
+		ALTER TABLE %[2]s DETACH PARTITION %[1]s;
+		%[5]s;
+		INSERT INTO %[3]s SELECT * FROM %[1]s WHERE %[4]s;
+		DELETE FROM %[1]s WHERE %[4]s;
+		ALTER TABLE %[2]s ATTACH PARTITION %[1]s DEFAULT;
+	ELSE
+		%[5]s;
+	END IF;
+END $$`, d.defaultPartition(table), table, partition, inMonth, create))
+	}
+	return added, statements
+}
+
+// DropPartitions implements PartitionDialect
+func (PostgresDialect) DropPartitions(table string, names []string) []string {
+	statements := make([]string, len(names))
+	for i, name := range names {
+		statements[i] = fmt.Sprintf("DROP TABLE IF EXISTS %s", name)
+	}
+	return statements
+}
+
+// ExpireUnpartitioned implements PartitionDialect; the default partition
+// collects every backfilled or out-of-window row and can grow large, so it
+// is expired in batches
+func (d PostgresDialect) ExpireUnpartitioned(table string, limit int) string {
+	return d.DeleteBatch(d.defaultPartition(table), "WHERE timestamp < $1", limit)
+}
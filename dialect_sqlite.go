@@ -0,0 +1,183 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqliteBusyTimeout is how long a connection waits for another process
+// holding the write lock before failing with SQLITE_BUSY
+const sqliteBusyTimeout = 5 * time.Second
+
+// SQLiteDialect is the SQLite dialect, registered as "sqlite". URLs are
+// opened with the bundled modernc.org/sqlite driver.
+type SQLiteDialect struct{}
+
+// Name implements Dialect
+func (SQLiteDialect) Name() string { return "sqlite" }
+
+// Placeholder implements Dialect
+func (SQLiteDialect) Placeholder(int) string { return "?" }
+
+// OpenURL implements DialectOpener for sqlite://path and file: URLs.
+// Connections use WAL mode, so readers do not block the writer, wait for
+// other writers for up to 5s, and take the write lock when transactions
+// begin, unless the URL sets these itself.
+func (SQLiteDialect) OpenURL(databaseURL string) (string, string, error) {
+	dsn := databaseURL
+	if rest, ok := strings.CutPrefix(databaseURL, "sqlite://"); ok {
+		if path, _, _ := strings.Cut(rest, "?"); path == "" {
+			return "", "", fmt.Errorf("sqlite URL must include a database path")
+		}
+		dsn = "file:" + rest
+	}
+
+	var params []string
+	if !strings.Contains(dsn, "busy_timeout") {
+		params = append(params, fmt.Sprintf("_pragma=busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()))
+	}
+	if !strings.Contains(dsn, "journal_mode") {
+		params = append(params, "_pragma=journal_mode(WAL)")
+	}
+	if !strings.Contains(dsn, "_txlock") {
+		params = append(params, "_txlock=immediate")
+	}
+	if len(params) > 0 {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + strings.Join(params, "&")
+	}
+	return "sqlite", dsn, nil
+}
+
+// CreateTable implements Dialect
+func (SQLiteDialect) CreateTable(table string, partitioned bool) ([]string, error) {
+	if schema, _ := splitTableName(table); schema != "" {
+		return nil, fmt.Errorf("schema-qualified table names are not supported on sqlite")
+	}
+	statements := []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			%s
+			metadata TEXT,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`, table, auditTableColumns)}
+	return append(statements, createIndexStatements(table)...), nil
+}
+
+// AlterColumnType implements Dialect; SQLite does not enforce VARCHAR
+// lengths
+func (SQLiteDialect) AlterColumnType(table, column, typ string) string { return "" }
+
+// CreateIndex implements Dialect
+func (SQLiteDialect) CreateIndex(table, index, column string) []string {
+	return []string{createIndexIfNotExists(table, index, column)}
+}
+
+// MetadataIndex implements Dialect
+func (SQLiteDialect) MetadataIndex(table, index, key string) string {
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", index, table, sqliteMetadataExpr(key))
+}
+
+// TextIndex implements Dialect
+func (SQLiteDialect) TextIndex(table string) string { return "" }
+
+// MetadataDocumentIndex implements Dialect
+func (SQLiteDialect) MetadataDocumentIndex(table string) string { return "" }
+
+// ConvertMetadataColumn implements Dialect; SQLite stores JSON as text
+func (SQLiteDialect) ConvertMetadataColumn(table string) string { return "" }
+
+// CurrentTimestamp implements Dialect
+func (SQLiteDialect) CurrentTimestamp() string { return "CURRENT_TIMESTAMP" }
+
+// TableExistsQuery implements Dialect
+func (SQLiteDialect) TableExistsQuery(table string) (string, []interface{}) {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", []interface{}{table}
+}
+
+// Lock implements Dialect. A database file has no advisory locks; callers
+// rely on unique keys to reject concurrent changes.
+func (SQLiteDialect) Lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (func(), error) {
+	return func() {}, nil
+}
+
+// Insert implements Dialect
+func (d SQLiteDialect) Insert(table string, columns []string, rows int) string {
+	return insertSQL(d, "INSERT INTO", table, columns, rows)
+}
+
+// InsertIgnore implements Dialect
+func (d SQLiteDialect) InsertIgnore(table string, columns []string, key string) string {
+	return insertSQL(d, "INSERT OR IGNORE INTO", table, columns, 1)
+}
+
+// DeleteBatch implements Dialect
+func (SQLiteDialect) DeleteBatch(table, where string, limit int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT id FROM %s %s ORDER BY id LIMIT %d)", table, table, where, limit)
+}
+
+// MetadataValue implements Dialect
+func (SQLiteDialect) MetadataValue(data []byte) interface{} {
+	if data == nil {
+		return nil
+	}
+	return string(data)
+}
+
+// MetadataExprs implements Dialect. json_valid skips rows written with an
+// empty string before NULL was used for empty metadata.
+func (SQLiteDialect) MetadataExprs(key string) (typ, value, text string) {
+	value = sqliteMetadataExpr(key)
+	typ = fmt.Sprintf(`CASE WHEN json_valid(metadata) THEN json_type(metadata, '$."%s"') END`, key)
+	return typ, value, value
+}
+
+// sqliteMetadataExpr is the SQLite expression for a metadata key, shared by
+// queries and expression indexes so the planner can match them
+func sqliteMetadataExpr(key string) string {
+	return fmt.Sprintf(`CASE WHEN json_valid(metadata) THEN json_extract(metadata, '$."%s"') END`, key)
+}
+
+// MetadataTypes implements Dialect; booleans have the types "true" and
+// "false"
+func (SQLiteDialect) MetadataTypes() (string, string, []string) {
+	return "text", "", []string{"integer", "real"}
+}
+
+// MetadataBoolEquals implements Dialect
+func (SQLiteDialect) MetadataBoolEquals(typ, text string, v bool) string {
+	return fmt.Sprintf("%s = '%t'", typ, v)
+}
+
+// MetadataCompare implements Dialect
+func (SQLiteDialect) MetadataCompare(isNumber, value, text, op, arg string) string {
+	return fmt.Sprintf("(%s AND %s %s %s)", isNumber, value, op, arg)
+}
+
+// ContainsText implements Dialect
+func (SQLiteDialect) ContainsText(column, arg string) string {
+	return fmt.Sprintf("LOWER(%s) LIKE %s ESCAPE '!'", column, arg)
+}
+
+// MetadataContainsText implements Dialect
+func (SQLiteDialect) MetadataContainsText(arg string) string {
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM json_tree(CASE WHEN json_valid(metadata) THEN metadata END) WHERE type = 'text' AND LOWER(value) LIKE %s ESCAPE '!')", arg)
+}
+
+// MetadataContains implements Dialect
+func (SQLiteDialect) MetadataContains(arg string) string { return "" }
+
+// TextIndexFilter implements Dialect
+func (SQLiteDialect) TextIndexFilter(arg string) string { return "" }
+
+// VacuumStatements implements EmbeddedDialect. VACUUM rewrites the
+// database without the pages freed by purges; in WAL mode the rewrite
+// reaches the file, and the WAL is truncated, at the checkpoint.
+func (SQLiteDialect) VacuumStatements(table string) []string {
+	return []string{"VACUUM", "PRAGMA wal_checkpoint(TRUNCATE)"}
+}
@@ -0,0 +1,658 @@
+package audit
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EncryptedValuePrefix marks a field value that was encrypted by FieldEncryptor
+const EncryptedValuePrefix = "enc:v1:"
+
+// AnonymousSubject is the data key subject used for records without a UserID
+const AnonymousSubject = "_anonymous"
+
+// dataKeySize is the size of per-subject AES-256 data keys
+const dataKeySize = 32
+
+// Column sizes of the fields FieldEncryptor seals, as widened by schema
+// version 5 (encryptedColumnsSchemaVersion). They hold the sealed form of
+// the longest raw value of each column.
+const (
+	encryptedIPColumnSize          = 255
+	encryptedDestinationColumnSize = 512
+	encryptedColumnsSchemaVersion  = 5
+)
+
+// ErrDataKeyNotFound is returned by a DataKeyStore when a subject has no key,
+// either because none was created yet or because it was shredded
+var ErrDataKeyNotFound = errors.New("data key not found")
+
+// DataKeyStore persists wrapped (master-key encrypted) per-subject data keys.
+// Deleting a subject's key makes every value encrypted with it unrecoverable.
+type DataKeyStore interface {
+	// GetDataKey returns the wrapped data key for subject, or ErrDataKeyNotFound
+	GetDataKey(ctx context.Context, subject string) ([]byte, error)
+
+	// PutDataKey stores a wrapped data key unless the subject already has one
+	PutDataKey(ctx context.Context, subject string, wrapped []byte) error
+
+	// DeleteDataKey removes the subject's data key (crypto-shredding)
+	DeleteDataKey(ctx context.Context, subject string) error
+}
+
+// FieldEncryptionConfig holds configuration for field-level encryption
+type FieldEncryptionConfig struct {
+	MasterKey []byte       // AES-256 key used to wrap data keys (required, 32 bytes)
+	KeyStore  DataKeyStore // Store for wrapped data keys (required)
+
+	// Fields to encrypt. If none are selected, Destination and IP are encrypted.
+	EncryptDestination bool
+	EncryptIP          bool
+	MetadataKeys       []string
+
+	// KeyCacheTTL controls how long unwrapped data keys are cached in memory
+	// (default: 5 minutes). Shredding through this encryptor evicts the cache
+	// immediately; other instances keep decrypting until their cache expires.
+	KeyCacheTTL time.Duration
+}
+
+// FieldEncryptor encrypts selected record fields with per-user data keys
+// (AES-GCM), which are themselves wrapped by a master key.
+type FieldEncryptor struct {
+	master       cipher.AEAD
+	store        DataKeyStore
+	destination  bool
+	ip           bool
+	metadataKeys []string
+	cacheTTL     time.Duration
+	cache        map[string]cachedDataKey
+	mu           sync.Mutex
+}
+
+type cachedDataKey struct {
+	aead    cipher.AEAD
+	expires time.Time
+}
+
+// NewFieldEncryptor creates a new field encryptor
+func NewFieldEncryptor(config *FieldEncryptionConfig) (*FieldEncryptor, error) {
+	if config == nil {
+		return nil, fmt.Errorf("field encryption config is required")
+	}
+	if len(config.MasterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes")
+	}
+	if config.KeyStore == nil {
+		return nil, fmt.Errorf("data key store is required")
+	}
+
+	master, err := newAEAD(config.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	destination, ip := config.EncryptDestination, config.EncryptIP
+	if !destination && !ip && len(config.MetadataKeys) == 0 {
+		destination, ip = true, true
+	}
+
+	cacheTTL := config.KeyCacheTTL
+	if cacheTTL <= 0 {
+		cacheTTL = 5 * time.Minute
+	}
+
+	return &FieldEncryptor{
+		master:       master,
+		store:        config.KeyStore,
+		destination:  destination,
+		ip:           ip,
+		metadataKeys: append([]string(nil), config.MetadataKeys...),
+		cacheTTL:     cacheTTL,
+		cache:        make(map[string]cachedDataKey),
+	}, nil
+}
+
+// EncryptRecord encrypts the configured fields of record in place, creating
+// the subject's data key on first use. Metadata is cloned before being modified.
+func (e *FieldEncryptor) EncryptRecord(ctx context.Context, record *Record) error {
+	if record == nil {
+		return nil
+	}
+	subject := encryptionSubject(record)
+	aead, err := e.dataKey(ctx, subject, true)
+	if err != nil {
+		return err
+	}
+
+	if e.destination && record.Destination != "" && !IsEncryptedValue(record.Destination) {
+		if record.Destination, err = sealColumn(aead, subject, "destination", record.Destination, encryptedDestinationColumnSize); err != nil {
+			return err
+		}
+	}
+	if e.ip && record.IP != "" && !IsEncryptedValue(record.IP) {
+		if record.IP, err = sealColumn(aead, subject, "ip", record.IP, encryptedIPColumnSize); err != nil {
+			return err
+		}
+	}
+
+	if len(e.metadataKeys) > 0 && len(record.Metadata) > 0 {
+		metadata := cloneMetadata(record.Metadata)
+		for _, key := range e.metadataKeys {
+			value, ok := metadata[key]
+			if !ok {
+				continue
+			}
+			if s, isString := value.(string); isString && IsEncryptedValue(s) {
+				continue
+			}
+			plain, err := json.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("failed to marshal metadata %q: %w", key, err)
+			}
+			if metadata[key], err = sealField(aead, subject, "metadata."+key, plain); err != nil {
+				return err
+			}
+		}
+		record.Metadata = metadata
+	}
+	return nil
+}
+
+// DecryptRecord decrypts encrypted fields of record in place. If the subject's
+// data key was shredded, the ciphertext is left untouched and no error is returned.
+func (e *FieldEncryptor) DecryptRecord(ctx context.Context, record *Record) error {
+	if record == nil || !hasEncryptedFields(record) {
+		return nil
+	}
+	subject := encryptionSubject(record)
+	aead, err := e.dataKey(ctx, subject, false)
+	if errors.Is(err, ErrDataKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if IsEncryptedValue(record.Destination) {
+		plain, err := openField(aead, subject, "destination", record.Destination)
+		if err != nil {
+			return err
+		}
+		record.Destination = string(plain)
+	}
+	if IsEncryptedValue(record.IP) {
+		plain, err := openField(aead, subject, "ip", record.IP)
+		if err != nil {
+			return err
+		}
+		record.IP = string(plain)
+	}
+
+	var metadata map[string]interface{}
+	for key, value := range record.Metadata {
+		s, ok := value.(string)
+		if !ok || !IsEncryptedValue(s) {
+			continue
+		}
+		plain, err := openField(aead, subject, "metadata."+key, s)
+		if err != nil {
+			return err
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(plain, &decoded); err != nil {
+			return fmt.Errorf("failed to unmarshal metadata %q: %w", key, err)
+		}
+		if metadata == nil {
+			metadata = cloneMetadata(record.Metadata)
+		}
+		metadata[key] = decoded
+	}
+	if metadata != nil {
+		record.Metadata = metadata
+	}
+	return nil
+}
+
+// ShredSubject deletes the subject's data key, making all of their encrypted
+// fields permanently unrecoverable. Pass the UserID as stored in records.
+func (e *FieldEncryptor) ShredSubject(ctx context.Context, subject string) error {
+	if subject == "" {
+		subject = AnonymousSubject
+	}
+	e.mu.Lock()
+	delete(e.cache, subject)
+	e.mu.Unlock()
+
+	if err := e.store.DeleteDataKey(ctx, subject); err != nil {
+		return fmt.Errorf("failed to delete data key: %w", err)
+	}
+	return nil
+}
+
+// dataKey returns the AEAD for subject's data key, optionally creating it
+func (e *FieldEncryptor) dataKey(ctx context.Context, subject string, create bool) (cipher.AEAD, error) {
+	now := time.Now()
+	e.mu.Lock()
+	if cached, ok := e.cache[subject]; ok && now.Before(cached.expires) {
+		e.mu.Unlock()
+		return cached.aead, nil
+	}
+	e.mu.Unlock()
+
+	wrapped, err := e.store.GetDataKey(ctx, subject)
+	if errors.Is(err, ErrDataKeyNotFound) && create {
+		key := make([]byte, dataKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate data key: %w", err)
+		}
+		sealed, err := seal(e.master, key, []byte(subject))
+		if err != nil {
+			return nil, err
+		}
+		if err := e.store.PutDataKey(ctx, subject, sealed); err != nil {
+			return nil, fmt.Errorf("failed to store data key: %w", err)
+		}
+		// Read back in case another writer created the key concurrently
+		wrapped, err = e.store.GetDataKey(ctx, subject)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get data key: %w", err)
+		}
+	} else if err != nil {
+		if errors.Is(err, ErrDataKeyNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get data key: %w", err)
+	}
+
+	key, err := open(e.master, wrapped, []byte(subject))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	e.cache[subject] = cachedDataKey{aead: aead, expires: now.Add(e.cacheTTL)}
+	e.mu.Unlock()
+	return aead, nil
+}
+
+// IsEncryptedValue reports whether s was produced by FieldEncryptor
+func IsEncryptedValue(s string) bool {
+	return strings.HasPrefix(s, EncryptedValuePrefix)
+}
+
+// hasEncryptedFields reports whether any field of record holds ciphertext
+func hasEncryptedFields(record *Record) bool {
+	if IsEncryptedValue(record.Destination) || IsEncryptedValue(record.IP) {
+		return true
+	}
+	for _, value := range record.Metadata {
+		if s, ok := value.(string); ok && IsEncryptedValue(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptionSubject returns the data key subject for record
+func encryptionSubject(record *Record) string {
+	if record.UserID == "" {
+		return AnonymousSubject
+	}
+	return record.UserID
+}
+
+// sealField encrypts a field value, binding it to the subject and field name
+func sealField(aead cipher.AEAD, subject, field string, plain []byte) (string, error) {
+	sealed, err := seal(aead, plain, []byte(subject+"\x00"+field))
+	if err != nil {
+		return "", err
+	}
+	return EncryptedValuePrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// sealColumn seals a field stored in a column of size characters,
+// rejecting values whose sealed form would not fit
+func sealColumn(aead cipher.AEAD, subject, field, value string, size int) (string, error) {
+	if n := sealedFieldLen(aead, len(value)); n > size {
+		return "", fmt.Errorf("encrypted %s would be %d characters, more than the %d its column holds", field, n, size)
+	}
+	return sealField(aead, subject, field, []byte(value))
+}
+
+// sealedFieldLen returns the length of sealField's result for n bytes
+func sealedFieldLen(aead cipher.AEAD, n int) int {
+	return len(EncryptedValuePrefix) + base64.RawURLEncoding.EncodedLen(aead.NonceSize()+n+aead.Overhead())
+}
+
+// openField decrypts a value produced by sealField
+func openField(aead cipher.AEAD, subject, field, value string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, EncryptedValuePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encrypted %s: %w", field, err)
+	}
+	plain, err := open(aead, sealed, []byte(subject+"\x00"+field))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", field, err)
+	}
+	return plain, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return aead, nil
+}
+
+// seal returns nonce || ciphertext
+func seal(aead cipher.AEAD, plain, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plain, additionalData), nil
+}
+
+// open reverses seal
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// cloneMetadata returns a shallow copy of metadata
+func cloneMetadata(metadata map[string]interface{}) map[string]interface{} {
+	if metadata == nil {
+		return nil
+	}
+	cp := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		cp[k] = v
+	}
+	return cp
+}
+
+// EncryptingStorage wraps a Storage and encrypts sensitive fields before
+// Write; Query transparently decrypts them when the data key is available.
+// Filters on encrypted fields (e.g. IP) cannot match, since ciphertext is randomized.
+type EncryptingStorage struct {
+	storage   Storage
+	encryptor *FieldEncryptor
+
+	mu            sync.Mutex
+	schemaChecked bool
+}
+
+// NewEncryptingStorage creates a storage that encrypts fields with encryptor
+func NewEncryptingStorage(storage Storage, encryptor *FieldEncryptor) *EncryptingStorage {
+	return &EncryptingStorage{
+		storage:   storage,
+		encryptor: encryptor,
+	}
+}
+
+// Write encrypts a copy of record and writes it to the underlying storage
+func (s *EncryptingStorage) Write(ctx context.Context, record *Record) error {
+	if record == nil {
+		return s.storage.Write(ctx, record)
+	}
+	if err := s.checkSchema(ctx); err != nil {
+		return err
+	}
+	cp := record.Copy()
+	if err := s.encryptor.EncryptRecord(ctx, cp); err != nil {
+		return fmt.Errorf("failed to encrypt audit record: %w", err)
+	}
+	return s.storage.Write(ctx, cp)
+}
+
+// checkSchema rejects writes to a database table whose columns are too
+// narrow for sealed values, i.e. below encryptedColumnsSchemaVersion on
+// databases that enforce column sizes. Success is remembered.
+func (s *EncryptingStorage) checkSchema(ctx context.Context) error {
+	db, ok := s.storage.(*DatabaseStorage)
+	if !ok || (!s.encryptor.ip && !s.encryptor.destination) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schemaChecked {
+		return nil
+	}
+	if db.dialect.AlterColumnType(db.tableName, "ip", "TEXT") != "" {
+		version, err := db.SchemaVersion(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check schema for encrypted fields: %w", err)
+		}
+		if version < encryptedColumnsSchemaVersion {
+			return fmt.Errorf("encrypted fields need schema version %d of %s, which is at version %d; run Migrate",
+				encryptedColumnsSchemaVersion, db.tableName, version)
+		}
+	}
+	s.schemaChecked = true
+	return nil
+}
+
+// Query queries the underlying storage and decrypts the results
+func (s *EncryptingStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record, error) {
+	return s.query(ctx, filter, nil)
+}
+
+// QueryWithReport implements ReportingQuerier when the underlying storage
+// does, and returns ErrReportNotSupported otherwise
+func (s *EncryptingStorage) QueryWithReport(ctx context.Context, filter *QueryFilter) ([]*Record, *QueryReport, error) {
+	report := &QueryReport{}
+	records, err := s.query(ctx, filter, report)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, report, nil
+}
+
+// query runs Query, filling report if not nil
+func (s *EncryptingStorage) query(ctx context.Context, filter *QueryFilter, report *QueryReport) ([]*Record, error) {
+	records, err := queryInto(ctx, s.storage, filter, report)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if err := s.encryptor.DecryptRecord(ctx, record); err != nil {
+			return nil, fmt.Errorf("failed to decrypt audit record: %w", err)
+		}
+	}
+	return records, nil
+}
+
+// Count counts records in the underlying storage
+func (s *EncryptingStorage) Count(ctx context.Context, filter *QueryFilter) (int64, error) {
+	agg, err := aggregatorOf(s.storage)
+	if err != nil {
+		return 0, err
+	}
+	return agg.Count(ctx, filter)
+}
+
+// GroupBy aggregates records in the underlying storage. Grouping on an
+// encrypted field yields one group per ciphertext, so group on plaintext
+// fields only.
+func (s *EncryptingStorage) GroupBy(ctx context.Context, filter *QueryFilter, fields []string, bucket time.Duration) ([]AggregateRow, error) {
+	agg, err := aggregatorOf(s.storage)
+	if err != nil {
+		return nil, err
+	}
+	return agg.GroupBy(ctx, filter, fields, bucket)
+}
+
+// Purge purges records from the underlying storage. Filters on encrypted
+// fields match ciphertext, so filter on plaintext fields only.
+func (s *EncryptingStorage) Purge(ctx context.Context, olderThan time.Time, filter *QueryFilter) (int64, error) {
+	p, err := purgerOf(s.storage)
+	if err != nil {
+		return 0, err
+	}
+	return p.Purge(ctx, olderThan, filter)
+}
+
+// Close closes the underlying storage
+func (s *EncryptingStorage) Close() error {
+	return s.storage.Close()
+}
+
+// Storage returns the underlying storage
+func (s *EncryptingStorage) Storage() Storage {
+	return s.storage
+}
+
+// Encryptor returns the field encryptor
+func (s *EncryptingStorage) Encryptor() *FieldEncryptor {
+	return s.encryptor
+}
+
+// MemoryDataKeyStore keeps wrapped data keys in memory. Intended for tests and
+// single-process deployments; keys are lost when the process exits.
+type MemoryDataKeyStore struct {
+	keys map[string][]byte
+	mu   sync.RWMutex
+}
+
+// NewMemoryDataKeyStore creates a new in-memory data key store
+func NewMemoryDataKeyStore() *MemoryDataKeyStore {
+	return &MemoryDataKeyStore{
+		keys: make(map[string][]byte),
+	}
+}
+
+// GetDataKey returns the wrapped data key for subject
+func (s *MemoryDataKeyStore) GetDataKey(ctx context.Context, subject string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[subject]
+	if !ok {
+		return nil, ErrDataKeyNotFound
+	}
+	return key, nil
+}
+
+// PutDataKey stores a wrapped data key unless one exists
+func (s *MemoryDataKeyStore) PutDataKey(ctx context.Context, subject string, wrapped []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[subject]; !ok {
+		s.keys[subject] = wrapped
+	}
+	return nil
+}
+
+// DeleteDataKey removes the data key for subject
+func (s *MemoryDataKeyStore) DeleteDataKey(ctx context.Context, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, subject)
+	return nil
+}
+
+// DatabaseDataKeyStore keeps wrapped data keys in a database table.
+// Supports the registered dialects, see RegisterDialect.
+type DatabaseDataKeyStore struct {
+	db        *sql.DB
+	dialect   Dialect
+	tableName string
+}
+
+// NewDatabaseDataKeyStore creates a database-backed data key store and its
+// table (default name: "audit_data_keys") if it does not exist
+func NewDatabaseDataKeyStore(db *sql.DB, dbType string, tableName string) (*DatabaseDataKeyStore, error) {
+	if tableName == "" {
+		tableName = "audit_data_keys"
+	}
+	if err := validateTableName(tableName); err != nil {
+		return nil, err
+	}
+
+	dialect, err := dialectFor(dbType)
+	if err != nil {
+		return nil, err
+	}
+	createSQL := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			subject VARCHAR(255) PRIMARY KEY,
+			wrapped_key TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT %s
+		)`, tableName, dialect.CurrentTimestamp())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, createSQL); err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+
+	return &DatabaseDataKeyStore{
+		db:        db,
+		dialect:   dialect,
+		tableName: tableName,
+	}, nil
+}
+
+// GetDataKey returns the wrapped data key for subject
+func (s *DatabaseDataKeyStore) GetDataKey(ctx context.Context, subject string) ([]byte, error) {
+	query := fmt.Sprintf("SELECT wrapped_key FROM %s WHERE subject = %s", s.tableName, s.placeholder(1))
+
+	var encoded string
+	err := s.db.QueryRowContext(ctx, query, subject).Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDataKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query data key: %w", err)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode data key: %w", err)
+	}
+	return wrapped, nil
+}
+
+// PutDataKey stores a wrapped data key unless the subject already has one
+func (s *DatabaseDataKeyStore) PutDataKey(ctx context.Context, subject string, wrapped []byte) error {
+	query := s.dialect.InsertIgnore(s.tableName, []string{"subject", "wrapped_key"}, "subject")
+
+	if _, err := s.db.ExecContext(ctx, query, subject, base64.StdEncoding.EncodeToString(wrapped)); err != nil {
+		return fmt.Errorf("failed to insert data key: %w", err)
+	}
+	return nil
+}
+
+// DeleteDataKey removes the data key for subject
+func (s *DatabaseDataKeyStore) DeleteDataKey(ctx context.Context, subject string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE subject = %s", s.tableName, s.placeholder(1))
+	if _, err := s.db.ExecContext(ctx, query, subject); err != nil {
+		return fmt.Errorf("failed to delete data key: %w", err)
+	}
+	return nil
+}
+
+func (s *DatabaseDataKeyStore) placeholder(n int) string {
+	return s.dialect.Placeholder(n)
+}
@@ -0,0 +1,321 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestFieldEncryptor(t *testing.T, store DataKeyStore, metadataKeys ...string) *FieldEncryptor {
+	e, err := NewFieldEncryptor(&FieldEncryptionConfig{
+		MasterKey:          testMasterKey,
+		KeyStore:           store,
+		EncryptDestination: true,
+		EncryptIP:          true,
+		MetadataKeys:       metadataKeys,
+	})
+	require.NoError(t, err)
+	return e
+}
+
+func TestNewFieldEncryptor_Errors(t *testing.T) {
+	_, err := NewFieldEncryptor(nil)
+	assert.Error(t, err)
+
+	_, err = NewFieldEncryptor(&FieldEncryptionConfig{MasterKey: []byte("short"), KeyStore: NewMemoryDataKeyStore()})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "master key")
+
+	_, err = NewFieldEncryptor(&FieldEncryptionConfig{MasterKey: testMasterKey})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "key store")
+}
+
+func TestNewFieldEncryptor_DefaultFields(t *testing.T) {
+	e, err := NewFieldEncryptor(&FieldEncryptionConfig{MasterKey: testMasterKey, KeyStore: NewMemoryDataKeyStore()})
+	require.NoError(t, err)
+	assert.True(t, e.destination)
+	assert.True(t, e.ip)
+}
+
+func TestFieldEncryptor_RoundTrip(t *testing.T) {
+	store := NewMemoryDataKeyStore()
+	e := newTestFieldEncryptor(t, store, "phone", "attempts")
+
+	original := NewRecord(EventSendSuccess, ResultSuccess).
+		WithUserID("user123").
+		WithDestination("13800138000").
+		WithIP("192.168.1.1").
+		WithMetadata("phone", "+8613800138000").
+		WithMetadata("attempts", 3).
+		WithMetadata("tenant", "acme")
+	record := original.Copy()
+
+	require.NoError(t, e.EncryptRecord(context.Background(), record))
+	assert.True(t, IsEncryptedValue(record.Destination))
+	assert.True(t, IsEncryptedValue(record.IP))
+	assert.True(t, IsEncryptedValue(record.Metadata["phone"].(string)))
+	assert.True(t, IsEncryptedValue(record.Metadata["attempts"].(string)))
+	assert.Equal(t, "acme", record.Metadata["tenant"])
+	assert.Equal(t, "user123", record.UserID)
+	// Original metadata map must not be modified
+	assert.Equal(t, "+8613800138000", original.Metadata["phone"])
+
+	// Encrypting again leaves ciphertext unchanged
+	encryptedIP := record.IP
+	require.NoError(t, e.EncryptRecord(context.Background(), record))
+	assert.Equal(t, encryptedIP, record.IP)
+
+	require.NoError(t, e.DecryptRecord(context.Background(), record))
+	assert.Equal(t, "13800138000", record.Destination)
+	assert.Equal(t, "192.168.1.1", record.IP)
+	assert.Equal(t, "+8613800138000", record.Metadata["phone"])
+	// Metadata round-trips through JSON, so numbers become float64
+	assert.Equal(t, float64(3), record.Metadata["attempts"])
+
+	assert.NoError(t, e.EncryptRecord(context.Background(), nil))
+	assert.NoError(t, e.DecryptRecord(context.Background(), nil))
+}
+
+func TestFieldEncryptor_PerSubjectKeys(t *testing.T) {
+	store := NewMemoryDataKeyStore()
+	e := newTestFieldEncryptor(t, store)
+
+	r1 := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("alice").WithIP("10.0.0.1")
+	r2 := NewRecord(EventLoginSuccess, ResultSuccess).WithIP("10.0.0.2")
+	require.NoError(t, e.EncryptRecord(context.Background(), r1))
+	require.NoError(t, e.EncryptRecord(context.Background(), r2))
+
+	_, err := store.GetDataKey(context.Background(), "alice")
+	assert.NoError(t, err)
+	_, err = store.GetDataKey(context.Background(), AnonymousSubject)
+	assert.NoError(t, err)
+
+	// Ciphertext is bound to the subject: moving it to another user fails
+	r1.UserID = AnonymousSubject
+	err = e.DecryptRecord(context.Background(), r1)
+	assert.Error(t, err)
+}
+
+func TestFieldEncryptor_ShredSubject(t *testing.T) {
+	store := NewMemoryDataKeyStore()
+	e := newTestFieldEncryptor(t, store)
+
+	record := NewRecord(EventSendSuccess, ResultSuccess).
+		WithUserID("user123").
+		WithDestination("user@example.com")
+	require.NoError(t, e.EncryptRecord(context.Background(), record))
+	ciphertext := record.Destination
+
+	require.NoError(t, e.ShredSubject(context.Background(), "user123"))
+	require.NoError(t, e.ShredSubject(context.Background(), ""))
+
+	// Event stays intact, PII is unrecoverable
+	require.NoError(t, e.DecryptRecord(context.Background(), record))
+	assert.Equal(t, ciphertext, record.Destination)
+	assert.Equal(t, EventSendSuccess, record.EventType)
+
+	// A new encryptor with the same master key cannot recover it either
+	e2 := newTestFieldEncryptor(t, store)
+	require.NoError(t, e2.DecryptRecord(context.Background(), record))
+	assert.Equal(t, ciphertext, record.Destination)
+}
+
+func TestFieldEncryptor_WrongMasterKey(t *testing.T) {
+	store := NewMemoryDataKeyStore()
+	e := newTestFieldEncryptor(t, store)
+
+	record := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("u1").WithIP("10.0.0.1")
+	require.NoError(t, e.EncryptRecord(context.Background(), record))
+
+	other, err := NewFieldEncryptor(&FieldEncryptionConfig{
+		MasterKey: []byte("fedcba9876543210fedcba9876543210"),
+		KeyStore:  store,
+	})
+	require.NoError(t, err)
+	err = other.DecryptRecord(context.Background(), record)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unwrap data key")
+}
+
+func TestFieldEncryptor_CorruptCiphertext(t *testing.T) {
+	e := newTestFieldEncryptor(t, NewMemoryDataKeyStore())
+
+	record := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("u1").WithIP("10.0.0.1")
+	require.NoError(t, e.EncryptRecord(context.Background(), record))
+
+	record.IP = EncryptedValuePrefix + "!!!"
+	assert.Error(t, e.DecryptRecord(context.Background(), record))
+
+	record.IP = EncryptedValuePrefix + "AAAA"
+	assert.Error(t, e.DecryptRecord(context.Background(), record))
+}
+
+type failingDataKeyStore struct{}
+
+func (failingDataKeyStore) GetDataKey(ctx context.Context, subject string) ([]byte, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func (failingDataKeyStore) PutDataKey(ctx context.Context, subject string, wrapped []byte) error {
+	return errors.New("store unavailable")
+}
+
+func (failingDataKeyStore) DeleteDataKey(ctx context.Context, subject string) error {
+	return errors.New("store unavailable")
+}
+
+func TestFieldEncryptor_StoreErrors(t *testing.T) {
+	e := newTestFieldEncryptor(t, failingDataKeyStore{})
+
+	record := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("u1").WithIP("10.0.0.1")
+	assert.Error(t, e.EncryptRecord(context.Background(), record))
+	assert.Error(t, e.ShredSubject(context.Background(), "u1"))
+
+	record.IP = EncryptedValuePrefix + "AAAA"
+	assert.Error(t, e.DecryptRecord(context.Background(), record))
+}
+
+func TestEncryptingStorage(t *testing.T) {
+	fileStorage, err := NewFileStorage(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+
+	e := newTestFieldEncryptor(t, NewMemoryDataKeyStore())
+	storage := NewEncryptingStorage(fileStorage, e)
+	defer func() { _ = storage.Close() }()
+	assert.Equal(t, fileStorage, storage.Storage())
+	assert.Equal(t, e, storage.Encryptor())
+
+	record := NewRecord(EventSendSuccess, ResultSuccess).
+		WithUserID("user123").
+		WithChannel("sms").
+		WithDestination("13800138000").
+		WithIP("192.168.1.1")
+	require.NoError(t, storage.Write(context.Background(), record))
+	// Caller's record is unchanged
+	assert.Equal(t, "13800138000", record.Destination)
+
+	// Raw storage only holds ciphertext
+	raw, err := fileStorage.Query(context.Background(), DefaultQueryFilter())
+	require.NoError(t, err)
+	require.Len(t, raw, 1)
+	assert.True(t, strings.HasPrefix(raw[0].Destination, EncryptedValuePrefix))
+
+	results, err := storage.Query(context.Background(), DefaultQueryFilter())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "13800138000", results[0].Destination)
+	assert.Equal(t, "192.168.1.1", results[0].IP)
+
+	// After shredding, the event remains but PII is gone
+	require.NoError(t, e.ShredSubject(context.Background(), "user123"))
+	results, err = storage.Query(context.Background(), DefaultQueryFilter())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, EventSendSuccess, results[0].EventType)
+	assert.True(t, IsEncryptedValue(results[0].Destination))
+}
+
+func TestEncryptingStorage_Errors(t *testing.T) {
+	storage := NewEncryptingStorage(&errorStorage{}, newTestFieldEncryptor(t, NewMemoryDataKeyStore()))
+	_, err := storage.Query(context.Background(), DefaultQueryFilter())
+	assert.Error(t, err)
+
+	failing := NewEncryptingStorage(newTestStorage(), newTestFieldEncryptor(t, failingDataKeyStore{}))
+	err = failing.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess).WithIP("10.0.0.1"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to encrypt")
+}
+
+func TestDatabaseDataKeyStore(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	store, err := NewDatabaseDataKeyStore(db, "sqlite", "")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	_, err = store.GetDataKey(ctx, "u1")
+	assert.ErrorIs(t, err, ErrDataKeyNotFound)
+
+	require.NoError(t, store.PutDataKey(ctx, "u1", []byte("first")))
+	require.NoError(t, store.PutDataKey(ctx, "u1", []byte("second")))
+	key, err := store.GetDataKey(ctx, "u1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("first"), key)
+
+	require.NoError(t, store.DeleteDataKey(ctx, "u1"))
+	_, err = store.GetDataKey(ctx, "u1")
+	assert.ErrorIs(t, err, ErrDataKeyNotFound)
+
+	// Works end-to-end with the encryptor
+	e := newTestFieldEncryptor(t, store)
+	record := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("u2").WithIP("10.0.0.1")
+	require.NoError(t, e.EncryptRecord(ctx, record))
+	require.NoError(t, e.DecryptRecord(ctx, record))
+	assert.Equal(t, "10.0.0.1", record.IP)
+}
+
+func TestNewDatabaseDataKeyStore_Errors(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	_, err := NewDatabaseDataKeyStore(db, "oracle", "")
+	assert.Error(t, err)
+
+	_, err = NewDatabaseDataKeyStore(db, "sqlite", "bad-name")
+	assert.Error(t, err)
+}
+
+func TestFieldEncryptor_SealedSize(t *testing.T) {
+	e := newTestFieldEncryptor(t, NewMemoryDataKeyStore())
+	ctx := context.Background()
+
+	// The longest raw values of the columns fit once sealed
+	record := NewRecord(EventSendSuccess, ResultSuccess).
+		WithIP("fe80:0000:0000:0000:0000:0000:0000:0001%" + strings.Repeat("e", 24)).
+		WithDestination(strings.Repeat("d", 255))
+	require.NoError(t, e.EncryptRecord(ctx, record))
+	assert.LessOrEqual(t, len(record.IP), encryptedIPColumnSize)
+	assert.LessOrEqual(t, len(record.Destination), encryptedDestinationColumnSize)
+
+	record = NewRecord(EventSendSuccess, ResultSuccess).WithDestination(strings.Repeat("d", 400))
+	err := e.EncryptRecord(ctx, record)
+	assert.ErrorContains(t, err, "encrypted destination would be 578 characters, more than the 512 its column holds")
+}
+
+func TestEncryptingStorage_SchemaVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs"}
+	storage := NewEncryptingStorage(s, newTestFieldEncryptor(t, NewMemoryDataKeyStore()))
+	ctx := context.Background()
+	record := NewRecord(EventLoginSuccess, ResultSuccess).WithIP("192.168.100.100")
+
+	expectVersion := func(version int) {
+		mock.ExpectQuery("information_schema.tables").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COALESCE").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+	}
+
+	// Columns of version 4 are too narrow for sealed values
+	expectVersion(4)
+	err = storage.Write(ctx, record)
+	assert.ErrorContains(t, err, "encrypted fields need schema version 5 of audit_logs, which is at version 4; run Migrate")
+
+	// Once migrated, the version is checked no more
+	expectVersion(5)
+	mock.ExpectExec("INSERT INTO audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO audit_logs").WillReturnResult(sqlmock.NewResult(2, 1))
+	require.NoError(t, storage.Write(ctx, record))
+	require.NoError(t, storage.Write(ctx, record))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -94,62 +94,6 @@ func ParseStorageType(s string) StorageType {
 	}
 }
 
-// MultiStorage combines multiple storage backends
-type MultiStorage struct {
-	storages []Storage
-}
-
-// NewMultiStorage creates a storage that writes to multiple backends
-func NewMultiStorage(storages ...Storage) *MultiStorage {
-	return &MultiStorage{
-		storages: storages,
-	}
-}
-
-// Write writes to all storage backends
-func (m *MultiStorage) Write(ctx context.Context, record *Record) error {
-	var firstErr error
-	for _, s := range m.storages {
-		if s == nil {
-			continue
-		}
-		if err := s.Write(ctx, record); err != nil && firstErr == nil {
-			firstErr = err
-		}
-	}
-	return firstErr
-}
-
-// Query queries from the first storage backend
-func (m *MultiStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record, error) {
-	for _, s := range m.storages {
-		if s == nil {
-			continue
-		}
-		return s.Query(ctx, filter)
-	}
-	return nil, fmt.Errorf("no storage configured")
-}
-
-// Close closes all storage backends
-func (m *MultiStorage) Close() error {
-	var firstErr error
-	for _, s := range m.storages {
-		if s == nil {
-			continue
-		}
-		if err := s.Close(); err != nil && firstErr == nil {
-			firstErr = err
-		}
-	}
-	return firstErr
-}
-
-// Storages returns all storage backends
-func (m *MultiStorage) Storages() []Storage {
-	return m.storages
-}
-
 // NoopStorage is a no-op storage that discards all records
 type NoopStorage struct{}
 
@@ -168,6 +112,21 @@ func (s *NoopStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record
 	return []*Record{}, nil
 }
 
+// Count returns zero
+func (s *NoopStorage) Count(ctx context.Context, filter *QueryFilter) (int64, error) {
+	return 0, nil
+}
+
+// GroupBy returns no rows
+func (s *NoopStorage) GroupBy(ctx context.Context, filter *QueryFilter, fields []string, bucket time.Duration) ([]AggregateRow, error) {
+	return []AggregateRow{}, nil
+}
+
+// Purge does nothing
+func (s *NoopStorage) Purge(ctx context.Context, olderThan time.Time, filter *QueryFilter) (int64, error) {
+	return 0, nil
+}
+
 // Close does nothing
 func (s *NoopStorage) Close() error {
 	return nil
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -89,7 +90,82 @@ func (s *FileStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record
 		filter = DefaultQueryFilter()
 	}
 	filter.Normalize()
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Only the records up to the end of the requested page are kept
+	top := newTopRecords(filter, filter.Offset+filter.Limit)
+	if err := s.scan(ctx, func(record *Record) {
+		if matchesFilter(record, filter) {
+			top.add(record)
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	matched := top.sorted()
+	if filter.Offset >= len(matched) {
+		return nil, nil
+	}
+	return matched[filter.Offset:], nil
+}
+
+// Count returns the number of records matching the filter
+func (s *FileStorage) Count(ctx context.Context, filter *QueryFilter) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	if err := filter.Validate(); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	err := s.scan(ctx, func(record *Record) {
+		if matchesFilter(record, filter) {
+			count++
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// GroupBy counts matching records per field values and time bucket
+func (s *FileStorage) GroupBy(ctx context.Context, filter *QueryFilter, fields []string, bucket time.Duration) ([]AggregateRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	seconds, err := validateGroupBy(fields, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := newGroupCounter(fields, seconds)
+	err = s.scan(ctx, func(record *Record) {
+		if matchesFilter(record, filter) {
+			counter.add(record)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counter.result(), nil
+}
 
+// scan reads every record in the file in insertion order and calls fn for
+// each one, skipping malformed lines. The caller must hold s.mu.
+func (s *FileStorage) scan(ctx context.Context, fn func(*Record)) error {
 	// Flush current writer
 	if err := s.writer.Flush(); err != nil {
 		// Log warning but continue
@@ -100,21 +176,20 @@ func (s *FileStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record
 	file, err := os.Open(s.filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return []*Record{}, nil
+			return nil
 		}
-		return nil, fmt.Errorf("failed to open file for reading: %w", err)
+		return fmt.Errorf("failed to open file for reading: %w", err)
 	}
 	defer func() { _ = file.Close() }()
 
-	// Read all records. Use a larger buffer so lines up to MaxRecordJSONSize
-	// are read in full (default 64KB would truncate and drop records).
-	var allRecords []*Record
+	// Use a larger buffer so lines up to MaxRecordJSONSize are read in full
+	// (default 64KB would truncate and drop records).
 	scanner := bufio.NewScanner(file)
 	scanner.Buffer(make([]byte, 0, 64), MaxRecordJSONSize)
 	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return ctx.Err()
 		default:
 		}
 
@@ -133,36 +208,14 @@ func (s *FileStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record
 			continue
 		}
 
-		allRecords = append(allRecords, &record)
+		fn(&record)
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
-	}
-
-	// Filter and paginate (newest first)
-	var results []*Record
-	offset := 0
-	for i := len(allRecords) - 1; i >= 0; i-- {
-		record := allRecords[i]
-
-		if !matchesFilter(record, filter) {
-			continue
-		}
-
-		// Apply offset
-		if offset < filter.Offset {
-			offset++
-			continue
-		}
-
-		results = append(results, record)
-		if len(results) >= filter.Limit {
-			break
-		}
+		return fmt.Errorf("failed to read file: %w", err)
 	}
 
-	return results, nil
+	return nil
 }
 
 // Close closes the file and releases resources
@@ -198,7 +251,7 @@ func (s *FileStorage) Rotate() error {
 	}
 
 	// Rename current file with timestamp
-	timestamp := time.Now().Format("20060102-150405")
+	timestamp := time.Now().Format(rotatedTimeFormat)
 	rotatedPath := fmt.Sprintf("%s.%s", s.filePath, timestamp)
 	if err := os.Rename(s.filePath, rotatedPath); err != nil {
 		return fmt.Errorf("failed to rename file: %w", err)
@@ -216,39 +269,158 @@ func (s *FileStorage) Rotate() error {
 	return nil
 }
 
-// FilePath returns the file path
-func (s *FileStorage) FilePath() string {
-	return s.filePath
+// rotatedTimeFormat is the timestamp suffix of files created by Rotate
+const rotatedTimeFormat = "20060102-150405"
+
+// Purge deletes records older than olderThan matching the filter from the
+// file and its rotated files. Rotated files left without records are
+// removed; other files are rewritten without the purged records.
+func (s *FileStorage) Purge(ctx context.Context, olderThan time.Time, filter *QueryFilter) (int64, error) {
+	filter, err := purgeFilter(olderThan, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	rotated, err := s.rotatedFiles()
+	if err != nil {
+		return 0, err
+	}
+	for _, path := range rotated {
+		n, err := purgeFile(ctx, path, filter, true)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to purge %s: %w", path, err)
+		}
+	}
+
+	// The active file is replaced, so reopen it afterwards
+	if err := s.writer.Flush(); err != nil {
+		return total, fmt.Errorf("failed to flush writer: %w", err)
+	}
+	if err := s.file.Close(); err != nil {
+		return total, fmt.Errorf("failed to close file: %w", err)
+	}
+	n, purgeErr := purgeFile(ctx, s.filePath, filter, false)
+	total += n
+
+	file, err := os.OpenFile(s.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return total, fmt.Errorf("failed to reopen file: %w", err)
+	}
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+
+	if purgeErr != nil {
+		return total, fmt.Errorf("failed to purge %s: %w", s.filePath, purgeErr)
+	}
+	return total, nil
+}
+
+// rotatedFiles lists the files created by Rotate, oldest first
+func (s *FileStorage) rotatedFiles() ([]string, error) {
+	dir := filepath.Dir(s.filePath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rotated files: %w", err)
+	}
+	prefix := filepath.Base(s.filePath) + "."
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(rotatedTimeFormat, name[len(prefix):]); err != nil {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return paths, nil
 }
 
-// matchesFilter checks if a record matches the filter criteria
-func matchesFilter(record *Record, filter *QueryFilter) bool {
-	if filter.EventType != "" && string(record.EventType) != filter.EventType {
-		return false
+// purgeFile rewrites path without the records matching filter and returns
+// how many were dropped. Malformed lines are kept. With removeEmpty, a file
+// left without lines is removed instead.
+func purgeFile(ctx context.Context, path string, filter *QueryFilter, removeEmpty bool) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".purge-*")
+	if err != nil {
+		return 0, err
 	}
-	if filter.UserID != "" && record.UserID != filter.UserID {
-		return false
+	defer func() {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+	}()
+	writer := bufio.NewWriter(out)
+
+	var purged, kept int64
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64), MaxRecordJSONSize)
+	for scanner.Scan() {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+		}
+
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(line, &record); err == nil && matchesFilter(&record, filter) {
+			purged++
+			continue
+		}
+		kept++
+		if _, err := writer.Write(line); err != nil {
+			return 0, err
+		}
+		if err := writer.WriteByte('\n'); err != nil {
+			return 0, err
+		}
 	}
-	if filter.ChallengeID != "" && record.ChallengeID != filter.ChallengeID {
-		return false
+	if err := scanner.Err(); err != nil {
+		return 0, err
 	}
-	if filter.SessionID != "" && record.SessionID != filter.SessionID {
-		return false
+	if purged == 0 {
+		return 0, nil
 	}
-	if filter.Channel != "" && record.Channel != filter.Channel {
-		return false
+
+	if kept == 0 && removeEmpty {
+		if err := os.Remove(path); err != nil {
+			return 0, err
+		}
+		return purged, nil
 	}
-	if filter.Result != "" && string(record.Result) != filter.Result {
-		return false
+	if err := writer.Flush(); err != nil {
+		return 0, err
 	}
-	if filter.IP != "" && record.IP != filter.IP {
-		return false
+	if err := out.Chmod(0644); err != nil {
+		return 0, err
 	}
-	if filter.StartTime > 0 && record.Timestamp < filter.StartTime {
-		return false
+	if err := out.Close(); err != nil {
+		return 0, err
 	}
-	if filter.EndTime > 0 && record.Timestamp > filter.EndTime {
-		return false
+	if err := os.Rename(out.Name(), path); err != nil {
+		return 0, err
 	}
-	return true
+	return purged, nil
+}
+
+// FilePath returns the file path
+func (s *FileStorage) FilePath() string {
+	return s.filePath
 }
@@ -0,0 +1,687 @@
+package audit
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidFilter is returned by Query when a filter condition is malformed
+var ErrInvalidFilter = errors.New("invalid query filter")
+
+// Sort keys and orders for QueryFilter
+const (
+	SortByTimestamp = "timestamp"
+	SortByDuration  = "duration_ms"
+	SortByEventType = "event_type"
+
+	SortAsc  = "asc"
+	SortDesc = "desc"
+)
+
+// FilterOp is the comparison applied by a Condition
+type FilterOp string
+
+const (
+	OpIn        FilterOp = "in"         // Field equals one of Values
+	OpNotIn     FilterOp = "not_in"     // Field equals none of Values
+	OpPrefix    FilterOp = "prefix"     // Field starts with one of Values
+	OpNotPrefix FilterOp = "not_prefix" // Field starts with none of Values
+	OpCIDR      FilterOp = "cidr"       // IP is inside one of the CIDR ranges in Values
+	OpNotCIDR   FilterOp = "not_cidr"   // IP is inside none of the CIDR ranges in Values
+)
+
+// Condition is an additional filter on a record field.
+// Conditions are combined with each other and with the equality fields of
+// QueryFilter using AND.
+type Condition struct {
+	Field  string   `json:"field"`
+	Op     FilterOp `json:"op"`
+	Values []string `json:"values"`
+}
+
+// filterFields lists the fields usable in conditions; names match the JSON
+// keys of Record and the database column names
+var filterFields = map[string]func(*Record) string{
+	"event_type":          func(r *Record) string { return string(r.EventType) },
+	"user_id":             func(r *Record) string { return r.UserID },
+	"challenge_id":        func(r *Record) string { return r.ChallengeID },
+	"session_id":          func(r *Record) string { return r.SessionID },
+	"channel":             func(r *Record) string { return r.Channel },
+	"result":              func(r *Record) string { return string(r.Result) },
+	"ip":                  func(r *Record) string { return r.IP },
+	"event_id":            func(r *Record) string { return r.EventID },
+	"request_id":          func(r *Record) string { return r.RequestID },
+	"trace_id":            func(r *Record) string { return r.TraceID },
+	"provider":            func(r *Record) string { return r.Provider },
+	"provider_message_id": func(r *Record) string { return r.ProviderMessageID },
+	"purpose":             func(r *Record) string { return r.Purpose },
+	"resource":            func(r *Record) string { return r.Resource },
+	"destination":         func(r *Record) string { return r.Destination },
+}
+
+// In matches records whose field equals one of values
+func In(field string, values ...string) Condition {
+	return Condition{Field: field, Op: OpIn, Values: values}
+}
+
+// NotIn matches records whose field equals none of values
+func NotIn(field string, values ...string) Condition {
+	return Condition{Field: field, Op: OpNotIn, Values: values}
+}
+
+// HasPrefix matches records whose field starts with one of prefixes
+func HasPrefix(field string, prefixes ...string) Condition {
+	return Condition{Field: field, Op: OpPrefix, Values: prefixes}
+}
+
+// NotHasPrefix matches records whose field starts with none of prefixes
+func NotHasPrefix(field string, prefixes ...string) Condition {
+	return Condition{Field: field, Op: OpNotPrefix, Values: prefixes}
+}
+
+// InCIDR matches records whose IP is inside one of the ranges
+// (e.g. "10.0.0.0/8", "2001:db8::/32"; a bare address matches only itself)
+func InCIDR(ranges ...string) Condition {
+	return Condition{Field: "ip", Op: OpCIDR, Values: ranges}
+}
+
+// NotInCIDR matches records whose IP is inside none of the ranges
+func NotInCIDR(ranges ...string) Condition {
+	return Condition{Field: "ip", Op: OpNotCIDR, Values: ranges}
+}
+
+// Where adds conditions to the filter
+func (f *QueryFilter) Where(conditions ...Condition) *QueryFilter {
+	f.Conditions = append(f.Conditions, conditions...)
+	return f
+}
+
+// Validate checks the sort options, that all conditions use a known field
+// and operator, that CIDR ranges parse and that metadata keys and values
+// are usable
+func (f *QueryFilter) Validate() error {
+	switch f.SortBy {
+	case "", SortByTimestamp, SortByDuration, SortByEventType:
+	default:
+		return fmt.Errorf("%w: unsupported sort key %q", ErrInvalidFilter, f.SortBy)
+	}
+	switch f.SortOrder {
+	case "", SortAsc, SortDesc:
+	default:
+		return fmt.Errorf("%w: unsupported sort order %q", ErrInvalidFilter, f.SortOrder)
+	}
+	for _, c := range f.Conditions {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	for _, c := range f.Metadata {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateText(f.Text); err != nil {
+		return err
+	}
+	if f.Expr != nil {
+		return f.Expr.validate(0)
+	}
+	return nil
+}
+
+func (c Condition) validate() error {
+	if _, ok := filterFields[c.Field]; !ok {
+		return fmt.Errorf("%w: unsupported field %q", ErrInvalidFilter, c.Field)
+	}
+	if len(c.Values) == 0 {
+		return fmt.Errorf("%w: condition on %q has no values", ErrInvalidFilter, c.Field)
+	}
+	switch c.Op {
+	case OpIn, OpNotIn, OpPrefix, OpNotPrefix:
+		return nil
+	case OpCIDR, OpNotCIDR:
+		if c.Field != "ip" {
+			return fmt.Errorf("%w: %s only applies to ip", ErrInvalidFilter, c.Op)
+		}
+		for _, v := range c.Values {
+			if _, err := parseCIDR(v); err != nil {
+				return fmt.Errorf("%w: invalid CIDR range %q", ErrInvalidFilter, v)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported operator %q", ErrInvalidFilter, c.Op)
+	}
+}
+
+// matches reports whether record satisfies the condition.
+// The condition must have been validated.
+func (c Condition) matches(record *Record) bool {
+	return c.matchesValue(filterFields[c.Field](record))
+}
+
+// matchesValue reports whether value of the condition's field satisfies it
+func (c Condition) matchesValue(value string) bool {
+	switch c.Op {
+	case OpIn:
+		return containsString(c.Values, value)
+	case OpNotIn:
+		return !containsString(c.Values, value)
+	case OpPrefix:
+		return hasAnyPrefix(value, c.Values)
+	case OpNotPrefix:
+		return !hasAnyPrefix(value, c.Values)
+	case OpCIDR:
+		return ipInRanges(value, c.Values)
+	case OpNotCIDR:
+		return !ipInRanges(value, c.Values)
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDR parses a CIDR range or a bare address (as a single-host range)
+func parseCIDR(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ipInRanges reports whether ip is inside one of ranges. ip may be a plain
+// address, an address with a port such as "10.0.0.1:8080" or a masked range
+// such as "192.168.1.0/24" (as produced by MaskIP), which matches when it
+// lies entirely inside a range. Other values never match.
+func ipInRanges(ip string, ranges []string) bool {
+	if ip == "" {
+		return false
+	}
+	var target netip.Prefix
+	if strings.Contains(ip, "/") {
+		p, err := netip.ParsePrefix(ip)
+		if err != nil {
+			return false
+		}
+		target = p
+	} else {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			ap, err := netip.ParseAddrPort(ip)
+			if err != nil {
+				return false
+			}
+			addr = ap.Addr()
+		}
+		target = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	for _, r := range ranges {
+		p, err := parseCIDR(r)
+		if err != nil {
+			continue
+		}
+		if p.Bits() <= target.Bits() && p.Contains(target.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFilter checks if a record matches the filter criteria
+func matchesFilter(record *Record, filter *QueryFilter) bool {
+	if filter.EventType != "" && string(record.EventType) != filter.EventType {
+		return false
+	}
+	if filter.UserID != "" && record.UserID != filter.UserID {
+		return false
+	}
+	if filter.ChallengeID != "" && record.ChallengeID != filter.ChallengeID {
+		return false
+	}
+	if filter.SessionID != "" && record.SessionID != filter.SessionID {
+		return false
+	}
+	if filter.Channel != "" && record.Channel != filter.Channel {
+		return false
+	}
+	if filter.Result != "" && string(record.Result) != filter.Result {
+		return false
+	}
+	if filter.IP != "" && record.IP != filter.IP {
+		return false
+	}
+	if filter.EventID != "" && record.EventID != filter.EventID {
+		return false
+	}
+	if filter.RequestID != "" && record.RequestID != filter.RequestID {
+		return false
+	}
+	if filter.TraceID != "" && record.TraceID != filter.TraceID {
+		return false
+	}
+	if filter.Provider != "" && record.Provider != filter.Provider {
+		return false
+	}
+	if filter.ProviderMessageID != "" && record.ProviderMessageID != filter.ProviderMessageID {
+		return false
+	}
+	if filter.Purpose != "" && record.Purpose != filter.Purpose {
+		return false
+	}
+	if filter.Resource != "" && record.Resource != filter.Resource {
+		return false
+	}
+	if filter.Destination != "" && record.Destination != filter.Destination {
+		return false
+	}
+	if filter.StartTime > 0 && record.Timestamp < filter.StartTime {
+		return false
+	}
+	if filter.EndTime > 0 && record.Timestamp > filter.EndTime {
+		return false
+	}
+	for _, c := range filter.Conditions {
+		if !c.matches(record) {
+			return false
+		}
+	}
+	for _, c := range filter.Metadata {
+		if !c.matches(record.Metadata) {
+			return false
+		}
+	}
+	if needle := textNeedle(filter.Text); needle != "" && !matchesText(record, needle) {
+		return false
+	}
+	if filter.Expr != nil && !filter.Expr.matches(record) {
+		return false
+	}
+	return true
+}
+
+// maxTextLen bounds full-text search fragments
+const maxTextLen = 256
+
+func validateText(text string) error {
+	if len(text) > maxTextLen {
+		return fmt.Errorf("%w: text search too long: max %d bytes", ErrInvalidFilter, maxTextLen)
+	}
+	return nil
+}
+
+// textNeedle returns the normalized search fragment; "" disables the search
+func textNeedle(text string) string {
+	return strings.ToLower(strings.TrimSpace(text))
+}
+
+// matchesText reports whether needle occurs in a searchable field of record
+func matchesText(record *Record, needle string) bool {
+	for _, field := range []string{record.Reason, record.UserAgent, record.Resource} {
+		if strings.Contains(strings.ToLower(field), needle) {
+			return true
+		}
+	}
+	return containsText(record.Metadata, needle)
+}
+
+// containsText searches the string values of decoded JSON at any depth
+func containsText(value interface{}, needle string) bool {
+	switch v := value.(type) {
+	case string:
+		return strings.Contains(strings.ToLower(v), needle)
+	case map[string]interface{}:
+		for _, item := range v {
+			if containsText(item, needle) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if containsText(item, needle) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MetadataOp is the comparison applied by a MetadataCondition
+type MetadataOp string
+
+const (
+	MetaEq        MetadataOp = "eq"         // Metadata[Key] equals Value (string, bool or number)
+	MetaNe        MetadataOp = "ne"         // Key is missing or does not equal Value
+	MetaExists    MetadataOp = "exists"     // Key is present (even with a null value)
+	MetaNotExists MetadataOp = "not_exists" // Key is missing
+	MetaGt        MetadataOp = "gt"         // Numeric value greater than Value
+	MetaGte       MetadataOp = "gte"        // Numeric value greater than or equal to Value
+	MetaLt        MetadataOp = "lt"         // Numeric value less than Value
+	MetaLte       MetadataOp = "lte"        // Numeric value less than or equal to Value
+)
+
+// maxMetadataKeyLen bounds metadata keys used in filters and indexes
+const maxMetadataKeyLen = 64
+
+// MetadataCondition filters on a top-level key of Record.Metadata.
+// Values only match values of the same JSON type: "42" does not equal 42.
+type MetadataCondition struct {
+	Key   string      `json:"key"`
+	Op    MetadataOp  `json:"op"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// MetadataEquals matches records whose metadata key equals value
+func MetadataEquals(key string, value interface{}) MetadataCondition {
+	return MetadataCondition{Key: key, Op: MetaEq, Value: value}
+}
+
+// MetadataNotEquals matches records whose metadata key is missing or differs from value
+func MetadataNotEquals(key string, value interface{}) MetadataCondition {
+	return MetadataCondition{Key: key, Op: MetaNe, Value: value}
+}
+
+// MetadataExists matches records that have the metadata key
+func MetadataExists(key string) MetadataCondition {
+	return MetadataCondition{Key: key, Op: MetaExists}
+}
+
+// MetadataNotExists matches records without the metadata key
+func MetadataNotExists(key string) MetadataCondition {
+	return MetadataCondition{Key: key, Op: MetaNotExists}
+}
+
+// MetadataCompare matches records whose numeric metadata value compares to
+// value with op (MetaGt, MetaGte, MetaLt or MetaLte)
+func MetadataCompare(key string, op MetadataOp, value float64) MetadataCondition {
+	return MetadataCondition{Key: key, Op: op, Value: value}
+}
+
+// WithMetadata adds a metadata equality filter
+func (f *QueryFilter) WithMetadata(key string, value interface{}) *QueryFilter {
+	return f.WhereMetadata(MetadataEquals(key, value))
+}
+
+// WhereMetadata adds metadata conditions to the filter
+func (f *QueryFilter) WhereMetadata(conditions ...MetadataCondition) *QueryFilter {
+	f.Metadata = append(f.Metadata, conditions...)
+	return f
+}
+
+// validateMetadataKey restricts keys to [A-Za-z0-9_.-] so they can be
+// embedded in JSON paths and index names
+func validateMetadataKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: metadata key cannot be empty", ErrInvalidFilter)
+	}
+	if len(key) > maxMetadataKeyLen {
+		return fmt.Errorf("%w: metadata key too long: max %d characters", ErrInvalidFilter, maxMetadataKeyLen)
+	}
+	for _, r := range key {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' && r != '.' && r != '-' {
+			return fmt.Errorf("%w: invalid metadata key %q", ErrInvalidFilter, key)
+		}
+	}
+	return nil
+}
+
+func (c MetadataCondition) validate() error {
+	if err := validateMetadataKey(c.Key); err != nil {
+		return err
+	}
+	switch c.Op {
+	case MetaExists, MetaNotExists:
+		return nil
+	case MetaEq, MetaNe:
+		switch c.Value.(type) {
+		case string, bool:
+			return nil
+		}
+		if _, ok := metadataNumber(c.Value); ok {
+			return nil
+		}
+		return fmt.Errorf("%w: metadata value for %q must be a string, bool or number", ErrInvalidFilter, c.Key)
+	case MetaGt, MetaGte, MetaLt, MetaLte:
+		if _, ok := metadataNumber(c.Value); ok {
+			return nil
+		}
+		return fmt.Errorf("%w: metadata value for %q must be a number", ErrInvalidFilter, c.Key)
+	default:
+		return fmt.Errorf("%w: unsupported metadata operator %q", ErrInvalidFilter, c.Op)
+	}
+}
+
+// matches reports whether metadata satisfies the condition.
+// The condition must have been validated.
+func (c MetadataCondition) matches(metadata map[string]interface{}) bool {
+	value, ok := metadata[c.Key]
+	switch c.Op {
+	case MetaExists:
+		return ok
+	case MetaNotExists:
+		return !ok
+	case MetaEq:
+		return ok && metadataEqual(value, c.Value)
+	case MetaNe:
+		return !ok || !metadataEqual(value, c.Value)
+	}
+
+	actual, ok := metadataNumber(value)
+	if !ok {
+		return false
+	}
+	target, _ := metadataNumber(c.Value)
+	switch c.Op {
+	case MetaGt:
+		return actual > target
+	case MetaGte:
+		return actual >= target
+	case MetaLt:
+		return actual < target
+	case MetaLte:
+		return actual <= target
+	}
+	return false
+}
+
+// metadataEqual compares a metadata value with a filter value of the same JSON type
+func metadataEqual(actual, expected interface{}) bool {
+	switch e := expected.(type) {
+	case string:
+		a, ok := actual.(string)
+		return ok && a == e
+	case bool:
+		a, ok := actual.(bool)
+		return ok && a == e
+	}
+	a, ok := metadataNumber(actual)
+	if !ok {
+		return false
+	}
+	n, _ := metadataNumber(expected)
+	return a == n
+}
+
+// metadataNumber converts Go and JSON numeric types to float64
+func metadataNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// sortKey returns the sort key, defaulting to timestamp
+func (f *QueryFilter) sortKey() string {
+	if f.SortBy == "" {
+		return SortByTimestamp
+	}
+	return f.SortBy
+}
+
+// ascending reports whether results are sorted oldest/smallest first
+func (f *QueryFilter) ascending() bool {
+	return f.SortOrder == SortAsc
+}
+
+// compareRecords orders records by the filter's sort key, then by
+// timestamp, in the filter's direction
+func compareRecords(a, b *Record, filter *QueryFilter) int {
+	c := 0
+	switch filter.sortKey() {
+	case SortByDuration:
+		c = compareInt64(a.DurationMS, b.DurationMS)
+	case SortByEventType:
+		c = strings.Compare(string(a.EventType), string(b.EventType))
+	}
+	if c == 0 {
+		c = compareInt64(a.Timestamp, b.Timestamp)
+	}
+	if !filter.ascending() {
+		c = -c
+	}
+	return c
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortRecords sorts records for the filter. The sort is stable, so callers
+// pass records in insertion order for the requested direction to break ties.
+func sortRecords(records []*Record, filter *QueryFilter) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return compareRecords(records[i], records[j], filter) < 0
+	})
+}
+
+// topRecords keeps the first n records in the filter's order out of records
+// added in insertion order, in O(n) memory. Ties are broken like
+// sortRecords on records in insertion order for the requested direction.
+type topRecords struct {
+	filter  *QueryFilter
+	n       int
+	added   int
+	records []*Record
+	seqs    []int
+}
+
+func newTopRecords(filter *QueryFilter, n int) *topRecords {
+	return &topRecords{filter: filter, n: n}
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface with the record
+// that sorts last on top
+func (t *topRecords) Len() int { return len(t.records) }
+func (t *topRecords) Less(i, j int) bool {
+	return t.before(t.records[j], t.seqs[j], t.records[i], t.seqs[i])
+}
+func (t *topRecords) Swap(i, j int) {
+	t.records[i], t.records[j] = t.records[j], t.records[i]
+	t.seqs[i], t.seqs[j] = t.seqs[j], t.seqs[i]
+}
+func (t *topRecords) Push(x interface{}) {
+	t.records = append(t.records, x.(*Record))
+	t.seqs = append(t.seqs, t.added)
+}
+func (t *topRecords) Pop() interface{} {
+	last := len(t.records) - 1
+	record := t.records[last]
+	t.records, t.seqs = t.records[:last], t.seqs[:last]
+	return record
+}
+
+// before reports whether record a, added as seq, sorts before b
+func (t *topRecords) before(a *Record, seqA int, b *Record, seqB int) bool {
+	if c := compareRecords(a, b, t.filter); c != 0 {
+		return c < 0
+	}
+	if t.filter.ascending() {
+		return seqA < seqB
+	}
+	return seqA > seqB
+}
+
+// add offers a record, dropping it or the last kept one when n are kept
+func (t *topRecords) add(record *Record) {
+	defer func() { t.added++ }()
+	if t.n <= 0 {
+		return
+	}
+	if len(t.records) < t.n {
+		heap.Push(t, record)
+		return
+	}
+	if t.before(record, t.added, t.records[0], t.seqs[0]) {
+		t.records[0], t.seqs[0] = record, t.added
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns the kept records in the filter's order
+func (t *topRecords) sorted() []*Record {
+	records := make([]*Record, len(t.records))
+	for i := len(records) - 1; i >= 0; i-- {
+		records[i] = heap.Pop(t).(*Record)
+	}
+	return records
+}
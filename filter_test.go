@@ -0,0 +1,911 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCondition_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition Condition
+		wantErr   bool
+	}{
+		{"in", In("event_type", "login_failed"), false},
+		{"not in", NotIn("result", "success", "failure"), false},
+		{"prefix", HasPrefix("user_id", "svc_"), false},
+		{"not prefix", NotHasPrefix("channel", "e"), false},
+		{"cidr", InCIDR("10.0.0.0/8", "2001:db8::/32", "192.168.1.1"), false},
+		{"not cidr", NotInCIDR("172.16.0.0/12"), false},
+		{"unknown field", In("reason", "x"), true},
+		{"no values", In("event_type"), true},
+		{"unknown op", Condition{Field: "user_id", Op: "like", Values: []string{"a"}}, true},
+		{"cidr on non-ip field", Condition{Field: "user_id", Op: OpCIDR, Values: []string{"10.0.0.0/8"}}, true},
+		{"invalid cidr", InCIDR("10.0.0.0/33"), true},
+		{"invalid address", NotInCIDR("not-an-ip"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DefaultQueryFilter().Where(tt.condition).Validate()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidFilter)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestIPInRanges(t *testing.T) {
+	tests := []struct {
+		ip       string
+		ranges   []string
+		expected bool
+	}{
+		{"10.1.2.3", []string{"10.0.0.0/8"}, true},
+		{"11.1.2.3", []string{"10.0.0.0/8"}, false},
+		{"172.31.255.255", []string{"172.16.0.0/12"}, true},
+		{"172.32.0.1", []string{"172.16.0.0/12"}, false},
+		{"2001:db8::1", []string{"2001:db8::/32"}, true},
+		{"2001:db9::1", []string{"2001:db8::/32"}, false},
+		{"192.168.1.1", []string{"192.168.1.1"}, true},
+		{"192.168.1.0/24", []string{"192.168.0.0/16"}, true},
+		{"192.168.1.0/24", []string{"192.168.1.0/25"}, false},
+		{"::ffff:10.0.0.1", []string{"10.0.0.0/8"}, false},
+		{"10.0.0.1:8080", []string{"10.0.0.0/8"}, true},
+		{"10.0.0.1:8080", []string{"10.0.0.1"}, true},
+		{"[2001:db8::1]:443", []string{"2001:db8::/32"}, true},
+		{"", []string{"0.0.0.0/0"}, false},
+		{"garbage", []string{"0.0.0.0/0"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ipInRanges(tt.ip, tt.ranges))
+		})
+	}
+}
+
+func TestIPv4Pattern(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		pattern string
+		exact   bool
+	}{
+		{"10.0.0.0/8", "10.%", true},
+		{"192.168.1.0/24", "192.168.1.%", true},
+		{"172.16.0.0/12", "172.%", false},
+		{"192.168.1.8/30", "192.168.1.%", false},
+		{"128.0.0.0/2", "%.%", false},
+		{"0.0.0.0/0", "%.%", false},
+		{"2001:db8::/32", "%:%", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			prefix, err := parseCIDR(tt.cidr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.pattern, ipv4Pattern(prefix))
+			assert.Equal(t, tt.exact, translatesExactly(prefix))
+		})
+	}
+}
+
+func TestSQLWhere_CIDR(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition Condition
+		expected  string
+		args      []interface{}
+		residual  bool
+	}{
+		{
+			name:      "octet ranges",
+			condition: InCIDR("10.0.0.0/8", "203.0.113.9"),
+			expected:  "WHERE (ip LIKE $1 OR ip = $2 OR ip LIKE $3)",
+			args:      []interface{}{"10.%", "203.0.113.9", "203.0.113.9:%"},
+		},
+		{
+			name:      "range inside an octet",
+			condition: InCIDR("172.16.0.0/12"),
+			expected:  "WHERE (ip LIKE $1)",
+			args:      []interface{}{"172.%"},
+			residual:  true,
+		},
+		{
+			name:      "not in octet ranges",
+			condition: NotInCIDR("192.168.0.0/16"),
+			expected:  "WHERE NOT (COALESCE(ip, '') LIKE $1)",
+			args:      []interface{}{"192.168.%"},
+		},
+		{
+			name:      "not in ipv6 and narrow ranges",
+			condition: NotInCIDR("2001:db8::/32", "192.168.1.0/25", "10.0.0.0/8"),
+			expected:  "WHERE NOT (COALESCE(ip, '') LIKE $1)",
+			args:      []interface{}{"10.%"},
+			residual:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where := &sqlWhere{dialect: PostgresDialect{}}
+			where.addCondition(tt.condition)
+			assert.Equal(t, tt.expected, where.String())
+			assert.Equal(t, tt.args, where.args)
+			if tt.residual {
+				assert.Equal(t, &QueryFilter{Conditions: []Condition{tt.condition}}, where.residualFilter())
+			} else {
+				assert.Nil(t, where.residualFilter())
+			}
+		})
+	}
+}
+
+// conditionFixtures returns records e1..e10, e10 being the newest
+func conditionFixtures() []*Record {
+	base := time.Now().Unix() - 1000
+	specs := []struct {
+		eventType EventType
+		userID    string
+		channel   string
+		ip        string
+		metadata  map[string]interface{}
+	}{
+		{EventLoginFailed, "alice", "sms", "10.0.0.5", map[string]interface{}{"tenant_id": "acme", "attempts": 3}},
+		{EventAccessDenied, "bob", "email", "203.0.113.7", map[string]interface{}{"tenant_id": "acme", "attempts": 1, "vip": true}},
+		{EventLoginFailed, "carol", "", "192.168.1.20:8080", map[string]interface{}{"tenant_id": "globex", "attempts": 5.5}},
+		{EventLoginSuccess, "alice", "", "203.0.113.9", map[string]interface{}{"tenant_id": 42}},
+		{EventAccessDenied, "dave", "", "2001:db8::1", map[string]interface{}{"app_id": nil}},
+		{EventLoginFailed, "erin", "", "2001:db9::1", map[string]interface{}{"tenant_id": "ACME", "attempts": "3"}},
+		{EventAccessDenied, "frank", "", "172.20.1.1:443", nil},
+		{EventLoginFailed, "", "", "", nil},
+		{EventSendFailed, "admin_x", "", "172.32.0.1", nil},
+		{EventLoginFailed, "alice2", "", "192.168.1.0/24", nil},
+	}
+	records := make([]*Record, len(specs))
+	for i, spec := range specs {
+		r := NewRecord(spec.eventType, ResultFailure).
+			WithUserID(spec.userID).
+			WithChannel(spec.channel).
+			WithIP(spec.ip)
+		r.EventID = fmt.Sprintf("e%d", i+1)
+		r.Metadata = spec.metadata
+		r.Timestamp = base + int64(i)
+		records[i] = r
+	}
+	return records
+}
+
+// newConditionBackends returns every storage backend filled with conditionFixtures
+func newConditionBackends(t *testing.T) map[string]Storage {
+	t.Helper()
+	return newFilledBackends(t, conditionFixtures())
+}
+
+// newFilledBackends returns every storage backend filled with records
+func newFilledBackends(t *testing.T, records []*Record) map[string]Storage {
+	t.Helper()
+	ctx := context.Background()
+
+	fileStorage, err := NewFileStorage(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = fileStorage.Close() })
+
+	client, mr := newTestRedisClient(t)
+	t.Cleanup(mr.Close)
+	redisStorage := NewRedisStorage(client)
+	t.Cleanup(func() { _ = redisStorage.Close() })
+
+	db := newTestSQLiteDB(t)
+	t.Cleanup(func() { _ = db.Close() })
+	sqliteStorage, err := NewDatabaseStorageFromDB(db, "sqlite", nil)
+	require.NoError(t, err)
+
+	for _, r := range records {
+		require.NoError(t, fileStorage.Write(ctx, r))
+		require.NoError(t, redisStorage.Write(ctx, r))
+		require.NoError(t, sqliteStorage.Write(ctx, r))
+	}
+
+	return map[string]Storage{
+		"file":   fileStorage,
+		"redis":  redisStorage,
+		"sqlite": sqliteStorage,
+		// Same table, queried with $n placeholders
+		"postgres-dialect": &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs"},
+	}
+}
+
+func TestQueryFilter_Conditions_AllBackends(t *testing.T) {
+	backends := newConditionBackends(t)
+
+	tests := []struct {
+		name     string
+		filter   *QueryFilter
+		expected []string
+	}{
+		{
+			name: "event types except internal networks",
+			filter: DefaultQueryFilter().Where(
+				In("event_type", string(EventLoginFailed), string(EventAccessDenied)),
+				NotInCIDR("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"),
+			),
+			expected: []string{"e8", "e6", "e5", "e2"},
+		},
+		{
+			name:     "not in",
+			filter:   DefaultQueryFilter().Where(NotIn("event_type", string(EventLoginFailed), string(EventAccessDenied))),
+			expected: []string{"e9", "e4"},
+		},
+		{
+			name:     "prefix",
+			filter:   DefaultQueryFilter().Where(HasPrefix("user_id", "ali")),
+			expected: []string{"e10", "e4", "e1"},
+		},
+		{
+			name:     "prefix is case-sensitive",
+			filter:   DefaultQueryFilter().Where(HasPrefix("user_id", "ALI")),
+			expected: nil,
+		},
+		{
+			name:     "not prefix",
+			filter:   DefaultQueryFilter().Where(NotHasPrefix("user_id", "ali", "admin_")),
+			expected: []string{"e8", "e7", "e6", "e5", "e3", "e2"},
+		},
+		{
+			name:     "in with empty value",
+			filter:   DefaultQueryFilter().Where(In("user_id", "", "bob")),
+			expected: []string{"e8", "e2"},
+		},
+		{
+			name:     "not in with empty field",
+			filter:   DefaultQueryFilter().Where(NotIn("channel", "sms"), In("event_type", string(EventAccessDenied))),
+			expected: []string{"e7", "e5", "e2"},
+		},
+		{
+			name:     "ipv4 cidr",
+			filter:   DefaultQueryFilter().Where(InCIDR("172.16.0.0/12")),
+			expected: []string{"e7"},
+		},
+		{
+			name:     "masked range inside cidr",
+			filter:   DefaultQueryFilter().Where(InCIDR("192.168.0.0/16")),
+			expected: []string{"e10", "e3"},
+		},
+		{
+			name:     "narrow cidr",
+			filter:   DefaultQueryFilter().Where(InCIDR("192.168.1.0/25")),
+			expected: []string{"e3"},
+		},
+		{
+			name:     "single address",
+			filter:   DefaultQueryFilter().Where(InCIDR("203.0.113.9")),
+			expected: []string{"e4"},
+		},
+		{
+			name:     "ipv6 cidr",
+			filter:   DefaultQueryFilter().Where(InCIDR("2001:db8::/32")),
+			expected: []string{"e5"},
+		},
+		{
+			name:     "mixed families",
+			filter:   DefaultQueryFilter().Where(InCIDR("10.0.0.0/8", "2001:db8::/32")),
+			expected: []string{"e5", "e1"},
+		},
+		{
+			name:     "all ipv4",
+			filter:   DefaultQueryFilter().Where(InCIDR("0.0.0.0/0")),
+			expected: []string{"e10", "e9", "e7", "e4", "e3", "e2", "e1"},
+		},
+		{
+			name:     "not ipv6 cidr with pagination",
+			filter:   DefaultQueryFilter().Where(NotInCIDR("2001:db8::/32")).WithLimit(3).WithOffset(2),
+			expected: []string{"e8", "e7", "e6"},
+		},
+		{
+			name:     "combined with equality fields",
+			filter:   DefaultQueryFilter().WithUserID("alice").Where(In("event_type", string(EventLoginFailed))),
+			expected: []string{"e1"},
+		},
+	}
+
+	for _, tt := range tests {
+		for name, storage := range backends {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				filter := *tt.filter
+				results, err := storage.Query(context.Background(), &filter)
+				require.NoError(t, err)
+
+				var ids []string
+				for _, r := range results {
+					ids = append(ids, r.EventID)
+				}
+				assert.Equal(t, tt.expected, ids)
+			})
+		}
+	}
+}
+
+func TestQueryFilter_Metadata_AllBackends(t *testing.T) {
+	backends := newConditionBackends(t)
+	// JSON operators of the postgres dialect cannot run on SQLite; the
+	// generated SQL is covered by TestSQLWhere_MetadataCondition
+	delete(backends, "postgres-dialect")
+
+	tests := []struct {
+		name     string
+		filter   *QueryFilter
+		expected []string
+	}{
+		{
+			name:     "string equals",
+			filter:   DefaultQueryFilter().WithMetadata("tenant_id", "acme"),
+			expected: []string{"e2", "e1"},
+		},
+		{
+			name:     "string equals is case-sensitive and typed",
+			filter:   DefaultQueryFilter().WithMetadata("tenant_id", "42"),
+			expected: nil,
+		},
+		{
+			name:     "number equals",
+			filter:   DefaultQueryFilter().WithMetadata("tenant_id", 42),
+			expected: []string{"e4"},
+		},
+		{
+			name:     "bool equals",
+			filter:   DefaultQueryFilter().WithMetadata("vip", true),
+			expected: []string{"e2"},
+		},
+		{
+			name:     "bool false",
+			filter:   DefaultQueryFilter().WithMetadata("vip", false),
+			expected: nil,
+		},
+		{
+			name:     "not equals includes missing keys",
+			filter:   DefaultQueryFilter().WhereMetadata(MetadataNotEquals("tenant_id", "acme")),
+			expected: []string{"e10", "e9", "e8", "e7", "e6", "e5", "e4", "e3"},
+		},
+		{
+			name:     "exists with null value",
+			filter:   DefaultQueryFilter().WhereMetadata(MetadataExists("app_id")),
+			expected: []string{"e5"},
+		},
+		{
+			name:     "not exists",
+			filter:   DefaultQueryFilter().WhereMetadata(MetadataNotExists("tenant_id")),
+			expected: []string{"e10", "e9", "e8", "e7", "e5"},
+		},
+		{
+			name:     "greater than skips non-numbers",
+			filter:   DefaultQueryFilter().WhereMetadata(MetadataCompare("attempts", MetaGt, 1)),
+			expected: []string{"e3", "e1"},
+		},
+		{
+			name:     "greater or equal",
+			filter:   DefaultQueryFilter().WhereMetadata(MetadataCompare("attempts", MetaGte, 5.5)),
+			expected: []string{"e3"},
+		},
+		{
+			name:     "less than",
+			filter:   DefaultQueryFilter().WhereMetadata(MetadataCompare("attempts", MetaLt, 3)),
+			expected: []string{"e2"},
+		},
+		{
+			name:     "less or equal",
+			filter:   DefaultQueryFilter().WhereMetadata(MetadataCompare("attempts", MetaLte, 3)),
+			expected: []string{"e2", "e1"},
+		},
+		{
+			name: "combined with conditions",
+			filter: DefaultQueryFilter().
+				Where(In("event_type", string(EventLoginFailed))).
+				WhereMetadata(MetadataExists("tenant_id"), MetadataNotEquals("tenant_id", "globex")),
+			expected: []string{"e6", "e1"},
+		},
+	}
+
+	for _, tt := range tests {
+		for name, storage := range backends {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				filter := *tt.filter
+				results, err := storage.Query(context.Background(), &filter)
+				require.NoError(t, err)
+
+				var ids []string
+				for _, r := range results {
+					ids = append(ids, r.EventID)
+				}
+				assert.Equal(t, tt.expected, ids)
+			})
+		}
+	}
+}
+
+func TestMetadataCondition_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition MetadataCondition
+		wantErr   bool
+	}{
+		{"string", MetadataEquals("tenant_id", "acme"), false},
+		{"number", MetadataEquals("app.id", 7), false},
+		{"bool", MetadataNotEquals("vip", false), false},
+		{"exists", MetadataExists("tenant-id"), false},
+		{"compare", MetadataCompare("attempts", MetaGte, 2), false},
+		{"empty key", MetadataExists(""), true},
+		{"key with quote", MetadataExists("a'b"), true},
+		{"key too long", MetadataExists(strings.Repeat("k", 65)), true},
+		{"nil value", MetadataEquals("tenant_id", nil), true},
+		{"object value", MetadataEquals("tenant_id", map[string]interface{}{}), true},
+		{"string compare", MetadataCondition{Key: "attempts", Op: MetaGt, Value: "3"}, true},
+		{"unknown op", MetadataCondition{Key: "attempts", Op: "between", Value: 1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DefaultQueryFilter().WhereMetadata(tt.condition).Validate()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidFilter)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMetadataNumber(t *testing.T) {
+	for _, v := range []interface{}{int(2), int8(2), int16(2), int32(2), int64(2), uint(2), uint8(2), uint16(2), uint32(2), uint64(2), float32(2), float64(2), json.Number("2")} {
+		n, ok := metadataNumber(v)
+		assert.True(t, ok, "%T", v)
+		assert.Equal(t, float64(2), n)
+	}
+	_, ok := metadataNumber("2")
+	assert.False(t, ok)
+	_, ok = metadataNumber(json.Number("x"))
+	assert.False(t, ok)
+	_, ok = metadataNumber(true)
+	assert.False(t, ok)
+}
+
+func TestSQLWhere_MetadataCondition(t *testing.T) {
+	tests := []struct {
+		dbType    string
+		condition MetadataCondition
+		expected  string
+		args      []interface{}
+	}{
+		{
+			dbType:    "postgres",
+			condition: MetadataEquals("tenant_id", "acme"),
+			expected:  "WHERE metadata @> $1::jsonb AND (jsonb_typeof(metadata->'tenant_id') = 'string' AND metadata->>'tenant_id' = $2)",
+			args:      []interface{}{`{"tenant_id":"acme"}`, "acme"},
+		},
+		{
+			dbType:    "postgres",
+			condition: MetadataEquals("attempts", 3),
+			expected:  "WHERE CASE WHEN jsonb_typeof(metadata->'attempts') IN ('number') THEN (metadata->>'attempts')::numeric = $1 ELSE FALSE END",
+			args:      []interface{}{float64(3)},
+		},
+		{
+			dbType:    "postgres",
+			condition: MetadataCompare("attempts", MetaGt, 3),
+			expected:  "WHERE CASE WHEN jsonb_typeof(metadata->'attempts') IN ('number') THEN (metadata->>'attempts')::numeric > $1 ELSE FALSE END",
+			args:      []interface{}{float64(3)},
+		},
+		{
+			dbType:    "postgres",
+			condition: MetadataNotEquals("vip", true),
+			expected:  "WHERE NOT COALESCE((jsonb_typeof(metadata->'vip') = 'boolean' AND metadata->>'vip' = 'true'), FALSE)",
+		},
+		{
+			dbType:    "postgres",
+			condition: MetadataExists("app_id"),
+			expected:  "WHERE jsonb_typeof(metadata->'app_id') IS NOT NULL",
+		},
+		{
+			dbType:    "mysql",
+			condition: MetadataEquals("tenant_id", "acme"),
+			expected:  `WHERE (JSON_TYPE(JSON_EXTRACT(metadata, '$."tenant_id"')) = 'STRING' AND JSON_UNQUOTE(JSON_EXTRACT(metadata, '$."tenant_id"')) = ?)`,
+			args:      []interface{}{"acme"},
+		},
+		{
+			dbType:    "mysql",
+			condition: MetadataCompare("attempts", MetaLte, 2),
+			expected:  `WHERE (JSON_TYPE(JSON_EXTRACT(metadata, '$."attempts"')) IN ('INTEGER', 'UNSIGNED INTEGER', 'DOUBLE', 'DECIMAL') AND JSON_EXTRACT(metadata, '$."attempts"') <= ?)`,
+			args:      []interface{}{float64(2)},
+		},
+		{
+			dbType:    "mysql",
+			condition: MetadataNotExists("app_id"),
+			expected:  `WHERE JSON_TYPE(JSON_EXTRACT(metadata, '$."app_id"')) IS NULL`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dbType+"/"+string(tt.condition.Op), func(t *testing.T) {
+			w := &sqlWhere{dialect: mustDialect(t, tt.dbType)}
+			w.addMetadataCondition(tt.condition)
+			assert.Equal(t, tt.expected, w.String())
+			assert.Equal(t, tt.args, w.args)
+		})
+	}
+}
+
+func TestQueryFilter_LookupFields_AllBackends(t *testing.T) {
+	backends := newConditionBackends(t)
+	ctx := context.Background()
+
+	base := time.Now().Unix() - 100
+	for i, provider := range []string{"aliyun", "twilio"} {
+		r := NewRecord(EventSendFailed, ResultFailure).
+			WithChannel("sms").
+			WithDestination(fmt.Sprintf("138****800%d", i)).
+			WithProvider(provider, fmt.Sprintf("msg_%d", i)).
+			WithRequestID(fmt.Sprintf("req_%d", i)).
+			WithTraceID(fmt.Sprintf("trace_%d", i)).
+			WithPurpose("login").
+			WithResource(fmt.Sprintf("/otp/%d", i))
+		r.EventID = fmt.Sprintf("send%d", i)
+		r.Timestamp = base + int64(i)
+		for name, storage := range backends {
+			if name == "postgres-dialect" {
+				continue // shares the sqlite table
+			}
+			require.NoError(t, storage.Write(ctx, r))
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filter   *QueryFilter
+		expected []string
+	}{
+		{"event id", DefaultQueryFilter().WithEventID("send1"), []string{"send1"}},
+		{"request id", DefaultQueryFilter().WithRequestID("req_0"), []string{"send0"}},
+		{"trace id", DefaultQueryFilter().WithTraceID("trace_1"), []string{"send1"}},
+		{"provider", DefaultQueryFilter().WithProvider("twilio"), []string{"send1"}},
+		{"provider message id", DefaultQueryFilter().WithProviderMessageID("msg_0"), []string{"send0"}},
+		{"purpose", DefaultQueryFilter().WithPurpose("login"), []string{"send1", "send0"}},
+		{"resource", DefaultQueryFilter().WithResource("/otp/0"), []string{"send0"}},
+		{"destination", DefaultQueryFilter().WithDestination("138****8001"), []string{"send1"}},
+		{"no match", DefaultQueryFilter().WithProvider("aliyun").WithTraceID("trace_1"), nil},
+		{"condition", DefaultQueryFilter().Where(HasPrefix("resource", "/otp/"), NotIn("provider", "aliyun")), []string{"send1"}},
+	}
+
+	for _, tt := range tests {
+		for name, storage := range backends {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				filter := *tt.filter
+				results, err := storage.Query(ctx, &filter)
+				require.NoError(t, err)
+
+				var ids []string
+				for _, r := range results {
+					ids = append(ids, r.EventID)
+				}
+				assert.Equal(t, tt.expected, ids)
+			})
+		}
+	}
+}
+
+func TestQueryFilter_Sort_AllBackends(t *testing.T) {
+	backends := newConditionBackends(t)
+	backends["multi"] = NewMultiStorage(backends["file"], backends["redis"])
+	ctx := context.Background()
+
+	// s1..s5 in one session; durations and event types tie to exercise the
+	// timestamp tie-break
+	base := time.Now().Unix() - 100
+	specs := []struct {
+		eventType  EventType
+		durationMS int64
+	}{
+		{EventChallengeCreated, 300},
+		{EventSendSuccess, 100},
+		{EventChallengeVerified, 300},
+		{EventSendSuccess, 50},
+		{EventLoginSuccess, 0},
+	}
+	for i, spec := range specs {
+		r := NewRecord(spec.eventType, ResultSuccess).WithSessionID("sess_sort").WithDuration(spec.durationMS)
+		r.EventID = fmt.Sprintf("s%d", i+1)
+		r.Timestamp = base + int64(i)
+		for _, name := range []string{"file", "redis", "sqlite"} {
+			require.NoError(t, backends[name].Write(ctx, r))
+		}
+	}
+
+	session := func() *QueryFilter { return DefaultQueryFilter().WithSessionID("sess_sort") }
+	tests := []struct {
+		name     string
+		filter   *QueryFilter
+		expected []string
+	}{
+		{"default newest first", session(), []string{"s5", "s4", "s3", "s2", "s1"}},
+		{"timestamp ascending", session().WithSort(SortByTimestamp, SortAsc), []string{"s1", "s2", "s3", "s4", "s5"}},
+		{"ascending pages", session().WithSort("", SortAsc).WithLimit(2).WithOffset(2), []string{"s3", "s4"}},
+		{"duration descending", session().WithSort(SortByDuration, SortDesc), []string{"s3", "s1", "s2", "s4", "s5"}},
+		{"duration ascending", session().WithSort(SortByDuration, SortAsc), []string{"s5", "s4", "s2", "s1", "s3"}},
+		{"event type ascending", session().WithSort(SortByEventType, SortAsc), []string{"s1", "s3", "s5", "s2", "s4"}},
+		{"event type descending", session().WithSort(SortByEventType, ""), []string{"s4", "s2", "s5", "s3", "s1"}},
+		{"duration with limit", session().WithSort(SortByDuration, SortDesc).WithLimit(1).WithOffset(1), []string{"s1"}},
+	}
+
+	for _, tt := range tests {
+		for name, storage := range backends {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				filter := *tt.filter
+				results, err := storage.Query(ctx, &filter)
+				require.NoError(t, err)
+
+				var ids []string
+				for _, r := range results {
+					ids = append(ids, r.EventID)
+				}
+				assert.Equal(t, tt.expected, ids)
+			})
+		}
+	}
+}
+
+// TestTopRecords checks that keeping only one page of records yields the
+// same results, ties included, as sorting every record
+func TestTopRecords(t *testing.T) {
+	// Few distinct keys, so most records tie
+	var records []*Record
+	for i := 0; i < 40; i++ {
+		r := NewRecord([]EventType{EventLoginSuccess, EventLogout}[i%2], ResultSuccess).WithDuration(int64(i % 3))
+		r.EventID = fmt.Sprintf("r%d", i)
+		r.Timestamp = int64(i % 5)
+		records = append(records, r)
+	}
+
+	for _, sortBy := range []string{SortByTimestamp, SortByDuration, SortByEventType} {
+		for _, order := range []string{SortAsc, SortDesc} {
+			for _, page := range [][2]int{{0, 1}, {0, 10}, {7, 5}, {35, 10}, {50, 10}} {
+				filter := DefaultQueryFilter().WithSort(sortBy, order).WithOffset(page[0]).WithLimit(page[1])
+
+				// The sort of every record, in insertion order for the direction
+				all := slices.Clone(records)
+				if !filter.ascending() {
+					slices.Reverse(all)
+				}
+				sortRecords(all, filter)
+				var want []*Record
+				if page[0] < len(all) {
+					want = all[page[0]:min(page[0]+page[1], len(all))]
+				}
+
+				top := newTopRecords(filter, page[0]+page[1])
+				for _, r := range records {
+					top.add(r)
+				}
+				var got []*Record
+				if sorted := top.sorted(); page[0] < len(sorted) {
+					got = sorted[page[0]:]
+				}
+				assert.Equal(t, want, got, "%s %s %v", sortBy, order, page)
+			}
+		}
+	}
+}
+
+func TestQueryFilter_Validate_Sort(t *testing.T) {
+	assert.NoError(t, DefaultQueryFilter().WithSort(SortByDuration, SortAsc).Validate())
+	assert.ErrorIs(t, DefaultQueryFilter().WithSort("user_id", SortAsc).Validate(), ErrInvalidFilter)
+	assert.ErrorIs(t, DefaultQueryFilter().WithSort(SortByTimestamp, "up").Validate(), ErrInvalidFilter)
+}
+
+func TestQueryFilter_Conditions_InvalidFilter(t *testing.T) {
+	for name, storage := range newConditionBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := storage.Query(context.Background(), DefaultQueryFilter().Where(In("reason", "x")))
+			assert.ErrorIs(t, err, ErrInvalidFilter)
+
+			_, err = storage.Query(context.Background(), DefaultQueryFilter().WithMetadata("bad key", "x"))
+			assert.ErrorIs(t, err, ErrInvalidFilter)
+		})
+	}
+}
+
+func TestRedisStorage_Query_ScansPastFirstBatch(t *testing.T) {
+	client, mr := newTestRedisClient(t)
+	defer mr.Close()
+	storage := NewRedisStorage(client)
+	defer func() { _ = storage.Close() }()
+
+	ctx := context.Background()
+	base := time.Now().Unix() - 1000
+	target := NewRecord(EventAccessDenied, ResultFailure).WithIP("10.0.0.1")
+	target.EventID = "target"
+	target.Timestamp = base
+	require.NoError(t, storage.Write(ctx, target))
+	for i := 0; i < 250; i++ {
+		r := NewRecord(EventLoginSuccess, ResultSuccess)
+		r.EventID = fmt.Sprintf("noise%d", i)
+		r.Timestamp = base + 1 + int64(i)
+		require.NoError(t, storage.Write(ctx, r))
+	}
+
+	results, err := storage.Query(ctx, DefaultQueryFilter().WithLimit(1).Where(InCIDR("10.0.0.0/8")))
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "target", results[0].EventID)
+}
+
+func TestParseCIDR(t *testing.T) {
+	p, err := parseCIDR("10.1.2.3/8")
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.0.0.0/8"), p)
+
+	p, err = parseCIDR("2001:db8::1")
+	require.NoError(t, err)
+	assert.Equal(t, 128, p.Bits())
+
+	_, err = parseCIDR("10.0.0.0/40")
+	assert.Error(t, err)
+}
+
+func TestQueryFilter_Text_AllBackends(t *testing.T) {
+	base := time.Now().Unix() - 1000
+	specs := []struct {
+		eventType EventType
+		reason    string
+		userAgent string
+		resource  string
+		metadata  map[string]interface{}
+	}{
+		{EventSendFailed, "Provider error: Quota Exceeded for project 42", "", "", nil},
+		{EventLoginSuccess, "", "Mozilla/5.0 (X11; Linux)", "", nil},
+		{EventAccessDenied, "", "", "/api/v1/100%_done", nil},
+		{EventSendFailed, "", "", "", map[string]interface{}{"provider_error": map[string]interface{}{"detail": "quota exceeded (daily)"}}},
+		{EventSendFailed, "", "", "", map[string]interface{}{"codes": []interface{}{"E_QUOTA", 7}}},
+		{EventSendFailed, "", "", "", map[string]interface{}{"quota exceeded": 1}},
+		{EventSendSuccess, "ok", "", "", nil},
+	}
+	records := make([]*Record, len(specs))
+	for i, spec := range specs {
+		r := NewRecord(spec.eventType, ResultFailure).WithReason(spec.reason).WithResource(spec.resource)
+		r.UserAgent = spec.userAgent
+		r.EventID = fmt.Sprintf("t%d", i+1)
+		r.Metadata = spec.metadata
+		r.Timestamp = base + int64(i)
+		records[i] = r
+	}
+	backends := newFilledBackends(t, records)
+	// ILIKE and jsonb functions cannot run on SQLite; the generated SQL is
+	// covered by TestSQLWhere_Text
+	delete(backends, "postgres-dialect")
+
+	tests := []struct {
+		name     string
+		filter   *QueryFilter
+		query    string
+		expected []string
+	}{
+		{name: "fragment in reason and nested metadata", filter: DefaultQueryFilter().WithText("quota exceeded"), expected: []string{"t4", "t1"}},
+		{name: "case-insensitive", filter: DefaultQueryFilter().WithText("QUOTA"), expected: []string{"t5", "t4", "t1"}},
+		{name: "user agent", filter: DefaultQueryFilter().WithText("mozilla/5"), expected: []string{"t2"}},
+		{name: "trimmed", filter: DefaultQueryFilter().WithText("  linux)  "), expected: []string{"t2"}},
+		{name: "like wildcards are literal", filter: DefaultQueryFilter().WithText("0%_d"), expected: []string{"t3"}},
+		{name: "percent does not match anything", filter: DefaultQueryFilter().WithText("a%"), expected: nil},
+		{name: "underscore does not match anything", filter: DefaultQueryFilter().WithText("v_"), expected: nil},
+		{name: "numbers and keys are not searched", filter: DefaultQueryFilter().WithText("7"), expected: nil},
+		{name: "combined with fields", filter: DefaultQueryFilter().WithText("quota").WithEventType(string(EventSendFailed)).WithLimit(1), expected: []string{"t5"}},
+		{name: "blank text", filter: DefaultQueryFilter().WithText("  ").WithEventType(string(EventSendSuccess)), expected: []string{"t7"}},
+		{name: "negated phrase", query: `quota -"exceeded (daily)"`, expected: []string{"t5", "t1"}},
+		{name: "phrase or field", query: `"quota exceeded" OR event_type:login_success`, expected: []string{"t4", "t2", "t1"}},
+	}
+
+	for _, tt := range tests {
+		for name, storage := range backends {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				filter := tt.filter
+				if tt.query != "" {
+					var err error
+					filter, err = CompileQuery(tt.query)
+					require.NoError(t, err)
+				} else {
+					copied := *tt.filter
+					filter = &copied
+				}
+				results, err := storage.Query(context.Background(), filter)
+				require.NoError(t, err)
+
+				var ids []string
+				for _, r := range results {
+					ids = append(ids, r.EventID)
+				}
+				assert.Equal(t, tt.expected, ids)
+			})
+		}
+	}
+}
+
+func TestSQLWhere_Text(t *testing.T) {
+	tests := []struct {
+		name      string
+		dbType    string
+		textIndex bool
+		text      string
+		expected  string
+		args      []interface{}
+	}{
+		{
+			name:     "postgres",
+			dbType:   "postgres",
+			text:     "Quota 100%",
+			expected: `WHERE (reason ILIKE $1 ESCAPE '!' OR user_agent ILIKE $2 ESCAPE '!' OR resource ILIKE $3 ESCAPE '!' OR EXISTS (SELECT 1 FROM jsonb_path_query(metadata, 'strict $.**') AS m(v) WHERE jsonb_typeof(m.v) = 'string' AND m.v #>> '{}' ILIKE $4 ESCAPE '!'))`,
+			args:     []interface{}{"%quota 100!%%", "%quota 100!%%", "%quota 100!%%", "%quota 100!%%"},
+		},
+		{
+			name:      "postgres with tsvector index",
+			dbType:    "postgres",
+			textIndex: true,
+			text:      "sms quota exceeded for tenant",
+			expected:  `WHERE ` + postgresTextVector + ` @@ to_tsquery('simple', $5) AND (reason ILIKE $1`,
+			args:      []interface{}{"quota & exceeded & for"},
+		},
+		{
+			name:      "postgres index needs inner words",
+			dbType:    "postgres",
+			textIndex: true,
+			text:      "quota exceeded",
+			expected:  `WHERE (reason ILIKE $1`,
+		},
+		{
+			name:     "mysql",
+			dbType:   "mysql",
+			text:     "a_b!",
+			expected: `WHERE (LOWER(reason) LIKE ? ESCAPE '!' OR LOWER(user_agent) LIKE ? ESCAPE '!' OR LOWER(resource) LIKE ? ESCAPE '!' OR JSON_SEARCH(LOWER(metadata), 'one', ?, '!') IS NOT NULL)`,
+			args:     []interface{}{"%a!_b!!%"},
+		},
+		{
+			name:     "sqlite",
+			dbType:   "sqlite",
+			text:     "quota",
+			expected: `OR EXISTS (SELECT 1 FROM json_tree(CASE WHEN json_valid(metadata) THEN metadata END) WHERE type = 'text' AND LOWER(value) LIKE ? ESCAPE '!'))`,
+		},
+		{
+			name:   "blank",
+			dbType: "sqlite",
+			text:   " ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where := &sqlWhere{dialect: mustDialect(t, tt.dbType), textIndex: tt.textIndex}
+			where.addText(tt.text)
+			if tt.expected == "" {
+				assert.Empty(t, where.String())
+				return
+			}
+			assert.Contains(t, where.String(), tt.expected)
+			for _, arg := range tt.args {
+				assert.Contains(t, where.args, arg)
+			}
+		})
+	}
+}
+
+func TestQueryFilter_Validate_Text(t *testing.T) {
+	assert.NoError(t, DefaultQueryFilter().WithText(strings.Repeat("a", maxTextLen)).Validate())
+	assert.ErrorIs(t, DefaultQueryFilter().WithText(strings.Repeat("a", maxTextLen+1)).Validate(), ErrInvalidFilter)
+	assert.ErrorIs(t, DefaultQueryFilter().WhereExpr(&Expr{Not: &Expr{Text: strings.Repeat("a", maxTextLen+1)}}).Validate(), ErrInvalidFilter)
+}
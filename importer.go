@@ -0,0 +1,454 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// defaultImportBatchSize is the number of records Importer loads per batch
+const defaultImportBatchSize = 1000
+
+// ImportConfig holds configuration for Importer
+type ImportConfig struct {
+	// BatchSize is the number of records loaded and checkpointed at a
+	// time (default: 1000)
+	BatchSize int
+
+	// CheckpointFile records how far each source was imported, so an
+	// interrupted import resumes after the last loaded batch. Empty
+	// disables checkpoints.
+	CheckpointFile string
+
+	// SkipDuplicates skips records whose EventID is already in the table
+	// or earlier in the batch. Records without EventID are always loaded.
+	// It is best-effort: the table is checked before each batch is loaded,
+	// without a unique constraint, so it only holds for a single importer
+	// with no other writers of the same EventIDs meanwhile.
+	SkipDuplicates bool
+
+	// ReadMode selects whether lines that are not valid records are
+	// counted and skipped (ReadLenient) or stop the import (ReadStrict)
+	ReadMode ReadMode
+
+	// Progress is called after each loaded batch and when a source is done
+	Progress func(ImportProgress)
+}
+
+// DefaultImportConfig returns default import configuration
+func DefaultImportConfig() *ImportConfig {
+	return &ImportConfig{
+		BatchSize:      defaultImportBatchSize,
+		SkipDuplicates: true,
+	}
+}
+
+// ImportProgress describes how far the import of one source got
+type ImportProgress struct {
+	Source     string `json:"source"`
+	Offset     int64  `json:"offset"`         // Bytes of the source processed
+	Size       int64  `json:"size,omitempty"` // Source size in bytes, 0 if unknown
+	Imported   int64  `json:"imported"`       // Records loaded
+	Duplicates int64  `json:"duplicates"`     // Records skipped by SkipDuplicates
+	Invalid    int64  `json:"invalid"`        // Lines skipped as not valid records
+	Done       bool   `json:"done"`
+}
+
+// Importer loads JSON Lines audit files, as written by FileStorage, into a
+// DatabaseStorage: with COPY on PostgreSQL through lib/pq (see CopyDialect)
+// and multi-row INSERT elsewhere. Each batch is loaded, then checkpointed; records of a
+// batch interrupted by a crash are loaded again on resume, which
+// SkipDuplicates absorbs for records with an EventID.
+type Importer struct {
+	storage *DatabaseStorage
+	config  *ImportConfig
+
+	mu          sync.Mutex
+	checkpoints map[string]ImportProgress
+}
+
+// NewImporter creates an importer into storage with the default config
+func NewImporter(storage *DatabaseStorage) *Importer {
+	return NewImporterWithConfig(storage, nil)
+}
+
+// NewImporterWithConfig creates an importer into storage with config
+func NewImporterWithConfig(storage *DatabaseStorage, config *ImportConfig) *Importer {
+	if config == nil {
+		config = DefaultImportConfig()
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultImportBatchSize
+	}
+	return &Importer{storage: storage, config: config}
+}
+
+// ImportFile imports the JSON Lines file at path, resuming from its
+// checkpoint. The path is the checkpoint key, so keep it stable across runs.
+func (im *Importer) ImportFile(ctx context.Context, path string) (*ImportProgress, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open import file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat import file: %w", err)
+	}
+	progress, err := im.checkpoint(path)
+	if err != nil {
+		return nil, err
+	}
+	if progress.Offset > info.Size() {
+		return nil, fmt.Errorf("checkpoint of %s is past its end (%d > %d bytes); the file was replaced", path, progress.Offset, info.Size())
+	}
+	if _, err := file.Seek(progress.Offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek import file: %w", err)
+	}
+	progress.Size = info.Size()
+	return im.run(ctx, file, progress)
+}
+
+// Import imports JSON Lines from r under the checkpoint key source. When
+// resuming, the already imported bytes are read from r and discarded.
+func (im *Importer) Import(ctx context.Context, source string, r io.Reader) (*ImportProgress, error) {
+	progress, err := im.checkpoint(source)
+	if err != nil {
+		return nil, err
+	}
+	if progress.Offset > 0 {
+		if _, err := io.CopyN(io.Discard, r, progress.Offset); err != nil {
+			return nil, fmt.Errorf("failed to skip to checkpoint of %s: %w", source, err)
+		}
+	}
+	return im.run(ctx, r, progress)
+}
+
+// run imports the lines of r, which starts at progress.Offset
+func (im *Importer) run(ctx context.Context, r io.Reader, progress ImportProgress) (*ImportProgress, error) {
+	reader := bufio.NewReader(r)
+	batch := make([]*Record, 0, im.config.BatchSize)
+	offset := progress.Offset
+
+	flush := func() error {
+		if len(batch) > 0 {
+			loaded, duplicates, err := im.load(ctx, batch)
+			if err != nil {
+				return err
+			}
+			progress.Imported += loaded
+			progress.Duplicates += duplicates
+			batch = batch[:0]
+		}
+		progress.Offset = offset
+		if err := im.saveCheckpoint(progress); err != nil {
+			return err
+		}
+		if im.config.Progress != nil {
+			im.config.Progress(progress)
+		}
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return &progress, err
+		}
+
+		data, n, readErr := readImportLine(reader, MaxRecordJSONSize)
+		if readErr != nil && readErr != io.EOF {
+			return &progress, fmt.Errorf("failed to read %s: %w", progress.Source, readErr)
+		}
+		start := offset
+		offset += n
+
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 {
+			record, err := parseImportLine(trimmed)
+			if err != nil {
+				if im.config.ReadMode == ReadStrict {
+					return &progress, fmt.Errorf("invalid record at byte %d of %s: %w", start, progress.Source, err)
+				}
+				log.Printf("[audit] Skipping invalid record at byte %d of %s: %v", start, progress.Source, err)
+				progress.Invalid++
+			} else {
+				batch = append(batch, record)
+			}
+		}
+
+		if len(batch) >= im.config.BatchSize {
+			if err := flush(); err != nil {
+				return &progress, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	progress.Done = true
+	if err := flush(); err != nil {
+		progress.Done = false
+		return &progress, err
+	}
+	return &progress, nil
+}
+
+// readImportLine reads the next line of r and returns it with its length in
+// r. Only the first max+1 bytes of a longer line are kept, enough for
+// parseImportLine to reject it without buffering the whole line.
+func readImportLine(r *bufio.Reader, max int) ([]byte, int64, error) {
+	var line []byte
+	var n int64
+	for {
+		chunk, err := r.ReadSlice('\n')
+		n += int64(len(chunk))
+		if keep := max + 1 - len(line); keep > 0 {
+			line = append(line, chunk[:min(len(chunk), keep)]...)
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, n, err
+		}
+	}
+}
+
+// parseImportLine decodes one JSON Lines record
+func parseImportLine(line []byte) (*Record, error) {
+	if len(line) > MaxRecordJSONSize {
+		return nil, fmt.Errorf("line exceeds %d bytes", MaxRecordJSONSize)
+	}
+	var record Record
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, err
+	}
+	if record.EventType == "" {
+		return nil, errors.New("missing event_type")
+	}
+	return &record, nil
+}
+
+// load writes a batch and returns the number of records loaded and
+// skipped as duplicates
+func (im *Importer) load(ctx context.Context, batch []*Record) (int64, int64, error) {
+	records := batch
+	if im.config.SkipDuplicates {
+		var err error
+		records, err = im.storage.withoutExistingEventIDs(ctx, batch)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := im.storage.bulkInsert(ctx, records); err != nil {
+		return 0, 0, err
+	}
+	return int64(len(records)), int64(len(batch) - len(records)), nil
+}
+
+// checkpoint returns the saved progress of source, or a fresh one
+func (im *Importer) checkpoint(source string) (ImportProgress, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if err := im.loadCheckpoints(); err != nil {
+		return ImportProgress{}, err
+	}
+	progress, ok := im.checkpoints[source]
+	if !ok {
+		progress = ImportProgress{Source: source}
+	}
+	progress.Done = false
+	return progress, nil
+}
+
+// loadCheckpoints reads the checkpoint file once; mu must be held
+func (im *Importer) loadCheckpoints() error {
+	if im.checkpoints != nil {
+		return nil
+	}
+	im.checkpoints = make(map[string]ImportProgress)
+	if im.config.CheckpointFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(im.config.CheckpointFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read checkpoint file: %w", err)
+	}
+	if err := json.Unmarshal(data, &im.checkpoints); err != nil {
+		return fmt.Errorf("failed to parse checkpoint file: %w", err)
+	}
+	return nil
+}
+
+// saveCheckpoint records progress, replacing the checkpoint file
+// atomically so a crash leaves either the old or the new one
+func (im *Importer) saveCheckpoint(progress ImportProgress) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.checkpoints[progress.Source] = progress
+	if im.config.CheckpointFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(im.checkpoints, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoints: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(im.config.CheckpointFile), filepath.Base(im.config.CheckpointFile)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write checkpoint file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write checkpoint file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write checkpoint file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), im.config.CheckpointFile); err != nil {
+		return fmt.Errorf("failed to write checkpoint file: %w", err)
+	}
+	return nil
+}
+
+// withoutExistingEventIDs drops the records whose EventID is already in
+// the table or earlier in records. The primary is asked, since a replica
+// may not have the previous batch yet. Records written between this check
+// and the insert are not seen, see ImportConfig.SkipDuplicates.
+func (s *DatabaseStorage) withoutExistingEventIDs(ctx context.Context, records []*Record) ([]*Record, error) {
+	var ids []interface{}
+	seen := make(map[string]bool)
+	for _, record := range records {
+		if record.EventID != "" && !seen[record.EventID] {
+			seen[record.EventID] = true
+			ids = append(ids, record.EventID)
+		}
+	}
+
+	// Looked up maxBatchRows at a time to stay within bind limits
+	existing := make(map[string]bool)
+	for start := 0; start < len(ids); start += maxBatchRows {
+		if err := s.existingEventIDs(ctx, ids[start:min(start+maxBatchRows, len(ids))], existing); err != nil {
+			return nil, err
+		}
+	}
+
+	kept := make([]*Record, 0, len(records))
+	for _, record := range records {
+		if record.EventID != "" {
+			if existing[record.EventID] {
+				continue
+			}
+			existing[record.EventID] = true
+		}
+		kept = append(kept, record)
+	}
+	return kept, nil
+}
+
+// existingEventIDs adds the ids that are in the table to existing
+func (s *DatabaseStorage) existingEventIDs(ctx context.Context, ids []interface{}, existing map[string]bool) error {
+	placeholders := make([]string, len(ids))
+	for i := range ids {
+		placeholders[i] = s.dialect.Placeholder(i + 1)
+	}
+	query := fmt.Sprintf("SELECT event_id FROM %s WHERE event_id IN (%s)", s.tableName, strings.Join(placeholders, ", "))
+
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, query, ids...)
+	if err != nil {
+		return fmt.Errorf("failed to look up event IDs: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to look up event IDs: %w", err)
+		}
+		existing[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to look up event IDs: %w", err)
+	}
+	return nil
+}
+
+// supportsCopy reports whether records can be loaded into db with the COPY
+// of dialect; the CopyIn statements are only understood by lib/pq
+func supportsCopy(db *sql.DB, dialect Dialect) bool {
+	if _, ok := dialect.(CopyDialect); !ok {
+		return false
+	}
+	_, ok := db.Driver().(*pq.Driver)
+	return ok
+}
+
+// bulkInsert writes records with COPY when the dialect and driver support
+// it, and with WriteBatch otherwise
+func (s *DatabaseStorage) bulkInsert(ctx context.Context, records []*Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	d, ok := s.dialect.(CopyDialect)
+	if !ok || !s.bulkCopy {
+		return s.WriteBatch(ctx, records)
+	}
+
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, d.CopyIn(s.tableName, recordInsertColumns))
+	if err != nil {
+		return fmt.Errorf("failed to start copy: %w", err)
+	}
+	defer func() { _ = stmt.Close() }()
+	for _, record := range records {
+		args, err := s.recordInsertArgs(record)
+		if err != nil {
+			return err
+		}
+		// COPY would send []byte as bytea; metadata goes as JSON text
+		for i, arg := range args {
+			if b, ok := arg.([]byte); ok {
+				args[i] = nil
+				if b != nil {
+					args[i] = string(b)
+				}
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("failed to copy audit records: %w", err)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("failed to copy audit records: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to copy audit records: %w", err)
+	}
+	return tx.Commit()
+}
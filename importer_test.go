@@ -0,0 +1,296 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestImportFile writes n records with FileStorage, every other one
+// with an EventID, plus an invalid line, and returns the file path
+func writeTestImportFile(t *testing.T, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	fs, err := NewFileStorage(path)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		record := NewRecord(EventLoginSuccess, ResultSuccess).
+			WithUserID(fmt.Sprintf("user-%d", i)).
+			WithMetadata("seq", i).
+			SetTimestamp(int64(1000 + i))
+		if i%2 == 0 {
+			record.EventID = fmt.Sprintf("evt-%d", i)
+		}
+		require.NoError(t, fs.Write(context.Background(), record))
+		if i == 1 {
+			require.NoError(t, fs.Close())
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+			require.NoError(t, err)
+			_, err = f.WriteString("not json\n\n")
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			fs, err = NewFileStorage(path)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, fs.Close())
+	return path
+}
+
+func newTestImportStorage(t *testing.T) *DatabaseStorage {
+	t.Helper()
+	db := newTestSQLiteDB(t)
+	t.Cleanup(func() { _ = db.Close() })
+	s, err := NewDatabaseStorageFromDB(db, "sqlite", nil)
+	require.NoError(t, err)
+	return s
+}
+
+func TestImporter_ImportFile(t *testing.T) {
+	ctx := context.Background()
+	path := writeTestImportFile(t, 5)
+	s := newTestImportStorage(t)
+
+	var updates []ImportProgress
+	config := DefaultImportConfig()
+	config.BatchSize = 2
+	config.Progress = func(p ImportProgress) { updates = append(updates, p) }
+	progress, err := NewImporterWithConfig(s, config).ImportFile(ctx, path)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, ImportProgress{Source: path, Offset: info.Size(), Size: info.Size(), Imported: 5, Invalid: 1, Done: true}, *progress)
+	require.Len(t, updates, 3)
+	assert.Equal(t, int64(2), updates[0].Imported)
+	assert.False(t, updates[0].Done)
+	assert.True(t, updates[2].Done)
+
+	filter := DefaultQueryFilter()
+	filter.SortOrder = SortAsc
+	records, err := s.Query(ctx, filter)
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	assert.Equal(t, "evt-0", records[0].EventID)
+	assert.Equal(t, "user-4", records[4].UserID)
+	assert.Equal(t, float64(3), records[3].Metadata["seq"])
+
+	// Without a checkpoint, records with an EventID are recognized
+	progress, err = NewImporter(s).ImportFile(ctx, path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), progress.Imported)
+	assert.Equal(t, int64(3), progress.Duplicates)
+
+	// Duplicates within one batch are dropped as well
+	lines := `{"event_type":"login_success","result":"success","event_id":"evt-x","timestamp":1}
+{"event_type":"login_success","result":"success","event_id":"evt-x","timestamp":1}
+`
+	progress, err = NewImporter(s).Import(ctx, "inline", strings.NewReader(lines))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), progress.Imported)
+	assert.Equal(t, int64(1), progress.Duplicates)
+}
+
+func TestImporter_Resume(t *testing.T) {
+	path := writeTestImportFile(t, 7)
+	s := newTestImportStorage(t)
+	checkpoints := filepath.Join(t.TempDir(), "checkpoints.json")
+
+	// Interrupt after the first batch
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := &ImportConfig{BatchSize: 3, CheckpointFile: checkpoints, Progress: func(ImportProgress) { cancel() }}
+	progress, err := NewImporterWithConfig(s, config).ImportFile(ctx, path)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int64(3), progress.Imported)
+	assert.False(t, progress.Done)
+
+	config = &ImportConfig{BatchSize: 3, CheckpointFile: checkpoints}
+	progress, err = NewImporterWithConfig(s, config).ImportFile(context.Background(), path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), progress.Imported)
+	assert.Equal(t, int64(1), progress.Invalid)
+	assert.True(t, progress.Done)
+
+	count, err := s.Count(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), count)
+
+	// A finished file is not read again, from a reader either
+	progress, err = NewImporterWithConfig(s, config).ImportFile(context.Background(), path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), progress.Imported)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	progress, err = NewImporterWithConfig(s, config).Import(context.Background(), path, strings.NewReader(string(data)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), progress.Imported)
+	count, err = s.Count(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), count)
+
+	// A replaced, shorter file does not resume at a stale offset
+	require.NoError(t, os.WriteFile(path, []byte("{}\n"), 0600))
+	_, err = NewImporterWithConfig(s, config).ImportFile(context.Background(), path)
+	assert.ErrorContains(t, err, "is past its end")
+}
+
+func TestImporter_Errors(t *testing.T) {
+	ctx := context.Background()
+	s := newTestImportStorage(t)
+
+	tests := []struct {
+		name    string
+		config  *ImportConfig
+		input   string
+		wantErr string
+	}{
+		{
+			name:    "strict invalid json",
+			config:  &ImportConfig{ReadMode: ReadStrict},
+			input:   "{\"event_type\":\"login_success\",\"timestamp\":1}\n{oops\n",
+			wantErr: "invalid record at byte 45 of input",
+		},
+		{
+			name:    "strict missing event type",
+			config:  &ImportConfig{ReadMode: ReadStrict},
+			input:   "{\"timestamp\":1}\n",
+			wantErr: "invalid record at byte 0 of input: missing event_type",
+		},
+		{
+			name:    "unreadable checkpoint",
+			config:  &ImportConfig{CheckpointFile: writeTestFile(t, "checkpoints.json", "[")},
+			input:   "",
+			wantErr: "failed to parse checkpoint file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewImporterWithConfig(s, tt.config).Import(ctx, "input", strings.NewReader(tt.input))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+
+	_, err := NewImporter(s).ImportFile(ctx, filepath.Join(t.TempDir(), "missing.log"))
+	assert.ErrorContains(t, err, "failed to open import file")
+}
+
+// writeTestFile writes content to a file in a temporary directory
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestImporter_PostgresCopy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit.logs", bulkCopy: true}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT event_id FROM audit.logs WHERE event_id IN ($1, $2)")).
+		WithArgs("evt-1", "evt-2").
+		WillReturnRows(sqlmock.NewRows([]string{"event_id"}).AddRow("evt-2"))
+	mock.ExpectBegin()
+	copyIn := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "audit"."logs" ("event_type", "event_id",`))
+	copyIn.ExpectExec().
+		WithArgs("login_success", "evt-1", "", "", "", "", "", "", "", "success", "", "", "", "", "", "", "", int64(10), int64(0), `{"tenant_id":"acme"}`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	copyIn.ExpectExec().
+		WithArgs("login_failed", "", "", "", "", "", "", "", "", "failure", "", "", "", "", "", "", "", int64(11), int64(0), nil).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	copyIn.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	lines := `{"event_type":"login_success","result":"success","event_id":"evt-1","timestamp":10,"metadata":{"tenant_id":"acme"}}
+{"event_type":"login_success","result":"success","event_id":"evt-2","timestamp":10}
+{"event_type":"login_failed","result":"failure","timestamp":11}
+`
+	progress, err := NewImporter(s).Import(context.Background(), "history", strings.NewReader(lines))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), progress.Imported)
+	assert.Equal(t, int64(1), progress.Duplicates)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestImporter_LongLine(t *testing.T) {
+	s := newTestImportStorage(t)
+	long := `{"event_type":"login_success","reason":"` + strings.Repeat("x", MaxRecordJSONSize) + `"}` + "\n"
+	input := "{\"event_type\":\"login_success\",\"timestamp\":1}\n" + long + "{\"event_type\":\"login_failed\",\"timestamp\":2}\n"
+
+	progress, err := NewImporter(s).Import(context.Background(), "input", strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), progress.Imported)
+	assert.Equal(t, int64(1), progress.Invalid)
+	assert.Equal(t, int64(len(input)), progress.Offset)
+}
+
+func TestReadImportLine(t *testing.T) {
+	r := bufio.NewReaderSize(strings.NewReader(strings.Repeat("a", 50)+"\nshort\nlast"), 16)
+
+	// Only max+1 bytes of a long line are kept, but all of it is consumed
+	line, n, err := readImportLine(r, 20)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 21), string(line))
+	assert.Equal(t, int64(51), n)
+
+	line, n, err = readImportLine(r, 20)
+	require.NoError(t, err)
+	assert.Equal(t, "short\n", string(line))
+	assert.Equal(t, int64(6), n)
+
+	line, n, err = readImportLine(r, 20)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, "last", string(line))
+	assert.Equal(t, int64(4), n)
+}
+
+func TestSupportsCopy(t *testing.T) {
+	mockDB, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = mockDB.Close() }()
+	pqDB, err := sql.Open("postgres", "postgres://localhost/audit")
+	require.NoError(t, err)
+	defer func() { _ = pqDB.Close() }()
+
+	assert.True(t, supportsCopy(pqDB, PostgresDialect{}))
+	// Other drivers of the same dialect fall back to multi-row inserts
+	assert.False(t, supportsCopy(mockDB, PostgresDialect{}))
+	assert.False(t, supportsCopy(pqDB, MySQLDialect{}))
+}
+
+func TestDatabaseStorage_WithoutExistingEventIDs_Chunked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs"}
+
+	records := make([]*Record, maxBatchRows+1)
+	for i := range records {
+		records[i] = NewRecord(EventLoginSuccess, ResultSuccess)
+		records[i].EventID = fmt.Sprintf("evt-%d", i)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE event_id IN ($1, $2, ") + ".*" + regexp.QuoteMeta(fmt.Sprintf(", $%d)", maxBatchRows))).
+		WillReturnRows(sqlmock.NewRows([]string{"event_id"}).AddRow("evt-0"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT event_id FROM audit_logs WHERE event_id IN ($1)")).
+		WithArgs(fmt.Sprintf("evt-%d", maxBatchRows)).
+		WillReturnRows(sqlmock.NewRows([]string{"event_id"}).AddRow(fmt.Sprintf("evt-%d", maxBatchRows)))
+
+	kept, err := s.withoutExistingEventIDs(context.Background(), records)
+	require.NoError(t, err)
+	assert.Len(t, kept, maxBatchRows-1)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
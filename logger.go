@@ -2,6 +2,7 @@ package audit
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -15,9 +16,28 @@ type Config struct {
 	// MaskDestination controls whether destinations (phone/email) should be masked
 	MaskDestination bool
 
-	// TTL for Redis/cache storage (0 means use storage default)
+	// Maskers selects the destination masker per channel
+	// (nil uses DefaultMaskerRegistry)
+	Maskers *MaskerRegistry
+
+	// TTL for Redis/cache storage (0 means use storage default). With
+	// Retention set and no policies, other storages keep records this long.
 	TTL time.Duration
 
+	// Retention purges expired records periodically when the storage
+	// implements Purger (nil disables purging)
+	Retention *RetentionConfig
+
+	// PIIScanner masks PII found in Reason, UserAgent and metadata strings
+	// before records are written (nil disables scanning)
+	PIIScanner *PIIScanner
+
+	// Pseudonymizer replaces identifiers (user ID, destination, IP) with stable
+	// tokens before records are written (nil disables pseudonymization).
+	// Records whose tokens cannot be stored in its vault are still written,
+	// see Logger.SetPseudonymizeFailedCallback.
+	Pseudonymizer *Pseudonymizer
+
 	// Writer configuration (for async writing)
 	Writer *WriterConfig
 }
@@ -37,7 +57,10 @@ type Logger struct {
 	config      *Config
 	storage     Storage
 	writer      *Writer
+	retention   *RetentionRunner
 	logCallback func(record *Record)
+
+	pseudonymizeFailedCallback func(record *Record, err error)
 }
 
 // NewLogger creates a new audit logger with storage
@@ -50,6 +73,7 @@ func NewLogger(storage Storage, config *Config) *Logger {
 		config:  config,
 		storage: storage,
 	}
+	logger.startRetention()
 
 	return logger
 }
@@ -63,11 +87,32 @@ func NewLoggerWithWriter(storage Storage, config *Config) *Logger {
 	writer := NewWriter(storage, config.Writer)
 	writer.Start()
 
-	return &Logger{
+	logger := &Logger{
 		config:  config,
 		storage: storage,
 		writer:  writer,
 	}
+	logger.startRetention()
+
+	return logger
+}
+
+// startRetention starts purging expired records if Retention is configured
+func (l *Logger) startRetention() {
+	if l.config.Retention == nil || l.storage == nil {
+		return
+	}
+	config := *l.config.Retention
+	if len(config.Policies) == 0 {
+		config.Policies = []RetentionPolicy{{MaxAge: l.config.TTL}}
+	}
+	runner, err := NewRetentionRunner(l.storage, &config)
+	if err != nil {
+		log.Printf("[audit] Retention disabled: %v", err)
+		return
+	}
+	runner.Start()
+	l.retention = runner
 }
 
 // SetLogCallback sets a callback that is called for each log entry
@@ -76,8 +121,19 @@ func (l *Logger) SetLogCallback(fn func(record *Record)) {
 	l.logCallback = fn
 }
 
+// SetPseudonymizeFailedCallback sets a callback that is called when the
+// tokens of a record cannot be stored in the pseudonym vault. The record is
+// still written with its tokens; fn receives it as passed to Log, so the
+// mapping can be stored again by applying the Pseudonymizer to a copy.
+func (l *Logger) SetPseudonymizeFailedCallback(fn func(record *Record, err error)) {
+	l.pseudonymizeFailedCallback = fn
+}
+
 // Stop stops the logger and releases resources
 func (l *Logger) Stop() error {
+	if l.retention != nil {
+		l.retention.Stop()
+	}
 	if l.writer != nil {
 		return l.writer.Stop()
 	}
@@ -98,14 +154,28 @@ func (l *Logger) Log(ctx context.Context, record *Record) {
 	if cp.Timestamp == 0 {
 		cp.Timestamp = time.Now().Unix()
 	}
-	if l.config.MaskDestination && cp.Destination != "" {
-		cp.Destination = MaskDestination(cp.Destination, cp.Channel)
+	if l.config.PIIScanner != nil {
+		l.config.PIIScanner.Apply(cp)
+	}
+	if p := l.config.Pseudonymizer; p != nil {
+		if err := p.Apply(ctx, cp); err != nil {
+			// The event is kept even if its tokens cannot be resolved yet
+			log.Printf("[audit] Failed to pseudonymize audit record %s: %v", cp.EventType, err)
+			if l.pseudonymizeFailedCallback != nil {
+				l.pseudonymizeFailedCallback(record, err)
+			}
+		}
+	}
+	if l.config.MaskDestination && cp.Destination != "" && !l.isPseudonym(cp.Destination) {
+		cp.Destination = l.maskers().Mask(cp.Destination, cp.Channel)
 	}
 
 	if l.writer != nil {
 		l.writer.Enqueue(cp)
 	} else if l.storage != nil {
-		if err := l.storage.Write(ctx, cp); err != nil {
+		if err := l.storage.Write(ctx, cp); errors.Is(err, ErrPartialWrite) {
+			log.Printf("[audit] Audit record %s: %v", cp.EventType, err)
+		} else if err != nil {
 			log.Printf("[audit] Failed to write audit record: %v", err)
 		}
 	}
@@ -115,6 +185,20 @@ func (l *Logger) Log(ctx context.Context, record *Record) {
 	}
 }
 
+// maskers returns the configured masker registry or the default one
+func (l *Logger) maskers() *MaskerRegistry {
+	if l.config.Maskers != nil {
+		return l.config.Maskers
+	}
+	return defaultMaskerRegistry
+}
+
+// isPseudonym reports whether value is a token from the configured pseudonymizer.
+// Tokens are not masked, otherwise they could no longer be correlated.
+func (l *Logger) isPseudonym(value string) bool {
+	return l.config.Pseudonymizer != nil && l.config.Pseudonymizer.IsToken(value)
+}
+
 // LogChallenge logs a challenge-related event
 func (l *Logger) LogChallenge(ctx context.Context, eventType EventType, challengeID, userID string, result Result, opts ...RecordOption) {
 	record := NewRecord(eventType, result).
@@ -486,3 +486,24 @@ func TestLogger_Log_MaskingWithDifferentChannels(t *testing.T) {
 		assert.NotEqual(t, "some_data", r.Destination)
 	}
 }
+
+func TestLogger_Log_CustomMaskers(t *testing.T) {
+	store := newTestStorage()
+	maskers := NewMaskerRegistry()
+	maskers.Register("webhook", DestinationMaskerFunc(func(string) string { return "[webhook]" }))
+	config := DefaultConfig()
+	config.Maskers = maskers
+	logger := NewLogger(store, config)
+
+	logger.Log(context.Background(), NewRecord(EventSendSuccess, ResultSuccess).
+		WithChannel("webhook").
+		WithDestination("https://hooks.example.com/secret"))
+	logger.Log(context.Background(), NewRecord(EventSendSuccess, ResultSuccess).
+		WithChannel("push").
+		WithDestination("740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78ad"))
+
+	records := store.getRecords()
+	require.Len(t, records, 2)
+	assert.Equal(t, "[webhook]", records[0].Destination)
+	assert.Equal(t, "740f****78ad", records[1].Destination)
+}
@@ -1,24 +1,123 @@
 package audit
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+
 	secure "github.com/soulteary/secure-kit"
 )
 
-// MaskDestination masks a destination (phone or email) based on channel
-func MaskDestination(dest string, channel string) string {
+// DestinationMasker masks a destination for a specific channel
+type DestinationMasker interface {
+	Mask(dest string) string
+}
+
+// DestinationMaskerFunc adapts an ordinary function to DestinationMasker
+type DestinationMaskerFunc func(dest string) string
+
+// Mask calls f(dest)
+func (f DestinationMaskerFunc) Mask(dest string) string {
+	return f(dest)
+}
+
+// MaskerRegistry maps channels to destination maskers. Channels are matched
+// case-insensitively; unknown channels use the fallback masker.
+type MaskerRegistry struct {
+	mu       sync.RWMutex
+	maskers  map[string]DestinationMasker
+	fallback DestinationMasker
+}
+
+// NewMaskerRegistry creates a registry with the built-in maskers:
+//   - sms, phone: international phone numbers
+//   - email: email addresses
+//   - push, apns, fcm: push tokens
+//   - webhook, url: URLs (host kept, path and query masked)
+//   - username, wechat, openid, slack, telegram: account names and IDs
+func NewMaskerRegistry() *MaskerRegistry {
+	r := &MaskerRegistry{
+		maskers:  make(map[string]DestinationMasker),
+		fallback: DestinationMaskerFunc(func(string) string { return "****" }),
+	}
+	for _, ch := range []string{"sms", "phone"} {
+		r.Register(ch, DestinationMaskerFunc(MaskInternationalPhone))
+	}
+	r.Register("email", DestinationMaskerFunc(MaskEmail))
+	for _, ch := range []string{"push", "apns", "fcm"} {
+		r.Register(ch, DestinationMaskerFunc(MaskPushToken))
+	}
+	for _, ch := range []string{"webhook", "url"} {
+		r.Register(ch, DestinationMaskerFunc(MaskURL))
+	}
+	for _, ch := range []string{"username", "wechat", "openid", "slack", "telegram"} {
+		r.Register(ch, DestinationMaskerFunc(MaskUsername))
+	}
+	return r
+}
+
+// Register sets the masker for a channel, replacing any existing one
+func (r *MaskerRegistry) Register(channel string, masker DestinationMasker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maskers[normalizeChannel(channel)] = masker
+}
+
+// SetFallback sets the masker used for channels without a registered masker
+func (r *MaskerRegistry) SetFallback(masker DestinationMasker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = masker
+}
+
+// Lookup returns the masker registered for a channel
+func (r *MaskerRegistry) Lookup(channel string) (DestinationMasker, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.maskers[normalizeChannel(channel)]
+	return m, ok
+}
+
+// Mask masks a destination using the masker registered for channel
+func (r *MaskerRegistry) Mask(dest string, channel string) string {
 	if dest == "" {
 		return ""
 	}
-
-	switch channel {
-	case "sms", "phone":
-		return secure.MaskPhone(dest)
-	case "email":
-		return secure.MaskEmail(dest)
-	default:
-		// Unknown channel, mask everything
+	m, ok := r.Lookup(channel)
+	if !ok {
+		r.mu.RLock()
+		m = r.fallback
+		r.mu.RUnlock()
+	}
+	if m == nil {
 		return "****"
 	}
+	return m.Mask(dest)
+}
+
+func normalizeChannel(channel string) string {
+	return strings.ToLower(strings.TrimSpace(channel))
+}
+
+var defaultMaskerRegistry = NewMaskerRegistry()
+
+// DefaultMaskerRegistry returns the package-level registry used by MaskDestination
+func DefaultMaskerRegistry() *MaskerRegistry {
+	return defaultMaskerRegistry
+}
+
+// RegisterDestinationMasker registers a masker for a channel in the default registry
+func RegisterDestinationMasker(channel string, masker DestinationMasker) {
+	defaultMaskerRegistry.Register(channel, masker)
+}
+
+// MaskDestination masks a destination based on channel using the default registry.
+// Unknown channels are masked entirely.
+func MaskDestination(dest string, channel string) string {
+	return defaultMaskerRegistry.Mask(dest, channel)
 }
 
 // MaskEmail masks an email address
@@ -31,38 +130,171 @@ func MaskPhone(phone string) string {
 	return secure.MaskPhone(phone)
 }
 
-// MaskIP masks an IP address (keeps first and last octet)
+// MaskInternationalPhone masks a phone number written in any common format,
+// e.g. "+44 20 7946 0958", "(555) 123-4567" or "0086-138-0013-8000".
+// Separators are removed and a leading "00" becomes "+" before masking.
+func MaskInternationalPhone(phone string) string {
+	phone = strings.TrimSpace(phone)
+	if phone == "" {
+		return ""
+	}
+	var b strings.Builder
+	for i, r := range phone {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')' || r == '/':
+		default:
+			// Not a phone number; do not leak any part of it
+			return "****"
+		}
+	}
+	normalized := b.String()
+	if strings.HasPrefix(normalized, "00") {
+		normalized = "+" + normalized[2:]
+	}
+	return secure.MaskPhone(normalized)
+}
+
+// MaskPushToken masks a device push token (APNs, FCM, etc.), keeping the
+// first and last 4 characters
+func MaskPushToken(token string) string {
+	return MaskString(strings.TrimSpace(token), 4)
+}
+
+// MaskURL masks a URL such as a webhook endpoint. Scheme and host are kept;
+// credentials are dropped and path, query and fragment are masked, e.g.
+// "https://hooks.example.com/T000/B000/XXXX?token=abc" -> "https://hooks.example.com/****".
+func MaskURL(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "****"
+	}
+	masked := u.Scheme + "://" + u.Host
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		masked += "/****"
+	}
+	return masked
+}
+
+// MaskUsername masks an account name or platform user ID (e.g. a WeChat OpenID).
+// Short names keep only their first character; longer ones keep two characters
+// at each end.
+func MaskUsername(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ""
+	}
+	runes := []rune(name)
+	switch {
+	case len(runes) <= 2:
+		return "****"
+	case len(runes) <= 6:
+		return string(runes[:1]) + "****"
+	default:
+		return MaskString(name, 2)
+	}
+}
+
+// ErrInvalidIP is returned when input cannot be parsed as an IP address
+var ErrInvalidIP = errors.New("invalid IP address")
+
+// InvalidIPMask is returned by MaskIP for input that is not a valid IP address.
+// Such input is flagged rather than partially masked, so no fragment of it leaks.
+const InvalidIPMask = "****"
+
+// Default prefix lengths kept by MaskIP
+const (
+	defaultIPv4PrefixLen = 24
+	defaultIPv6PrefixLen = 48
+)
+
+// IPMaskOptions controls how many leading bits of an address are kept.
+// Zero fields use the default.
+type IPMaskOptions struct {
+	IPv4PrefixLen int // Bits kept for IPv4 addresses (default: 24, max: 32)
+	IPv6PrefixLen int // Bits kept for IPv6 addresses (default: 48, max: 128)
+}
+
+// DefaultIPMaskOptions returns default IP masking options (IPv4 /24, IPv6 /48)
+func DefaultIPMaskOptions() *IPMaskOptions {
+	return &IPMaskOptions{
+		IPv4PrefixLen: defaultIPv4PrefixLen,
+		IPv6PrefixLen: defaultIPv6PrefixLen,
+	}
+}
+
+// MaskIP masks an IP address by truncating it to its network prefix
+// (IPv4 /24, IPv6 /48), e.g. "192.168.1.100" -> "192.168.1.0/24".
+// Ports, brackets and zone IDs are stripped and IPv4-mapped IPv6 addresses are
+// treated as IPv4. Invalid input returns InvalidIPMask.
 func MaskIP(ip string) string {
+	masked, err := MaskIPWithOptions(ip, nil)
+	if err != nil {
+		return InvalidIPMask
+	}
+	return masked
+}
+
+// MaskIPWithOptions truncates an IP address to the configured prefix length and
+// returns it in CIDR notation. Accepts "addr", "addr%zone", "host:port" and
+// "[addr]:port" input. Returns ErrInvalidIP for anything that is not an address.
+func MaskIPWithOptions(ip string, opts *IPMaskOptions) (string, error) {
+	ip = strings.TrimSpace(ip)
 	if ip == "" {
-		return ""
+		return "", nil
+	}
+	if opts == nil {
+		opts = DefaultIPMaskOptions()
 	}
 
-	// Handle IPv4
-	if len(ip) >= 7 { // Minimum valid IP: x.x.x.x
-		// Find positions of dots
-		firstDot := -1
-		lastDot := -1
-		for i, c := range ip {
-			if c == '.' {
-				if firstDot == -1 {
-					firstDot = i
-				}
-				lastDot = i
-			}
-		}
+	addr, err := parseIPInput(ip)
+	if err != nil {
+		return "", err
+	}
 
-		if firstDot != -1 && lastDot != firstDot {
-			// Mask middle octets
-			return ip[:firstDot+1] + "***" + ip[lastDot:]
-		}
+	bits, defaultBits := opts.IPv6PrefixLen, defaultIPv6PrefixLen
+	if addr.Is4() {
+		bits, defaultBits = opts.IPv4PrefixLen, defaultIPv4PrefixLen
+	}
+	if bits == 0 {
+		bits = defaultBits
+	}
+	if bits < 0 || bits > addr.BitLen() {
+		return "", fmt.Errorf("invalid prefix length %d for %d-bit address", bits, addr.BitLen())
 	}
 
-	// For IPv6 or invalid format, return masked
-	if len(ip) > 8 {
-		return ip[:4] + "****" + ip[len(ip)-4:]
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidIP, err)
 	}
+	return prefix.String(), nil
+}
 
-	return "****"
+// parseIPInput parses an address with optional port, brackets or zone and
+// returns it without zone, with IPv4-mapped IPv6 addresses unmapped
+func parseIPInput(ip string) (netip.Addr, error) {
+	var addr netip.Addr
+	if ap, err := netip.ParseAddrPort(ip); err == nil {
+		addr = ap.Addr()
+	} else {
+		host := ip
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+		parsed, err := netip.ParseAddr(host)
+		if err != nil {
+			return netip.Addr{}, ErrInvalidIP
+		}
+		addr = parsed
+	}
+	return addr.WithZone("").Unmap(), nil
 }
 
 // MaskString masks a string, keeping first and last n characters
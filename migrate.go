@@ -0,0 +1,309 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// SchemaVersionTable records the migrations applied to each audit table.
+// It is created in the schema of schema-qualified audit tables.
+const SchemaVersionTable = "audit_schema_version"
+
+// schemaMigration is one step of the audit table schema. Steps are applied
+// in Version order and never edited once released; add a new step instead.
+// This includes indexes: version 1 may be recorded for a table it did not
+// create, so an index added to it would be missing there.
+type schemaMigration struct {
+	Version     int
+	Description string
+
+	// Statements returns the SQL for the storage's dialect and table; an
+	// empty list records the version without changes
+	Statements func(s *DatabaseStorage) ([]string, error)
+}
+
+// schemaMigrations lists every schema version
+var schemaMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "create audit table and indexes",
+		Statements: func(s *DatabaseStorage) ([]string, error) {
+			return s.tableStatements()
+		},
+	},
+	{
+		Version:     2,
+		Description: "widen ip column for IPv6 addresses with zones",
+		Statements: func(s *DatabaseStorage) ([]string, error) {
+			if stmt := s.dialect.AlterColumnType(s.tableName, "ip", "VARCHAR(64)"); stmt != "" {
+				return []string{stmt}, nil
+			}
+			return nil, nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "store metadata as native JSON and index the document",
+		Statements: func(s *DatabaseStorage) ([]string, error) {
+			var statements []string
+			for _, stmt := range []string{
+				s.dialect.ConvertMetadataColumn(s.tableName),
+				s.dialect.MetadataDocumentIndex(s.tableName),
+			} {
+				if stmt != "" {
+					statements = append(statements, stmt)
+				}
+			}
+			return statements, nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "index event, request, trace and provider message ids",
+		Statements: func(s *DatabaseStorage) ([]string, error) {
+			return s.lookupIndexStatements(), nil
+		},
+	},
+	{
+		Version:     encryptedColumnsSchemaVersion,
+		Description: "widen ip and destination columns for encrypted values",
+		Statements: func(s *DatabaseStorage) ([]string, error) {
+			var statements []string
+			for _, column := range []struct {
+				name string
+				size int
+			}{
+				{"ip", encryptedIPColumnSize},
+				{"destination", encryptedDestinationColumnSize},
+			} {
+				if stmt := s.dialect.AlterColumnType(s.tableName, column.name, fmt.Sprintf("VARCHAR(%d)", column.size)); stmt != "" {
+					statements = append(statements, stmt)
+				}
+			}
+			return statements, nil
+		},
+	},
+}
+
+// LatestSchemaVersion is the schema version Migrate brings a table to
+var LatestSchemaVersion = schemaMigrations[len(schemaMigrations)-1].Version
+
+// MigrateOptions controls DatabaseStorage.Migrate
+type MigrateOptions struct {
+	// DryRun prints the SQL of pending migrations to Output instead of
+	// running it. No lock is taken and nothing is written.
+	DryRun bool
+	Output io.Writer // Destination for DryRun (default: os.Stdout)
+
+	// LockTimeout bounds the wait for another instance's migration
+	// (default: 1 minute)
+	LockTimeout time.Duration
+}
+
+// DefaultMigrateOptions returns default migrate options
+func DefaultMigrateOptions() *MigrateOptions {
+	return &MigrateOptions{
+		Output:      os.Stdout,
+		LockTimeout: time.Minute,
+	}
+}
+
+// Migrate brings the table to LatestSchemaVersion and returns the resulting
+// version. Applied versions are recorded in SchemaVersionTable. Concurrent
+// instances are serialized by an advisory lock (PostgreSQL, MySQL); on SQLite
+// a concurrent migration fails on the version row and can be retried.
+// Tables created before migrations existed are adopted as version 1, whose
+// statements are all IF NOT EXISTS; later versions then add what the table
+// lacks, such as the lookup indexes of version 4.
+func (s *DatabaseStorage) Migrate(ctx context.Context, opts *MigrateOptions) (int, error) {
+	if opts == nil {
+		opts = DefaultMigrateOptions()
+	}
+	lockTimeout := opts.LockTimeout
+	if lockTimeout <= 0 {
+		lockTimeout = time.Minute
+	}
+
+	// Locks are per session, so every statement runs on one connection
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if opts.DryRun {
+		return s.migrateDryRun(ctx, conn, opts.Output)
+	}
+
+	unlock, err := s.lockMigrations(ctx, conn, lockTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	if _, err := conn.ExecContext(ctx, s.versionTableSQL()); err != nil {
+		return 0, fmt.Errorf("failed to create schema version table: %w", err)
+	}
+	version, err := s.schemaVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range schemaMigrations {
+		if m.Version <= version {
+			continue
+		}
+		if err := s.applyMigration(ctx, conn, m); err != nil {
+			return version, fmt.Errorf("failed to apply schema version %d (%s): %w", m.Version, m.Description, err)
+		}
+		version = m.Version
+	}
+
+	if err := execStatements(ctx, conn, s.configIndexStatements()); err != nil {
+		return version, fmt.Errorf("failed to create configured indexes: %w", err)
+	}
+	return version, nil
+}
+
+// SchemaVersion returns the latest applied schema version of the table, or
+// 0 if it was never migrated
+func (s *DatabaseStorage) SchemaVersion(ctx context.Context) (int, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	exists, err := s.versionTableExists(ctx, conn)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return s.schemaVersion(ctx, conn)
+}
+
+// migrateDryRun prints the pending migrations and returns the current version
+func (s *DatabaseStorage) migrateDryRun(ctx context.Context, conn *sql.Conn, out io.Writer) (int, error) {
+	if out == nil {
+		out = os.Stdout
+	}
+	version := 0
+	exists, err := s.versionTableExists(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		if version, err = s.schemaVersion(ctx, conn); err != nil {
+			return 0, err
+		}
+	} else {
+		_, _ = fmt.Fprintf(out, "%s;\n", s.versionTableSQL())
+	}
+
+	for _, m := range schemaMigrations {
+		if m.Version <= version {
+			continue
+		}
+		statements, err := m.Statements(s)
+		if err != nil {
+			return version, err
+		}
+		_, _ = fmt.Fprintf(out, "-- %d: %s\n", m.Version, m.Description)
+		for _, stmt := range statements {
+			_, _ = fmt.Fprintf(out, "%s;\n", stmt)
+		}
+	}
+	for _, stmt := range s.configIndexStatements() {
+		_, _ = fmt.Fprintf(out, "%s;\n", stmt)
+	}
+	return version, nil
+}
+
+// applyMigration runs one migration and records its version. DDL is
+// transactional on PostgreSQL and SQLite; MySQL commits each statement.
+func (s *DatabaseStorage) applyMigration(ctx context.Context, conn *sql.Conn, m schemaMigration) error {
+	statements, err := m.Statements(s)
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := execStatements(ctx, tx, statements); err != nil {
+		return err
+	}
+	versionTable, tableName := s.versionTable()
+	insert := fmt.Sprintf("INSERT INTO %s (table_name, version, description, applied_at) VALUES (%s, %s, %s, %s)",
+		versionTable, s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4))
+	if _, err := tx.ExecContext(ctx, insert, tableName, m.Version, m.Description, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to record schema version: %w", err)
+	}
+	return tx.Commit()
+}
+
+// versionTable returns the SchemaVersionTable of the audit table and the
+// name the audit table is recorded under, both qualified by its schema
+func (s *DatabaseStorage) versionTable() (string, string) {
+	schema, name := splitTableName(s.tableName)
+	if schema == "" {
+		return SchemaVersionTable, name
+	}
+	return schema + "." + SchemaVersionTable, name
+}
+
+// versionTableSQL creates SchemaVersionTable
+func (s *DatabaseStorage) versionTableSQL() string {
+	versionTable, _ := s.versionTable()
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			table_name VARCHAR(64) NOT NULL,
+			version INTEGER NOT NULL,
+			description VARCHAR(255),
+			applied_at BIGINT NOT NULL,
+			PRIMARY KEY (table_name, version)
+		)`, versionTable)
+}
+
+// versionTableExists reports whether SchemaVersionTable exists
+func (s *DatabaseStorage) versionTableExists(ctx context.Context, conn *sql.Conn) (bool, error) {
+	versionTable, _ := s.versionTable()
+	query, args := s.dialect.TableExistsQuery(versionTable)
+	var n int
+	if err := conn.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to check schema version table: %w", err)
+	}
+	return n > 0, nil
+}
+
+// schemaVersion reads the latest applied version of the table
+func (s *DatabaseStorage) schemaVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	versionTable, tableName := s.versionTable()
+	query := fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s WHERE table_name = %s", versionTable, s.placeholder(1))
+	var version int
+	if err := conn.QueryRowContext(ctx, query, tableName).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// lockMigrations takes the migration lock of the table on conn and returns
+// its release function. Locks are per session; on SQLite there are none and
+// the version primary key rejects a concurrent migration of the same version.
+func (s *DatabaseStorage) lockMigrations(ctx context.Context, conn *sql.Conn, timeout time.Duration) (func(), error) {
+	unlock, err := s.dialect.Lock(ctx, conn, "audit_migrate_"+s.tableName, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	return unlock, nil
+}
+
+// placeholder returns the n-th bind parameter for the dialect
+func (s *DatabaseStorage) placeholder(n int) string {
+	return s.dialect.Placeholder(n)
+}
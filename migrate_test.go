@@ -0,0 +1,389 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabaseStorage_Migrate_SQLite(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: SQLiteDialect{}, tableName: "audit_logs"}
+
+	version, err := s.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	version, err = s.Migrate(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, LatestSchemaVersion, version)
+
+	version, err = s.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, LatestSchemaVersion, version)
+
+	// Every version is recorded once
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM "+SchemaVersionTable+" WHERE table_name = 'audit_logs'").Scan(&n))
+	assert.Equal(t, len(schemaMigrations), n)
+
+	// Running again is a no-op
+	version, err = s.Migrate(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, LatestSchemaVersion, version)
+
+	require.NoError(t, s.Write(ctx, NewRecord(EventLoginSuccess, ResultSuccess).WithIP("fe80::1%eth0")))
+	records, err := s.Query(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "fe80::1%eth0", records[0].IP)
+}
+
+func TestDatabaseStorage_Migrate_AdoptsExistingTable(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	// Table created before migrations existed, with fewer indexes than the
+	// current version 1
+	_, err := db.Exec(`CREATE TABLE audit_logs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			` + auditTableColumns + `
+			metadata TEXT,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`)
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE INDEX idx_audit_logs_user_id ON audit_logs(user_id)")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO audit_logs (event_type, result, timestamp) VALUES ('logout', 'success', 1)")
+	require.NoError(t, err)
+
+	s, err := NewDatabaseStorageFromDB(db, "sqlite", &DatabaseConfig{
+		AutoMigrate:         true,
+		IndexedMetadataKeys: []string{"tenant_id"},
+	})
+	require.NoError(t, err)
+
+	version, err := s.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, LatestSchemaVersion, version)
+
+	records, err := s.Query(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	for _, column := range append(append([]string{"meta_tenant_id"}, auditIndexColumns...), lookupIndexColumns...) {
+		var n int
+		require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", "idx_audit_logs_"+column).Scan(&n))
+		assert.Equal(t, 1, n, column)
+	}
+}
+
+// TestSchemaMigrations_Version1Indexes guards version 1 against indexes
+// added after release, which adopted tables would never get
+func TestSchemaMigrations_Version1Indexes(t *testing.T) {
+	for _, d := range []Dialect{PostgresDialect{}, MySQLDialect{}, SQLiteDialect{}} {
+		statements, err := d.CreateTable("audit_logs", false)
+		require.NoError(t, err)
+		indexes := regexp.MustCompile(`idx_audit_logs_(\w+)`).FindAllStringSubmatch(strings.Join(statements, "\n"), -1)
+		var columns []string
+		for _, m := range indexes {
+			columns = append(columns, m[1])
+		}
+		assert.ElementsMatch(t, auditIndexColumns, columns, d.Name())
+	}
+}
+
+func TestDatabaseStorage_Migrate_PerTable(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	a := &DatabaseStorage{db: db, dialect: SQLiteDialect{}, tableName: "audit_a"}
+	b := &DatabaseStorage{db: db, dialect: SQLiteDialect{}, tableName: "audit_b"}
+	_, err := a.Migrate(ctx, nil)
+	require.NoError(t, err)
+
+	version, err := b.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	version, err = b.Migrate(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, LatestSchemaVersion, version)
+}
+
+func TestDatabaseStorage_Migrate_DryRun(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: SQLiteDialect{}, tableName: "audit_logs"}
+
+	var out bytes.Buffer
+	version, err := s.Migrate(ctx, &MigrateOptions{DryRun: true, Output: &out})
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+	assert.Contains(t, out.String(), "CREATE TABLE IF NOT EXISTS "+SchemaVersionTable)
+	assert.Contains(t, out.String(), "-- 1: create audit table and indexes\nCREATE TABLE IF NOT EXISTS audit_logs")
+	assert.Contains(t, out.String(), "-- 2: widen ip column")
+	assert.Contains(t, out.String(), "-- 3: store metadata as native JSON")
+	assert.Contains(t, out.String(), "-- 4: index event, request, trace and provider message ids\nCREATE INDEX IF NOT EXISTS idx_audit_logs_event_id ON audit_logs(event_id);")
+
+	// Nothing was created
+	version, err = s.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	_, err = s.Migrate(ctx, nil)
+	require.NoError(t, err)
+	out.Reset()
+	_, err = s.Migrate(ctx, &MigrateOptions{DryRun: true, Output: &out})
+	require.NoError(t, err)
+	assert.Empty(t, out.String())
+}
+
+func TestDatabaseStorage_Migrate_Postgres(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs"}
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS " + SchemaVersionTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) FROM " + SchemaVersionTable + " WHERE table_name = $1")).
+		WithArgs("audit_logs").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE audit_logs ALTER COLUMN ip TYPE VARCHAR(64)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+SchemaVersionTable+" (table_name, version, description, applied_at) VALUES ($1, $2, $3, $4)")).
+		WithArgs("audit_logs", 2, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("IF (SELECT format_type(atttypid, NULL) FROM pg_attribute WHERE attrelid = 'audit_logs'::regclass AND attname = 'metadata') <> 'jsonb' THEN")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS idx_audit_logs_metadata ON audit_logs USING GIN (metadata jsonb_path_ops)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+SchemaVersionTable)).
+		WithArgs("audit_logs", 3, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectLookupIndexMigration(mock, "audit_logs", SchemaVersionTable, "audit_logs")
+	expectEncryptedColumnsMigration(mock, "audit_logs", SchemaVersionTable, "audit_logs")
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	version, err := s.Migrate(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 5, version)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestDatabaseStorage_Migrate_LegacyTextMetadata migrates a table created
+// before migrations, whose metadata column is still text: the document
+// index must not be created until version 3 has converted the column
+func TestDatabaseStorage_Migrate_LegacyTextMetadata(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs"}
+
+	mock.ExpectExec("pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS " + SchemaVersionTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COALESCE").WithArgs("audit_logs").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+
+	// Version 1 adopts the existing table; a GIN index on the text column
+	// would fail here
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS audit_logs (")).WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, column := range auditIndexColumns {
+		mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS idx_audit_logs_" + column + " ON audit_logs(" + column + ")")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+SchemaVersionTable)).
+		WithArgs("audit_logs", 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("ALTER TABLE audit_logs ALTER COLUMN ip").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+SchemaVersionTable)).
+		WithArgs("audit_logs", 2, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// Version 3 converts the column, then indexes it
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE audit_logs ALTER COLUMN metadata TYPE JSONB")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS idx_audit_logs_metadata ON audit_logs USING GIN (metadata jsonb_path_ops)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+SchemaVersionTable)).
+		WithArgs("audit_logs", 3, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectLookupIndexMigration(mock, "audit_logs", SchemaVersionTable, "audit_logs")
+	expectEncryptedColumnsMigration(mock, "audit_logs", SchemaVersionTable, "audit_logs")
+	mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	version, err := s.Migrate(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 5, version)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDatabaseStorage_Migrate_SchemaQualified(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit.logs"}
+
+	versionTable := "audit." + SchemaVersionTable
+	mock.ExpectExec("pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS " + versionTable)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) FROM " + versionTable + " WHERE table_name = $1")).
+		WithArgs("logs").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE audit.logs ALTER COLUMN ip TYPE VARCHAR(64)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+versionTable+" (table_name")).
+		WithArgs("logs", 2, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("attrelid = 'audit.logs'::regclass")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS idx_logs_metadata ON audit.logs USING GIN")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+versionTable+" (table_name")).
+		WithArgs("logs", 3, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectLookupIndexMigration(mock, "audit.logs", versionTable, "logs")
+	expectEncryptedColumnsMigration(mock, "audit.logs", versionTable, "logs")
+	mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	version, err := s.Migrate(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 5, version)
+
+	mock.ExpectQuery(regexp.QuoteMeta("table_schema = $1 AND table_name = $2")).
+		WithArgs("audit", SchemaVersionTable).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT COALESCE").WithArgs("logs").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(5))
+	version, err = s.SchemaVersion(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 5, version)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// expectLookupIndexMigration expects schema version 4 on a PostgreSQL table
+func expectLookupIndexMigration(mock sqlmock.Sqlmock, table, versionTable, recorded string) {
+	_, name := splitTableName(table)
+	mock.ExpectBegin()
+	for _, column := range lookupIndexColumns {
+		mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS idx_" + name + "_" + column + " ON " + table + "(" + column + ")")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+versionTable+" (table_name")).
+		WithArgs(recorded, 4, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+// expectEncryptedColumnsMigration expects schema version 5 on a PostgreSQL
+// table
+func expectEncryptedColumnsMigration(mock sqlmock.Sqlmock, table, versionTable, recorded string) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE " + table + " ALTER COLUMN ip TYPE VARCHAR(255)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE " + table + " ALTER COLUMN destination TYPE VARCHAR(512)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+versionTable+" (table_name")).
+		WithArgs(recorded, 5, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestDatabaseStorage_Migrate_FailureRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs"}
+
+	mock.ExpectExec("pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS " + SchemaVersionTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COALESCE").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec("ALTER TABLE").WillReturnError(errors.New("permission denied"))
+	mock.ExpectRollback()
+	mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	version, err := s.Migrate(context.Background(), nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to apply schema version 2 (widen ip column for IPv6 addresses with zones): permission denied")
+	assert.Equal(t, 1, version)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDatabaseStorage_Migrate_MySQLLock(t *testing.T) {
+	t.Run("up to date", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer func() { _ = db.Close() }()
+		s := &DatabaseStorage{db: db, dialect: MySQLDialect{}, tableName: "audit_logs"}
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(?, ?)")).
+			WithArgs("audit_migrate_audit_logs", 30).
+			WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS " + SchemaVersionTable).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE table_name = ?")).
+			WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(LatestSchemaVersion))
+		mock.ExpectExec(regexp.QuoteMeta("SELECT RELEASE_LOCK(?)")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		version, err := s.Migrate(context.Background(), &MigrateOptions{LockTimeout: 30 * time.Second})
+		require.NoError(t, err)
+		assert.Equal(t, LatestSchemaVersion, version)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("lock timeout", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer func() { _ = db.Close() }()
+		s := &DatabaseStorage{db: db, dialect: MySQLDialect{}, tableName: "audit_logs"}
+
+		mock.ExpectQuery("GET_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(0))
+
+		_, err = s.Migrate(context.Background(), &MigrateOptions{LockTimeout: time.Second})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to acquire migration lock: timed out after 1s")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestDatabaseStorage_Migrate_AutoMigrateFails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectExec("pg_advisory_lock").WillReturnError(errors.New("connection reset"))
+
+	_, err = NewDatabaseStorageFromDB(db, "postgres", &DatabaseConfig{AutoMigrate: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to migrate schema: failed to acquire migration lock")
+}
+
+func TestSchemaMigrations_Ordered(t *testing.T) {
+	for i, m := range schemaMigrations {
+		assert.Equal(t, i+1, m.Version, "versions must be consecutive")
+		assert.NotEmpty(t, m.Description)
+		for _, dialect := range []Dialect{PostgresDialect{}, MySQLDialect{}, SQLiteDialect{}} {
+			_, err := m.Statements(&DatabaseStorage{dialect: dialect, tableName: "audit_logs"})
+			assert.NoError(t, err, "version %d on %s", m.Version, dialect.Name())
+		}
+	}
+}
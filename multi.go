@@ -0,0 +1,689 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultiQueryMode selects how MultiStorage answers queries
+type MultiQueryMode string
+
+const (
+	// QueryFirst queries the first non-nil backend only (default)
+	QueryFirst MultiQueryMode = "first"
+
+	// QueryMerge queries all backends concurrently, merges the results in
+	// filter order, drops duplicates (same EventID, or same content for
+	// records without one) and applies limit/offset to the merged list
+	QueryMerge MultiQueryMode = "merge"
+
+	// QueryTiered routes each part of the time range to the backend that
+	// owns it (see MultiStorageConfig.TierAges) and merges the results
+	QueryTiered MultiQueryMode = "tiered"
+)
+
+// MultiWritePolicy selects when a MultiStorage write succeeds
+type MultiWritePolicy string
+
+const (
+	// WriteAll writes to all backends concurrently and fails if any fails
+	// (default)
+	WriteAll MultiWritePolicy = "all"
+
+	// WriteQuorum writes to all backends concurrently and fails if fewer
+	// than MultiStorageConfig.Quorum succeed. A write that meets the
+	// quorum despite failures returns a *MultiWriteError matching
+	// ErrPartialWrite.
+	WriteQuorum MultiWritePolicy = "quorum"
+
+	// WritePrimary writes to the first non-nil backend and fails if it
+	// fails; the other backends are written in the background and their
+	// failures are only logged
+	WritePrimary MultiWritePolicy = "primary"
+
+	// WriteFailover writes to the backends in order until one succeeds
+	WriteFailover MultiWritePolicy = "failover"
+)
+
+// MultiStorageConfig holds configuration for multi-storage
+type MultiStorageConfig struct {
+	QueryMode MultiQueryMode // How queries are answered (default: QueryFirst)
+
+	WritePolicy MultiWritePolicy // When a write succeeds (default: WriteAll)
+
+	// Quorum is the number of backends that must succeed with WriteQuorum
+	// (default: a majority of the non-nil backends)
+	Quorum int
+
+	// BestEffortTimeout bounds background writes with WritePrimary
+	// (default: 5s)
+	BestEffortTimeout time.Duration
+
+	// TierAges[i] is the age of the oldest records storage i serves in
+	// QueryTiered mode, e.g. 7 days for Redis in front of a database. Ages
+	// must increase; 0 (last tier only) serves everything older. Records
+	// older than the last non-zero age are not queried.
+	TierAges []time.Duration
+}
+
+// DefaultMultiStorageConfig returns default multi-storage configuration
+func DefaultMultiStorageConfig() *MultiStorageConfig {
+	return &MultiStorageConfig{
+		QueryMode:         QueryFirst,
+		WritePolicy:       WriteAll,
+		BestEffortTimeout: 5 * time.Second,
+	}
+}
+
+// MultiStorage combines multiple storage backends
+type MultiStorage struct {
+	storages  []Storage
+	queryMode MultiQueryMode
+	tierAges  []time.Duration
+
+	writePolicy       MultiWritePolicy
+	quorum            int
+	bestEffortTimeout time.Duration
+	pending           sync.WaitGroup // Background writes (WritePrimary)
+
+	mu     sync.Mutex
+	closed bool // Close has started; no background writes are added
+}
+
+// NewMultiStorage creates a storage that writes to multiple backends
+func NewMultiStorage(storages ...Storage) *MultiStorage {
+	return &MultiStorage{
+		storages:    storages,
+		queryMode:   QueryFirst,
+		writePolicy: WriteAll,
+	}
+}
+
+// NewMultiStorageWithConfig creates a multi-storage with config
+func NewMultiStorageWithConfig(config *MultiStorageConfig, storages ...Storage) (*MultiStorage, error) {
+	if config == nil {
+		config = DefaultMultiStorageConfig()
+	}
+
+	mode := config.QueryMode
+	switch mode {
+	case "":
+		mode = QueryFirst
+	case QueryFirst, QueryMerge:
+	case QueryTiered:
+		if len(config.TierAges) != len(storages) {
+			return nil, fmt.Errorf("tiered query mode needs one tier age per storage: got %d ages for %d storages", len(config.TierAges), len(storages))
+		}
+		for i, age := range config.TierAges {
+			if age < 0 {
+				return nil, fmt.Errorf("tier age %d cannot be negative", i)
+			}
+			if age == 0 && i != len(config.TierAges)-1 {
+				return nil, fmt.Errorf("only the last tier can have an unlimited age")
+			}
+			if i > 0 && age != 0 && age <= config.TierAges[i-1] {
+				return nil, fmt.Errorf("tier ages must increase: tier %d (%s) is not older than tier %d", i, age, i-1)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported query mode: %s", mode)
+	}
+
+	configured := 0
+	for _, s := range storages {
+		if s != nil {
+			configured++
+		}
+	}
+
+	policy := config.WritePolicy
+	quorum := 0
+	switch policy {
+	case "":
+		policy = WriteAll
+	case WriteAll, WritePrimary, WriteFailover:
+	case WriteQuorum:
+		quorum = config.Quorum
+		if quorum == 0 {
+			quorum = configured/2 + 1
+		}
+		if quorum < 1 || quorum > configured {
+			return nil, fmt.Errorf("quorum must be between 1 and %d, got %d", configured, config.Quorum)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported write policy: %s", policy)
+	}
+
+	timeout := config.BestEffortTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	return &MultiStorage{
+		storages:          storages,
+		queryMode:         mode,
+		tierAges:          config.TierAges,
+		writePolicy:       policy,
+		quorum:            quorum,
+		bestEffortTimeout: timeout,
+	}, nil
+}
+
+// ErrPartialWrite matches a *MultiWriteError whose write met the policy: the
+// record is stored, but some backends failed
+var ErrPartialWrite = errors.New("audit record stored with backend failures")
+
+// BackendError is the failure of one backend in a MultiStorage operation
+type BackendError struct {
+	Index int // Position of the backend in the storages passed to the constructor
+	Err   error
+}
+
+// MultiWriteError is returned by MultiStorage.Write when the write policy
+// is not satisfied
+type MultiWriteError struct {
+	Policy    MultiWritePolicy
+	Succeeded int  // Number of backends that stored the record
+	Partial   bool // The policy was met anyway, see ErrPartialWrite
+	Failures  []BackendError
+}
+
+// Error implements error
+func (e *MultiWriteError) Error() string {
+	parts := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		parts[i] = fmt.Sprintf("storage %d: %v", f.Index, f.Err)
+	}
+	action := "failed to write to storages"
+	if e.Partial {
+		action = "wrote to storages with failures"
+	}
+	return fmt.Sprintf("%s (policy %s, %d succeeded): %s",
+		action, e.Policy, e.Succeeded, strings.Join(parts, "; "))
+}
+
+// Is reports whether a partial write is compared to ErrPartialWrite
+func (e *MultiWriteError) Is(target error) bool {
+	return e.Partial && target == ErrPartialWrite
+}
+
+// Unwrap returns the backend errors for errors.Is and errors.As
+func (e *MultiWriteError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// Write writes to the backends according to the write policy. A write that
+// does not satisfy the policy returns a *MultiWriteError; so does a quorum
+// write with failures, matching ErrPartialWrite.
+func (m *MultiStorage) Write(ctx context.Context, record *Record) error {
+	var indexes []int
+	for i, s := range m.storages {
+		if s != nil {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	switch m.writePolicy {
+	case WritePrimary:
+		return m.writePrimary(ctx, record, indexes)
+	case WriteFailover:
+		return m.writeFailover(ctx, record, indexes)
+	}
+
+	errs := make([]error, len(indexes))
+	var wg sync.WaitGroup
+	for i, index := range indexes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = m.storages[index].Write(ctx, record)
+		}()
+	}
+	wg.Wait()
+
+	report := &MultiWriteError{Policy: m.writePolicy}
+	for i, err := range errs {
+		if err != nil {
+			report.Failures = append(report.Failures, BackendError{Index: indexes[i], Err: err})
+		} else {
+			report.Succeeded++
+		}
+	}
+	if len(report.Failures) == 0 {
+		return nil
+	}
+	report.Partial = m.writePolicy == WriteQuorum && report.Succeeded >= m.quorum
+	return report
+}
+
+// writePrimary writes to the first backend and the rest in the background
+func (m *MultiStorage) writePrimary(ctx context.Context, record *Record, indexes []int) error {
+	if err := m.storages[indexes[0]].Write(ctx, record); err != nil {
+		return &MultiWriteError{
+			Policy:   WritePrimary,
+			Failures: []BackendError{{Index: indexes[0], Err: err}},
+		}
+	}
+
+	// Added under the lock so Close cannot start waiting in between
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		log.Printf("[audit] Skipping best-effort writes to %d storages: storage is closed", len(indexes)-1)
+		return nil
+	}
+	m.pending.Add(len(indexes) - 1)
+
+	// Background writes outlive the caller's context
+	bg := context.WithoutCancel(ctx)
+	for _, index := range indexes[1:] {
+		go func() {
+			defer m.pending.Done()
+			writeCtx, cancel := context.WithTimeout(bg, m.bestEffortTimeout)
+			defer cancel()
+			if err := m.storages[index].Write(writeCtx, record); err != nil {
+				log.Printf("[audit] Best-effort write to storage %d failed: %v", index, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// writeFailover writes to the backends in order until one succeeds
+func (m *MultiStorage) writeFailover(ctx context.Context, record *Record, indexes []int) error {
+	report := &MultiWriteError{Policy: WriteFailover}
+	for _, index := range indexes {
+		err := m.storages[index].Write(ctx, record)
+		if err == nil {
+			return nil
+		}
+		report.Failures = append(report.Failures, BackendError{Index: index, Err: err})
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return report
+}
+
+// Query queries the backends according to the query mode
+func (m *MultiStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record, error) {
+	return m.query(ctx, filter, nil)
+}
+
+// QueryWithReport implements ReportingQuerier, combining the reports of the
+// backends asked. It returns ErrReportNotSupported if one of them cannot
+// report.
+func (m *MultiStorage) QueryWithReport(ctx context.Context, filter *QueryFilter) ([]*Record, *QueryReport, error) {
+	report := &QueryReport{}
+	records, err := m.query(ctx, filter, report)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, report, nil
+}
+
+// query runs Query, filling report if not nil
+func (m *MultiStorage) query(ctx context.Context, filter *QueryFilter, report *QueryReport) ([]*Record, error) {
+	if m.queryMode == QueryFirst {
+		for _, s := range m.storages {
+			if s == nil {
+				continue
+			}
+			return queryInto(ctx, s, filter, report)
+		}
+		return nil, fmt.Errorf("no storage configured")
+	}
+
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	filter.Normalize()
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	targets, err := m.targets(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeQuery(ctx, targets, filter, report)
+}
+
+// Count counts records in the first storage backend, or sums the tiers in
+// QueryTiered mode. QueryMerge cannot count duplicates once and returns
+// ErrAggregationNotSupported.
+func (m *MultiStorage) Count(ctx context.Context, filter *QueryFilter) (int64, error) {
+	switch m.queryMode {
+	case QueryMerge:
+		return 0, ErrAggregationNotSupported
+	case QueryTiered:
+		if filter == nil {
+			filter = DefaultQueryFilter()
+		}
+		if err := filter.Validate(); err != nil {
+			return 0, err
+		}
+		targets, err := m.targets(filter)
+		if err != nil {
+			return 0, err
+		}
+		return countTargets(ctx, targets)
+	}
+
+	for _, s := range m.storages {
+		if s == nil {
+			continue
+		}
+		agg, err := aggregatorOf(s)
+		if err != nil {
+			return 0, err
+		}
+		return agg.Count(ctx, filter)
+	}
+	return 0, fmt.Errorf("no storage configured")
+}
+
+// GroupBy aggregates records in the first storage backend, or combines the
+// tiers in QueryTiered mode. QueryMerge returns ErrAggregationNotSupported.
+func (m *MultiStorage) GroupBy(ctx context.Context, filter *QueryFilter, fields []string, bucket time.Duration) ([]AggregateRow, error) {
+	switch m.queryMode {
+	case QueryMerge:
+		return nil, ErrAggregationNotSupported
+	case QueryTiered:
+		if filter == nil {
+			filter = DefaultQueryFilter()
+		}
+		if err := filter.Validate(); err != nil {
+			return nil, err
+		}
+		seconds, err := validateGroupBy(fields, bucket)
+		if err != nil {
+			return nil, err
+		}
+		targets, err := m.targets(filter)
+		if err != nil {
+			return nil, err
+		}
+		return groupTargets(ctx, targets, fields, bucket, seconds)
+	}
+
+	for _, s := range m.storages {
+		if s == nil {
+			continue
+		}
+		agg, err := aggregatorOf(s)
+		if err != nil {
+			return nil, err
+		}
+		return agg.GroupBy(ctx, filter, fields, bucket)
+	}
+	return nil, fmt.Errorf("no storage configured")
+}
+
+// queryTarget is a backend and the filter to send it
+type queryTarget struct {
+	index   int
+	storage Storage
+	filter  *QueryFilter
+}
+
+// targets returns the backends to ask for filter: every non-nil backend in
+// QueryMerge mode, and the tiers overlapping the time range (with the range
+// narrowed to the tier) in QueryTiered mode
+func (m *MultiStorage) targets(filter *QueryFilter) ([]queryTarget, error) {
+	now := time.Now().Unix()
+	var targets []queryTarget
+	for i, s := range m.storages {
+		if s == nil {
+			continue
+		}
+		if m.queryMode != QueryTiered {
+			targets = append(targets, queryTarget{index: i, storage: s, filter: filter})
+			continue
+		}
+
+		// Tier i holds [now-age(i), now-age(i-1)); the first tier is open
+		// towards the future and an age of 0 towards the past
+		var start, end int64
+		if age := m.tierAges[i]; age > 0 {
+			start = now - int64(age/time.Second)
+		}
+		if i > 0 {
+			end = now - int64(m.tierAges[i-1]/time.Second) - 1
+		}
+		sub := *filter
+		if start > sub.StartTime {
+			sub.StartTime = start
+		}
+		if end > 0 && (sub.EndTime == 0 || end < sub.EndTime) {
+			sub.EndTime = end
+		}
+		if sub.EndTime > 0 && sub.StartTime > sub.EndTime {
+			continue
+		}
+		targets = append(targets, queryTarget{index: i, storage: s, filter: &sub})
+	}
+	if len(targets) == 0 && m.queryMode != QueryTiered {
+		return nil, fmt.Errorf("no storage configured")
+	}
+	return targets, nil
+}
+
+// eachTarget runs fn for every target concurrently and returns the first
+// error
+func eachTarget(targets []queryTarget, fn func(i int, t queryTarget) error) error {
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, t)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to query storage %d: %w", targets[i].index, err)
+		}
+	}
+	return nil
+}
+
+// mergeQuery queries the targets concurrently and returns the requested
+// page of their merged, deduplicated results, adding their findings to
+// report if not nil. filter must be normalized.
+func mergeQuery(ctx context.Context, targets []queryTarget, filter *QueryFilter, report *QueryReport) ([]*Record, error) {
+	want := filter.Offset + filter.Limit
+	results := make([][]*Record, len(targets))
+	reports := make([]*QueryReport, len(targets))
+	err := eachTarget(targets, func(i int, t queryTarget) error {
+		if report != nil {
+			reports[i] = &QueryReport{}
+		}
+		records, err := queryTop(ctx, t.storage, t.filter, want, reports[i])
+		results[i] = records
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if report != nil {
+		for _, r := range reports {
+			report.merge(r)
+		}
+	}
+
+	var merged []*Record
+	for _, records := range results {
+		merged = append(merged, records...)
+	}
+	sortRecords(merged, filter)
+	merged = dedupeRecords(merged)
+
+	if filter.Offset >= len(merged) {
+		return []*Record{}, nil
+	}
+	end := filter.Offset + filter.Limit
+	if end > len(merged) {
+		end = len(merged)
+	}
+	return merged[filter.Offset:end], nil
+}
+
+// countTargets sums the counts of targets holding disjoint records
+func countTargets(ctx context.Context, targets []queryTarget) (int64, error) {
+	counts := make([]int64, len(targets))
+	err := eachTarget(targets, func(i int, t queryTarget) error {
+		agg, err := aggregatorOf(t.storage)
+		if err != nil {
+			return err
+		}
+		counts[i], err = agg.Count(ctx, t.filter)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	return total, nil
+}
+
+// groupTargets combines the groups of targets holding disjoint records
+func groupTargets(ctx context.Context, targets []queryTarget, fields []string, bucket time.Duration, seconds int64) ([]AggregateRow, error) {
+	results := make([][]AggregateRow, len(targets))
+	err := eachTarget(targets, func(i int, t queryTarget) error {
+		agg, err := aggregatorOf(t.storage)
+		if err != nil {
+			return err
+		}
+		results[i], err = agg.GroupBy(ctx, t.filter, fields, bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The same group (e.g. a time bucket) can come from several targets
+	counter := newGroupCounter(fields, seconds)
+	for _, rows := range results {
+		for _, row := range rows {
+			values := make([]string, len(fields))
+			for i, field := range fields {
+				values[i] = row.Groups[field]
+			}
+			counter.addRow(row.Bucket, values, row.Count)
+		}
+	}
+	return counter.result(), nil
+}
+
+// queryTop returns up to n leading records of s for filter, paging past the
+// per-query limit, and adds the findings of each page to report if not nil
+func queryTop(ctx context.Context, s Storage, filter *QueryFilter, n int, report *QueryReport) ([]*Record, error) {
+	var records []*Record
+	for len(records) < n {
+		page := *filter
+		page.Offset = len(records)
+		page.Limit = min(n-len(records), maxQueryLimit)
+		batch, err := queryInto(ctx, s, &page, report)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, batch...)
+		if len(batch) < page.Limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+// dedupeRecords keeps the first of records with the same EventID, or with
+// the same content when EventID is empty
+func dedupeRecords(records []*Record) []*Record {
+	seen := make(map[string]bool, len(records))
+	unique := records[:0]
+	for _, r := range records {
+		key := "id:" + r.EventID
+		if r.EventID == "" {
+			data, err := json.Marshal(r)
+			if err != nil {
+				unique = append(unique, r)
+				continue
+			}
+			sum := sha256.Sum256(data)
+			key = "hash:" + hex.EncodeToString(sum[:])
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, r)
+	}
+	return unique
+}
+
+// Purge purges matching records from every backend concurrently and returns
+// the total deleted; mirrored records count once per backend
+func (m *MultiStorage) Purge(ctx context.Context, olderThan time.Time, filter *QueryFilter) (int64, error) {
+	var targets []queryTarget
+	for i, s := range m.storages {
+		if s != nil {
+			targets = append(targets, queryTarget{index: i, storage: s, filter: filter})
+		}
+	}
+	return purgeTargets(ctx, targets, olderThan)
+}
+
+// Close waits for background writes and closes all storage backends
+func (m *MultiStorage) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.pending.Wait()
+
+	var firstErr error
+	for _, s := range m.storages {
+		if s == nil {
+			continue
+		}
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Storages returns all storage backends
+func (m *MultiStorage) Storages() []Storage {
+	return m.storages
+}
+
+// QueryMode returns the query mode
+func (m *MultiStorage) QueryMode() MultiQueryMode {
+	return m.queryMode
+}
+
+// WritePolicy returns the write policy
+func (m *MultiStorage) WritePolicy() MultiWritePolicy {
+	return m.writePolicy
+}
@@ -0,0 +1,514 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMultiTestRecord(id string, timestamp int64) *Record {
+	r := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("user-" + id)
+	r.EventID = id
+	r.Timestamp = timestamp
+	return r
+}
+
+func TestNewMultiStorageWithConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *MultiStorageConfig
+		count   int
+		mode    MultiQueryMode
+		wantErr string
+	}{
+		{name: "nil config", config: nil, count: 2, mode: QueryFirst},
+		{name: "empty mode", config: &MultiStorageConfig{}, count: 2, mode: QueryFirst},
+		{name: "merge", config: &MultiStorageConfig{QueryMode: QueryMerge}, count: 2, mode: QueryMerge},
+		{name: "tiered", config: &MultiStorageConfig{QueryMode: QueryTiered, TierAges: []time.Duration{time.Hour, 0}}, count: 2, mode: QueryTiered},
+		{name: "tiered bounded", config: &MultiStorageConfig{QueryMode: QueryTiered, TierAges: []time.Duration{time.Hour, 24 * time.Hour}}, count: 2, mode: QueryTiered},
+		{name: "unknown mode", config: &MultiStorageConfig{QueryMode: "random"}, count: 2, wantErr: "unsupported query mode"},
+		{name: "tier count mismatch", config: &MultiStorageConfig{QueryMode: QueryTiered, TierAges: []time.Duration{time.Hour}}, count: 2, wantErr: "one tier age per storage"},
+		{name: "negative age", config: &MultiStorageConfig{QueryMode: QueryTiered, TierAges: []time.Duration{-time.Hour, 0}}, count: 2, wantErr: "cannot be negative"},
+		{name: "unlimited first tier", config: &MultiStorageConfig{QueryMode: QueryTiered, TierAges: []time.Duration{0, time.Hour}}, count: 2, wantErr: "only the last tier"},
+		{name: "decreasing ages", config: &MultiStorageConfig{QueryMode: QueryTiered, TierAges: []time.Duration{time.Hour, time.Minute}}, count: 2, wantErr: "must increase"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storages := make([]Storage, tt.count)
+			for i := range storages {
+				storages[i] = NewNoopStorage()
+			}
+			multi, err := NewMultiStorageWithConfig(tt.config, storages...)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.mode, multi.QueryMode())
+		})
+	}
+}
+
+func TestMultiStorage_QueryMerge(t *testing.T) {
+	ctx := context.Background()
+	fileStorage, err := NewFileStorage(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	client, mr := newTestRedisClient(t)
+	defer mr.Close()
+	redisStorage := NewRedisStorage(client)
+
+	now := time.Now().Unix()
+	// a and c only in file, b and d in both, e only in redis
+	for _, r := range []*Record{
+		newMultiTestRecord("a", now-50),
+		newMultiTestRecord("b", now-40),
+		newMultiTestRecord("c", now-30),
+		newMultiTestRecord("d", now-20),
+	} {
+		require.NoError(t, fileStorage.Write(ctx, r))
+	}
+	for _, r := range []*Record{
+		newMultiTestRecord("b", now-40),
+		newMultiTestRecord("d", now-20),
+		newMultiTestRecord("e", now-10),
+	} {
+		require.NoError(t, redisStorage.Write(ctx, r))
+	}
+
+	multi, err := NewMultiStorageWithConfig(&MultiStorageConfig{QueryMode: QueryMerge}, fileStorage, nil, redisStorage)
+	require.NoError(t, err)
+	defer func() { _ = multi.Close() }()
+
+	ids := func(records []*Record) []string {
+		out := make([]string, len(records))
+		for i, r := range records {
+			out[i] = r.EventID
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		filter *QueryFilter
+		want   []string
+	}{
+		{name: "newest first", filter: DefaultQueryFilter(), want: []string{"e", "d", "c", "b", "a"}},
+		{name: "oldest first", filter: DefaultQueryFilter().WithSort("timestamp", "asc"), want: []string{"a", "b", "c", "d", "e"}},
+		{name: "global limit", filter: DefaultQueryFilter().WithLimit(2), want: []string{"e", "d"}},
+		{name: "global offset", filter: DefaultQueryFilter().WithLimit(2).WithOffset(2), want: []string{"c", "b"}},
+		{name: "offset past end", filter: DefaultQueryFilter().WithOffset(10), want: []string{}},
+		{name: "filtered", filter: DefaultQueryFilter().WithUserID("user-d"), want: []string{"d"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := multi.Query(ctx, tt.filter)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ids(records))
+		})
+	}
+}
+
+func TestMultiStorage_QueryMerge_DedupeByContent(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s1, err := NewFileStorage(filepath.Join(dir, "a.log"))
+	require.NoError(t, err)
+	s2, err := NewFileStorage(filepath.Join(dir, "b.log"))
+	require.NoError(t, err)
+
+	now := time.Now().Unix()
+	same := NewRecord(EventLogout, ResultSuccess).WithUserID("alice")
+	same.Timestamp = now
+	other := NewRecord(EventLogout, ResultSuccess).WithUserID("bob")
+	other.Timestamp = now
+	require.NoError(t, s1.Write(ctx, same))
+	require.NoError(t, s2.Write(ctx, same))
+	require.NoError(t, s2.Write(ctx, other))
+
+	multi, err := NewMultiStorageWithConfig(&MultiStorageConfig{QueryMode: QueryMerge}, s1, s2)
+	require.NoError(t, err)
+	defer func() { _ = multi.Close() }()
+
+	records, err := multi.Query(ctx, DefaultQueryFilter())
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestMultiStorage_QueryMerge_BeyondQueryLimit(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s1, err := NewFileStorage(filepath.Join(dir, "a.log"))
+	require.NoError(t, err)
+	s2, err := NewFileStorage(filepath.Join(dir, "b.log"))
+	require.NoError(t, err)
+
+	// s1 holds the 1200 newest records, s2 the next 10
+	now := time.Now().Unix()
+	for i := 0; i < 1200; i++ {
+		require.NoError(t, s1.Write(ctx, newMultiTestRecord(fmt.Sprintf("n%d", i), now-int64(i))))
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s2.Write(ctx, newMultiTestRecord(fmt.Sprintf("o%d", i), now-2000-int64(i))))
+	}
+
+	multi, err := NewMultiStorageWithConfig(&MultiStorageConfig{QueryMode: QueryMerge}, s1, s2)
+	require.NoError(t, err)
+	defer func() { _ = multi.Close() }()
+
+	records, err := multi.Query(ctx, DefaultQueryFilter().WithLimit(100).WithOffset(1150))
+	require.NoError(t, err)
+	require.Len(t, records, 60)
+	assert.Equal(t, "n1150", records[0].EventID)
+	assert.Equal(t, "o0", records[50].EventID)
+	assert.Equal(t, "o9", records[59].EventID)
+}
+
+func TestMultiStorage_QueryMerge_Errors(t *testing.T) {
+	ctx := context.Background()
+	fileStorage, err := NewFileStorage(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+
+	multi, err := NewMultiStorageWithConfig(&MultiStorageConfig{QueryMode: QueryMerge}, fileStorage, &errorStorage{})
+	require.NoError(t, err)
+
+	_, err = multi.Query(ctx, DefaultQueryFilter())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to query storage 1")
+
+	_, err = multi.Query(ctx, &QueryFilter{SortBy: "user_id"})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+
+	_, err = multi.Count(ctx, nil)
+	assert.ErrorIs(t, err, ErrAggregationNotSupported)
+	_, err = multi.GroupBy(ctx, nil, []string{"event_type"}, 0)
+	assert.ErrorIs(t, err, ErrAggregationNotSupported)
+
+	empty, err := NewMultiStorageWithConfig(&MultiStorageConfig{QueryMode: QueryMerge}, nil)
+	require.NoError(t, err)
+	_, err = empty.Query(ctx, nil)
+	assert.Error(t, err)
+}
+
+func TestMultiStorage_QueryTiered(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	hot, err := NewFileStorage(filepath.Join(dir, "hot.log"))
+	require.NoError(t, err)
+	cold, err := NewFileStorage(filepath.Join(dir, "cold.log"))
+	require.NoError(t, err)
+
+	now := time.Now().Unix()
+	day := int64(24 * 60 * 60)
+	// hot keeps a copy of everything it received, but only owns the last day
+	require.NoError(t, hot.Write(ctx, newMultiTestRecord("recent", now-60)))
+	require.NoError(t, hot.Write(ctx, newMultiTestRecord("stale", now-2*day)))
+	require.NoError(t, cold.Write(ctx, newMultiTestRecord("stale", now-2*day)))
+	require.NoError(t, cold.Write(ctx, newMultiTestRecord("old", now-10*day)))
+	// cold has not caught up with the last day
+	require.NoError(t, cold.Write(ctx, newMultiTestRecord("leak", now-120)))
+
+	multi, err := NewMultiStorageWithConfig(&MultiStorageConfig{
+		QueryMode: QueryTiered,
+		TierAges:  []time.Duration{24 * time.Hour, 0},
+	}, hot, cold)
+	require.NoError(t, err)
+	defer func() { _ = multi.Close() }()
+
+	ids := func(records []*Record) []string {
+		out := make([]string, len(records))
+		for i, r := range records {
+			out[i] = r.EventID
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		filter *QueryFilter
+		want   []string
+		count  int64
+	}{
+		{name: "all tiers", filter: DefaultQueryFilter(), want: []string{"recent", "stale", "old"}, count: 3},
+		{name: "hot only", filter: DefaultQueryFilter().WithTimeRange(now-3600, 0), want: []string{"recent"}, count: 1},
+		{name: "cold only", filter: DefaultQueryFilter().WithTimeRange(0, now-3*day), want: []string{"old"}, count: 1},
+		{name: "across tiers", filter: DefaultQueryFilter().WithTimeRange(now-3*day, now), want: []string{"recent", "stale"}, count: 2},
+		{name: "empty range", filter: DefaultQueryFilter().WithTimeRange(now+day, now+2*day), want: []string{}, count: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := multi.Query(ctx, tt.filter)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ids(records))
+
+			count, err := multi.Count(ctx, tt.filter)
+			require.NoError(t, err)
+			assert.Equal(t, tt.count, count)
+		})
+	}
+
+	rows, err := multi.GroupBy(ctx, nil, []string{"event_type"}, 0)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, int64(3), rows[0].Count)
+
+	_, err = multi.GroupBy(ctx, nil, nil, 0)
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+}
+
+func TestMultiStorage_QueryTiered_BoundedLastTier(t *testing.T) {
+	ctx := context.Background()
+	hot, err := NewFileStorage(filepath.Join(t.TempDir(), "hot.log"))
+	require.NoError(t, err)
+
+	now := time.Now().Unix()
+	require.NoError(t, hot.Write(ctx, newMultiTestRecord("recent", now-60)))
+	require.NoError(t, hot.Write(ctx, newMultiTestRecord("expired", now-7200)))
+
+	multi, err := NewMultiStorageWithConfig(&MultiStorageConfig{
+		QueryMode: QueryTiered,
+		TierAges:  []time.Duration{time.Hour},
+	}, hot)
+	require.NoError(t, err)
+
+	records, err := multi.Query(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "recent", records[0].EventID)
+}
+
+func TestNewMultiStorageWithConfig_WritePolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     *MultiStorageConfig
+		storages   []Storage
+		policy     MultiWritePolicy
+		wantQuorum int
+		wantErr    string
+	}{
+		{name: "default", config: &MultiStorageConfig{}, storages: []Storage{newMockStorage()}, policy: WriteAll},
+		{name: "primary", config: &MultiStorageConfig{WritePolicy: WritePrimary}, storages: []Storage{newMockStorage()}, policy: WritePrimary},
+		{name: "failover", config: &MultiStorageConfig{WritePolicy: WriteFailover}, storages: []Storage{newMockStorage()}, policy: WriteFailover},
+		{name: "majority of three", config: &MultiStorageConfig{WritePolicy: WriteQuorum}, storages: []Storage{newMockStorage(), newMockStorage(), newMockStorage()}, policy: WriteQuorum, wantQuorum: 2},
+		{name: "majority skips nil", config: &MultiStorageConfig{WritePolicy: WriteQuorum}, storages: []Storage{newMockStorage(), nil, newMockStorage()}, policy: WriteQuorum, wantQuorum: 2},
+		{name: "explicit quorum", config: &MultiStorageConfig{WritePolicy: WriteQuorum, Quorum: 1}, storages: []Storage{newMockStorage(), newMockStorage()}, policy: WriteQuorum, wantQuorum: 1},
+		{name: "quorum too large", config: &MultiStorageConfig{WritePolicy: WriteQuorum, Quorum: 3}, storages: []Storage{newMockStorage(), newMockStorage()}, wantErr: "quorum must be between 1 and 2"},
+		{name: "negative quorum", config: &MultiStorageConfig{WritePolicy: WriteQuorum, Quorum: -1}, storages: []Storage{newMockStorage()}, wantErr: "quorum must be between"},
+		{name: "unknown policy", config: &MultiStorageConfig{WritePolicy: "some"}, storages: []Storage{newMockStorage()}, wantErr: "unsupported write policy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			multi, err := NewMultiStorageWithConfig(tt.config, tt.storages...)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.policy, multi.WritePolicy())
+			assert.Equal(t, tt.wantQuorum, multi.quorum)
+		})
+	}
+}
+
+func TestMultiStorage_WritePolicies(t *testing.T) {
+	failing := func() *mockStorage {
+		s := newMockStorage()
+		s.shouldError = true
+		return s
+	}
+
+	tests := []struct {
+		name        string
+		config      *MultiStorageConfig
+		storages    []*mockStorage
+		wantErr     bool
+		wantPartial bool // The error matches ErrPartialWrite
+		wantFailed  []int
+		wantSuccess int
+		wantWritten []int // records per storage after Close
+	}{
+		{
+			name:        "all succeeds",
+			config:      &MultiStorageConfig{WritePolicy: WriteAll},
+			storages:    []*mockStorage{newMockStorage(), newMockStorage()},
+			wantWritten: []int{1, 1},
+		},
+		{
+			name:        "all with one failure",
+			config:      &MultiStorageConfig{WritePolicy: WriteAll},
+			storages:    []*mockStorage{newMockStorage(), failing()},
+			wantErr:     true,
+			wantFailed:  []int{1},
+			wantSuccess: 1,
+			wantWritten: []int{1, 0},
+		},
+		{
+			name:        "quorum met",
+			config:      &MultiStorageConfig{WritePolicy: WriteQuorum},
+			storages:    []*mockStorage{newMockStorage(), newMockStorage(), newMockStorage()},
+			wantWritten: []int{1, 1, 1},
+		},
+		{
+			name:        "quorum met with failure",
+			config:      &MultiStorageConfig{WritePolicy: WriteQuorum},
+			storages:    []*mockStorage{newMockStorage(), failing(), newMockStorage()},
+			wantErr:     true,
+			wantPartial: true,
+			wantFailed:  []int{1},
+			wantSuccess: 2,
+			wantWritten: []int{1, 0, 1},
+		},
+		{
+			name:        "quorum missed",
+			config:      &MultiStorageConfig{WritePolicy: WriteQuorum},
+			storages:    []*mockStorage{failing(), failing(), newMockStorage()},
+			wantErr:     true,
+			wantFailed:  []int{0, 1},
+			wantSuccess: 1,
+			wantWritten: []int{0, 0, 1},
+		},
+		{
+			name:        "primary succeeds, secondary fails",
+			config:      &MultiStorageConfig{WritePolicy: WritePrimary},
+			storages:    []*mockStorage{newMockStorage(), failing(), newMockStorage()},
+			wantWritten: []int{1, 0, 1},
+		},
+		{
+			name:        "primary fails",
+			config:      &MultiStorageConfig{WritePolicy: WritePrimary},
+			storages:    []*mockStorage{failing(), newMockStorage()},
+			wantErr:     true,
+			wantFailed:  []int{0},
+			wantWritten: []int{0, 0},
+		},
+		{
+			name:        "failover to second",
+			config:      &MultiStorageConfig{WritePolicy: WriteFailover},
+			storages:    []*mockStorage{failing(), newMockStorage(), newMockStorage()},
+			wantWritten: []int{0, 1, 0},
+		},
+		{
+			name:        "failover exhausted",
+			config:      &MultiStorageConfig{WritePolicy: WriteFailover},
+			storages:    []*mockStorage{failing(), failing()},
+			wantErr:     true,
+			wantFailed:  []int{0, 1},
+			wantWritten: []int{0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storages := make([]Storage, len(tt.storages))
+			for i, s := range tt.storages {
+				storages[i] = s
+			}
+			multi, err := NewMultiStorageWithConfig(tt.config, storages...)
+			require.NoError(t, err)
+
+			err = multi.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess))
+			if tt.wantErr {
+				var writeErr *MultiWriteError
+				require.ErrorAs(t, err, &writeErr)
+				assert.Equal(t, tt.config.WritePolicy, writeErr.Policy)
+				assert.Equal(t, tt.wantSuccess, writeErr.Succeeded)
+				assert.Equal(t, tt.wantPartial, writeErr.Partial)
+				assert.Equal(t, tt.wantPartial, errors.Is(err, ErrPartialWrite))
+				failed := make([]int, len(writeErr.Failures))
+				for i, f := range writeErr.Failures {
+					failed[i] = f.Index
+				}
+				assert.Equal(t, tt.wantFailed, failed)
+				assert.Contains(t, err.Error(), "write error")
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, multi.Close())
+			for i, s := range tt.storages {
+				assert.Equal(t, tt.wantWritten[i], s.getRecordCount(), "storage %d", i)
+			}
+		})
+	}
+}
+
+func TestMultiStorage_WriteConcurrent(t *testing.T) {
+	slow1 := newMockStorage()
+	slow1.writeDelay = 200 * time.Millisecond
+	slow2 := newMockStorage()
+	slow2.writeDelay = 200 * time.Millisecond
+
+	multi := NewMultiStorage(slow1, slow2)
+	start := time.Now()
+	require.NoError(t, multi.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess)))
+	assert.Less(t, time.Since(start), 350*time.Millisecond)
+	assert.Equal(t, 1, slow1.getRecordCount())
+	assert.Equal(t, 1, slow2.getRecordCount())
+}
+
+func TestMultiStorage_WritePrimary_Background(t *testing.T) {
+	primary := newMockStorage()
+	slow := newMockStorage()
+	slow.writeDelay = 100 * time.Millisecond
+
+	multi, err := NewMultiStorageWithConfig(&MultiStorageConfig{WritePolicy: WritePrimary}, primary, slow)
+	require.NoError(t, err)
+
+	// A canceled caller context does not abort background writes
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, multi.Write(ctx, NewRecord(EventLoginSuccess, ResultSuccess)))
+	cancel()
+	assert.Equal(t, 1, primary.getRecordCount())
+	assert.Equal(t, 0, slow.getRecordCount())
+
+	require.NoError(t, multi.Close())
+	assert.Equal(t, 1, slow.getRecordCount())
+
+	// Background writes are bounded by BestEffortTimeout
+	stuck := newMockStorage()
+	stuck.writeDelay = time.Minute
+	multi, err = NewMultiStorageWithConfig(&MultiStorageConfig{
+		WritePolicy:       WritePrimary,
+		BestEffortTimeout: 50 * time.Millisecond,
+	}, newMockStorage(), stuck)
+	require.NoError(t, err)
+	require.NoError(t, multi.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess)))
+	start := time.Now()
+	require.NoError(t, multi.Close())
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, 0, stuck.getRecordCount())
+}
+
+func TestMultiStorage_WritePrimary_AfterClose(t *testing.T) {
+	secondary := newMockStorage()
+	multi, err := NewMultiStorageWithConfig(&MultiStorageConfig{WritePolicy: WritePrimary}, newMockStorage(), secondary)
+	require.NoError(t, err)
+	require.NoError(t, multi.Close())
+
+	// No background write is started once Close has waited for them
+	require.NoError(t, multi.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess)))
+	require.NoError(t, multi.Close())
+	assert.Equal(t, 0, secondary.getRecordCount())
+}
+
+func TestMultiWriteError_Unwrap(t *testing.T) {
+	errA := errors.New("a failed")
+	err := error(&MultiWriteError{
+		Policy:   WriteAll,
+		Failures: []BackendError{{Index: 0, Err: errA}, {Index: 2, Err: context.DeadlineExceeded}},
+	})
+	assert.ErrorIs(t, err, errA)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, "failed to write to storages (policy all, 0 succeeded): storage 0: a failed; storage 2: context deadline exceeded", err.Error())
+}
@@ -0,0 +1,256 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+const (
+	// defaultPartitionsAhead is the number of upcoming months kept created
+	defaultPartitionsAhead = 3
+
+	// defaultPartitionInterval is how often partitions are maintained
+	defaultPartitionInterval = 24 * time.Hour
+
+	// mysqlMaxPartition catches MySQL rows past the created months
+	mysqlMaxPartition = "pmax"
+
+	// maxPostgresIdentifierLen is the PostgreSQL identifier limit
+	maxPostgresIdentifierLen = 63
+)
+
+// PartitionReport lists the partitions changed by MaintainPartitions
+type PartitionReport struct {
+	Created []string `json:"created,omitempty"`
+	Dropped []string `json:"dropped,omitempty"`
+}
+
+// monthStart returns the first second of the UTC month containing t
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// partitionSuffix names the partition of the month starting at month
+func partitionSuffix(month time.Time) string {
+	return month.Format("p200601")
+}
+
+// parsePartitionSuffix returns the month of a partition name ending in
+// partitionSuffix
+func parsePartitionSuffix(name string) (time.Time, bool) {
+	if len(name) < 7 {
+		return time.Time{}, false
+	}
+	month, err := time.Parse("p200601", name[len(name)-7:])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return month, true
+}
+
+// partitionDialect returns the dialect as a PartitionDialect
+func (s *DatabaseStorage) partitionDialect() (PartitionDialect, error) {
+	d, ok := s.dialect.(PartitionDialect)
+	if !ok {
+		return nil, fmt.Errorf("partitioning is not supported on %s", s.dialect.Name())
+	}
+	return d, nil
+}
+
+// partitionName returns the name of the month partition in the dialect
+func (s *DatabaseStorage) partitionName(month time.Time) string {
+	return s.dialect.(PartitionDialect).PartitionName(s.tableName, month)
+}
+
+// validatePartitioning checks the partitioning options of config
+func validatePartitioning(dialect Dialect, tableName string, config *DatabaseConfig) error {
+	if !config.Partitioned {
+		return nil
+	}
+	d, ok := dialect.(PartitionDialect)
+	if !ok {
+		return fmt.Errorf("partitioning is not supported on %s", dialect.Name())
+	}
+	if err := d.ValidatePartitioning(tableName); err != nil {
+		return err
+	}
+	if config.PartitionsAhead < 0 {
+		return fmt.Errorf("partitions ahead cannot be negative")
+	}
+	if config.PartitionRetention < 0 {
+		return fmt.Errorf("partition retention cannot be negative")
+	}
+	return nil
+}
+
+// MaintainPartitions creates the partitions for the current month and the
+// next PartitionsAhead months, and drops the partitions whose records are
+// all older than PartitionRetention. It runs on startup and every
+// PartitionInterval; call it directly from a scheduler instead if preferred.
+func (s *DatabaseStorage) MaintainPartitions(ctx context.Context) (*PartitionReport, error) {
+	if !s.partitioned {
+		return nil, fmt.Errorf("table %s is not partitioned", s.tableName)
+	}
+	return s.maintainPartitions(ctx, time.Now())
+}
+
+// maintainPartitions maintains the partitions as of now
+func (s *DatabaseStorage) maintainPartitions(ctx context.Context, now time.Time) (*PartitionReport, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	d, err := s.partitionDialect()
+	if err != nil {
+		return nil, err
+	}
+	report, err := s.updatePartitions(ctx, conn, d, now)
+	if err != nil || s.partitionRetention <= 0 {
+		return report, err
+	}
+	// Expiring rows changes no partition, so it runs without the lock
+	if err := s.expireUnpartitioned(ctx, conn, d, now.Add(-s.partitionRetention).Unix()); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// updatePartitions creates and drops the partitions as of now under the
+// migration lock
+func (s *DatabaseStorage) updatePartitions(ctx context.Context, conn *sql.Conn, d PartitionDialect, now time.Time) (*PartitionReport, error) {
+	// Instances maintaining the same table take turns with migrations
+	unlock, err := s.lockMigrations(ctx, conn, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var existing []time.Time
+	query, args := d.ListPartitionsQuery(s.tableName)
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to list partitions: %w", err)
+		}
+		// Catch-all partitions have no month suffix
+		if month, ok := parsePartitionSuffix(name); ok {
+			existing = append(existing, month)
+		}
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+	slices.SortFunc(existing, func(a, b time.Time) int { return a.Compare(b) })
+
+	report := &PartitionReport{}
+
+	// Create the missing upcoming months
+	var missing []time.Time
+	current := monthStart(now)
+	for i := 0; i <= s.partitionsAhead; i++ {
+		month := current.AddDate(0, i, 0)
+		if !slices.ContainsFunc(existing, month.Equal) {
+			missing = append(missing, month)
+		}
+	}
+	if added, statements := d.AddPartitions(s.tableName, existing, missing); len(added) > 0 {
+		if err := execStatements(ctx, conn, statements); err != nil {
+			return nil, fmt.Errorf("failed to create partitions: %w", err)
+		}
+		for _, month := range added {
+			report.Created = append(report.Created, d.PartitionName(s.tableName, month))
+		}
+	}
+
+	if s.partitionRetention <= 0 {
+		return report, nil
+	}
+
+	// Drop months that ended before the cutoff, never the current one
+	cutoff := now.Add(-s.partitionRetention).Unix()
+	var expired []string
+	for _, month := range existing {
+		if month.AddDate(0, 1, 0).Unix() <= cutoff && month.Before(current) {
+			expired = append(expired, d.PartitionName(s.tableName, month))
+		}
+	}
+	if len(expired) > 0 {
+		if err := execStatements(ctx, conn, d.DropPartitions(s.tableName, expired)); err != nil {
+			return report, fmt.Errorf("failed to drop partitions: %w", err)
+		}
+		report.Dropped = expired
+	}
+	return report, nil
+}
+
+// expireUnpartitioned deletes the rows older than cutoff outside the monthly
+// partitions, at most PurgeBatchSize rows per statement
+func (s *DatabaseStorage) expireUnpartitioned(ctx context.Context, conn *sql.Conn, d PartitionDialect, cutoff int64) error {
+	query := d.ExpireUnpartitioned(s.tableName, s.purgeBatchSize)
+	if query == "" {
+		return nil
+	}
+	for {
+		result, err := conn.ExecContext(ctx, query, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to expire default partition: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to expire default partition: %w", err)
+		}
+		if n < int64(s.purgeBatchSize) {
+			return nil
+		}
+	}
+}
+
+// startPartitionMaintenance maintains the partitions every interval until
+// Close
+func (s *DatabaseStorage) startPartitionMaintenance(interval time.Duration) {
+	s.stopMaintenance = make(chan struct{})
+	s.maintenanceDone = make(chan struct{})
+	go func() {
+		defer close(s.maintenanceDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopMaintenance:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+				report, err := s.maintainPartitions(ctx, time.Now())
+				cancel()
+				if err != nil {
+					log.Printf("[audit] Failed to maintain partitions of %s: %v", s.tableName, err)
+				} else if len(report.Created) > 0 || len(report.Dropped) > 0 {
+					log.Printf("[audit] Maintained partitions of %s: created=%v dropped=%v", s.tableName, report.Created, report.Dropped)
+				}
+			}
+		}
+	}()
+}
+
+// stopPartitionMaintenance stops the background maintenance, if running
+func (s *DatabaseStorage) stopPartitionMaintenance() {
+	if s.stopMaintenance == nil {
+		return
+	}
+	close(s.stopMaintenance)
+	<-s.maintenanceDone
+	s.stopMaintenance = nil
+}
@@ -0,0 +1,270 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePartitioning(t *testing.T) {
+	tests := []struct {
+		name      string
+		dialect   Dialect
+		tableName string
+		config    *DatabaseConfig
+		wantErr   string
+	}{
+		{name: "not partitioned", dialect: SQLiteDialect{}, tableName: "audit_logs", config: &DatabaseConfig{}},
+		{name: "postgres", dialect: PostgresDialect{}, tableName: "audit_logs", config: &DatabaseConfig{Partitioned: true}},
+		{name: "mysql", dialect: MySQLDialect{}, tableName: "audit_logs", config: &DatabaseConfig{Partitioned: true, PartitionsAhead: 6, PartitionRetention: 365 * 24 * time.Hour}},
+		{name: "sqlite", dialect: SQLiteDialect{}, tableName: "audit_logs", config: &DatabaseConfig{Partitioned: true}, wantErr: "partitioning is not supported on sqlite"},
+		{name: "postgres name too long", dialect: PostgresDialect{}, tableName: strings.Repeat("a", 55), config: &DatabaseConfig{Partitioned: true}, wantErr: "table name too long for partitioning: max 54 characters"},
+		{name: "negative ahead", dialect: MySQLDialect{}, tableName: "audit_logs", config: &DatabaseConfig{Partitioned: true, PartitionsAhead: -1}, wantErr: "partitions ahead cannot be negative"},
+		{name: "negative retention", dialect: MySQLDialect{}, tableName: "audit_logs", config: &DatabaseConfig{Partitioned: true, PartitionRetention: -time.Hour}, wantErr: "partition retention cannot be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePartitioning(tt.dialect, tt.tableName, tt.config)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestParsePartitionSuffix(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   time.Time
+		wantOK bool
+	}{
+		{name: "audit_logs_p202610", want: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), wantOK: true},
+		{name: "p202601", want: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), wantOK: true},
+		{name: "audit_logs_pdefault"},
+		{name: "pmax"},
+		{name: "p202613"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			month, ok := parsePartitionSuffix(tt.name)
+			assert.Equal(t, tt.wantOK, ok)
+			if tt.wantOK {
+				assert.True(t, tt.want.Equal(month), "got %s", month)
+			}
+		})
+	}
+}
+
+func TestNewDatabaseStorageFromDB_Partitioned_SQLite(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	_, err := NewDatabaseStorageFromDB(db, "sqlite", &DatabaseConfig{Partitioned: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "partitioning is not supported on sqlite")
+}
+
+func TestNewDatabaseStorageFromDB_Partitioned_Postgres(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS audit_logs \(\s+id BIGSERIAL,(?s).*PRIMARY KEY \(id, timestamp\)\s+\) PARTITION BY RANGE \(timestamp\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for range auditIndexColumns {
+		mock.ExpectExec("CREATE INDEX.*").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS audit_logs_pdefault PARTITION OF audit_logs DEFAULT")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for range lookupIndexColumns {
+		mock.ExpectExec("CREATE INDEX.*").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec("idx_audit_logs_metadata ON audit_logs USING GIN").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("pg_inherits").WithArgs("audit_logs").
+		WillReturnRows(sqlmock.NewRows([]string{"relname"}).AddRow("audit_logs_pdefault"))
+	for i := 0; i < 2; i++ {
+		mock.ExpectExec(`CREATE TABLE IF NOT EXISTS audit_logs_p\d{6} PARTITION OF audit_logs FOR VALUES FROM \(\d+\) TO \(\d+\)`).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	storage, err := NewDatabaseStorageFromDB(db, "postgres", &DatabaseConfig{Partitioned: true, PartitionsAhead: 1})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// Close stops the background maintenance before closing the database
+	mock.ExpectClose()
+	require.NoError(t, storage.Close())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDatabaseStorage_MaintainPartitions_Postgres(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	s := &DatabaseStorage{
+		db:                 db,
+		dialect:            PostgresDialect{},
+		tableName:          "audit_logs",
+		partitioned:        true,
+		partitionsAhead:    2,
+		partitionRetention: 90 * 24 * time.Hour,
+		purgeBatchSize:     2,
+	}
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	existing := sqlmock.NewRows([]string{"relname"}).AddRow("audit_logs_pdefault")
+	for month := 1; month <= 11; month++ {
+		existing.AddRow(s.partitionName(time.Date(2026, time.Month(month), 1, 0, 0, 0, 0, time.UTC)))
+	}
+	mock.ExpectExec("pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("pg_inherits").WillReturnRows(existing)
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS audit_logs_p202612 PARTITION OF audit_logs FOR VALUES FROM (1796083200) TO (1798761600)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	// Cutoff is 2026-07-17: months ending by then are dropped
+	for month := 1; month <= 6; month++ {
+		mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf("DROP TABLE IF EXISTS audit_logs_p2026%02d", month))).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+	// The default partition is expired in batches after the lock is released
+	expire := regexp.QuoteMeta("DELETE FROM audit_logs_pdefault WHERE id IN (SELECT id FROM audit_logs_pdefault WHERE timestamp < $1 ORDER BY id LIMIT 2)")
+	cutoff := now.Add(-90 * 24 * time.Hour).Unix()
+	mock.ExpectExec(expire).WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(expire).WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	report, err := s.maintainPartitions(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"audit_logs_p202612"}, report.Created)
+	assert.Equal(t, []string{
+		"audit_logs_p202601", "audit_logs_p202602", "audit_logs_p202603",
+		"audit_logs_p202604", "audit_logs_p202605", "audit_logs_p202606",
+	}, report.Dropped)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresDialect_AddPartitions_MovesDefaultRows(t *testing.T) {
+	month := time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC)
+	added, statements := PostgresDialect{}.AddPartitions("audit_logs", nil, []time.Time{month})
+	assert.Equal(t, []time.Time{month}, added)
+	require.Len(t, statements, 1)
+
+	inMonth := "timestamp >= 1796083200 AND timestamp < 1798761600"
+	statement := statements[0]
+	for _, want := range []string{
+		"IF EXISTS (SELECT 1 FROM audit_logs_pdefault WHERE " + inMonth + ")",
+		"ALTER TABLE audit_logs DETACH PARTITION audit_logs_pdefault;",
+		"CREATE TABLE IF NOT EXISTS audit_logs_p202612 PARTITION OF audit_logs FOR VALUES FROM (1796083200) TO (1798761600);",
+		"INSERT INTO audit_logs_p202612 SELECT * FROM audit_logs_pdefault WHERE " + inMonth + ";",
+		"DELETE FROM audit_logs_pdefault WHERE " + inMonth + ";",
+		"ALTER TABLE audit_logs ATTACH PARTITION audit_logs_pdefault DEFAULT;",
+	} {
+		assert.Contains(t, statement, want)
+	}
+	// The default partition is detached before, and attached after, the move
+	assert.Less(t, strings.Index(statement, "DETACH"), strings.Index(statement, "INSERT INTO"))
+	assert.Less(t, strings.Index(statement, "DELETE FROM"), strings.Index(statement, "ATTACH"))
+}
+
+func TestDatabaseStorage_MaintainPartitions_MySQL(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	t.Run("create after last month", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer func() { _ = db.Close() }()
+		s := &DatabaseStorage{db: db, dialect: MySQLDialect{}, tableName: "audit_logs", partitioned: true, partitionsAhead: 2}
+
+		mock.ExpectQuery("GET_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+		mock.ExpectQuery("information_schema.PARTITIONS").WithArgs("audit_logs").
+			WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("p202610").AddRow("pmax"))
+		mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE audit_logs REORGANIZE PARTITION pmax INTO (" +
+			"PARTITION p202611 VALUES LESS THAN (1796083200), " +
+			"PARTITION p202612 VALUES LESS THAN (1798761600), " +
+			"PARTITION pmax VALUES LESS THAN MAXVALUE)")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		report, err := s.maintainPartitions(context.Background(), now)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"p202611", "p202612"}, report.Created)
+		assert.Empty(t, report.Dropped)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("drop expired", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer func() { _ = db.Close() }()
+		s := &DatabaseStorage{db: db, dialect: MySQLDialect{}, tableName: "audit_logs", partitioned: true, partitionsAhead: 0, partitionRetention: 60 * 24 * time.Hour}
+
+		mock.ExpectQuery("GET_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+		mock.ExpectQuery("information_schema.PARTITIONS").
+			WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("p202607").AddRow("p202608").AddRow("p202609").AddRow("p202610").AddRow("pmax"))
+		mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE audit_logs DROP PARTITION p202607")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		report, err := s.maintainPartitions(context.Background(), now)
+		require.NoError(t, err)
+		assert.Empty(t, report.Created)
+		assert.Equal(t, []string{"p202607"}, report.Dropped)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("create fails", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer func() { _ = db.Close() }()
+		s := &DatabaseStorage{db: db, dialect: MySQLDialect{}, tableName: "audit_logs", partitioned: true, partitionsAhead: 1}
+
+		mock.ExpectQuery("GET_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+		mock.ExpectQuery("information_schema.PARTITIONS").
+			WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("p202610").AddRow("pmax"))
+		mock.ExpectExec("REORGANIZE").WillReturnError(errors.New("lock wait timeout"))
+		mock.ExpectExec("RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		_, err = s.maintainPartitions(context.Background(), now)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to create partitions: lock wait timeout")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestDatabaseStorage_TableStatements_MySQLPartitioned(t *testing.T) {
+	s := &DatabaseStorage{dialect: MySQLDialect{}, tableName: "audit_logs", partitioned: true}
+	statements, err := s.tableStatements()
+	require.NoError(t, err)
+	require.Len(t, statements, 1)
+
+	month := monthStart(time.Now())
+	assert.Contains(t, statements[0], "id BIGINT AUTO_INCREMENT,")
+	assert.Contains(t, statements[0], "PRIMARY KEY (id, timestamp)")
+	assert.Contains(t, statements[0], "PARTITION BY RANGE (timestamp) (PARTITION "+partitionSuffix(month)+" VALUES LESS THAN (")
+	assert.Contains(t, statements[0], "PARTITION pmax VALUES LESS THAN MAXVALUE)")
+}
+
+func TestDatabaseStorage_MaintainPartitions_NotPartitioned(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+	s, err := NewDatabaseStorageFromDB(db, "sqlite", nil)
+	require.NoError(t, err)
+
+	_, err = s.MaintainPartitions(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "table audit_logs is not partitioned")
+}
@@ -0,0 +1,343 @@
+package audit
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	secure "github.com/soulteary/secure-kit"
+)
+
+// PIIRedactedKey is the metadata key listing the detectors that fired on a record
+const PIIRedactedKey = "pii_redacted"
+
+// PIIDetector finds and masks one kind of PII in free text
+type PIIDetector struct {
+	// Name is reported in the pii_redacted metadata field (e.g. "email")
+	Name string
+
+	// Pattern matches candidate values
+	Pattern *regexp.Regexp
+
+	// Validate optionally rejects false positives (e.g. Luhn check for card numbers)
+	Validate func(match string) bool
+
+	// Mask replaces a match (default: "[REDACTED:<name>]")
+	Mask func(match string) string
+}
+
+// Built-in detector names
+const (
+	PIIEmail      = "email"
+	PIIPhone      = "phone"
+	PIICardNumber = "card_number"
+	PIINationalID = "national_id"
+	PIIJWT        = "jwt"
+	PIIAPIKey     = "api_key"
+)
+
+var (
+	piiJWTPattern    = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+	piiAPIKeyPattern = regexp.MustCompile(`\b(?:(?:sk|pk|rk)_(?:live|test)_[A-Za-z0-9]{10,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|xox[baprs]-[A-Za-z0-9-]{10,}|AIza[0-9A-Za-z_-]{35})\b`)
+	piiEmailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	// Chinese resident ID (18 chars with checksum) and US SSN
+	piiNationalIDPattern = regexp.MustCompile(`\b(?:\d{17}[\dXx]|\d{3}-\d{2}-\d{4})\b`)
+	piiCardPattern       = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	// E.164 with optional separators, Chinese mobile numbers and NANP formats
+	piiPhonePattern = regexp.MustCompile(`(?:\+\d{1,3}[ .-]?(?:\(\d{1,4}\)|\d{1,4})(?:[ .-]?\d{2,4}){1,4}|\b1[3-9]\d{9}\b|\(\d{3}\) ?\d{3}-\d{4}|\b\d{3}-\d{3}-\d{4}\b)`)
+)
+
+// DefaultPIIDetectors returns the built-in detectors in the order they are
+// applied: JWTs, API keys, emails, national IDs, card numbers, phone numbers.
+func DefaultPIIDetectors() []*PIIDetector {
+	return []*PIIDetector{
+		{
+			Name:    PIIJWT,
+			Pattern: piiJWTPattern,
+		},
+		{
+			Name:    PIIAPIKey,
+			Pattern: piiAPIKeyPattern,
+			Mask:    secure.MaskAPIKey,
+		},
+		{
+			Name:    PIIEmail,
+			Pattern: piiEmailPattern,
+			Mask:    MaskEmail,
+		},
+		{
+			Name:     PIINationalID,
+			Pattern:  piiNationalIDPattern,
+			Validate: validNationalID,
+			Mask:     maskKeepLast4,
+		},
+		{
+			Name:     PIICardNumber,
+			Pattern:  piiCardPattern,
+			Validate: validCardNumber,
+			Mask:     maskKeepLast4,
+		},
+		{
+			Name:     PIIPhone,
+			Pattern:  piiPhonePattern,
+			Validate: validPhoneNumber,
+			Mask:     MaskInternationalPhone,
+		},
+	}
+}
+
+// PIIScanner masks PII found in free-text record fields: Reason, UserAgent and
+// string values in Metadata (including nested maps and arrays).
+type PIIScanner struct {
+	detectors []*PIIDetector
+}
+
+// NewPIIScanner creates a scanner with the given detectors, applied in order.
+// Without detectors, DefaultPIIDetectors is used.
+func NewPIIScanner(detectors ...*PIIDetector) *PIIScanner {
+	if len(detectors) == 0 {
+		detectors = DefaultPIIDetectors()
+	}
+	return &PIIScanner{
+		detectors: detectors,
+	}
+}
+
+// ScanString masks every detected match in text and returns the masked text
+// with the names of the detectors that fired
+func (s *PIIScanner) ScanString(text string) (string, []string) {
+	if text == "" {
+		return text, nil
+	}
+	var fired []string
+	for _, d := range s.detectors {
+		if d == nil || d.Pattern == nil {
+			continue
+		}
+		hit := false
+		text = d.Pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if d.Validate != nil && !d.Validate(match) {
+				return match
+			}
+			hit = true
+			if d.Mask != nil {
+				return d.Mask(match)
+			}
+			return "[REDACTED:" + d.Name + "]"
+		})
+		if hit {
+			fired = append(fired, d.Name)
+		}
+	}
+	return text, fired
+}
+
+// Apply masks PII in record in place and returns the detectors that fired.
+// When anything is found, the detector names are recorded in
+// Metadata[PIIRedactedKey]. Metadata is cloned before being modified.
+func (s *PIIScanner) Apply(record *Record) []string {
+	if record == nil {
+		return nil
+	}
+	found := make(map[string]struct{})
+	collect := func(names []string) {
+		for _, n := range names {
+			found[n] = struct{}{}
+		}
+	}
+
+	var names []string
+	record.Reason, names = s.ScanString(record.Reason)
+	collect(names)
+	record.UserAgent, names = s.ScanString(record.UserAgent)
+	collect(names)
+
+	var metadata map[string]interface{}
+	for key, value := range record.Metadata {
+		if key == PIIRedactedKey {
+			continue
+		}
+		masked, changed := s.scanValue(value, collect)
+		if !changed {
+			continue
+		}
+		if metadata == nil {
+			metadata = cloneMetadata(record.Metadata)
+		}
+		metadata[key] = masked
+	}
+
+	if len(found) == 0 {
+		return nil
+	}
+	if metadata == nil {
+		metadata = cloneMetadata(record.Metadata)
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+	}
+	// Merge with detectors recorded by an earlier scan
+	switch prev := metadata[PIIRedactedKey].(type) {
+	case []string:
+		collect(prev)
+	case []interface{}:
+		for _, v := range prev {
+			if name, ok := v.(string); ok {
+				found[name] = struct{}{}
+			}
+		}
+	}
+
+	result := make([]string, 0, len(found))
+	for name := range found {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	metadata[PIIRedactedKey] = result
+	record.Metadata = metadata
+	return result
+}
+
+// scanValue masks string values in a metadata value, copying maps and slices
+// that contain changes
+func (s *PIIScanner) scanValue(value interface{}, collect func([]string)) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		masked, names := s.ScanString(v)
+		if len(names) == 0 {
+			return v, false
+		}
+		collect(names)
+		return masked, true
+	case map[string]interface{}:
+		var cp map[string]interface{}
+		for key, item := range v {
+			masked, changed := s.scanValue(item, collect)
+			if !changed {
+				continue
+			}
+			if cp == nil {
+				cp = cloneMetadata(v)
+			}
+			cp[key] = masked
+		}
+		if cp == nil {
+			return v, false
+		}
+		return cp, true
+	case []interface{}:
+		var cp []interface{}
+		for i, item := range v {
+			masked, changed := s.scanValue(item, collect)
+			if !changed {
+				continue
+			}
+			if cp == nil {
+				cp = append([]interface{}(nil), v...)
+			}
+			cp[i] = masked
+		}
+		if cp == nil {
+			return v, false
+		}
+		return cp, true
+	case []string:
+		var cp []string
+		for i, item := range v {
+			masked, names := s.ScanString(item)
+			if len(names) == 0 {
+				continue
+			}
+			collect(names)
+			if cp == nil {
+				cp = append([]string(nil), v...)
+			}
+			cp[i] = masked
+		}
+		if cp == nil {
+			return v, false
+		}
+		return cp, true
+	default:
+		return value, false
+	}
+}
+
+// digitsOf returns only the ASCII digits of s
+func digitsOf(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// validCardNumber reports whether s has 13-19 digits and passes the Luhn check
+func validCardNumber(s string) bool {
+	digits := digitsOf(s)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// validNationalID checks the ISO 7064 MOD 11-2 checksum of an 18-character
+// Chinese resident ID; SSN-formatted matches are accepted as-is
+func validNationalID(s string) bool {
+	if len(s) != 18 {
+		return strings.Count(s, "-") == 2
+	}
+	weights := []int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+	checks := "10X98765432"
+	sum := 0
+	for i := 0; i < 17; i++ {
+		sum += int(s[i]-'0') * weights[i]
+	}
+	return strings.EqualFold(string(checks[sum%11]), s[17:])
+}
+
+// validPhoneNumber reports whether s has a plausible number of digits
+func validPhoneNumber(s string) bool {
+	n := len(digitsOf(s))
+	return n >= 7 && n <= 15
+}
+
+// maskKeepLast4 masks every digit (and ID check character) except the last
+// four, keeping separators
+func maskKeepLast4(s string) string {
+	isMasked := func(r rune) bool { return (r >= '0' && r <= '9') || r == 'X' || r == 'x' }
+	total := 0
+	for _, r := range s {
+		if isMasked(r) {
+			total++
+		}
+	}
+	var b strings.Builder
+	seen := 0
+	for _, r := range s {
+		if isMasked(r) {
+			seen++
+			if seen <= total-4 {
+				b.WriteByte('*')
+				continue
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,422 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PseudonymField identifies a record field that can be pseudonymized
+type PseudonymField string
+
+const (
+	PseudonymUserID      PseudonymField = "user_id"
+	PseudonymDestination PseudonymField = "destination"
+	PseudonymIP          PseudonymField = "ip"
+)
+
+// DefaultPseudonymPrefix is prepended to every pseudonym token
+const DefaultPseudonymPrefix = "psn_"
+
+// minPseudonymKeyLen is the minimum HMAC key length accepted by NewPseudonymizer
+const minPseudonymKeyLen = 16
+
+// pseudonymTokenHexLen is the number of hex characters kept from the HMAC (128 bits)
+const pseudonymTokenHexLen = 32
+
+// ErrPseudonymNotFound is returned by a vault when a token is unknown
+var ErrPseudonymNotFound = errors.New("pseudonym not found")
+
+// PseudonymVault stores the mapping from pseudonym tokens back to raw values.
+// Access to a vault must be restricted to privileged re-identification tooling.
+type PseudonymVault interface {
+	// Store records the raw value for a token. Storing an existing token is a no-op.
+	Store(ctx context.Context, token, value string) error
+
+	// Lookup returns the raw value for a token, or ErrPseudonymNotFound
+	Lookup(ctx context.Context, token string) (string, error)
+}
+
+// PseudonymizerConfig holds configuration for the pseudonymizer
+type PseudonymizerConfig struct {
+	Key    []byte           // HMAC-SHA256 key (required, at least 16 bytes)
+	Fields []PseudonymField // Fields to pseudonymize (default: user_id, destination, ip)
+	Prefix string           // Token prefix (default: "psn_")
+	Vault  PseudonymVault   // Optional vault for lawful re-identification
+}
+
+// Pseudonymizer replaces identifiers with stable HMAC-based tokens.
+// The same input always maps to the same token, so events can still be
+// correlated without storing the raw identifier.
+type Pseudonymizer struct {
+	key    []byte
+	fields []PseudonymField
+	prefix string
+	vault  PseudonymVault
+}
+
+// NewPseudonymizer creates a new pseudonymizer
+func NewPseudonymizer(config *PseudonymizerConfig) (*Pseudonymizer, error) {
+	if config == nil {
+		return nil, fmt.Errorf("pseudonymizer config is required")
+	}
+	if len(config.Key) < minPseudonymKeyLen {
+		return nil, fmt.Errorf("pseudonymizer key too short: min %d bytes", minPseudonymKeyLen)
+	}
+
+	fields := config.Fields
+	if len(fields) == 0 {
+		fields = []PseudonymField{PseudonymUserID, PseudonymDestination, PseudonymIP}
+	}
+	for _, f := range fields {
+		switch f {
+		case PseudonymUserID, PseudonymDestination, PseudonymIP:
+		default:
+			return nil, fmt.Errorf("unsupported pseudonym field: %s", f)
+		}
+	}
+
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = DefaultPseudonymPrefix
+	}
+
+	key := make([]byte, len(config.Key))
+	copy(key, config.Key)
+
+	return &Pseudonymizer{
+		key:    key,
+		fields: fields,
+		prefix: prefix,
+		vault:  config.Vault,
+	}, nil
+}
+
+// Token returns the pseudonym token for a value. Empty values map to "".
+func (p *Pseudonymizer) Token(value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(value))
+	sum := hex.EncodeToString(mac.Sum(nil))
+	return p.prefix + sum[:pseudonymTokenHexLen]
+}
+
+// IsToken reports whether s looks like a token produced by this pseudonymizer
+func (p *Pseudonymizer) IsToken(s string) bool {
+	return isPseudonymToken(s, p.prefix)
+}
+
+// Fields returns the fields this pseudonymizer replaces
+func (p *Pseudonymizer) Fields() []PseudonymField {
+	return p.fields
+}
+
+// Apply replaces the configured fields of record with tokens in place.
+// Values that are already tokens are left unchanged. When a vault is configured,
+// each token is stored so it can later be resolved by a Depseudonymizer; the
+// first vault error is returned after all fields have been replaced.
+func (p *Pseudonymizer) Apply(ctx context.Context, record *Record) error {
+	if record == nil {
+		return nil
+	}
+
+	var firstErr error
+	for _, f := range p.fields {
+		ptr := pseudonymFieldPtr(record, f)
+		if ptr == nil || *ptr == "" || p.IsToken(*ptr) {
+			continue
+		}
+		raw := *ptr
+		token := p.Token(raw)
+		*ptr = token
+		if p.vault != nil {
+			if err := p.vault.Store(ctx, token, raw); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to store pseudonym: %w", err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// Depseudonymizer resolves pseudonym tokens back to raw values using a vault.
+// It is intentionally separate from Pseudonymizer so that only privileged
+// tooling holds the ability to re-identify subjects.
+type Depseudonymizer struct {
+	vault  PseudonymVault
+	prefix string
+}
+
+// NewDepseudonymizer creates a depseudonymizer for tokens with the default prefix
+func NewDepseudonymizer(vault PseudonymVault) *Depseudonymizer {
+	return NewDepseudonymizerWithPrefix(vault, DefaultPseudonymPrefix)
+}
+
+// NewDepseudonymizerWithPrefix creates a depseudonymizer for tokens with a custom prefix
+func NewDepseudonymizerWithPrefix(vault PseudonymVault, prefix string) *Depseudonymizer {
+	if prefix == "" {
+		prefix = DefaultPseudonymPrefix
+	}
+	return &Depseudonymizer{
+		vault:  vault,
+		prefix: prefix,
+	}
+}
+
+// Reveal returns the raw value for a token
+func (d *Depseudonymizer) Reveal(ctx context.Context, token string) (string, error) {
+	if d.vault == nil {
+		return "", fmt.Errorf("pseudonym vault not configured")
+	}
+	if !isPseudonymToken(token, d.prefix) {
+		return "", fmt.Errorf("not a pseudonym token")
+	}
+	return d.vault.Lookup(ctx, token)
+}
+
+// RevealRecord returns a copy of record with UserID, Destination and IP
+// resolved to their raw values. Fields that are not tokens are copied as-is.
+func (d *Depseudonymizer) RevealRecord(ctx context.Context, record *Record) (*Record, error) {
+	if record == nil {
+		return nil, nil
+	}
+	cp := record.Copy()
+	for _, f := range []PseudonymField{PseudonymUserID, PseudonymDestination, PseudonymIP} {
+		ptr := pseudonymFieldPtr(cp, f)
+		if !isPseudonymToken(*ptr, d.prefix) {
+			continue
+		}
+		raw, err := d.Reveal(ctx, *ptr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reveal %s: %w", f, err)
+		}
+		*ptr = raw
+	}
+	return cp, nil
+}
+
+// pseudonymFieldPtr returns a pointer to the record field for f
+func pseudonymFieldPtr(record *Record, f PseudonymField) *string {
+	switch f {
+	case PseudonymUserID:
+		return &record.UserID
+	case PseudonymDestination:
+		return &record.Destination
+	case PseudonymIP:
+		return &record.IP
+	default:
+		return nil
+	}
+}
+
+// isPseudonymToken reports whether s is prefix followed by a hex HMAC digest
+func isPseudonymToken(s, prefix string) bool {
+	if len(s) != len(prefix)+pseudonymTokenHexLen || !strings.HasPrefix(s, prefix) {
+		return false
+	}
+	for _, c := range s[len(prefix):] {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// FilePseudonymVault stores pseudonym mappings in a local JSON Lines file.
+// The file is created with 0600 permissions; keep it outside of the audit log
+// directory and restrict access to it.
+type FilePseudonymVault struct {
+	filePath string
+	file     *os.File
+	entries  map[string]string
+	mu       sync.Mutex
+}
+
+type pseudonymVaultEntry struct {
+	Token string `json:"token"`
+	Value string `json:"value"`
+}
+
+// NewFilePseudonymVault opens (or creates) a file-backed pseudonym vault.
+// filePath must come from trusted configuration only.
+func NewFilePseudonymVault(filePath string) (*FilePseudonymVault, error) {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	entries := make(map[string]string)
+	if existing, err := os.Open(filePath); err == nil {
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(make([]byte, 0, 64), MaxRecordJSONSize)
+		for scanner.Scan() {
+			var entry pseudonymVaultEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Token == "" {
+				continue
+			}
+			entries[entry.Token] = entry.Value
+		}
+		scanErr := scanner.Err()
+		_ = existing.Close()
+		if scanErr != nil {
+			return nil, fmt.Errorf("failed to read vault: %w", scanErr)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open vault: %w", err)
+	}
+
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vault: %w", err)
+	}
+
+	return &FilePseudonymVault{
+		filePath: filePath,
+		file:     file,
+		entries:  entries,
+	}, nil
+}
+
+// Store appends the mapping to the vault file if the token is new
+func (v *FilePseudonymVault) Store(ctx context.Context, token, value string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.entries[token]; ok {
+		return nil
+	}
+
+	data, err := json.Marshal(pseudonymVaultEntry{Token: token, Value: value})
+	if err != nil {
+		return fmt.Errorf("failed to marshal vault entry: %w", err)
+	}
+	if _, err := v.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write vault entry: %w", err)
+	}
+
+	v.entries[token] = value
+	return nil
+}
+
+// Lookup returns the raw value for token
+func (v *FilePseudonymVault) Lookup(ctx context.Context, token string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	value, ok := v.entries[token]
+	if !ok {
+		return "", ErrPseudonymNotFound
+	}
+	return value, nil
+}
+
+// Close closes the vault file
+func (v *FilePseudonymVault) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.file != nil {
+		return v.file.Close()
+	}
+	return nil
+}
+
+// maxVaultCacheEntries bounds the set of tokens DatabasePseudonymVault remembers
+// as already stored, so repeated Store calls for hot tokens skip the database.
+const maxVaultCacheEntries = 100000
+
+// DatabasePseudonymVault stores pseudonym mappings in a database table.
+// Supports the registered dialects, see RegisterDialect.
+type DatabasePseudonymVault struct {
+	db        *sql.DB
+	dialect   Dialect
+	tableName string
+	known     map[string]struct{}
+	mu        sync.Mutex
+}
+
+// NewDatabasePseudonymVault creates a database-backed pseudonym vault and its
+// table (default name: "audit_pseudonyms") if it does not exist
+func NewDatabasePseudonymVault(db *sql.DB, dbType string, tableName string) (*DatabasePseudonymVault, error) {
+	if tableName == "" {
+		tableName = "audit_pseudonyms"
+	}
+	if err := validateTableName(tableName); err != nil {
+		return nil, err
+	}
+
+	dialect, err := dialectFor(dbType)
+	if err != nil {
+		return nil, err
+	}
+	createSQL := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			token VARCHAR(100) PRIMARY KEY,
+			value TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT %s
+		)`, tableName, dialect.CurrentTimestamp())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, createSQL); err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+
+	return &DatabasePseudonymVault{
+		db:        db,
+		dialect:   dialect,
+		tableName: tableName,
+		known:     make(map[string]struct{}),
+	}, nil
+}
+
+// Store inserts the mapping unless the token already exists
+func (v *DatabasePseudonymVault) Store(ctx context.Context, token, value string) error {
+	v.mu.Lock()
+	_, ok := v.known[token]
+	v.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	query := v.dialect.InsertIgnore(v.tableName, []string{"token", "value"}, "token")
+
+	if _, err := v.db.ExecContext(ctx, query, token, value); err != nil {
+		return fmt.Errorf("failed to insert pseudonym: %w", err)
+	}
+
+	v.mu.Lock()
+	if len(v.known) >= maxVaultCacheEntries {
+		v.known = make(map[string]struct{})
+	}
+	v.known[token] = struct{}{}
+	v.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the raw value for token
+func (v *DatabasePseudonymVault) Lookup(ctx context.Context, token string) (string, error) {
+	query := fmt.Sprintf("SELECT value FROM %s WHERE token = %s", v.tableName, v.dialect.Placeholder(1))
+
+	var value string
+	err := v.db.QueryRowContext(ctx, query, token).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrPseudonymNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup pseudonym: %w", err)
+	}
+	return value, nil
+}
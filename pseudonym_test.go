@@ -0,0 +1,273 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPseudonymKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestPseudonymizer(t *testing.T, vault PseudonymVault) *Pseudonymizer {
+	p, err := NewPseudonymizer(&PseudonymizerConfig{Key: testPseudonymKey, Vault: vault})
+	require.NoError(t, err)
+	return p
+}
+
+func TestNewPseudonymizer_Errors(t *testing.T) {
+	_, err := NewPseudonymizer(nil)
+	assert.Error(t, err)
+
+	_, err = NewPseudonymizer(&PseudonymizerConfig{Key: []byte("short")})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "key too short")
+
+	_, err = NewPseudonymizer(&PseudonymizerConfig{Key: testPseudonymKey, Fields: []PseudonymField{"reason"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported pseudonym field")
+}
+
+func TestPseudonymizer_Token(t *testing.T) {
+	p := newTestPseudonymizer(t, nil)
+
+	token := p.Token("13800138000")
+	assert.True(t, strings.HasPrefix(token, DefaultPseudonymPrefix))
+	assert.Len(t, token, len(DefaultPseudonymPrefix)+32)
+	assert.Equal(t, token, p.Token("13800138000"), "tokens must be stable")
+	assert.NotEqual(t, token, p.Token("13800138001"))
+	assert.Equal(t, "", p.Token(""))
+	assert.True(t, p.IsToken(token))
+	assert.False(t, p.IsToken("13800138000"))
+
+	other, err := NewPseudonymizer(&PseudonymizerConfig{Key: []byte("another-key-0123456789")})
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other.Token("13800138000"), "different keys must produce different tokens")
+}
+
+func TestPseudonymizer_Apply(t *testing.T) {
+	p := newTestPseudonymizer(t, nil)
+
+	record := NewRecord(EventSendSuccess, ResultSuccess).
+		WithUserID("user123").
+		WithDestination("13800138000").
+		WithIP("192.168.1.1").
+		WithChallengeID("ch_1")
+
+	require.NoError(t, p.Apply(context.Background(), record))
+	assert.Equal(t, p.Token("user123"), record.UserID)
+	assert.Equal(t, p.Token("13800138000"), record.Destination)
+	assert.Equal(t, p.Token("192.168.1.1"), record.IP)
+	assert.Equal(t, "ch_1", record.ChallengeID)
+
+	// Applying twice must not double-pseudonymize
+	userToken := record.UserID
+	require.NoError(t, p.Apply(context.Background(), record))
+	assert.Equal(t, userToken, record.UserID)
+
+	assert.NoError(t, p.Apply(context.Background(), nil))
+}
+
+func TestPseudonymizer_Apply_SelectedFields(t *testing.T) {
+	p, err := NewPseudonymizer(&PseudonymizerConfig{
+		Key:    testPseudonymKey,
+		Fields: []PseudonymField{PseudonymDestination},
+		Prefix: "p_",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []PseudonymField{PseudonymDestination}, p.Fields())
+
+	record := NewRecord(EventSendSuccess, ResultSuccess).
+		WithUserID("user123").
+		WithDestination("user@example.com")
+	require.NoError(t, p.Apply(context.Background(), record))
+
+	assert.Equal(t, "user123", record.UserID)
+	assert.True(t, strings.HasPrefix(record.Destination, "p_"))
+}
+
+type failingPseudonymVault struct{}
+
+func (failingPseudonymVault) Store(ctx context.Context, token, value string) error {
+	return errors.New("vault unavailable")
+}
+
+func (failingPseudonymVault) Lookup(ctx context.Context, token string) (string, error) {
+	return "", errors.New("vault unavailable")
+}
+
+func TestPseudonymizer_Apply_VaultError(t *testing.T) {
+	p := newTestPseudonymizer(t, failingPseudonymVault{})
+
+	record := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("user123")
+	err := p.Apply(context.Background(), record)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to store pseudonym")
+	// The raw identifier must never be kept even when the vault fails
+	assert.Equal(t, p.Token("user123"), record.UserID)
+}
+
+func TestFilePseudonymVault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault", "pseudonyms.jsonl")
+	vault, err := NewFilePseudonymVault(path)
+	require.NoError(t, err)
+
+	p := newTestPseudonymizer(t, vault)
+	record := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("user123").WithIP("10.0.0.1")
+	require.NoError(t, p.Apply(context.Background(), record))
+	// Storing the same token again is a no-op
+	require.NoError(t, vault.Store(context.Background(), record.UserID, "user123"))
+	require.NoError(t, vault.Close())
+
+	// Reopen and resolve
+	vault, err = NewFilePseudonymVault(path)
+	require.NoError(t, err)
+	defer func() { _ = vault.Close() }()
+	assert.Len(t, vault.entries, 2)
+
+	d := NewDepseudonymizer(vault)
+	raw, err := d.Reveal(context.Background(), record.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, "user123", raw)
+
+	_, err = vault.Lookup(context.Background(), p.Token("unknown"))
+	assert.ErrorIs(t, err, ErrPseudonymNotFound)
+}
+
+func TestDatabasePseudonymVault(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	vault, err := NewDatabasePseudonymVault(db, "sqlite", "")
+	require.NoError(t, err)
+
+	p := newTestPseudonymizer(t, vault)
+	record := NewRecord(EventSendSuccess, ResultSuccess).
+		WithUserID("user123").
+		WithDestination("13800138000")
+	require.NoError(t, p.Apply(context.Background(), record))
+	// Duplicate stores are ignored
+	vault.known = make(map[string]struct{})
+	require.NoError(t, vault.Store(context.Background(), record.UserID, "user123"))
+
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM audit_pseudonyms").Scan(&count))
+	assert.Equal(t, 2, count)
+
+	raw, err := vault.Lookup(context.Background(), record.Destination)
+	require.NoError(t, err)
+	assert.Equal(t, "13800138000", raw)
+
+	_, err = vault.Lookup(context.Background(), p.Token("unknown"))
+	assert.ErrorIs(t, err, ErrPseudonymNotFound)
+}
+
+func TestNewDatabasePseudonymVault_Errors(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+
+	_, err := NewDatabasePseudonymVault(db, "oracle", "")
+	assert.Error(t, err)
+
+	_, err = NewDatabasePseudonymVault(db, "sqlite", "bad-name")
+	assert.Error(t, err)
+}
+
+func TestDepseudonymizer_RevealRecord(t *testing.T) {
+	vault, err := NewFilePseudonymVault(filepath.Join(t.TempDir(), "vault.jsonl"))
+	require.NoError(t, err)
+	defer func() { _ = vault.Close() }()
+
+	p := newTestPseudonymizer(t, vault)
+	original := NewRecord(EventSendSuccess, ResultSuccess).
+		WithUserID("user123").
+		WithDestination("13800138000").
+		WithIP("192.168.1.1")
+	pseudonymized := original.Copy()
+	require.NoError(t, p.Apply(context.Background(), pseudonymized))
+
+	d := NewDepseudonymizer(vault)
+	revealed, err := d.RevealRecord(context.Background(), pseudonymized)
+	require.NoError(t, err)
+	assert.Equal(t, original.UserID, revealed.UserID)
+	assert.Equal(t, original.Destination, revealed.Destination)
+	assert.Equal(t, original.IP, revealed.IP)
+	// Input is not modified
+	assert.True(t, p.IsToken(pseudonymized.UserID))
+
+	revealed, err = d.RevealRecord(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Nil(t, revealed)
+}
+
+func TestDepseudonymizer_Errors(t *testing.T) {
+	_, err := NewDepseudonymizer(nil).Reveal(context.Background(), "psn_x")
+	assert.Error(t, err)
+
+	vault, err := NewFilePseudonymVault(filepath.Join(t.TempDir(), "vault.jsonl"))
+	require.NoError(t, err)
+	defer func() { _ = vault.Close() }()
+
+	d := NewDepseudonymizerWithPrefix(vault, "")
+	_, err = d.Reveal(context.Background(), "user123")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not a pseudonym token")
+
+	p := newTestPseudonymizer(t, nil)
+	record := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID(p.Token("user123"))
+	_, err = d.RevealRecord(context.Background(), record)
+	assert.ErrorIs(t, err, ErrPseudonymNotFound)
+}
+
+func TestLogger_Log_Pseudonymize(t *testing.T) {
+	store := newTestStorage()
+	p := newTestPseudonymizer(t, nil)
+	config := DefaultConfig()
+	config.Pseudonymizer = p
+	logger := NewLogger(store, config)
+
+	record := NewRecord(EventSendSuccess, ResultSuccess).
+		WithUserID("user123").
+		WithChannel("sms").
+		WithDestination("13800138000").
+		WithIP("192.168.1.1")
+	logger.Log(context.Background(), record)
+
+	records := store.getRecords()
+	require.Len(t, records, 1)
+	assert.Equal(t, p.Token("user123"), records[0].UserID)
+	// Destination token is not masked so it stays correlatable
+	assert.Equal(t, p.Token("13800138000"), records[0].Destination)
+	assert.Equal(t, p.Token("192.168.1.1"), records[0].IP)
+	// Caller's record is unchanged
+	assert.Equal(t, "user123", record.UserID)
+}
+
+func TestLogger_Log_PseudonymizeVaultError(t *testing.T) {
+	store := newTestStorage()
+	p := newTestPseudonymizer(t, failingPseudonymVault{})
+	config := DefaultConfig()
+	config.Pseudonymizer = p
+	logger := NewLogger(store, config)
+	var failed *Record
+	var failedErr error
+	logger.SetPseudonymizeFailedCallback(func(record *Record, err error) {
+		failed, failedErr = record, err
+	})
+
+	// The event is kept with its token even though the vault lost the mapping
+	record := NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("user123")
+	logger.Log(context.Background(), record)
+
+	records := store.getRecords()
+	require.Len(t, records, 1)
+	assert.Equal(t, p.Token("user123"), records[0].UserID)
+	// The callback gets the raw record so the mapping can be stored again
+	assert.Same(t, record, failed)
+	assert.Equal(t, "user123", failed.UserID)
+	assert.ErrorContains(t, failedErr, "failed to store pseudonym")
+}
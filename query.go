@@ -0,0 +1,732 @@
+package audit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxQueryLength  = 4096 // Maximum text query length in bytes
+	maxQueryNesting = 32   // Maximum nesting of parentheses and NOT in a text query
+	maxExprDepth    = 100  // Maximum depth of an Expr tree
+)
+
+// Expr is a boolean expression over record fields, usually built by
+// ParseQuery. Exactly one member is set.
+type Expr struct {
+	And []*Expr `json:"and,omitempty"`
+	Or  []*Expr `json:"or,omitempty"`
+	Not *Expr   `json:"not,omitempty"`
+
+	Condition *Condition         `json:"condition,omitempty"`
+	Metadata  *MetadataCondition `json:"metadata,omitempty"`
+	Time      *TimeRange         `json:"time,omitempty"`
+	Text      string             `json:"text,omitempty"` // See QueryFilter.Text
+}
+
+// TimeRange bounds Record.Timestamp. Both ends are inclusive Unix
+// timestamps; 0 leaves that end open.
+type TimeRange struct {
+	Start int64 `json:"start,omitempty"`
+	End   int64 `json:"end,omitempty"`
+}
+
+// QueryParseError reports a syntax error in a text query.
+// It wraps ErrInvalidFilter.
+type QueryParseError struct {
+	Pos int    // Byte offset in the query where the error was found
+	Msg string // Description of the problem
+}
+
+func (e *QueryParseError) Error() string {
+	return fmt.Sprintf("query parse error at position %d: %s", e.Pos, e.Msg)
+}
+
+// Unwrap returns ErrInvalidFilter
+func (e *QueryParseError) Unwrap() error {
+	return ErrInvalidFilter
+}
+
+// ParseQuery parses a text query such as
+//
+//	event_type:login_failed AND ip:10.0.0.0/8 AND timestamp>now-24h
+//
+// Terms are combined with AND (also implied between terms), OR, NOT or a
+// leading "-", and parentheses. A term is one of:
+//
+//	quota              text search (see QueryFilter.Text)
+//	"quota exceeded"   text search for a phrase
+//	field:a,b          field equals a or b ("=" also works, "!=" negates)
+//	field:abc*         field starts with abc
+//	field:*            field is not empty
+//	ip:10.0.0.0/8      ip is inside the range
+//	timestamp>now-24h  also >=, <, <= and ":"; times are now[-+]N(s|m|h|d|w),
+//	                   Unix seconds, RFC 3339 or YYYY-MM-DD (UTC)
+//	meta.key:value     metadata equals value; numbers and true/false are typed
+//	meta.key:*         metadata key exists
+//	meta.key>=3        numeric metadata comparison
+//
+// Fields are those accepted by conditions (see Where). Values containing
+// spaces or special characters, or that should stay strings, are quoted
+// with "; a quoted "*" is literal. Relative times are resolved against now.
+// An empty query returns a nil expression.
+func ParseQuery(query string, now time.Time) (*Expr, error) {
+	if len(query) > maxQueryLength {
+		return nil, &QueryParseError{Pos: maxQueryLength, Msg: fmt.Sprintf("query too long: max %d bytes", maxQueryLength)}
+	}
+
+	p := &queryParser{input: query, now: now}
+	p.skipSpace()
+	if p.eof() {
+		return nil, nil
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf(p.pos, "unexpected %q", p.input[p.pos])
+	}
+	return expr, nil
+}
+
+// CompileQuery parses query relative to the current time and returns a
+// default filter restricted to it
+func CompileQuery(query string) (*QueryFilter, error) {
+	expr, err := ParseQuery(query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return DefaultQueryFilter().WhereExpr(expr), nil
+}
+
+// WhereExpr restricts the filter to records matching e. Top-level AND terms
+// are merged into Conditions, Metadata and the time range so backends can
+// use their indexes; the rest is kept in Expr.
+func (f *QueryFilter) WhereExpr(e *Expr) *QueryFilter {
+	if e == nil {
+		return f
+	}
+	terms := []*Expr{e}
+	if len(e.And) > 0 {
+		terms = e.And
+	}
+
+	var rest []*Expr
+	if f.Expr != nil {
+		rest = append(rest, f.Expr)
+	}
+	for _, t := range terms {
+		switch {
+		case t.Condition != nil:
+			f.Conditions = append(f.Conditions, *t.Condition)
+		case t.Metadata != nil:
+			f.Metadata = append(f.Metadata, *t.Metadata)
+		case t.Text != "" && f.Text == "":
+			f.Text = t.Text
+		case t.Time != nil:
+			if t.Time.Start > f.StartTime {
+				f.StartTime = t.Time.Start
+			}
+			if t.Time.End > 0 && (f.EndTime == 0 || t.Time.End < f.EndTime) {
+				f.EndTime = t.Time.End
+			}
+		default:
+			rest = append(rest, t)
+		}
+	}
+	if len(rest) > 0 {
+		f.Expr = allOf(rest)
+	}
+	return f
+}
+
+// allOf returns the conjunction of exprs, flattening nested ANDs
+func allOf(exprs []*Expr) *Expr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	var terms []*Expr
+	for _, e := range exprs {
+		if len(e.And) > 0 {
+			terms = append(terms, e.And...)
+		} else {
+			terms = append(terms, e)
+		}
+	}
+	return &Expr{And: terms}
+}
+
+// anyOf returns the disjunction of exprs, flattening nested ORs
+func anyOf(exprs []*Expr) *Expr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	var terms []*Expr
+	for _, e := range exprs {
+		if len(e.Or) > 0 {
+			terms = append(terms, e.Or...)
+		} else {
+			terms = append(terms, e)
+		}
+	}
+	return &Expr{Or: terms}
+}
+
+func (e *Expr) validate(depth int) error {
+	if depth > maxExprDepth {
+		return fmt.Errorf("%w: expression nested too deeply", ErrInvalidFilter)
+	}
+	set := 0
+	for _, ok := range []bool{len(e.And) > 0, len(e.Or) > 0, e.Not != nil, e.Condition != nil, e.Metadata != nil, e.Time != nil, e.Text != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("%w: expression must have exactly one member set", ErrInvalidFilter)
+	}
+
+	switch {
+	case e.Not != nil:
+		return e.Not.validate(depth + 1)
+	case e.Condition != nil:
+		return e.Condition.validate()
+	case e.Metadata != nil:
+		return e.Metadata.validate()
+	case e.Text != "":
+		return validateText(e.Text)
+	case e.Time != nil:
+		if e.Time.Start < 0 || e.Time.End < 0 {
+			return fmt.Errorf("%w: time range cannot be negative", ErrInvalidFilter)
+		}
+		return nil
+	}
+	for _, sub := range append(e.And, e.Or...) {
+		if sub == nil {
+			return fmt.Errorf("%w: nil expression", ErrInvalidFilter)
+		}
+		if err := sub.validate(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether record satisfies the expression.
+// The expression must have been validated.
+func (e *Expr) matches(record *Record) bool {
+	switch {
+	case len(e.And) > 0:
+		for _, sub := range e.And {
+			if !sub.matches(record) {
+				return false
+			}
+		}
+		return true
+	case len(e.Or) > 0:
+		for _, sub := range e.Or {
+			if sub.matches(record) {
+				return true
+			}
+		}
+		return false
+	case e.Not != nil:
+		return !e.Not.matches(record)
+	case e.Condition != nil:
+		return e.Condition.matches(record)
+	case e.Metadata != nil:
+		return e.Metadata.matches(record.Metadata)
+	case e.Text != "":
+		needle := textNeedle(e.Text)
+		return needle == "" || matchesText(record, needle)
+	case e.Time != nil:
+		return (e.Time.Start == 0 || record.Timestamp >= e.Time.Start) &&
+			(e.Time.End == 0 || record.Timestamp <= e.Time.End)
+	}
+	return false
+}
+
+// queryParser is a recursive descent parser over the query text
+type queryParser struct {
+	input   string
+	pos     int
+	nesting int
+	now     time.Time
+}
+
+// queryValue is a value in a term; quoted values are never wildcards
+type queryValue struct {
+	text   string
+	quoted bool
+	pos    int
+}
+
+func (p *queryParser) errorf(pos int, format string, args ...interface{}) error {
+	return &QueryParseError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *queryParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *queryParser) skipSpace() {
+	for !p.eof() && isQuerySpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// consume advances past c if it is the next byte
+func (p *queryParser) consume(c byte) bool {
+	if !p.eof() && p.input[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// keyword consumes kw (case-insensitive) if it is a whole word at the
+// current position
+func (p *queryParser) keyword(kw string) bool {
+	end := p.pos + len(kw)
+	if end > len(p.input) || !strings.EqualFold(p.input[p.pos:end], kw) {
+		return false
+	}
+	if end < len(p.input) && !isQuerySpace(p.input[end]) && p.input[end] != '(' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+// peekKeyword reports whether kw is next without consuming it
+func (p *queryParser) peekKeyword(kw string) bool {
+	pos := p.pos
+	ok := p.keyword(kw)
+	p.pos = pos
+	return ok
+}
+
+// scanWhile consumes bytes accepted by fn and returns them
+func (p *queryParser) scanWhile(fn func(byte) bool) string {
+	start := p.pos
+	for !p.eof() && fn(p.input[p.pos]) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isFieldChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '.' || c == '-'
+}
+
+func isValueChar(c byte) bool {
+	return !isQuerySpace(c) && c != ',' && c != '(' && c != ')' && c != '"'
+}
+
+// parseOr parses terms separated by OR
+func (p *queryParser) parseOr() (*Expr, error) {
+	var terms []*Expr
+	for {
+		e, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, e)
+		p.skipSpace()
+		if !p.keyword("OR") {
+			return anyOf(terms), nil
+		}
+	}
+}
+
+// parseAnd parses terms separated by AND or by whitespace alone
+func (p *queryParser) parseAnd() (*Expr, error) {
+	var terms []*Expr
+	for {
+		p.skipSpace()
+		explicit := len(terms) > 0 && p.keyword("AND")
+		if explicit {
+			p.skipSpace()
+		}
+		if p.eof() || p.input[p.pos] == ')' || p.peekKeyword("OR") {
+			if !explicit && len(terms) == 0 && p.peekKeyword("OR") {
+				return nil, p.errorf(p.pos, "expected a term before OR")
+			}
+			if explicit || len(terms) == 0 {
+				return nil, p.errorf(p.pos, "expected a term")
+			}
+			return allOf(terms), nil
+		}
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, e)
+	}
+}
+
+// parseUnary parses a negation, a parenthesized expression or a term
+func (p *queryParser) parseUnary() (*Expr, error) {
+	p.skipSpace()
+	start := p.pos
+	for _, kw := range []string{"AND", "OR"} {
+		if p.peekKeyword(kw) {
+			return nil, p.errorf(start, "expected a term before %s", kw)
+		}
+	}
+
+	negate := p.keyword("NOT") || p.consume('-')
+	open := !negate && p.consume('(')
+	if negate || open {
+		p.nesting++
+		if p.nesting > maxQueryNesting {
+			return nil, p.errorf(start, "query nested too deeply: max %d levels", maxQueryNesting)
+		}
+		defer func() { p.nesting-- }()
+	}
+
+	if negate {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{Not: e}, nil
+	}
+	if open {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume(')') {
+			return nil, p.errorf(p.pos, "expected ')' to close '(' at position %d", start)
+		}
+		return e, nil
+	}
+	return p.parseTerm()
+}
+
+// parseTerm parses "field op value[,value...]", or a bare word or quoted
+// phrase searched as text
+func (p *queryParser) parseTerm() (*Expr, error) {
+	start := p.pos
+	if p.eof() {
+		return nil, p.errorf(start, "expected a term")
+	}
+	if p.input[p.pos] == '"' {
+		return p.textTerm()
+	}
+
+	field := p.scanWhile(isFieldChar)
+	opPos := p.pos
+	op := ""
+	for _, candidate := range []string{":", "!=", ">=", "<=", "=", ">", "<"} {
+		if field != "" && strings.HasPrefix(p.input[p.pos:], candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		p.pos = start
+		return p.textTerm()
+	}
+	p.pos += len(op)
+
+	var values []queryValue
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if !p.consume(',') {
+			break
+		}
+	}
+	if len(values) > 1 && op != ":" && op != "=" && op != "!=" {
+		return nil, p.errorf(values[1].pos-1, "operator %s takes a single value", op)
+	}
+
+	switch {
+	case field == "timestamp":
+		return p.timeTerm(opPos, op, values)
+	case strings.HasPrefix(field, "meta."):
+		return p.metadataTerm(start, field[len("meta."):], op, values)
+	}
+	if _, ok := filterFields[field]; !ok {
+		return nil, p.errorf(start, "unknown field %q", field)
+	}
+	return p.fieldTerm(opPos, field, op, values)
+}
+
+// textTerm parses a bare word or quoted phrase as a text search
+func (p *queryParser) textTerm() (*Expr, error) {
+	start := p.pos
+	v, err := p.parseValue()
+	if err != nil {
+		if p.input[start] == '"' {
+			return nil, err
+		}
+		return nil, p.errorf(start, "expected a term, found %q", p.input[start])
+	}
+	if strings.TrimSpace(v.text) == "" {
+		return nil, p.errorf(start, "empty search text")
+	}
+	if err := validateText(v.text); err != nil {
+		return nil, p.errorf(start, "search text too long: max %d bytes", maxTextLen)
+	}
+	return &Expr{Text: v.text}, nil
+}
+
+// parseValue parses a bare or double-quoted value
+func (p *queryParser) parseValue() (queryValue, error) {
+	start := p.pos
+	if !p.consume('"') {
+		text := p.scanWhile(isValueChar)
+		if text == "" {
+			return queryValue{}, p.errorf(start, "expected a value")
+		}
+		return queryValue{text: text, pos: start}, nil
+	}
+
+	var b strings.Builder
+	for !p.eof() {
+		c := p.input[p.pos]
+		p.pos++
+		switch {
+		case c == '"':
+			return queryValue{text: b.String(), quoted: true, pos: start}, nil
+		case c == '\\' && !p.eof():
+			b.WriteByte(p.input[p.pos])
+			p.pos++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return queryValue{}, p.errorf(start, "unterminated quoted value")
+}
+
+// fieldTerm builds conditions on a record field. Values of different kinds
+// (exact, prefix, CIDR, non-empty) are combined with OR, or with AND when
+// the term is negated.
+func (p *queryParser) fieldTerm(opPos int, field, op string, values []queryValue) (*Expr, error) {
+	negate := op == "!="
+	if op != ":" && op != "=" && !negate {
+		return nil, p.errorf(opPos, "operator %s only applies to timestamp and meta.* fields", op)
+	}
+
+	var exact, prefixes, ranges []string
+	nonEmpty := false
+	for _, v := range values {
+		switch {
+		case !v.quoted && v.text == "*":
+			nonEmpty = true
+		case !v.quoted && strings.HasSuffix(v.text, "*"):
+			prefixes = append(prefixes, strings.TrimSuffix(v.text, "*"))
+		case field == "ip" && !v.quoted && strings.Contains(v.text, "/"):
+			if _, err := parseCIDR(v.text); err != nil {
+				return nil, p.errorf(v.pos, "invalid CIDR range %q", v.text)
+			}
+			ranges = append(ranges, v.text)
+		default:
+			exact = append(exact, v.text)
+		}
+	}
+
+	var terms []*Expr
+	leaf := func(c Condition) {
+		terms = append(terms, &Expr{Condition: &c})
+	}
+	if len(exact) > 0 {
+		if negate {
+			leaf(NotIn(field, exact...))
+		} else {
+			leaf(In(field, exact...))
+		}
+	}
+	if len(prefixes) > 0 {
+		if negate {
+			leaf(NotHasPrefix(field, prefixes...))
+		} else {
+			leaf(HasPrefix(field, prefixes...))
+		}
+	}
+	if len(ranges) > 0 {
+		if negate {
+			leaf(NotInCIDR(ranges...))
+		} else {
+			leaf(InCIDR(ranges...))
+		}
+	}
+	if nonEmpty {
+		if negate {
+			leaf(In(field, ""))
+		} else {
+			leaf(NotIn(field, ""))
+		}
+	}
+	if negate {
+		return allOf(terms), nil
+	}
+	return anyOf(terms), nil
+}
+
+// timeTerm builds a time range from a timestamp comparison. A date stands
+// for its whole day, so timestamp:2024-05-01 matches all of it and
+// timestamp<=2024-05-01 includes it.
+func (p *queryParser) timeTerm(opPos int, op string, values []queryValue) (*Expr, error) {
+	if len(values) > 1 {
+		return nil, p.errorf(values[1].pos-1, "timestamp takes a single value")
+	}
+	v := values[0]
+	first, last, err := p.parseTime(v)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &TimeRange{}
+	switch op {
+	case ":", "=":
+		r.Start, r.End = first, last
+	case ">":
+		r.Start = last + 1
+	case ">=":
+		r.Start = first
+	case "<":
+		r.End = first - 1
+	case "<=":
+		r.End = last
+	default:
+		return nil, p.errorf(opPos, "operator %s does not apply to timestamp", op)
+	}
+	// 0 would leave the bound open
+	if (op == "<" || op == "<=") && r.End <= 0 {
+		return nil, p.errorf(v.pos, "time %q is before the Unix epoch", v.text)
+	}
+	return &Expr{Time: r}, nil
+}
+
+// parseTime parses now[-+]N(s|m|h|d|w), Unix seconds, RFC 3339 or a UTC
+// date, and returns the first and last second it covers: the same second,
+// or the whole day of a date
+func (p *queryParser) parseTime(v queryValue) (int64, int64, error) {
+	if ts, ok := p.relativeTime(v.text); ok {
+		return ts, ts, nil
+	}
+	if ts, err := strconv.ParseInt(v.text, 10, 64); err == nil && ts >= 0 {
+		return ts, ts, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v.text); err == nil {
+		return t.Unix(), t.Unix(), nil
+	}
+	if t, err := time.Parse("2006-01-02", v.text); err == nil {
+		return t.Unix(), t.AddDate(0, 0, 1).Unix() - 1, nil
+	}
+	return 0, 0, p.errorf(v.pos, "invalid time %q: use now-24h, Unix seconds, RFC 3339 or YYYY-MM-DD", v.text)
+}
+
+// relativeTime parses "now" with an optional offset such as "now-7d"
+func (p *queryParser) relativeTime(s string) (int64, bool) {
+	rest, ok := strings.CutPrefix(s, "now")
+	if !ok {
+		return 0, false
+	}
+	if rest == "" {
+		return p.now.Unix(), true
+	}
+	if len(rest) < 3 || (rest[0] != '-' && rest[0] != '+') {
+		return 0, false
+	}
+
+	var unit int64
+	switch rest[len(rest)-1] {
+	case 's':
+		unit = 1
+	case 'm':
+		unit = 60
+	case 'h':
+		unit = 3600
+	case 'd':
+		unit = 86400
+	case 'w':
+		unit = 7 * 86400
+	default:
+		return 0, false
+	}
+	n, err := strconv.ParseInt(rest[1:len(rest)-1], 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt32 {
+		return 0, false
+	}
+	if rest[0] == '-' {
+		n = -n
+	}
+	return p.now.Unix() + n*unit, true
+}
+
+// metadataTerm builds conditions on a metadata key
+func (p *queryParser) metadataTerm(start int, key, op string, values []queryValue) (*Expr, error) {
+	if err := validateMetadataKey(key); err != nil {
+		return nil, p.errorf(start, "invalid metadata key %q: use letters, digits, '_', '.' and '-' (max %d)", key, maxMetadataKeyLen)
+	}
+
+	var terms []*Expr
+	leaf := func(c MetadataCondition) {
+		terms = append(terms, &Expr{Metadata: &c})
+	}
+	switch op {
+	case ">", ">=", "<", "<=":
+		v := values[0]
+		n, err := strconv.ParseFloat(v.text, 64)
+		if v.quoted || err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, p.errorf(v.pos, "operator %s needs a number, got %q", op, v.text)
+		}
+		ops := map[string]MetadataOp{">": MetaGt, ">=": MetaGte, "<": MetaLt, "<=": MetaLte}
+		leaf(MetadataCompare(key, ops[op], n))
+		return terms[0], nil
+	}
+
+	negate := op == "!="
+	for _, v := range values {
+		switch {
+		case !v.quoted && v.text == "*" && negate:
+			leaf(MetadataNotExists(key))
+		case !v.quoted && v.text == "*":
+			leaf(MetadataExists(key))
+		case negate:
+			leaf(MetadataNotEquals(key, metadataQueryValue(v)))
+		default:
+			leaf(MetadataEquals(key, metadataQueryValue(v)))
+		}
+	}
+	if negate {
+		return allOf(terms), nil
+	}
+	return anyOf(terms), nil
+}
+
+// metadataQueryValue types a bare value as a bool or number when it looks
+// like one; quoted values stay strings
+func metadataQueryValue(v queryValue) interface{} {
+	if v.quoted {
+		return v.text
+	}
+	switch v.text {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if n, err := strconv.ParseFloat(v.text, 64); err == nil && !math.IsNaN(n) && !math.IsInf(n, 0) {
+		return n
+	}
+	return v.text
+}
@@ -0,0 +1,325 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func condExpr(c Condition) *Expr {
+	return &Expr{Condition: &c}
+}
+
+func metaExpr(c MetadataCondition) *Expr {
+	return &Expr{Metadata: &c}
+}
+
+func TestParseQuery(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+
+	tests := []struct {
+		query    string
+		expected *Expr
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"event_type:login_failed", condExpr(In("event_type", "login_failed"))},
+		{"event_type=login_failed", condExpr(In("event_type", "login_failed"))},
+		{
+			"event_type:login_failed result:failure",
+			&Expr{And: []*Expr{condExpr(In("event_type", "login_failed")), condExpr(In("result", "failure"))}},
+		},
+		{
+			"user_id:alice OR user_id:bob AND result:failure",
+			&Expr{Or: []*Expr{
+				condExpr(In("user_id", "alice")),
+				{And: []*Expr{condExpr(In("user_id", "bob")), condExpr(In("result", "failure"))}},
+			}},
+		},
+		{
+			"user_id:a or user_id:b or user_id:c",
+			&Expr{Or: []*Expr{condExpr(In("user_id", "a")), condExpr(In("user_id", "b")), condExpr(In("user_id", "c"))}},
+		},
+		{
+			"NOT (channel:sms OR channel:email)",
+			&Expr{Not: &Expr{Or: []*Expr{condExpr(In("channel", "sms")), condExpr(In("channel", "email"))}}},
+		},
+		{"-channel:sms", &Expr{Not: condExpr(In("channel", "sms"))}},
+		{"not(channel:sms)", &Expr{Not: condExpr(In("channel", "sms"))}},
+		{"channel:sms,email", condExpr(In("channel", "sms", "email"))},
+		{"user_id:svc_*", condExpr(HasPrefix("user_id", "svc_"))},
+		{"user_id:*", condExpr(NotIn("user_id", ""))},
+		{`user_id:"*"`, condExpr(In("user_id", "*"))},
+		{`user_id:""`, condExpr(In("user_id", ""))},
+		{
+			"user_id!=svc_*,root",
+			&Expr{And: []*Expr{condExpr(NotIn("user_id", "root")), condExpr(NotHasPrefix("user_id", "svc_"))}},
+		},
+		{"ip:2001:db8::/32", condExpr(InCIDR("2001:db8::/32"))},
+		{
+			"ip:10.0.0.0/8,10.1.2.3",
+			&Expr{Or: []*Expr{condExpr(In("ip", "10.1.2.3")), condExpr(InCIDR("10.0.0.0/8"))}},
+		},
+		{"ip!=10.0.0.0/8", condExpr(NotInCIDR("10.0.0.0/8"))},
+		{`ip:"192.168.1.0/24"`, condExpr(In("ip", "192.168.1.0/24"))},
+		{`resource:"/api/v1 (admin)"`, condExpr(In("resource", "/api/v1 (admin)"))},
+		{`user_id:"a\"b\\c"`, condExpr(In("user_id", `a"b\c`))},
+		{"timestamp>now-24h", &Expr{Time: &TimeRange{Start: 1_000_000 - 86400 + 1}}},
+		{"timestamp>=now-2w", &Expr{Time: &TimeRange{Start: 1_000_000 - 14*86400}}},
+		{"timestamp<now", &Expr{Time: &TimeRange{End: 1_000_000 - 1}}},
+		{"timestamp<=now+30m", &Expr{Time: &TimeRange{End: 1_000_000 + 1800}}},
+		{"timestamp:1700000000", &Expr{Time: &TimeRange{Start: 1_700_000_000, End: 1_700_000_000}}},
+		{"timestamp>=2026-01-02", &Expr{Time: &TimeRange{Start: 1_767_312_000}}},
+		// A date covers its whole UTC day
+		{"timestamp:2026-01-02", &Expr{Time: &TimeRange{Start: 1_767_312_000, End: 1_767_312_000 + 86399}}},
+		{"timestamp=2026-01-02", &Expr{Time: &TimeRange{Start: 1_767_312_000, End: 1_767_312_000 + 86399}}},
+		{"timestamp<=2026-01-02", &Expr{Time: &TimeRange{End: 1_767_312_000 + 86399}}},
+		{"timestamp>2026-01-02", &Expr{Time: &TimeRange{Start: 1_767_312_000 + 86400}}},
+		{"timestamp<2026-01-02", &Expr{Time: &TimeRange{End: 1_767_312_000 - 1}}},
+		{"timestamp<=2026-01-02T01:00:00+01:00", &Expr{Time: &TimeRange{End: 1_767_312_000}}},
+		{"meta.tenant_id:acme", metaExpr(MetadataEquals("tenant_id", "acme"))},
+		{
+			"meta.tenant_id:acme,42,true",
+			&Expr{Or: []*Expr{
+				metaExpr(MetadataEquals("tenant_id", "acme")),
+				metaExpr(MetadataEquals("tenant_id", float64(42))),
+				metaExpr(MetadataEquals("tenant_id", true)),
+			}},
+		},
+		{`meta.tenant_id:"42"`, metaExpr(MetadataEquals("tenant_id", "42"))},
+		{"meta.tenant_id!=acme", metaExpr(MetadataNotEquals("tenant_id", "acme"))},
+		{"meta.app.id:*", metaExpr(MetadataExists("app.id"))},
+		{"meta.app_id!=*", metaExpr(MetadataNotExists("app_id"))},
+		{"meta.attempts>=3", metaExpr(MetadataCompare("attempts", MetaGte, 3))},
+		{"meta.score<-0.5", metaExpr(MetadataCompare("score", MetaLt, -0.5))},
+		{"quota", &Expr{Text: "quota"}},
+		{`"Quota exceeded" -event_type:login_failed`, &Expr{And: []*Expr{{Text: "Quota exceeded"}, {Not: condExpr(In("event_type", "login_failed"))}}}},
+		{"quota exceeded!", &Expr{And: []*Expr{{Text: "quota"}, {Text: "exceeded!"}}}},
+		{"event_type", &Expr{Text: "event_type"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := ParseQuery(tt.query, now)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, expr)
+		})
+	}
+}
+
+func TestParseQuery_Errors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{"event_type:", 11, "expected a value"},
+		{"event_type:(a OR b)", 11, "expected a value"},
+		{"foo:bar", 0, `unknown field "foo"`},
+		{"(event_type:x", 13, "expected ')' to close '(' at position 0"},
+		{"event_type:x)", 12, "unexpected ')'"},
+		{"event_type:x AND", 16, "expected a term"},
+		{"event_type:x OR OR y:z", 16, "expected a term before OR"},
+		{"AND event_type:x", 0, "expected a term before AND"},
+		{"()", 1, "expected a term"},
+		{",x:y", 0, "expected a term, found ','"},
+		{`""`, 0, "empty search text"},
+		{`"` + strings.Repeat("a", maxTextLen+1) + `"`, 0, "search text too long"},
+		{"-", 1, "expected a term"},
+		{"timestamp>yesterday", 10, `invalid time "yesterday"`},
+		{"timestamp>now-1y", 10, `invalid time "now-1y"`},
+		{"timestamp!=5", 9, "operator != does not apply to timestamp"},
+		{"timestamp>5,6", 11, "operator > takes a single value"},
+		{"timestamp:5,6", 11, "timestamp takes a single value"},
+		{"timestamp<1", 10, `time "1" is before the Unix epoch`},
+		{"user_id>5", 7, "operator > only applies to timestamp and meta.* fields"},
+		{"meta.:x", 0, `invalid metadata key ""`},
+		{"meta.n>abc", 7, `operator > needs a number, got "abc"`},
+		{`meta.n>"3"`, 7, `operator > needs a number`},
+		{"ip:10.0.0.0/33", 3, `invalid CIDR range "10.0.0.0/33"`},
+		{`user_id:"abc`, 8, "unterminated quoted value"},
+		{strings.Repeat("(", 40) + "user_id:a", 32, "nested too deeply"},
+		{strings.Repeat("NOT ", 40) + "user_id:a", 128, "nested too deeply"},
+		{"user_id:" + strings.Repeat("a", maxQueryLength), maxQueryLength, "query too long"},
+	}
+
+	for _, tt := range tests {
+		name := tt.query
+		if len(name) > 40 {
+			name = name[:40]
+		}
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseQuery(tt.query, time.Now())
+			require.Error(t, err)
+			assert.ErrorIs(t, err, ErrInvalidFilter)
+
+			var parseErr *QueryParseError
+			require.True(t, errors.As(err, &parseErr))
+			assert.Equal(t, tt.pos, parseErr.Pos)
+			assert.Contains(t, parseErr.Msg, tt.msg)
+		})
+	}
+
+	_, err := ParseQuery("foo:bar", time.Now())
+	assert.EqualError(t, err, `query parse error at position 0: unknown field "foo"`)
+}
+
+func TestCompileQuery(t *testing.T) {
+	filter, err := CompileQuery("event_type:login_failed timestamp>=100 timestamp<=200 meta.vip:true (user_id:a OR user_id:b)")
+	require.NoError(t, err)
+
+	assert.Equal(t, 100, filter.Limit)
+	assert.Equal(t, []Condition{In("event_type", "login_failed")}, filter.Conditions)
+	assert.Equal(t, []MetadataCondition{MetadataEquals("vip", true)}, filter.Metadata)
+	assert.Equal(t, int64(100), filter.StartTime)
+	assert.Equal(t, int64(200), filter.EndTime)
+	assert.Equal(t, &Expr{Or: []*Expr{condExpr(In("user_id", "a")), condExpr(In("user_id", "b"))}}, filter.Expr)
+	assert.NoError(t, filter.Validate())
+
+	filter, err = CompileQuery("  ")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultQueryFilter(), filter)
+
+	_, err = CompileQuery("event_type:")
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+}
+
+func TestQueryFilter_WhereExpr(t *testing.T) {
+	or := &Expr{Or: []*Expr{condExpr(In("user_id", "a")), condExpr(In("user_id", "b"))}}
+	not := &Expr{Not: condExpr(In("channel", "sms"))}
+
+	filter := DefaultQueryFilter().WithTimeRange(100, 300).
+		WhereExpr(nil).
+		WhereExpr(&Expr{And: []*Expr{{Time: &TimeRange{Start: 50, End: 200}}, or}}).
+		WhereExpr(not).
+		WhereExpr(&Expr{Time: &TimeRange{Start: 150}})
+
+	assert.Equal(t, int64(150), filter.StartTime)
+	assert.Equal(t, int64(200), filter.EndTime)
+	assert.Equal(t, &Expr{And: []*Expr{or, not}}, filter.Expr)
+}
+
+func TestExpr_Validate(t *testing.T) {
+	deep := condExpr(In("user_id", "a"))
+	for i := 0; i <= maxExprDepth; i++ {
+		deep = &Expr{Not: deep}
+	}
+
+	tests := []struct {
+		name    string
+		expr    *Expr
+		wantErr bool
+	}{
+		{"leaf", condExpr(In("user_id", "a")), false},
+		{"nested", &Expr{Or: []*Expr{{Not: metaExpr(MetadataExists("k"))}, {Time: &TimeRange{Start: 1}}}}, false},
+		{"empty", &Expr{}, true},
+		{"two members", &Expr{Not: condExpr(In("user_id", "a")), Time: &TimeRange{Start: 1}}, true},
+		{"nil operand", &Expr{And: []*Expr{nil}}, true},
+		{"invalid condition", &Expr{Or: []*Expr{condExpr(In("reason", "x"))}}, true},
+		{"invalid metadata", metaExpr(MetadataCompare("k", MetaEq, 1)), false},
+		{"invalid metadata key", metaExpr(MetadataExists("bad key")), true},
+		{"negative time", &Expr{Time: &TimeRange{End: -1}}, true},
+		{"too deep", deep, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DefaultQueryFilter().WhereExpr(&Expr{Not: tt.expr}).Validate()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidFilter)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSQLWhere_Expr(t *testing.T) {
+	expr := &Expr{Or: []*Expr{
+		condExpr(In("user_id", "a")),
+		{Not: &Expr{Time: &TimeRange{Start: 5, End: 9}}},
+	}}
+	where := &sqlWhere{dialect: PostgresDialect{}}
+	where.addEqual("channel", "sms")
+	where.addExpr(expr)
+	assert.Equal(t, "WHERE channel = $1 AND (COALESCE(user_id IN ($2), FALSE) OR NOT COALESCE(timestamp >= $3 AND timestamp <= $4, FALSE))", where.String())
+	assert.Equal(t, []interface{}{"sms", "a", int64(5), int64(9)}, where.args)
+	assert.Nil(t, where.residualFilter())
+
+	// IPv6 ranges cannot be matched exactly in SQL
+	ipv6 := &Expr{Not: condExpr(InCIDR("2001:db8::/32"))}
+	where = &sqlWhere{dialect: SQLiteDialect{}}
+	where.addExpr(ipv6)
+	assert.Equal(t, "", where.String())
+	assert.Equal(t, &QueryFilter{Expr: ipv6}, where.residualFilter())
+}
+
+func TestQueryFilter_Expr_AllBackends(t *testing.T) {
+	backends := newConditionBackends(t)
+
+	tests := []struct {
+		query    string
+		metadata bool
+		limit    int
+		offset   int
+		expected []string
+	}{
+		{query: "event_type:login_failed AND ip:10.0.0.0/8", expected: []string{"e1"}},
+		{query: "user_id:alice OR channel:email", expected: []string{"e4", "e2", "e1"}},
+		{query: "NOT event_type:login_failed", expected: []string{"e9", "e7", "e5", "e4", "e2"}},
+		{query: "-user_id:*", expected: []string{"e8"}},
+		{query: "user_id:a*,bob", expected: []string{"e10", "e9", "e4", "e2", "e1"}},
+		{query: "channel!=sms,email", expected: []string{"e10", "e9", "e8", "e7", "e6", "e5", "e4", "e3"}},
+		{query: "event_type:login_failed AND (channel:sms OR NOT user_id:alice*)", expected: []string{"e8", "e6", "e3", "e1"}},
+		{query: "(ip:2001:db8::/32 OR ip:10.0.0.0/8) AND NOT event_type:access_denied", expected: []string{"e1"}},
+		{query: "NOT ip:2001:db8::/32", limit: 3, offset: 2, expected: []string{"e8", "e7", "e6"}},
+		{query: "(ip:172.16.0.0/12 OR ip:192.168.0.0/16) -user_id:alice2", expected: []string{"e7", "e3"}},
+		{query: `ip:"192.168.1.0/24"`, expected: []string{"e10"}},
+		{query: "timestamp>now-1h event_type:send_failed", expected: []string{"e9"}},
+		{query: "timestamp<100 OR user_id:bob", expected: []string{"e2"}},
+		{query: "meta.tenant_id:acme OR meta.attempts>=5", metadata: true, expected: []string{"e3", "e2", "e1"}},
+		{query: "NOT meta.tenant_id:*", metadata: true, expected: []string{"e10", "e9", "e8", "e7", "e5"}},
+		{query: "meta.tenant_id:42", metadata: true, expected: []string{"e4"}},
+		{query: `meta.tenant_id:"42"`, metadata: true, expected: nil},
+		{query: "meta.vip:true OR meta.attempts<2", metadata: true, expected: []string{"e2"}},
+		{query: "meta.tenant_id!=acme event_type:login_failed", metadata: true, expected: []string{"e10", "e8", "e6", "e3"}},
+		{query: "NOT (meta.tenant_id:acme OR meta.attempts>3)", metadata: true, expected: []string{"e10", "e9", "e8", "e7", "e6", "e5", "e4"}},
+	}
+
+	for _, tt := range tests {
+		for name, storage := range backends {
+			if tt.metadata && name == "postgres-dialect" {
+				// JSON operators of the postgres dialect cannot run on SQLite
+				continue
+			}
+			t.Run(tt.query+"/"+name, func(t *testing.T) {
+				filter, err := CompileQuery(tt.query)
+				require.NoError(t, err)
+				if tt.limit > 0 {
+					filter.WithLimit(tt.limit).WithOffset(tt.offset)
+				}
+
+				// Compiled filters survive a JSON round trip
+				data, err := json.Marshal(filter)
+				require.NoError(t, err)
+				var decoded QueryFilter
+				require.NoError(t, json.Unmarshal(data, &decoded))
+
+				results, err := storage.Query(context.Background(), &decoded)
+				require.NoError(t, err)
+
+				var ids []string
+				for _, r := range results {
+					ids = append(ids, r.EventID)
+				}
+				assert.Equal(t, tt.expected, ids)
+			})
+		}
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"sort"
+	"log"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -18,12 +18,18 @@ type RedisStorage struct {
 	client    *redis.Client
 	keyPrefix string
 	ttl       time.Duration
+	readMode  ReadMode
 }
 
 // RedisConfig holds configuration for Redis storage
 type RedisConfig struct {
 	KeyPrefix string        // Key prefix (default: "audit:")
 	TTL       time.Duration // Time-to-live for records (default: 7 days)
+
+	// ReadMode selects whether keys that cannot be read or hold invalid
+	// JSON are left out of results (ReadLenient, see QueryWithReport) or
+	// fail the read (ReadStrict)
+	ReadMode ReadMode
 }
 
 // DefaultRedisConfig returns default Redis configuration
@@ -56,6 +62,7 @@ func NewRedisStorageWithConfig(client *redis.Client, config *RedisConfig) *Redis
 		client:    client,
 		keyPrefix: config.KeyPrefix,
 		ttl:       config.TTL,
+		readMode:  config.ReadMode,
 	}
 }
 
@@ -104,12 +111,125 @@ func (s *RedisStorage) Write(ctx context.Context, record *Record) error {
 
 // Query queries audit records from Redis
 func (s *RedisStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record, error) {
+	return s.query(ctx, filter, nil)
+}
+
+// QueryWithReport implements ReportingQuerier
+func (s *RedisStorage) QueryWithReport(ctx context.Context, filter *QueryFilter) ([]*Record, *QueryReport, error) {
+	report := &QueryReport{}
+	records, err := s.query(ctx, filter, report)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, report, nil
+}
+
+// query runs Query, filling report if not nil
+func (s *RedisStorage) query(ctx context.Context, filter *QueryFilter, report *QueryReport) ([]*Record, error) {
 	if filter == nil {
 		filter = DefaultQueryFilter()
 	}
 	filter.Normalize()
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Scan keys in timestamp order for the requested direction until enough
+	// records match the filter or the index is exhausted
+	want := filter.Offset + filter.Limit
+	var records []*Record
+	if filter.sortKey() == SortByTimestamp {
+		err := s.scan(ctx, filter, int64(want+100), report, func(record *Record) bool {
+			records = append(records, record)
+			return len(records) < want
+		})
+		if err != nil {
+			return nil, err
+		}
+		sortRecords(records, filter)
+	} else {
+		// Other sort keys need every matching record, but only the records
+		// up to the end of the requested page are kept. topRecords breaks
+		// ties on records added oldest first.
+		top := newTopRecords(filter, want)
+		oldestFirst := *filter
+		oldestFirst.SortOrder = SortAsc
+		err := s.scan(ctx, &oldestFirst, redisScanBatch, report, func(record *Record) bool {
+			top.add(record)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		records = top.sorted()
+	}
+
+	// Apply pagination
+	start := filter.Offset
+	if start >= len(records) {
+		return []*Record{}, nil
+	}
 
-	// Get keys from sorted set
+	end := start + filter.Limit
+	if end > len(records) {
+		end = len(records)
+	}
+
+	return records[start:end], nil
+}
+
+// Count returns the number of records matching the filter
+func (s *RedisStorage) Count(ctx context.Context, filter *QueryFilter) (int64, error) {
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	if err := filter.Validate(); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	err := s.scan(ctx, filter, redisScanBatch, nil, func(*Record) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// GroupBy counts matching records per field values and time bucket
+func (s *RedisStorage) GroupBy(ctx context.Context, filter *QueryFilter, fields []string, bucket time.Duration) ([]AggregateRow, error) {
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	seconds, err := validateGroupBy(fields, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := newGroupCounter(fields, seconds)
+	err = s.scan(ctx, filter, redisScanBatch, nil, func(record *Record) bool {
+		counter.add(record)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counter.result(), nil
+}
+
+// redisScanBatch is the index batch size used when every record is scanned
+const redisScanBatch = 500
+
+// scan walks the index in timestamp order for the filter's direction, in
+// batches, and calls fn for each live record matching the filter until fn
+// returns false. Expired keys are removed from the index afterwards;
+// unreadable ones are added to report, if not nil.
+func (s *RedisStorage) scan(ctx context.Context, filter *QueryFilter, batch int64, report *QueryReport, fn func(*Record) bool) error {
 	setKey := s.keyPrefix + "index"
 
 	var min, max string
@@ -124,64 +244,174 @@ func (s *RedisStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Recor
 		max = "+inf"
 	}
 
-	// Get keys in descending order (newest first)
-	keys, err := s.client.ZRevRangeByScore(ctx, setKey, &redis.ZRangeBy{
-		Min:    min,
-		Max:    max,
-		Offset: 0,
-		Count:  int64(filter.Limit + filter.Offset + 100), // Get extra for filtering
-	}).Result()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get keys: %w", err)
-	}
-
-	if len(keys) == 0 {
-		return []*Record{}, nil
-	}
-
-	// Get records
-	var records []*Record
-	for _, key := range keys {
-		data, err := s.client.Get(ctx, key).Bytes()
+	var expired []interface{}
+	unreadable := 0
+	defer func() {
+		if len(expired) > 0 {
+			_ = s.client.ZRem(ctx, setKey, expired...)
+		}
+		if unreadable > 0 {
+			log.Printf("[audit] Skipped %d unreadable audit records under %s; use QueryWithReport to find them", unreadable, s.keyPrefix)
+		}
+	}()
+
+	for start := int64(0); ; start += batch {
+		rangeBy := &redis.ZRangeBy{
+			Min:    min,
+			Max:    max,
+			Offset: start,
+			Count:  batch,
+		}
+		var keys []string
+		var err error
+		if filter.ascending() {
+			keys, err = s.client.ZRangeByScore(ctx, setKey, rangeBy).Result()
+		} else {
+			keys, err = s.client.ZRevRangeByScore(ctx, setKey, rangeBy).Result()
+		}
 		if err != nil {
+			return fmt.Errorf("failed to get keys: %w", err)
+		}
+
+		for _, key := range keys {
+			record, err := s.get(ctx, key)
 			if err == redis.Nil {
-				// Key expired, remove from index
-				_ = s.client.ZRem(ctx, setKey, key)
+				// Key expired, remove from index once the scan is done
+				expired = append(expired, key)
+				continue
+			}
+			if err != nil {
+				if s.readMode == ReadStrict {
+					return err
+				}
+				if report != nil {
+					report.Skipped = append(report.Skipped, SkippedRecord{Key: key, Reason: err.Error()})
+				} else {
+					unreadable++
+				}
 				continue
 			}
-			continue
-		}
 
-		var record Record
-		if err := json.Unmarshal(data, &record); err != nil {
-			continue
+			// Apply filters
+			if !matchesFilter(record, filter) {
+				continue
+			}
+
+			if !fn(record) {
+				return nil
+			}
 		}
 
-		// Apply filters
-		if !matchesFilter(&record, filter) {
-			continue
+		if int64(len(keys)) < batch {
+			return nil
 		}
+	}
+}
 
-		records = append(records, &record)
+// get reads the record stored at key; redis.Nil means it expired
+func (s *RedisStorage) get(ctx context.Context, key string) (*Record, error) {
+	data, err := s.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record %s: %w", key, err)
+	}
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode record %s: %w", key, err)
 	}
+	return &record, nil
+}
 
-	// Sort by timestamp descending
-	sort.Slice(records, func(i, j int) bool {
-		return records[i].Timestamp > records[j].Timestamp
-	})
+// Purge deletes records older than olderThan matching the filter. Without
+// criteria beyond the time range, keys are deleted straight from the index
+// and the range is dropped with ZREMRANGEBYSCORE; otherwise each record is
+// read and matched first.
+func (s *RedisStorage) Purge(ctx context.Context, olderThan time.Time, filter *QueryFilter) (int64, error) {
+	filter, err := purgeFilter(olderThan, filter)
+	if err != nil {
+		return 0, err
+	}
+	setKey := s.keyPrefix + "index"
 
-	// Apply pagination
-	start := filter.Offset
-	if start >= len(records) {
-		return []*Record{}, nil
+	min := "-inf"
+	if filter.StartTime > 0 {
+		min = fmt.Sprintf("%d", filter.StartTime)
 	}
+	max := fmt.Sprintf("%d", filter.EndTime)
+	all := timeOnly(filter)
+
+	const batch = 500
+	var total int64
+	var offset int64
+	for {
+		keys, err := s.client.ZRangeByScore(ctx, setKey, &redis.ZRangeBy{
+			Min:    min,
+			Max:    max,
+			Offset: offset,
+			Count:  batch,
+		}).Result()
+		if err != nil {
+			return total, fmt.Errorf("failed to get keys: %w", err)
+		}
 
-	end := start + filter.Limit
-	if end > len(records) {
-		end = len(records)
+		var remove []string
+		if all {
+			remove = keys
+		} else {
+			for _, key := range keys {
+				data, err := s.client.Get(ctx, key).Bytes()
+				if err == redis.Nil {
+					// Expired; drop it from the index as well
+					remove = append(remove, key)
+					continue
+				}
+				if err != nil {
+					return total, fmt.Errorf("failed to get record: %w", err)
+				}
+				var record Record
+				if err := json.Unmarshal(data, &record); err != nil {
+					if s.readMode == ReadStrict {
+						return total, fmt.Errorf("failed to decode record %s: %w", key, err)
+					}
+					continue
+				}
+				if matchesFilter(&record, filter) {
+					remove = append(remove, key)
+				}
+			}
+		}
+
+		if len(remove) > 0 {
+			members := make([]interface{}, len(remove))
+			for i, key := range remove {
+				members[i] = key
+			}
+			pipe := s.client.TxPipeline()
+			deleted := pipe.Del(ctx, remove...)
+			pipe.ZRem(ctx, setKey, members...)
+			if _, err := pipe.Exec(ctx); err != nil {
+				return total, fmt.Errorf("failed to delete records: %w", err)
+			}
+			total += deleted.Val()
+		}
+
+		if int64(len(keys)) < batch {
+			break
+		}
+		// Kept keys stay in the range; removed ones shift the rest down
+		offset += int64(len(keys) - len(remove))
 	}
 
-	return records[start:end], nil
+	if all {
+		// Drop index entries written into the range meanwhile; their keys
+		// expire with the TTL
+		if err := s.client.ZRemRangeByScore(ctx, setKey, min, max).Err(); err != nil {
+			return total, fmt.Errorf("failed to trim index: %w", err)
+		}
+	}
+	return total, nil
 }
 
 // Close closes the Redis connection
@@ -2,6 +2,8 @@ package audit
 
 import (
 	"context"
+	"fmt"
+	"slices"
 	"testing"
 	"time"
 
@@ -215,6 +217,46 @@ func TestRedisStorage_Query_Pagination(t *testing.T) {
 	assert.Len(t, results, 3)
 }
 
+func TestRedisStorage_Query_SortedPages(t *testing.T) {
+	client, mr := newTestRedisClient(t)
+	defer mr.Close()
+	defer func() { _ = client.Close() }()
+	storage := NewRedisStorage(client)
+	ctx := context.Background()
+
+	// Few distinct durations and timestamps, so most records tie
+	now := time.Now().Unix()
+	for i := 0; i < 30; i++ {
+		record := NewRecord(EventLoginSuccess, ResultSuccess).WithDuration(int64(i % 3)).SetTimestamp(now - int64(i%4))
+		record.EventID = fmt.Sprintf("r%d", i)
+		require.NoError(t, storage.Write(ctx, record))
+	}
+	newest, err := storage.Query(ctx, DefaultQueryFilter().WithLimit(100))
+	require.NoError(t, err)
+	require.Len(t, newest, 30)
+
+	for _, order := range []string{SortAsc, SortDesc} {
+		// Pages match sorting every record in scan order for the direction
+		filter := DefaultQueryFilter().WithSort(SortByDuration, order)
+		want := slices.Clone(newest)
+		if filter.ascending() {
+			slices.Reverse(want)
+		}
+		sortRecords(want, filter)
+
+		var got []*Record
+		for offset := 0; offset < 30; offset += 7 {
+			page, err := storage.Query(ctx, DefaultQueryFilter().WithSort(SortByDuration, order).WithOffset(offset).WithLimit(7))
+			require.NoError(t, err)
+			got = append(got, page...)
+		}
+		require.Len(t, got, len(want))
+		for i := range want {
+			assert.Equal(t, want[i].EventID, got[i].EventID, "%s record %d", order, i)
+		}
+	}
+}
+
 func TestRedisStorage_Query_Empty(t *testing.T) {
 	client, mr := newTestRedisClient(t)
 	defer mr.Close()
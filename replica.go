@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// openReplica sets up the read replica selected by config: ReplicaDB as
+// is, or a connection opened from ReplicaURL that Close also closes
+func (s *DatabaseStorage) openReplica(config *DatabaseConfig) error {
+	s.replicaFreshness = config.ReplicaFreshness
+	if config.ReplicaDB != nil {
+		s.replica = config.ReplicaDB
+		return nil
+	}
+	if config.ReplicaURL == "" {
+		return nil
+	}
+
+	dialect, driver, dsn, err := openDialectURL(config.ReplicaURL)
+	if err != nil {
+		return fmt.Errorf("invalid replica URL: %w", err)
+	}
+	if dialect.Name() != s.dialect.Name() {
+		return fmt.Errorf("replica must be a %s database, not %s", s.dialect.Name(), dialect.Name())
+	}
+	// As for the primary, errors may contain the DSN and are not logged
+	replica, err := sql.Open(driver, dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open replica: %w", err)
+	}
+	configurePool(replica, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.connectTimeout())
+	defer cancel()
+	if err := replica.PingContext(ctx); err != nil {
+		_ = replica.Close()
+		return fmt.Errorf("failed to ping replica: %w", err)
+	}
+	s.replica = replica
+	s.ownsReplica = true
+	return nil
+}
+
+// readDB returns the database serving reads matching filter: the replica,
+// unless there is none or the filter can match records within the
+// freshness window, which the replica may not have caught up with yet
+func (s *DatabaseStorage) readDB(filter *QueryFilter) *sql.DB {
+	if s.replica == nil {
+		return s.db
+	}
+	if s.replicaFreshness > 0 {
+		end := filter.EndTime
+		if exprEnd, ok := exprTimeEnd(filter.Expr); ok && (end == 0 || exprEnd < end) {
+			end = exprEnd
+		}
+		if end == 0 || end > time.Now().Add(-s.replicaFreshness).Unix() {
+			return s.db
+		}
+	}
+	return s.replica
+}
+
+// exprTimeEnd returns the latest timestamp a record matching e can have,
+// and false if e does not bound it. Negations are not analyzed.
+func exprTimeEnd(e *Expr) (int64, bool) {
+	if e == nil {
+		return 0, false
+	}
+	switch {
+	case e.Time != nil:
+		return e.Time.End, e.Time.End > 0
+	case len(e.And) > 0:
+		var end int64
+		bounded := false
+		for _, child := range e.And {
+			if childEnd, ok := exprTimeEnd(child); ok && (!bounded || childEnd < end) {
+				end, bounded = childEnd, true
+			}
+		}
+		return end, bounded
+	case len(e.Or) > 0:
+		var end int64
+		for _, child := range e.Or {
+			childEnd, ok := exprTimeEnd(child)
+			if !ok {
+				return 0, false
+			}
+			end = max(end, childEnd)
+		}
+		return end, true
+	}
+	return 0, false
+}
+
+// closeReplica closes a replica opened from ReplicaURL
+func (s *DatabaseStorage) closeReplica() error {
+	if !s.ownsReplica || s.replica == nil {
+		return nil
+	}
+	return s.replica.Close()
+}
+
+// Replica returns the read replica connection, or nil if reads go to the
+// primary
+func (s *DatabaseStorage) Replica() *sql.DB {
+	return s.replica
+}
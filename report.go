@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ReadMode selects how storage backends handle stored records they cannot
+// read, e.g. rows that fail to scan or keys holding invalid JSON
+type ReadMode int
+
+const (
+	// ReadLenient leaves unreadable records out of the results; use
+	// QueryWithReport to find them (default)
+	ReadLenient ReadMode = iota
+
+	// ReadStrict fails the read on the first unreadable record
+	ReadStrict
+)
+
+// ErrReportNotSupported is returned by QueryWithReport of storages wrapping
+// a backend that does not implement ReportingQuerier
+var ErrReportNotSupported = errors.New("storage does not support query reports")
+
+// ReportingQuerier is implemented by storage backends that can report the
+// stored records a query could not fully read
+type ReportingQuerier interface {
+	// QueryWithReport is Query that also returns a report of unreadable
+	// records. In ReadStrict mode they fail the query instead.
+	QueryWithReport(ctx context.Context, filter *QueryFilter) ([]*Record, *QueryReport, error)
+}
+
+// reporterOf returns storage as a ReportingQuerier, or ErrReportNotSupported
+func reporterOf(storage Storage) (ReportingQuerier, error) {
+	if rq, ok := storage.(ReportingQuerier); ok {
+		return rq, nil
+	}
+	return nil, ErrReportNotSupported
+}
+
+// queryInto runs Query on storage, or QueryWithReport adding its findings
+// to report if not nil
+func queryInto(ctx context.Context, storage Storage, filter *QueryFilter, report *QueryReport) ([]*Record, error) {
+	if report == nil {
+		return storage.Query(ctx, filter)
+	}
+	rq, err := reporterOf(storage)
+	if err != nil {
+		return nil, err
+	}
+	records, found, err := rq.QueryWithReport(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	report.merge(found)
+	return records, nil
+}
+
+// QueryReport describes the problems found while reading query results
+type QueryReport struct {
+	// DecodeErrors lists the records whose stored metadata could not be
+	// decoded; they are returned with nil Metadata
+	DecodeErrors []*DecodeError `json:"decode_errors,omitempty"`
+
+	// Skipped lists the stored records left out because they could not be
+	// read at all
+	Skipped []SkippedRecord `json:"skipped,omitempty"`
+}
+
+// Complete reports whether every record read was returned intact
+func (r *QueryReport) Complete() bool {
+	return len(r.DecodeErrors) == 0 && len(r.Skipped) == 0
+}
+
+// merge adds the findings of other to r
+func (r *QueryReport) merge(other *QueryReport) {
+	if other == nil {
+		return
+	}
+	r.DecodeErrors = append(r.DecodeErrors, other.DecodeErrors...)
+	r.Skipped = append(r.Skipped, other.Skipped...)
+}
+
+// SkippedRecord identifies a stored record a query left out
+type SkippedRecord struct {
+	ID     int64  `json:"id,omitempty"`  // Row id (DatabaseStorage)
+	Key    string `json:"key,omitempty"` // Record key (RedisStorage)
+	Reason string `json:"reason"`
+}
+
+// DecodeError reports a stored record whose metadata is not valid JSON
+type DecodeError struct {
+	ID      int64  // Row id in the audit table (0 outside QueryWithReport)
+	EventID string // EventID of the record, if any
+	Err     error
+}
+
+// Error implements error
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode metadata of record %d: %v", e.ID, e.Err)
+}
+
+// Unwrap returns the JSON error
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// MarshalJSON encodes the error as its message
+func (e *DecodeError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"id":       e.ID,
+		"event_id": e.EventID,
+		"error":    e.Err.Error(),
+	})
+}
+
+// isDecodeError reports whether err from scanRecord came with a record
+func isDecodeError(err error) bool {
+	var decodeErr *DecodeError
+	return errors.As(err, &decodeErr)
+}
@@ -0,0 +1,236 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportingQuerier_Implementations(t *testing.T) {
+	var _ ReportingQuerier = (*DatabaseStorage)(nil)
+	var _ ReportingQuerier = (*RedisStorage)(nil)
+	var _ ReportingQuerier = (*EncryptingStorage)(nil)
+	var _ ReportingQuerier = (*MultiStorage)(nil)
+	var _ ReportingQuerier = (*RoutingStorage)(nil)
+}
+
+func TestQueryWithReport_Wrappers(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestUnreadableDatabase(t, ReadLenient)
+	rs, _ := newTestUnreadableRedis(t, ReadLenient)
+
+	merged, err := NewMultiStorageWithConfig(&MultiStorageConfig{QueryMode: QueryMerge}, db, rs)
+	require.NoError(t, err)
+	routing, err := NewRoutingStorage(&RoutingConfig{
+		Routes:  []Route{{Results: []Result{ResultFailure}, Storage: rs}},
+		Default: db,
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		storage     ReportingQuerier
+		wantSkipped []SkippedRecord
+		wantDecoded int
+	}{
+		{
+			name:        "encrypting",
+			storage:     NewEncryptingStorage(db, newTestFieldEncryptor(t, NewMemoryDataKeyStore())),
+			wantSkipped: []SkippedRecord{{ID: 3}},
+			wantDecoded: 1,
+		},
+		{
+			name:        "multi first",
+			storage:     NewMultiStorage(db, rs),
+			wantSkipped: []SkippedRecord{{ID: 3}},
+			wantDecoded: 1,
+		},
+		{
+			name:        "multi merge",
+			storage:     merged,
+			wantSkipped: []SkippedRecord{{ID: 3}, {Key: "audit:200:bad"}},
+			wantDecoded: 1,
+		},
+		{
+			name:        "routing",
+			storage:     routing,
+			wantSkipped: []SkippedRecord{{Key: "audit:200:bad"}, {ID: 3}},
+			wantDecoded: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, report, err := tt.storage.QueryWithReport(ctx, DefaultQueryFilter())
+			require.NoError(t, err)
+			assert.NotEmpty(t, results)
+			require.Len(t, report.Skipped, len(tt.wantSkipped))
+			for i, want := range tt.wantSkipped {
+				assert.Equal(t, want.ID, report.Skipped[i].ID)
+				assert.Equal(t, want.Key, report.Skipped[i].Key)
+			}
+			assert.Len(t, report.DecodeErrors, tt.wantDecoded)
+		})
+	}
+
+	// Backends that cannot report fail the report, not the plain query
+	multi := NewMultiStorage(newTestStorage())
+	_, _, err = multi.QueryWithReport(ctx, DefaultQueryFilter())
+	assert.ErrorIs(t, err, ErrReportNotSupported)
+	_, err = multi.Query(ctx, DefaultQueryFilter())
+	assert.NoError(t, err)
+}
+
+func TestQueryReport_Complete(t *testing.T) {
+	assert.True(t, (&QueryReport{}).Complete())
+	assert.False(t, (&QueryReport{Skipped: []SkippedRecord{{Key: "audit:1:a", Reason: "bad"}}}).Complete())
+	assert.False(t, (&QueryReport{DecodeErrors: []*DecodeError{{ID: 1}}}).Complete())
+}
+
+// newTestUnreadableDatabase returns a SQLite storage holding one readable
+// record (timestamp 300), one with invalid metadata (id 2, timestamp 200)
+// and one whose timestamp fails to scan (id 3)
+func newTestUnreadableDatabase(t *testing.T, mode ReadMode) (*DatabaseStorage, *sql.DB) {
+	t.Helper()
+	db := newTestSQLiteDB(t)
+	t.Cleanup(func() { _ = db.Close() })
+	s, err := NewDatabaseStorageFromDB(db, "sqlite", &DatabaseConfig{ReadMode: mode})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, s.Write(ctx, NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("u1").SetTimestamp(300)))
+	_, err = db.Exec(`INSERT INTO audit_logs (event_type, user_id, result, timestamp, metadata) VALUES ('login_success', 'u2', 'success', 200, '{')`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO audit_logs (event_type, user_id, result, timestamp) VALUES ('login_success', 'u3', 'success', 'yesterday')`)
+	require.NoError(t, err)
+	return s, db
+}
+
+func TestDatabaseStorage_ReadMode(t *testing.T) {
+	ctx := context.Background()
+	// Expressions with IPv6 ranges are evaluated in Go on every row
+	residual := func() *QueryFilter {
+		inRange := InCIDR("2001:db8::/32")
+		return DefaultQueryFilter().WhereExpr(&Expr{Not: &Expr{Condition: &inRange}})
+	}
+
+	t.Run("lenient", func(t *testing.T) {
+		s, _ := newTestUnreadableDatabase(t, ReadLenient)
+
+		results, report, err := s.QueryWithReport(ctx, DefaultQueryFilter())
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+		assert.False(t, report.Complete())
+		require.Len(t, report.Skipped, 1)
+		assert.Equal(t, int64(3), report.Skipped[0].ID)
+		assert.Empty(t, report.Skipped[0].Key)
+		require.Len(t, report.DecodeErrors, 1)
+		assert.Equal(t, int64(2), report.DecodeErrors[0].ID)
+
+		count, err := s.Count(ctx, residual())
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), count)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		s, _ := newTestUnreadableDatabase(t, ReadStrict)
+
+		_, err := s.Query(ctx, DefaultQueryFilter())
+		assert.ErrorContains(t, err, "failed to read audit record 3")
+
+		// The record with invalid metadata is reached first in this range
+		filter := DefaultQueryFilter()
+		filter.EndTime = 250
+		_, _, err = s.QueryWithReport(ctx, filter)
+		var decodeErr *DecodeError
+		require.ErrorAs(t, err, &decodeErr)
+		assert.Equal(t, int64(2), decodeErr.ID)
+
+		_, err = s.Count(ctx, residual())
+		assert.ErrorContains(t, err, "failed to read audit record")
+
+		_, err = s.Purge(ctx, time.Unix(1000, 0), residual())
+		assert.ErrorContains(t, err, "failed to read audit record 2")
+
+		// Readable ranges are unaffected
+		filter = DefaultQueryFilter()
+		filter.StartTime = 250
+		filter.EndTime = 350
+		results, report, err := s.QueryWithReport(ctx, filter)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.True(t, report.Complete())
+	})
+}
+
+// newTestUnreadableRedis returns a Redis storage holding one readable
+// record (timestamp 300) and a key with invalid JSON (timestamp 200)
+func newTestUnreadableRedis(t *testing.T, mode ReadMode) (*RedisStorage, *redis.Client) {
+	t.Helper()
+	client, mr := newTestRedisClient(t)
+	t.Cleanup(mr.Close)
+	t.Cleanup(func() { _ = client.Close() })
+	s := NewRedisStorageWithConfig(client, &RedisConfig{ReadMode: mode})
+
+	ctx := context.Background()
+	require.NoError(t, s.Write(ctx, NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("u1").SetTimestamp(300)))
+	require.NoError(t, client.Set(ctx, "audit:200:bad", "{", 0).Err())
+	require.NoError(t, client.ZAdd(ctx, "audit:index", redis.Z{Score: 200, Member: "audit:200:bad"}).Err())
+	return s, client
+}
+
+func TestRedisStorage_ReadMode(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("lenient", func(t *testing.T) {
+		s, _ := newTestUnreadableRedis(t, ReadLenient)
+
+		results, err := s.Query(ctx, DefaultQueryFilter())
+		require.NoError(t, err)
+		assert.Len(t, results, 1)
+
+		results, report, err := s.QueryWithReport(ctx, DefaultQueryFilter())
+		require.NoError(t, err)
+		assert.Len(t, results, 1)
+		require.Len(t, report.Skipped, 1)
+		assert.Equal(t, "audit:200:bad", report.Skipped[0].Key)
+		assert.Contains(t, report.Skipped[0].Reason, "failed to decode record audit:200:bad")
+
+		count, err := s.Count(ctx, nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+
+		filter := DefaultQueryFilter()
+		filter.UserID = "u1"
+		purged, err := s.Purge(ctx, time.Unix(1000, 0), filter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), purged)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		s, client := newTestUnreadableRedis(t, ReadStrict)
+
+		_, err := s.Query(ctx, DefaultQueryFilter())
+		assert.ErrorContains(t, err, "failed to decode record audit:200:bad")
+		_, _, err = s.QueryWithReport(ctx, DefaultQueryFilter())
+		assert.ErrorContains(t, err, "failed to decode record audit:200:bad")
+		_, err = s.Count(ctx, nil)
+		assert.ErrorContains(t, err, "failed to decode record audit:200:bad")
+
+		filter := DefaultQueryFilter()
+		filter.UserID = "u1"
+		_, err = s.Purge(ctx, time.Unix(1000, 0), filter)
+		assert.ErrorContains(t, err, "failed to decode record audit:200:bad")
+
+		// Expired keys are not unreadable
+		require.NoError(t, client.Del(ctx, "audit:200:bad").Err())
+		results, report, err := s.QueryWithReport(ctx, DefaultQueryFilter())
+		require.NoError(t, err)
+		assert.Len(t, results, 1)
+		assert.True(t, report.Complete())
+	})
+}
@@ -0,0 +1,263 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ErrPurgeNotSupported is returned when the storage backend does not
+// implement Purger
+var ErrPurgeNotSupported = errors.New("storage does not support purging")
+
+// Purger is implemented by storage backends that can delete old records
+type Purger interface {
+	// Purge deletes the records with a timestamp before olderThan that match
+	// the filter (nil matches every record) and returns how many were
+	// deleted. Limit, Offset and sort options of the filter are ignored.
+	Purge(ctx context.Context, olderThan time.Time, filter *QueryFilter) (int64, error)
+}
+
+// purgerOf returns storage as a Purger, or ErrPurgeNotSupported
+func purgerOf(storage Storage) (Purger, error) {
+	if p, ok := storage.(Purger); ok {
+		return p, nil
+	}
+	return nil, ErrPurgeNotSupported
+}
+
+// purgeFilter returns a validated copy of filter that also ends before
+// olderThan, so backends can match purged records like queried ones
+func purgeFilter(olderThan time.Time, filter *QueryFilter) (*QueryFilter, error) {
+	f := QueryFilter{}
+	if filter != nil {
+		f = *filter
+	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	end := olderThan.Unix() - 1
+	if f.EndTime <= 0 || f.EndTime > end {
+		f.EndTime = end
+	}
+	return &f, nil
+}
+
+// timeOnly reports whether filter restricts nothing but the time range
+func timeOnly(filter *QueryFilter) bool {
+	rest := *filter
+	rest.StartTime, rest.EndTime = 0, 0
+	rest.SortBy, rest.SortOrder = "", ""
+	rest.Limit, rest.Offset = 0, 0
+	return reflect.DeepEqual(rest, QueryFilter{})
+}
+
+// purgeTargets purges the targets concurrently and returns the total
+// number of deleted records
+func purgeTargets(ctx context.Context, targets []queryTarget, olderThan time.Time) (int64, error) {
+	counts := make([]int64, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := purgerOf(t.storage)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			counts[i], errs[i] = p.Purge(ctx, olderThan, t.filter)
+		}()
+	}
+	wg.Wait()
+
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	for i, err := range errs {
+		if err != nil {
+			return total, fmt.Errorf("failed to purge storage %d: %w", targets[i].index, err)
+		}
+	}
+	return total, nil
+}
+
+// RetentionPolicy keeps the records of EventTypes for MaxAge. A policy
+// without event types applies to every event type no other policy lists.
+type RetentionPolicy struct {
+	EventTypes []EventType
+	MaxAge     time.Duration
+}
+
+// RetentionConfig holds configuration for the retention runner
+type RetentionConfig struct {
+	// Policies to enforce. Without policies, records of every event type
+	// are kept for Config.TTL when used through the Logger.
+	Policies []RetentionPolicy
+
+	Interval time.Duration // How often records are purged (default: 1h)
+	Timeout  time.Duration // Bound on one run (default: 10m)
+}
+
+// DefaultRetentionConfig returns default retention configuration
+func DefaultRetentionConfig() *RetentionConfig {
+	return &RetentionConfig{
+		Interval: time.Hour,
+		Timeout:  10 * time.Minute,
+	}
+}
+
+// RetentionRunner purges expired records according to retention policies,
+// on demand with Run or periodically after Start
+type RetentionRunner struct {
+	purger   Purger
+	policies []RetentionPolicy
+	interval time.Duration
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRetentionRunner creates a retention runner for storage, which must
+// implement Purger
+func NewRetentionRunner(storage Storage, config *RetentionConfig) (*RetentionRunner, error) {
+	if config == nil {
+		config = DefaultRetentionConfig()
+	}
+	purger, err := purgerOf(storage)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Policies) == 0 {
+		return nil, fmt.Errorf("at least one retention policy is required")
+	}
+
+	seen := make(map[EventType]bool)
+	hasDefault := false
+	for i, p := range config.Policies {
+		if p.MaxAge <= 0 {
+			return nil, fmt.Errorf("retention policy %d: max age must be positive", i)
+		}
+		if len(p.EventTypes) == 0 {
+			if hasDefault {
+				return nil, fmt.Errorf("retention policy %d: only one policy may omit event types", i)
+			}
+			hasDefault = true
+		}
+		for _, et := range p.EventTypes {
+			if seen[et] {
+				return nil, fmt.Errorf("retention policy %d: event type %s is already covered", i, et)
+			}
+			seen[et] = true
+		}
+	}
+
+	r := &RetentionRunner{
+		purger:   purger,
+		policies: config.Policies,
+		interval: config.Interval,
+		timeout:  config.Timeout,
+	}
+	if r.interval <= 0 {
+		r.interval = time.Hour
+	}
+	if r.timeout <= 0 {
+		r.timeout = 10 * time.Minute
+	}
+	return r, nil
+}
+
+// Run applies every policy once and returns the number of purged records.
+// A failing policy does not stop the others; their errors are joined.
+func (r *RetentionRunner) Run(ctx context.Context) (int64, error) {
+	return r.run(ctx, time.Now())
+}
+
+// run applies every policy as of now
+func (r *RetentionRunner) run(ctx context.Context, now time.Time) (int64, error) {
+	var total int64
+	var errs []error
+	for i, p := range r.policies {
+		n, err := r.purger.Purge(ctx, now.Add(-p.MaxAge), r.policyFilter(p))
+		total += n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("retention policy %d: %w", i, err))
+		}
+	}
+	return total, errors.Join(errs...)
+}
+
+// policyFilter selects the records governed by the policy
+func (r *RetentionRunner) policyFilter(p RetentionPolicy) *QueryFilter {
+	op := OpIn
+	types := p.EventTypes
+	if len(types) == 0 {
+		// The default policy covers the event types of no other policy
+		op = OpNotIn
+		for _, other := range r.policies {
+			types = append(types, other.EventTypes...)
+		}
+		if len(types) == 0 {
+			return &QueryFilter{}
+		}
+	}
+	values := make([]string, len(types))
+	for i, et := range types {
+		values[i] = string(et)
+	}
+	return (&QueryFilter{}).Where(Condition{Field: "event_type", Op: op, Values: values})
+}
+
+// Start runs the policies immediately and then every interval until Stop
+func (r *RetentionRunner) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+			n, err := r.Run(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("[audit] Failed to enforce retention: %v", err)
+			}
+			if n > 0 {
+				log.Printf("[audit] Purged %d expired audit records", n)
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(r.stop, r.done)
+}
+
+// Stop stops the periodic runs and waits for a running one to finish
+func (r *RetentionRunner) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
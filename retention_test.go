@@ -0,0 +1,503 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// retentionRecords returns records aged 10, 5 and 1 days before now, with
+// alternating event types
+func retentionRecords(now time.Time) []*Record {
+	ages := []int{10, 10, 5, 5, 1, 1}
+	records := make([]*Record, len(ages))
+	for i, days := range ages {
+		eventType := EventLoginSuccess
+		if i%2 == 1 {
+			eventType = EventSendSuccess
+		}
+		records[i] = NewRecord(eventType, ResultSuccess).WithUserID("user")
+		records[i].Timestamp = now.AddDate(0, 0, -days).Unix()
+	}
+	return records
+}
+
+func writeRecords(t *testing.T, s Storage, records []*Record) {
+	for _, r := range records {
+		require.NoError(t, s.Write(context.Background(), r))
+	}
+}
+
+func countRecords(t *testing.T, s Storage, filter *QueryFilter) int {
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	records, err := s.Query(context.Background(), filter.WithLimit(maxQueryLimit))
+	require.NoError(t, err)
+	return len(records)
+}
+
+func TestPurgeFilter(t *testing.T) {
+	olderThan := time.Unix(1000, 0)
+
+	tests := []struct {
+		name    string
+		filter  *QueryFilter
+		wantEnd int64
+		wantErr bool
+	}{
+		{name: "nil filter", filter: nil, wantEnd: 999},
+		{name: "later end time", filter: &QueryFilter{EndTime: 5000}, wantEnd: 999},
+		{name: "earlier end time", filter: &QueryFilter{EndTime: 500}, wantEnd: 500},
+		{name: "invalid filter", filter: &QueryFilter{SortBy: "user_id"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := purgeFilter(olderThan, tt.filter)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidFilter)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantEnd, f.EndTime)
+			if tt.filter != nil {
+				assert.NotSame(t, tt.filter, f, "caller's filter must not change")
+			}
+		})
+	}
+}
+
+func TestTimeOnly(t *testing.T) {
+	assert.True(t, timeOnly(&QueryFilter{}))
+	assert.True(t, timeOnly(&QueryFilter{StartTime: 1, EndTime: 2, Limit: 10, SortOrder: "asc"}))
+	assert.False(t, timeOnly(&QueryFilter{EventType: "login_success"}))
+	assert.False(t, timeOnly((&QueryFilter{}).Where(Condition{Field: "channel", Op: OpIn, Values: []string{"sms"}})))
+	assert.False(t, timeOnly(&QueryFilter{Text: "timeout"}))
+}
+
+func TestFileStorage_Purge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileStorage(path)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+
+	records := retentionRecords(now)
+	writeRecords(t, s, records[:2])
+	require.NoError(t, s.Rotate())
+	rotated, err := s.rotatedFiles()
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+	writeRecords(t, s, records[2:])
+
+	t.Run("filtered", func(t *testing.T) {
+		n, err := s.Purge(ctx, now.AddDate(0, 0, -3), DefaultQueryFilter().WithEventType(string(EventSendSuccess)))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		assert.FileExists(t, rotated[0])
+		assert.Equal(t, 3, countRecords(t, s, nil), "Query reads the active file only")
+	})
+
+	t.Run("drops emptied rotated files", func(t *testing.T) {
+		n, err := s.Purge(ctx, now.AddDate(0, 0, -3), nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		assert.NoFileExists(t, rotated[0])
+		assert.Equal(t, 2, countRecords(t, s, nil))
+	})
+
+	t.Run("nothing to purge", func(t *testing.T) {
+		n, err := s.Purge(ctx, now.AddDate(0, 0, -3), nil)
+		require.NoError(t, err)
+		assert.Zero(t, n)
+	})
+
+	t.Run("still writable", func(t *testing.T) {
+		require.NoError(t, s.Write(ctx, NewRecord(EventLogout, ResultSuccess)))
+		assert.Equal(t, 3, countRecords(t, s, nil))
+
+		n, err := s.Purge(ctx, now.Add(time.Hour), nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), n)
+		assert.FileExists(t, path, "the active file is kept")
+	})
+}
+
+func TestFileStorage_Purge_KeepsMalformedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	data := `{"event_type":"logout","result":"success","timestamp":100}` + "\nnot json\n"
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+
+	s, err := NewFileStorage(path)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+
+	n, err := s.Purge(context.Background(), time.Unix(200, 0), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "not json\n", string(content))
+}
+
+func TestRedisStorage_Purge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	client, mr := newTestRedisClient(t)
+	defer mr.Close()
+	s := NewRedisStorageWithConfig(client, &RedisConfig{KeyPrefix: "audit:", TTL: 30 * 24 * time.Hour})
+
+	records := retentionRecords(now)
+	for i, r := range records {
+		r.EventID = string(rune('a' + i))
+	}
+	writeRecords(t, s, records)
+
+	t.Run("filtered", func(t *testing.T) {
+		n, err := s.Purge(ctx, now.AddDate(0, 0, -3), DefaultQueryFilter().WithEventType(string(EventSendSuccess)))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		assert.Equal(t, 4, countRecords(t, s, nil))
+	})
+
+	t.Run("time range only", func(t *testing.T) {
+		n, err := s.Purge(ctx, now.AddDate(0, 0, -3), nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		assert.Equal(t, 2, countRecords(t, s, nil))
+
+		size, err := client.ZCard(ctx, "audit:index").Result()
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), size)
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		_, err := s.Purge(ctx, now, &QueryFilter{SortBy: "user_id"})
+		assert.ErrorIs(t, err, ErrInvalidFilter)
+	})
+}
+
+func TestRedisStorage_Purge_ExpiredKeys(t *testing.T) {
+	ctx := context.Background()
+	client, mr := newTestRedisClient(t)
+	defer mr.Close()
+	s := NewRedisStorage(client)
+
+	record := NewRecord(EventLogout, ResultSuccess).WithUserID("alice")
+	record.Timestamp = 100
+	require.NoError(t, s.Write(ctx, record))
+	keys, err := client.ZRange(ctx, "audit:index", 0, -1).Result()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	mr.Del(keys[0])
+
+	n, err := s.Purge(ctx, time.Unix(200, 0), DefaultQueryFilter().WithUserID("alice"))
+	require.NoError(t, err)
+	assert.Zero(t, n, "expired keys are not counted")
+
+	size, err := client.ZCard(ctx, "audit:index").Result()
+	require.NoError(t, err)
+	assert.Zero(t, size)
+}
+
+func TestDatabaseStorage_Purge_SQLite(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+	s, err := NewDatabaseStorageFromDB(db, "sqlite", &DatabaseConfig{PurgeBatchSize: 2})
+	require.NoError(t, err)
+
+	records := retentionRecords(now)
+	for i, r := range records {
+		r.IP = "10.0.0.1"
+		if i < 2 {
+			r.IP = "2001:db8::1"
+		}
+	}
+	writeRecords(t, s, records)
+
+	t.Run("residual condition", func(t *testing.T) {
+		filter := (&QueryFilter{}).Where(Condition{Field: "ip", Op: OpCIDR, Values: []string{"2001:db8::/32"}})
+		n, err := s.Purge(ctx, now, filter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		assert.Equal(t, 4, countRecords(t, s, nil))
+	})
+
+	t.Run("batched", func(t *testing.T) {
+		n, err := s.Purge(ctx, now.AddDate(0, 0, -3), nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		assert.Equal(t, 2, countRecords(t, s, nil))
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		n, err := s.Purge(ctx, now, DefaultQueryFilter().WithEventType(string(EventSendSuccess)))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		assert.Equal(t, 1, countRecords(t, s, nil))
+	})
+}
+
+func TestDatabaseStorage_Purge_UnreadableRows(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	defer func() { _ = db.Close() }()
+	s, err := NewDatabaseStorageFromDB(db, "sqlite", &DatabaseConfig{PurgeBatchSize: 1})
+	require.NoError(t, err)
+
+	// The first batch holds only a row whose duration fails to scan
+	_, err = db.Exec(`INSERT INTO audit_logs (event_type, result, ip, timestamp, duration_ms) VALUES ('login_success', 'success', '2001:db8::1', 100, 'slow')`)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, s.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess).WithIP("2001:db8::2").SetTimestamp(100)))
+	}
+
+	filter := (&QueryFilter{}).Where(Condition{Field: "ip", Op: OpCIDR, Values: []string{"2001:db8::/32"}})
+	n, err := s.Purge(context.Background(), time.Unix(1000, 0), filter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	count, err := s.Count(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestDatabaseStorage_Purge_SQL(t *testing.T) {
+	olderThan := time.Unix(1000, 0)
+
+	t.Run("postgres", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer func() { _ = db.Close() }()
+		s := &DatabaseStorage{db: db, dialect: PostgresDialect{}, tableName: "audit_logs", purgeBatchSize: 2}
+
+		query := regexp.QuoteMeta("DELETE FROM audit_logs WHERE id IN (SELECT id FROM audit_logs WHERE event_type = $1 AND timestamp <= $2 ORDER BY id LIMIT 2)")
+		mock.ExpectExec(query).WithArgs("logout", int64(999)).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(query).WithArgs("logout", int64(999)).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		n, err := s.Purge(context.Background(), olderThan, DefaultQueryFilter().WithEventType("logout"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), n)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer func() { _ = db.Close() }()
+		s := &DatabaseStorage{db: db, dialect: MySQLDialect{}, tableName: "audit_logs", purgeBatchSize: 1000}
+
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM audit_logs WHERE timestamp <= ? ORDER BY id LIMIT 1000")).
+			WithArgs(int64(999)).
+			WillReturnResult(sqlmock.NewResult(0, 10))
+
+		n, err := s.Purge(context.Background(), olderThan, nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(10), n)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestPurge_Wrappers(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	dir := t.TempDir()
+
+	t.Run("multi", func(t *testing.T) {
+		a, err := NewFileStorage(filepath.Join(dir, "a.log"))
+		require.NoError(t, err)
+		b, err := NewFileStorage(filepath.Join(dir, "b.log"))
+		require.NoError(t, err)
+		m := NewMultiStorage(a, b)
+		defer func() { _ = m.Close() }()
+		writeRecords(t, m, retentionRecords(now))
+
+		n, err := m.Purge(ctx, now.AddDate(0, 0, -3), nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(8), n)
+		assert.Equal(t, 2, countRecords(t, a, nil))
+		assert.Equal(t, 2, countRecords(t, b, nil))
+	})
+
+	t.Run("multi with unsupported backend", func(t *testing.T) {
+		m := NewMultiStorage(NewNoopStorage(), newMockStorage())
+		_, err := m.Purge(ctx, now, nil)
+		assert.ErrorIs(t, err, ErrPurgeNotSupported)
+		assert.Contains(t, err.Error(), "failed to purge storage 1")
+	})
+
+	t.Run("routing", func(t *testing.T) {
+		s, security, delivery, general := newTestRoutingStorage(t)
+		records := retentionRecords(now)
+		records[0].EventType = EventUserDeleted
+		for i, r := range records {
+			r.EventID = string(rune('a' + i))
+		}
+		writeRecords(t, s, records)
+
+		n, err := s.Purge(ctx, now.AddDate(0, 0, -3), nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), n)
+		assert.Equal(t, 0, countRecords(t, security, nil))
+		assert.Equal(t, 1, countRecords(t, delivery, nil))
+		assert.Equal(t, 1, countRecords(t, general, nil))
+	})
+
+	t.Run("encrypting", func(t *testing.T) {
+		inner, err := NewFileStorage(filepath.Join(dir, "encrypted.log"))
+		require.NoError(t, err)
+		encryptor, err := NewFieldEncryptor(&FieldEncryptionConfig{
+			MasterKey: make([]byte, 32),
+			KeyStore:  NewMemoryDataKeyStore(),
+		})
+		require.NoError(t, err)
+		s := NewEncryptingStorage(inner, encryptor)
+		defer func() { _ = s.Close() }()
+		writeRecords(t, s, retentionRecords(now))
+
+		n, err := s.Purge(ctx, now.AddDate(0, 0, -3), DefaultQueryFilter().WithEventType(string(EventLoginSuccess)))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+
+		_, err = NewEncryptingStorage(newMockStorage(), encryptor).Purge(ctx, now, nil)
+		assert.ErrorIs(t, err, ErrPurgeNotSupported)
+	})
+}
+
+func TestNewRetentionRunner(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		name    string
+		storage Storage
+		config  *RetentionConfig
+		wantErr string
+	}{
+		{name: "valid", storage: NewNoopStorage(), config: &RetentionConfig{Policies: []RetentionPolicy{
+			{EventTypes: []EventType{EventLoginSuccess}, MaxAge: day},
+			{MaxAge: 30 * day},
+		}}},
+		{name: "unsupported storage", storage: newMockStorage(), config: &RetentionConfig{Policies: []RetentionPolicy{{MaxAge: day}}}, wantErr: ErrPurgeNotSupported.Error()},
+		{name: "nil config", storage: NewNoopStorage(), config: nil, wantErr: "at least one retention policy is required"},
+		{name: "zero max age", storage: NewNoopStorage(), config: &RetentionConfig{Policies: []RetentionPolicy{{}}}, wantErr: "retention policy 0: max age must be positive"},
+		{name: "two default policies", storage: NewNoopStorage(), config: &RetentionConfig{Policies: []RetentionPolicy{
+			{MaxAge: day}, {MaxAge: 2 * day},
+		}}, wantErr: "retention policy 1: only one policy may omit event types"},
+		{name: "event type in two policies", storage: NewNoopStorage(), config: &RetentionConfig{Policies: []RetentionPolicy{
+			{EventTypes: []EventType{EventLogout}, MaxAge: day},
+			{EventTypes: []EventType{EventLogout}, MaxAge: 2 * day},
+		}}, wantErr: "retention policy 1: event type logout is already covered"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRetentionRunner(tt.storage, tt.config)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, time.Hour, r.interval)
+			assert.Equal(t, 10*time.Minute, r.timeout)
+		})
+	}
+}
+
+func TestRetentionRunner_Run(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s, err := NewFileStorage(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+	writeRecords(t, s, retentionRecords(now))
+
+	r, err := NewRetentionRunner(s, &RetentionConfig{Policies: []RetentionPolicy{
+		{EventTypes: []EventType{EventSendSuccess}, MaxAge: 3 * 24 * time.Hour},
+		{MaxAge: 7 * 24 * time.Hour},
+	}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Condition{{Field: "event_type", Op: OpNotIn, Values: []string{"send_success"}}},
+		r.policyFilter(r.policies[1]).Conditions)
+
+	n, err := r.run(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, 0, countRecords(t, s, DefaultQueryFilter().WithEventType(string(EventSendSuccess)).WithTimeRange(0, now.AddDate(0, 0, -3).Unix())))
+	assert.Equal(t, 2, countRecords(t, s, DefaultQueryFilter().WithEventType(string(EventLoginSuccess))))
+	assert.Equal(t, 3, countRecords(t, s, nil))
+}
+
+func TestRetentionRunner_RunErrors(t *testing.T) {
+	// MultiStorage implements Purger even if a backend does not
+	m := NewMultiStorage(NewNoopStorage(), &errorStorage{})
+	r, err := NewRetentionRunner(m, &RetentionConfig{Policies: []RetentionPolicy{
+		{EventTypes: []EventType{EventLogout}, MaxAge: time.Hour},
+		{MaxAge: time.Hour},
+	}})
+	require.NoError(t, err)
+	_, err = r.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "retention policy 0")
+	assert.Contains(t, err.Error(), "retention policy 1")
+}
+
+func TestRetentionRunner_StartStop(t *testing.T) {
+	now := time.Now()
+	s, err := NewFileStorage(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+	writeRecords(t, s, retentionRecords(now))
+
+	r, err := NewRetentionRunner(s, &RetentionConfig{
+		Policies: []RetentionPolicy{{MaxAge: 3 * 24 * time.Hour}},
+		Interval: time.Hour,
+	})
+	require.NoError(t, err)
+	r.Start()
+	r.Start()
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var n int
+		_ = s.scan(context.Background(), func(*Record) { n++ })
+		return n == 2
+	}, time.Second, 10*time.Millisecond)
+	r.Stop()
+	r.Stop()
+}
+
+func TestLogger_Retention(t *testing.T) {
+	now := time.Now()
+	s, err := NewFileStorage(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	writeRecords(t, s, retentionRecords(now))
+
+	config := DefaultConfig()
+	config.TTL = 3 * 24 * time.Hour
+	config.Retention = DefaultRetentionConfig()
+	logger := NewLogger(s, config)
+	require.NotNil(t, logger.retention)
+	assert.Equal(t, []RetentionPolicy{{MaxAge: config.TTL}}, logger.retention.policies)
+
+	assert.Eventually(t, func() bool {
+		return countRecords(t, s, nil) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, logger.Stop())
+
+	t.Run("unsupported storage", func(t *testing.T) {
+		logger := NewLogger(newMockStorage(), &Config{Enabled: true, TTL: time.Hour, Retention: DefaultRetentionConfig()})
+		assert.Nil(t, logger.retention)
+		require.NoError(t, logger.Stop())
+	})
+}
@@ -0,0 +1,303 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// ErrNoRoute is returned by RoutingStorage.Write when no route matches the
+// record and no default storage is configured
+var ErrNoRoute = errors.New("no route for audit record")
+
+// Route sends the records matching all of its non-empty criteria to Storage.
+// Within a criterion any listed value matches.
+type Route struct {
+	Name       string              // Optional, used in errors
+	EventTypes []EventType         // e.g. EventUserDeleted, EventAccessDenied
+	Results    []Result            // e.g. ResultFailure
+	Channels   []string            // e.g. "sms", "email"
+	Metadata   []MetadataCondition // All conditions must match
+	Storage    Storage             // A pointer; use MultiStorage to write to several backends
+}
+
+// RoutingConfig holds configuration for routing storage
+type RoutingConfig struct {
+	Routes  []Route // Evaluated in order; the first matching route wins
+	Default Storage // Records matching no route (nil: Write returns ErrNoRoute)
+}
+
+// storageKey identifies a routed storage by its type and address, so a
+// storage shared by several routes is queried, counted and closed once.
+// Unlike ==, it cannot panic on storages of non-comparable types.
+type storageKey struct {
+	typ  reflect.Type
+	addr uintptr
+}
+
+// keyOf returns the storageKey of a storage checked by validateRoutedStorage
+func keyOf(storage Storage) storageKey {
+	v := reflect.ValueOf(storage)
+	return storageKey{typ: v.Type(), addr: v.Pointer()}
+}
+
+// validateRoutedStorage checks that storage has an address to tell it apart
+func validateRoutedStorage(storage Storage) error {
+	if reflect.ValueOf(storage).Kind() != reflect.Pointer {
+		return fmt.Errorf("storage of type %T must be a pointer", storage)
+	}
+	return nil
+}
+
+// RoutingStorage dispatches each record to a storage backend chosen by rules
+// on the record, e.g. security-critical events to a database and high-volume
+// delivery events to Redis. Query, Count and GroupBy ask only the backends
+// whose routes can hold matching records and merge their results.
+type RoutingStorage struct {
+	routes   []Route
+	fallback Storage
+}
+
+// NewRoutingStorage creates a routing storage
+func NewRoutingStorage(config *RoutingConfig) (*RoutingStorage, error) {
+	if config == nil {
+		return nil, fmt.Errorf("routing config is required")
+	}
+	for i, route := range config.Routes {
+		if route.Storage == nil {
+			return nil, fmt.Errorf("route %s has no storage", route.label(i))
+		}
+		if err := validateRoutedStorage(route.Storage); err != nil {
+			return nil, fmt.Errorf("route %s: %w", route.label(i), err)
+		}
+		for _, c := range route.Metadata {
+			if err := c.validate(); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route.label(i), err)
+			}
+		}
+	}
+
+	if config.Default != nil {
+		if err := validateRoutedStorage(config.Default); err != nil {
+			return nil, fmt.Errorf("default route: %w", err)
+		}
+	}
+
+	return &RoutingStorage{
+		routes:   config.Routes,
+		fallback: config.Default,
+	}, nil
+}
+
+// label names the route in errors
+func (r *Route) label(index int) string {
+	if r.Name != "" {
+		return fmt.Sprintf("%q", r.Name)
+	}
+	return fmt.Sprintf("%d", index)
+}
+
+// matches reports whether record satisfies every criterion of the route
+func (r *Route) matches(record *Record) bool {
+	if len(r.EventTypes) > 0 && !slices.Contains(r.EventTypes, record.EventType) {
+		return false
+	}
+	if len(r.Results) > 0 && !slices.Contains(r.Results, record.Result) {
+		return false
+	}
+	if len(r.Channels) > 0 && !slices.Contains(r.Channels, record.Channel) {
+		return false
+	}
+	for _, c := range r.Metadata {
+		if !c.matches(record.Metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+// mayHold reports whether the route can hold records matching the equality
+// fields, conditions and expression of filter on the routed fields.
+// Expressions under NOT are not used for pruning.
+func (r *Route) mayHold(filter *QueryFilter) bool {
+	if filter.EventType != "" && len(r.EventTypes) > 0 && !slices.Contains(r.EventTypes, EventType(filter.EventType)) {
+		return false
+	}
+	if filter.Result != "" && len(r.Results) > 0 && !slices.Contains(r.Results, Result(filter.Result)) {
+		return false
+	}
+	if filter.Channel != "" && len(r.Channels) > 0 && !slices.Contains(r.Channels, filter.Channel) {
+		return false
+	}
+	for _, c := range filter.Conditions {
+		if !r.mayMatch(c) {
+			return false
+		}
+	}
+	return filter.Expr == nil || r.mayMatchExpr(filter.Expr)
+}
+
+// mayMatch reports whether one of the values the route accepts for the
+// field of c satisfies it; unrouted fields always may
+func (r *Route) mayMatch(c Condition) bool {
+	var values []string
+	switch c.Field {
+	case "event_type":
+		for _, t := range r.EventTypes {
+			values = append(values, string(t))
+		}
+	case "result":
+		for _, res := range r.Results {
+			values = append(values, string(res))
+		}
+	case "channel":
+		values = r.Channels
+	}
+	if len(values) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(values, c.matchesValue)
+}
+
+// mayMatchExpr reports whether the route can hold records matching e
+func (r *Route) mayMatchExpr(e *Expr) bool {
+	switch {
+	case len(e.And) > 0:
+		for _, sub := range e.And {
+			if !r.mayMatchExpr(sub) {
+				return false
+			}
+		}
+		return true
+	case len(e.Or) > 0:
+		return slices.ContainsFunc(e.Or, r.mayMatchExpr)
+	case e.Condition != nil:
+		return r.mayMatch(*e.Condition)
+	}
+	return true
+}
+
+// Write writes the record to the storage of the first matching route
+func (s *RoutingStorage) Write(ctx context.Context, record *Record) error {
+	for i := range s.routes {
+		if s.routes[i].matches(record) {
+			if err := s.routes[i].Storage.Write(ctx, record); err != nil {
+				return fmt.Errorf("failed to write to route %s: %w", s.routes[i].label(i), err)
+			}
+			return nil
+		}
+	}
+	if s.fallback == nil {
+		return fmt.Errorf("%w: event_type=%s", ErrNoRoute, record.EventType)
+	}
+	return s.fallback.Write(ctx, record)
+}
+
+// Query queries the storages that can hold matching records and merges the
+// results
+func (s *RoutingStorage) Query(ctx context.Context, filter *QueryFilter) ([]*Record, error) {
+	return s.query(ctx, filter, nil)
+}
+
+// QueryWithReport implements ReportingQuerier, combining the reports of the
+// storages asked. It returns ErrReportNotSupported if one of them cannot
+// report.
+func (s *RoutingStorage) QueryWithReport(ctx context.Context, filter *QueryFilter) ([]*Record, *QueryReport, error) {
+	report := &QueryReport{}
+	records, err := s.query(ctx, filter, report)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, report, nil
+}
+
+// query runs Query, filling report if not nil
+func (s *RoutingStorage) query(ctx context.Context, filter *QueryFilter, report *QueryReport) ([]*Record, error) {
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	filter.Normalize()
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	return mergeQuery(ctx, s.targets(filter), filter, report)
+}
+
+// Count counts matching records across the routed storages
+func (s *RoutingStorage) Count(ctx context.Context, filter *QueryFilter) (int64, error) {
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	if err := filter.Validate(); err != nil {
+		return 0, err
+	}
+	return countTargets(ctx, s.targets(filter))
+}
+
+// GroupBy aggregates matching records across the routed storages
+func (s *RoutingStorage) GroupBy(ctx context.Context, filter *QueryFilter, fields []string, bucket time.Duration) ([]AggregateRow, error) {
+	if filter == nil {
+		filter = DefaultQueryFilter()
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	seconds, err := validateGroupBy(fields, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return groupTargets(ctx, s.targets(filter), fields, bucket, seconds)
+}
+
+// Purge purges matching records from the routed storages
+func (s *RoutingStorage) Purge(ctx context.Context, olderThan time.Time, filter *QueryFilter) (int64, error) {
+	if filter == nil {
+		filter = &QueryFilter{}
+	}
+	if err := filter.Validate(); err != nil {
+		return 0, err
+	}
+	return purgeTargets(ctx, s.targets(filter), olderThan)
+}
+
+// targets returns each storage that can hold records matching filter once.
+// The default storage is always included. The index of a target is its route
+// position, or len(routes) for the default storage.
+func (s *RoutingStorage) targets(filter *QueryFilter) []queryTarget {
+	var targets []queryTarget
+	seen := make(map[storageKey]bool)
+	add := func(index int, storage Storage) {
+		if key := keyOf(storage); !seen[key] {
+			seen[key] = true
+			targets = append(targets, queryTarget{index: index, storage: storage, filter: filter})
+		}
+	}
+	for i := range s.routes {
+		if s.routes[i].mayHold(filter) {
+			add(i, s.routes[i].Storage)
+		}
+	}
+	if s.fallback != nil {
+		add(len(s.routes), s.fallback)
+	}
+	return targets
+}
+
+// Close closes every routed storage once
+func (s *RoutingStorage) Close() error {
+	var firstErr error
+	for _, t := range s.targets(&QueryFilter{}) {
+		if err := t.storage.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Routes returns the configured routes
+func (s *RoutingStorage) Routes() []Route {
+	return s.routes
+}
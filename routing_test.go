@@ -0,0 +1,340 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRoutingStorage(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *RoutingConfig
+		wantErr string
+	}{
+		{name: "nil config", config: nil, wantErr: "routing config is required"},
+		{name: "empty config", config: &RoutingConfig{}},
+		{name: "route without storage", config: &RoutingConfig{Routes: []Route{{Name: "security"}}}, wantErr: `route "security" has no storage`},
+		{name: "unnamed route without storage", config: &RoutingConfig{Routes: []Route{{Storage: NewNoopStorage()}, {}}}, wantErr: "route 1 has no storage"},
+		{name: "invalid metadata condition", config: &RoutingConfig{Routes: []Route{{
+			Storage:  NewNoopStorage(),
+			Metadata: []MetadataCondition{{Key: "level", Op: MetaGt, Value: "high"}},
+		}}}, wantErr: "must be a number"},
+		{name: "storage value", config: &RoutingConfig{Routes: []Route{{Name: "tags", Storage: mapStorage{}}}}, wantErr: `route "tags": storage of type audit.mapStorage must be a pointer`},
+		{name: "default storage value", config: &RoutingConfig{Default: mapStorage{}}, wantErr: "default route: storage of type audit.mapStorage must be a pointer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewRoutingStorage(tt.config)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.NotNil(t, s)
+		})
+	}
+}
+
+func TestRoute_Matches(t *testing.T) {
+	record := NewRecord(EventSendFailed, ResultFailure).
+		WithChannel("sms").
+		WithMetadata("tenant", "acme")
+
+	tests := []struct {
+		name  string
+		route Route
+		want  bool
+	}{
+		{name: "no criteria", route: Route{}, want: true},
+		{name: "event type", route: Route{EventTypes: []EventType{EventSendSuccess, EventSendFailed}}, want: true},
+		{name: "other event type", route: Route{EventTypes: []EventType{EventSendSuccess}}, want: false},
+		{name: "result", route: Route{Results: []Result{ResultFailure}}, want: true},
+		{name: "other result", route: Route{Results: []Result{ResultSuccess}}, want: false},
+		{name: "channel", route: Route{Channels: []string{"email", "sms"}}, want: true},
+		{name: "other channel", route: Route{Channels: []string{"email"}}, want: false},
+		{name: "metadata", route: Route{Metadata: []MetadataCondition{MetadataEquals("tenant", "acme")}}, want: true},
+		{name: "other metadata", route: Route{Metadata: []MetadataCondition{MetadataEquals("tenant", "other")}}, want: false},
+		{name: "all criteria", route: Route{
+			EventTypes: []EventType{EventSendFailed},
+			Results:    []Result{ResultFailure},
+			Channels:   []string{"sms"},
+			Metadata:   []MetadataCondition{{Key: "tenant", Op: MetaExists}},
+		}, want: true},
+		{name: "one criterion fails", route: Route{
+			EventTypes: []EventType{EventSendFailed},
+			Channels:   []string{"email"},
+		}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.route.matches(record))
+		})
+	}
+}
+
+func TestRoute_MayHold(t *testing.T) {
+	route := Route{
+		EventTypes: []EventType{EventUserDeleted, EventAccessDenied},
+		Channels:   []string{"sms"},
+	}
+	parse := func(query string) *Expr {
+		expr, err := ParseQuery(query, time.Now())
+		require.NoError(t, err)
+		return expr
+	}
+
+	tests := []struct {
+		name   string
+		filter *QueryFilter
+		want   bool
+	}{
+		{name: "empty", filter: DefaultQueryFilter(), want: true},
+		{name: "equal event type", filter: DefaultQueryFilter().WithEventType(string(EventUserDeleted)), want: true},
+		{name: "other event type", filter: DefaultQueryFilter().WithEventType(string(EventLoginSuccess)), want: false},
+		{name: "in", filter: DefaultQueryFilter().Where(In("event_type", string(EventLoginSuccess), string(EventAccessDenied))), want: true},
+		{name: "not in", filter: DefaultQueryFilter().Where(In("event_type", string(EventLoginSuccess))), want: false},
+		{name: "excluded", filter: DefaultQueryFilter().Where(NotIn("event_type", string(EventUserDeleted), string(EventAccessDenied))), want: false},
+		{name: "prefix", filter: DefaultQueryFilter().Where(HasPrefix("event_type", "access_")), want: true},
+		{name: "other prefix", filter: DefaultQueryFilter().Where(HasPrefix("event_type", "login_")), want: false},
+		{name: "other channel", filter: DefaultQueryFilter().Where(In("channel", "email")), want: false},
+		{name: "unrouted result", filter: DefaultQueryFilter().Where(In("result", string(ResultFailure))), want: true},
+		{name: "unrouted field", filter: DefaultQueryFilter().Where(In("user_id", "alice")), want: true},
+		{name: "expr", filter: DefaultQueryFilter().WhereExpr(parse("event_type:login_success OR channel:email")), want: false},
+		{name: "expr one branch", filter: DefaultQueryFilter().WhereExpr(parse("event_type:login_success OR event_type:user_deleted")), want: true},
+		{name: "expr and", filter: DefaultQueryFilter().WhereExpr(parse("(event_type:user_deleted OR user_id:bob) AND (channel:email OR channel:voice)")), want: false},
+		{name: "expr not", filter: DefaultQueryFilter().WhereExpr(parse("NOT event_type:user_deleted OR channel:email")), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, route.mayHold(tt.filter))
+		})
+	}
+}
+
+func newTestRoutingStorage(t *testing.T) (*RoutingStorage, *FileStorage, *RedisStorage, *FileStorage) {
+	dir := t.TempDir()
+	security, err := NewFileStorage(filepath.Join(dir, "security.log"))
+	require.NoError(t, err)
+	client, mr := newTestRedisClient(t)
+	t.Cleanup(mr.Close)
+	delivery := NewRedisStorageWithConfig(client, &RedisConfig{KeyPrefix: "delivery:", TTL: time.Hour})
+	general, err := NewFileStorage(filepath.Join(dir, "general.log"))
+	require.NoError(t, err)
+
+	s, err := NewRoutingStorage(&RoutingConfig{
+		Routes: []Route{
+			{Name: "security", EventTypes: []EventType{EventUserDeleted, EventAccessDenied}, Storage: security},
+			{Name: "delivery", EventTypes: []EventType{EventSendSuccess}, Storage: delivery},
+		},
+		Default: general,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s, security, delivery, general
+}
+
+func TestRoutingStorage_Write(t *testing.T) {
+	ctx := context.Background()
+	s, security, delivery, general := newTestRoutingStorage(t)
+
+	now := time.Now().Unix()
+	records := []*Record{
+		NewRecord(EventUserDeleted, ResultSuccess).WithUserID("alice"),
+		NewRecord(EventAccessDenied, ResultFailure).WithUserID("bob"),
+		NewRecord(EventSendSuccess, ResultSuccess).WithUserID("alice"),
+		NewRecord(EventSendSuccess, ResultSuccess).WithUserID("bob"),
+		NewRecord(EventLoginSuccess, ResultSuccess).WithUserID("carol"),
+	}
+	for i, r := range records {
+		r.Timestamp = now - int64(len(records)-i)
+		require.NoError(t, s.Write(ctx, r))
+	}
+
+	count := func(storage Storage) int {
+		out, err := storage.Query(ctx, DefaultQueryFilter())
+		require.NoError(t, err)
+		return len(out)
+	}
+	assert.Equal(t, 2, count(security))
+	assert.Equal(t, 2, count(delivery))
+	assert.Equal(t, 1, count(general))
+
+	t.Run("query all", func(t *testing.T) {
+		out, err := s.Query(ctx, nil)
+		require.NoError(t, err)
+		require.Len(t, out, 5)
+		assert.Equal(t, EventLoginSuccess, out[0].EventType)
+		assert.Equal(t, EventUserDeleted, out[4].EventType)
+	})
+
+	t.Run("query routed by event type", func(t *testing.T) {
+		filter := DefaultQueryFilter().WithEventType(string(EventSendSuccess))
+		targets := s.targets(filter)
+		require.Len(t, targets, 2)
+		assert.Same(t, delivery, targets[0].storage)
+		assert.Same(t, general, targets[1].storage)
+
+		out, err := s.Query(ctx, filter)
+		require.NoError(t, err)
+		assert.Len(t, out, 2)
+	})
+
+	t.Run("query across routes", func(t *testing.T) {
+		out, err := s.Query(ctx, DefaultQueryFilter().WithUserID("alice").WithLimit(1).WithOffset(1))
+		require.NoError(t, err)
+		require.Len(t, out, 1)
+		assert.Equal(t, EventUserDeleted, out[0].EventType)
+	})
+
+	t.Run("count and group by", func(t *testing.T) {
+		n, err := s.Count(ctx, nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), n)
+
+		n, err = s.Count(ctx, DefaultQueryFilter().WithUserID("bob"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+
+		rows, err := s.GroupBy(ctx, nil, []string{"result"}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []AggregateRow{
+			{Groups: map[string]string{"result": "failure"}, Count: 1},
+			{Groups: map[string]string{"result": "success"}, Count: 4},
+		}, rows)
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		_, err := s.Query(ctx, &QueryFilter{SortBy: "user_id"})
+		assert.ErrorIs(t, err, ErrInvalidFilter)
+		_, err = s.Count(ctx, &QueryFilter{SortBy: "user_id"})
+		assert.ErrorIs(t, err, ErrInvalidFilter)
+		_, err = s.GroupBy(ctx, nil, []string{"unknown"}, 0)
+		assert.ErrorIs(t, err, ErrInvalidFilter)
+	})
+}
+
+func TestRoutingStorage_NoRoute(t *testing.T) {
+	ctx := context.Background()
+	store := newMockStorage()
+	s, err := NewRoutingStorage(&RoutingConfig{
+		Routes: []Route{{Results: []Result{ResultFailure}, Storage: store}},
+	})
+	require.NoError(t, err)
+
+	err = s.Write(ctx, NewRecord(EventLoginSuccess, ResultSuccess))
+	assert.ErrorIs(t, err, ErrNoRoute)
+	assert.Contains(t, err.Error(), "event_type=login_success")
+
+	require.NoError(t, s.Write(ctx, NewRecord(EventLoginFailed, ResultFailure)))
+	assert.Equal(t, 1, store.getRecordCount())
+}
+
+func TestRoutingStorage_Errors(t *testing.T) {
+	ctx := context.Background()
+	failing := newMockStorage()
+	failing.shouldError = true
+	s, err := NewRoutingStorage(&RoutingConfig{
+		Routes:  []Route{{Name: "failures", Results: []Result{ResultFailure}, Storage: failing}},
+		Default: &errorStorage{},
+	})
+	require.NoError(t, err)
+
+	err = s.Write(ctx, NewRecord(EventLoginFailed, ResultFailure))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `failed to write to route "failures"`)
+
+	_, err = s.Query(ctx, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to query storage 1")
+
+	// mockStorage does not implement Aggregator
+	_, err = s.Count(ctx, nil)
+	assert.ErrorIs(t, err, ErrAggregationNotSupported)
+
+	assert.Error(t, s.Close())
+}
+
+// mapStorage is a Storage of a non-comparable type
+type mapStorage map[string]int
+
+func (mapStorage) Write(context.Context, *Record) error { return nil }
+func (mapStorage) Query(context.Context, *QueryFilter) ([]*Record, error) {
+	return nil, nil
+}
+func (mapStorage) Close() error { return nil }
+
+// countingStorage counts the records written and the calls to Count
+type countingStorage struct {
+	written int64
+	counted int
+}
+
+func (s *countingStorage) Write(context.Context, *Record) error { s.written++; return nil }
+func (s *countingStorage) Query(context.Context, *QueryFilter) ([]*Record, error) {
+	return nil, nil
+}
+func (s *countingStorage) Count(context.Context, *QueryFilter) (int64, error) {
+	s.counted++
+	return s.written, nil
+}
+func (s *countingStorage) GroupBy(context.Context, *QueryFilter, []string, time.Duration) ([]AggregateRow, error) {
+	return nil, nil
+}
+func (s *countingStorage) Close() error { return nil }
+
+func TestRoutingStorage_SharedStorage(t *testing.T) {
+	ctx := context.Background()
+	shared, err := NewFileStorage(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+
+	s, err := NewRoutingStorage(&RoutingConfig{
+		Routes: []Route{
+			{EventTypes: []EventType{EventUserDeleted}, Storage: shared},
+			{EventTypes: []EventType{EventAccessDenied}, Storage: shared},
+		},
+		Default: shared,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Write(ctx, NewRecord(EventUserDeleted, ResultSuccess)))
+	require.NoError(t, s.Write(ctx, NewRecord(EventAccessDenied, ResultFailure)))
+	assert.Len(t, s.targets(DefaultQueryFilter()), 1)
+
+	n, err := s.Count(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	require.NoError(t, s.Close())
+}
+
+func TestRoutingStorage_SharedStorage_CountedOnce(t *testing.T) {
+	ctx := context.Background()
+	shared, other := &countingStorage{}, &countingStorage{}
+	s, err := NewRoutingStorage(&RoutingConfig{
+		Routes: []Route{
+			{EventTypes: []EventType{EventUserDeleted}, Storage: shared},
+			{EventTypes: []EventType{EventAccessDenied}, Storage: shared},
+			{EventTypes: []EventType{EventLogout}, Storage: other},
+		},
+		Default: shared,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Write(ctx, NewRecord(EventUserDeleted, ResultSuccess)))
+	require.NoError(t, s.Write(ctx, NewRecord(EventAccessDenied, ResultFailure)))
+	require.NoError(t, s.Write(ctx, NewRecord(EventLogout, ResultSuccess)))
+
+	n, err := s.Count(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, 1, shared.counted)
+	assert.Equal(t, 1, other.counted)
+}
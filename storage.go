@@ -10,7 +10,8 @@ type Storage interface {
 	Write(ctx context.Context, record *Record) error
 
 	// Query queries audit records based on filter criteria
-	// Returns records matching the filter, ordered by timestamp (newest first)
+	// Returns records matching the filter, ordered by filter.SortBy and
+	// filter.SortOrder (default: timestamp, newest first)
 	Query(ctx context.Context, filter *QueryFilter) ([]*Record, error)
 
 	// Close closes the storage connection and releases resources
@@ -38,6 +39,35 @@ type QueryFilter struct {
 	// Filter by IP
 	IP string `json:"ip,omitempty"`
 
+	// Filter by identifiers used for lookups
+	EventID           string `json:"event_id,omitempty"`
+	RequestID         string `json:"request_id,omitempty"`
+	TraceID           string `json:"trace_id,omitempty"`
+	ProviderMessageID string `json:"provider_message_id,omitempty"`
+
+	// Filter by delivery and access details
+	Provider    string `json:"provider,omitempty"`
+	Purpose     string `json:"purpose,omitempty"`
+	Resource    string `json:"resource,omitempty"`
+	Destination string `json:"destination,omitempty"`
+
+	// Additional set membership, prefix and CIDR conditions (see Where)
+	Conditions []Condition `json:"conditions,omitempty"`
+
+	// Conditions on Record.Metadata keys (see WhereMetadata)
+	Metadata []MetadataCondition `json:"metadata,omitempty"`
+
+	// Case-insensitive substring search over Reason, UserAgent, Resource and
+	// metadata string values (see WithText)
+	Text string `json:"text,omitempty"`
+
+	// Boolean expression, e.g. compiled from a text query (see WhereExpr)
+	Expr *Expr `json:"expr,omitempty"`
+
+	// Sorting (default: timestamp, newest first)
+	SortBy    string `json:"sort_by,omitempty"`    // "timestamp", "duration_ms" or "event_type"
+	SortOrder string `json:"sort_order,omitempty"` // "asc" or "desc"
+
 	// Pagination
 	Limit  int `json:"limit,omitempty"`  // Maximum number of records (default: 100)
 	Offset int `json:"offset,omitempty"` // Offset for pagination (default: 0)
@@ -99,6 +129,70 @@ func (f *QueryFilter) WithIP(ip string) *QueryFilter {
 	return f
 }
 
+// WithEventID sets the event ID filter
+func (f *QueryFilter) WithEventID(eventID string) *QueryFilter {
+	f.EventID = eventID
+	return f
+}
+
+// WithRequestID sets the request ID filter
+func (f *QueryFilter) WithRequestID(requestID string) *QueryFilter {
+	f.RequestID = requestID
+	return f
+}
+
+// WithTraceID sets the trace ID filter
+func (f *QueryFilter) WithTraceID(traceID string) *QueryFilter {
+	f.TraceID = traceID
+	return f
+}
+
+// WithProvider sets the provider filter
+func (f *QueryFilter) WithProvider(provider string) *QueryFilter {
+	f.Provider = provider
+	return f
+}
+
+// WithProviderMessageID sets the provider message ID filter
+func (f *QueryFilter) WithProviderMessageID(messageID string) *QueryFilter {
+	f.ProviderMessageID = messageID
+	return f
+}
+
+// WithPurpose sets the purpose filter
+func (f *QueryFilter) WithPurpose(purpose string) *QueryFilter {
+	f.Purpose = purpose
+	return f
+}
+
+// WithResource sets the resource filter
+func (f *QueryFilter) WithResource(resource string) *QueryFilter {
+	f.Resource = resource
+	return f
+}
+
+// WithDestination sets the destination filter. Destinations are stored as
+// written, so pass the masked or pseudonymized form when the logger
+// transforms them.
+func (f *QueryFilter) WithDestination(destination string) *QueryFilter {
+	f.Destination = destination
+	return f
+}
+
+// WithText sets the full-text search fragment, e.g. "quota exceeded"
+func (f *QueryFilter) WithText(text string) *QueryFilter {
+	f.Text = text
+	return f
+}
+
+// WithSort sets the sort key (SortByTimestamp, SortByDuration or
+// SortByEventType) and order (SortAsc or SortDesc)
+func (f *QueryFilter) WithSort(sortBy, order string) *QueryFilter {
+	f.SortBy = sortBy
+	f.SortOrder = order
+	return f
+}
+
 // WithLimit sets the limit
 func (f *QueryFilter) WithLimit(limit int) *QueryFilter {
 	f.Limit = limit
@@ -111,13 +205,16 @@ func (f *QueryFilter) WithOffset(offset int) *QueryFilter {
 	return f
 }
 
+// maxQueryLimit is the largest number of records returned by one query
+const maxQueryLimit = 1000
+
 // Normalize ensures filter has valid values
 func (f *QueryFilter) Normalize() {
 	if f.Limit <= 0 {
 		f.Limit = 100
 	}
-	if f.Limit > 1000 {
-		f.Limit = 1000
+	if f.Limit > maxQueryLimit {
+		f.Limit = maxQueryLimit
 	}
 	if f.Offset < 0 {
 		f.Offset = 0
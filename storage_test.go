@@ -23,6 +23,14 @@ func TestQueryFilter_Fluent(t *testing.T) {
 		WithResult("success").
 		WithTimeRange(1000, 2000).
 		WithIP("192.168.1.1").
+		WithEventID("evt_1").
+		WithRequestID("req_1").
+		WithTraceID("trace_1").
+		WithProvider("aliyun").
+		WithProviderMessageID("msg_1").
+		WithPurpose("login").
+		WithResource("/admin").
+		WithDestination("138****8000").
 		WithLimit(50).
 		WithOffset(10)
 
@@ -35,6 +43,14 @@ func TestQueryFilter_Fluent(t *testing.T) {
 	assert.Equal(t, int64(1000), filter.StartTime)
 	assert.Equal(t, int64(2000), filter.EndTime)
 	assert.Equal(t, "192.168.1.1", filter.IP)
+	assert.Equal(t, "evt_1", filter.EventID)
+	assert.Equal(t, "req_1", filter.RequestID)
+	assert.Equal(t, "trace_1", filter.TraceID)
+	assert.Equal(t, "aliyun", filter.Provider)
+	assert.Equal(t, "msg_1", filter.ProviderMessageID)
+	assert.Equal(t, "login", filter.Purpose)
+	assert.Equal(t, "/admin", filter.Resource)
+	assert.Equal(t, "138****8000", filter.Destination)
 	assert.Equal(t, 50, filter.Limit)
 	assert.Equal(t, 10, filter.Offset)
 }
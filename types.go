@@ -216,7 +216,7 @@ func (r *Record) Copy() *Record {
 		return nil
 	}
 	cp := *r
-	// Metadata is shared (shallow); we do not mutate it in Log()
+	// Metadata is shared (shallow); Log() processors clone it before changing it
 	return &cp
 }
 
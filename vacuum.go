@@ -0,0 +1,58 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Vacuum compacts an embedded database (SQLite): it checkpoints the
+// write-ahead log and returns pages freed by Purge to the filesystem.
+// Writes wait until it completes; it returns an error on other databases.
+func (s *DatabaseStorage) Vacuum(ctx context.Context) error {
+	d, ok := s.dialect.(EmbeddedDialect)
+	if !ok {
+		return fmt.Errorf("vacuum is not supported on %s", s.dialect.Name())
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := execStatements(ctx, s.db, d.VacuumStatements(s.tableName)); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	return nil
+}
+
+// startVacuum vacuums the database every interval until Close
+func (s *DatabaseStorage) startVacuum(interval time.Duration) {
+	s.stopVacuum = make(chan struct{})
+	s.vacuumDone = make(chan struct{})
+	go func() {
+		defer close(s.vacuumDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopVacuum:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+				if err := s.Vacuum(ctx); err != nil {
+					log.Printf("[audit] Failed to vacuum %s: %v", s.tableName, err)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+// stopVacuuming stops the background vacuum, if running
+func (s *DatabaseStorage) stopVacuuming() {
+	if s.stopVacuum == nil {
+		return
+	}
+	close(s.stopVacuum)
+	<-s.vacuumDone
+	s.stopVacuum = nil
+}
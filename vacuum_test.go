@@ -0,0 +1,62 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabaseStorage_Vacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.db")
+	storage, err := NewDatabaseStorage("sqlite://" + path)
+	require.NoError(t, err)
+	defer func() { _ = storage.Close() }()
+
+	ctx := context.Background()
+	records := make([]*Record, 2000)
+	for i := range records {
+		records[i] = NewRecord(EventLoginSuccess, ResultSuccess)
+		records[i].UserAgent = strings.Repeat("x", 200)
+	}
+	require.NoError(t, storage.WriteBatch(ctx, records))
+	require.NoError(t, storage.Vacuum(ctx))
+	full, err := os.Stat(path)
+	require.NoError(t, err)
+
+	_, err = storage.Purge(ctx, time.Now().Add(time.Hour), nil)
+	require.NoError(t, err)
+	require.NoError(t, storage.Vacuum(ctx))
+
+	compacted, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Less(t, compacted.Size(), full.Size()/4)
+	wal, err := os.Stat(path + "-wal")
+	require.NoError(t, err)
+	assert.Zero(t, wal.Size(), "checkpoint should truncate the WAL")
+}
+
+func TestDatabaseStorage_Vacuum_Unsupported(t *testing.T) {
+	storage := &DatabaseStorage{dialect: PostgresDialect{}, tableName: "audit_logs"}
+	err := storage.Vacuum(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "vacuum is not supported on postgres")
+}
+
+func TestDatabaseStorage_VacuumInterval(t *testing.T) {
+	storage, err := NewDatabaseStorageWithConfig("sqlite://"+filepath.Join(t.TempDir(), "audit.db"), &DatabaseConfig{
+		VacuumInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, storage.stopVacuum)
+
+	require.NoError(t, storage.Write(context.Background(), NewRecord(EventLoginSuccess, ResultSuccess)))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, storage.Close())
+	assert.Nil(t, storage.stopVacuum)
+}
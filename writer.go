@@ -2,6 +2,7 @@ package audit
 
 import (
 	"context"
+	"errors"
 	"log"
 	"sync"
 	"time"
@@ -195,9 +196,15 @@ func (w *Writer) worker(id int) {
 	}
 }
 
-// writeRecord writes a single record to storage
+// writeRecord writes a single record to storage. Partial writes stored the
+// record, so they are only logged.
 func (w *Writer) writeRecord(workerID int, record *Record) {
-	if err := w.storage.Write(w.ctx, record); err != nil {
+	err := w.storage.Write(w.ctx, record)
+	if errors.Is(err, ErrPartialWrite) {
+		log.Printf("[audit] Worker %d wrote record: %v", workerID, err)
+		return
+	}
+	if err != nil {
 		if w.onWriteFailed != nil {
 			w.onWriteFailed(record, err)
 		} else {
@@ -528,3 +528,18 @@ func TestWriter_EnqueueNilRecord(t *testing.T) {
 	ok := writer.Enqueue(nil)
 	assert.False(t, ok)
 }
+
+func TestWriter_PartialWrite(t *testing.T) {
+	failing := newMockStorage()
+	failing.shouldError = true
+	multi, err := NewMultiStorageWithConfig(&MultiStorageConfig{WritePolicy: WriteQuorum, Quorum: 1}, newMockStorage(), failing)
+	require.NoError(t, err)
+	var failed []*Record
+	writer := NewWriter(multi, DefaultWriterConfig()).OnWriteFailed(func(record *Record, err error) {
+		failed = append(failed, record)
+	})
+
+	// The record is stored, so it is not reported as failed
+	writer.writeRecord(0, NewRecord(EventLoginSuccess, ResultSuccess))
+	assert.Empty(t, failed)
+}